@@ -7,15 +7,22 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"tunapanel/internal/config"
 	"tunapanel/internal/models"
 )
 
+// socketPath is the agent socket, set from --socket or $TUNAPANEL_SOCKET.
+var socketPath = config.ClientSocketPath()
+
 func main() {
 	if os.Geteuid() == 0 {
 		fmt.Fprintln(os.Stderr, "tunactl must not run as root")
@@ -23,6 +30,7 @@ func main() {
 	}
 
 	dryRun := flag.Bool("dry-run", false, "show what would change without executing")
+	flag.StringVar(&socketPath, "socket", socketPath, "path of the agent socket (env "+config.SocketEnv+")")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -49,35 +57,337 @@ func main() {
 		}
 		switch args[1] {
 		case "list":
-			if len(args) != 2 {
+			fs := flag.NewFlagSet("service list", flag.ExitOnError)
+			fs.Usage = usage
+			state := fs.String("state", "enabled", "enabled, running, all or failed")
+			unitType := fs.String("type", "service", "unit type: service, socket, path, mount, target, timer or all")
+			_ = fs.Parse(args[2:])
+			if fs.NArg() != 0 {
+				usage()
+				os.Exit(2)
+			}
+			command, ok := listCommands[*state]
+			if !ok {
 				usage()
 				os.Exit(2)
 			}
-			req.Command = "service.list"
-		case "start":
+			req.Command = command
+			req.Type = *unitType
+		case "failed":
+			fs := flag.NewFlagSet("service failed", flag.ExitOnError)
+			fs.Usage = usage
+			unitType := fs.String("type", "service", "unit type: service, socket, path, mount, target, timer or all")
+			_ = fs.Parse(args[2:])
+			if fs.NArg() != 0 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service.failed"
+			req.Type = *unitType
+		case "reset-failed":
+			if len(args) > 3 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service.reset-failed"
+			if len(args) == 3 {
+				req.Service = args[2]
+			}
+		case "start", "stop", "restart":
+			fs := flag.NewFlagSet("service "+args[1], flag.ExitOnError)
+			fs.Usage = usage
+			wait := fs.Bool("wait", false, "wait for the unit to settle and explain failures")
+			timeout := fs.Duration("timeout", 0, "how long to wait (default 30s, implies --wait)")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) == 0 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service." + args[1]
+			if len(rest) == 1 && !strings.ContainsAny(rest[0], "*?[") {
+				req.Service = rest[0]
+			} else {
+				req.Services = rest
+			}
+			req.Wait = *wait || *timeout > 0
+			req.WaitTimeout = int(math.Ceil(timeout.Seconds()))
+		case "reload", "reload-or-restart", "try-restart":
 			if len(args) != 3 {
 				usage()
 				os.Exit(2)
 			}
-			req.Command = "service.start"
+			req.Command = "service." + args[1]
 			req.Service = args[2]
-		case "stop":
+		case "show", "deps", "cat":
 			if len(args) != 3 {
 				usage()
 				os.Exit(2)
 			}
-			req.Command = "service.stop"
+			req.Command = "service." + args[1]
 			req.Service = args[2]
+		case "enable", "disable", "mask", "unmask":
+			fs := flag.NewFlagSet("service "+args[1], flag.ExitOnError)
+			fs.Usage = usage
+			now := fs.Bool("now", false, "also start or stop the service")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) != 1 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service." + args[1]
+			req.Service = rest[0]
+			req.Now = *now
+		case "override":
+			fs := flag.NewFlagSet("service override", flag.ExitOnError)
+			fs.Usage = usage
+			dropIn := fs.String("name", "", "drop-in name (default override)")
+			file := fs.String("file", "-", "read the drop-in from this file, - for stdin")
+			remove := fs.Bool("remove", false, "remove the drop-in")
+			revert := fs.Bool("revert", false, "restore the drop-in's previous content")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) != 1 || (*remove && *revert) {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service.override"
+			req.Service = rest[0]
+			req.DropIn = *dropIn
+			req.Remove = *remove
+			req.Revert = *revert
+			if !*remove && !*revert {
+				content, err := readInput(*file)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "error:", err)
+					os.Exit(1)
+				}
+				req.Content = content
+			}
+		case "set-property":
+			fs := flag.NewFlagSet("service set-property", flag.ExitOnError)
+			fs.Usage = usage
+			runtime := fs.Bool("runtime", false, "only until the next reboot")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) < 2 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service.set-property"
+			req.Service = rest[0]
+			req.Runtime = *runtime
+			req.Properties = make(map[string]string)
+			for _, arg := range rest[1:] {
+				key, value, ok := strings.Cut(arg, "=")
+				if !ok || key == "" {
+					usage()
+					os.Exit(2)
+				}
+				req.Properties[key] = value
+			}
+		case "logs":
+			fs := flag.NewFlagSet("service logs", flag.ExitOnError)
+			fs.Usage = usage
+			lines := fs.Int("n", 0, "number of journal lines to show")
+			since := fs.String("since", "", "show entries since this time (e.g. 1h, yesterday)")
+			until := fs.String("until", "", "show entries until this time")
+			priority := fs.String("p", "", "priority or range (e.g. err, warning..emerg)")
+			follow := fs.Bool("f", false, "follow new journal entries")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) != 1 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "service.logs"
+			req.Service = rest[0]
+			req.Lines = *lines
+			req.Since = *since
+			req.Until = *until
+			req.Priority = *priority
+			if *follow {
+				if err := followLogs(req); err != nil {
+					fmt.Fprintln(os.Stderr, "error:", err)
+					os.Exit(1)
+				}
+				return
+			}
+		default:
+			usage()
+			os.Exit(2)
+		}
+	case "timer":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		switch args[1] {
+		case "list":
+			if len(args) != 2 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "timer.list"
+		case "start", "stop", "trigger":
+			if len(args) != 3 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "timer." + args[1]
+			req.Service = args[2]
+		case "enable", "disable":
+			fs := flag.NewFlagSet("timer "+args[1], flag.ExitOnError)
+			fs.Usage = usage
+			now := fs.Bool("now", false, "also start or stop the timer")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) != 1 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "timer." + args[1]
+			req.Service = rest[0]
+			req.Now = *now
+		default:
+			usage()
+			os.Exit(2)
+		}
+	case "job":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		switch args[1] {
+		case "scripts", "list":
+			if len(args) != 2 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "job." + args[1]
+		case "run":
+			if len(args) != 3 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "job.run"
+			req.Script = args[2]
+		case "status":
+			fs := flag.NewFlagSet("job status", flag.ExitOnError)
+			fs.Usage = usage
+			lines := fs.Int("n", 0, "number of output lines to show")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) != 1 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "job.status"
+			req.Job = rest[0]
+			req.Lines = *lines
+		default:
+			usage()
+			os.Exit(2)
+		}
+	case "approvals":
+		sub := "list"
+		if len(args) > 1 {
+			sub = args[1]
+		}
+		switch sub {
+		case "list":
+			if len(args) > 2 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "approval.list"
+		case "approve", "reject":
+			fs := flag.NewFlagSet("approvals "+sub, flag.ExitOnError)
+			fs.Usage = usage
+			reason := fs.String("reason", "", "why the request is approved or rejected")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) != 1 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "approval." + sub
+			req.Approval = rest[0]
+			req.Reason = *reason
 		default:
 			usage()
 			os.Exit(2)
 		}
+	case "token":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		switch args[1] {
+		case "create":
+			fs := flag.NewFlagSet("token create", flag.ExitOnError)
+			fs.Usage = usage
+			expires := fs.String("expires", "", "how long the token lasts, e.g. 12h or 90d (default 30d)")
+			units := fs.String("units", "", "comma-separated units or patterns the token may act on (default any)")
+			rest := parseInterspersed(fs, args[2:])
+			if len(rest) < 2 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "token.create"
+			req.Name = rest[0]
+			req.Commands = rest[1:]
+			req.Expires = *expires
+			if *units != "" {
+				req.Units = strings.Split(*units, ",")
+			}
+		case "list":
+			if len(args) != 2 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "token.list"
+		case "revoke":
+			if len(args) != 3 {
+				usage()
+				os.Exit(2)
+			}
+			req.Command = "token.revoke"
+			req.Token = args[2]
+		default:
+			usage()
+			os.Exit(2)
+		}
+	case "policy":
+		if len(args) < 2 || args[1] != "check" {
+			usage()
+			os.Exit(2)
+		}
+		fs := flag.NewFlagSet("policy check", flag.ExitOnError)
+		fs.Usage = usage
+		userName := fs.String("user", "", "check another user (name or uid)")
+		rest := parseInterspersed(fs, args[2:])
+		if len(rest) > 2 {
+			usage()
+			os.Exit(2)
+		}
+		req.Command = "policy.check"
+		req.User = *userName
+		if len(rest) > 0 {
+			req.Check = rest[0]
+		}
+		if len(rest) > 1 {
+			if strings.HasPrefix(req.Check, "job.") {
+				req.Script = rest[1]
+			} else {
+				req.Service = rest[1]
+			}
+		}
 	default:
 		usage()
 		os.Exit(2)
 	}
 
 	resp, err := doRequest(req)
+	if len(resp.Results) > 0 {
+		printResults(resp)
+	}
+	if resp.Diagnosis != nil {
+		printDiagnosis(resp.Diagnosis)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
@@ -94,15 +404,421 @@ func main() {
 	if resp.Message != "" {
 		fmt.Println(resp.Message)
 	}
-	for _, svc := range resp.Services {
-		fmt.Println(svc)
+	if len(resp.Services) > 0 {
+		if req.Command == "service.failed" {
+			printFailedServices(resp.Services)
+		} else {
+			printServices(resp.Services)
+		}
+	} else if req.Command == "service.failed" {
+		fmt.Println("no failed units")
+	}
+	for _, change := range resp.Changes {
+		fmt.Println(change)
+	}
+	if len(resp.Impact) > 0 {
+		fmt.Println("would also stop:")
+		for _, unit := range resp.Impact {
+			fmt.Println("  " + unit)
+		}
+	}
+	if resp.UnitFileState != "" {
+		fmt.Println("unit file state:", resp.UnitFileState)
+	}
+	if resp.Service != nil {
+		printServiceStatus(resp.Service)
+	}
+	for _, script := range resp.Scripts {
+		fmt.Println(script)
+	}
+	if req.Command == "job.scripts" && len(resp.Scripts) == 0 {
+		fmt.Println("no scripts")
+	}
+	if resp.Job != nil && req.Command == "job.status" {
+		printJob(resp.Job)
+	}
+	if len(resp.Jobs) > 0 {
+		printJobs(resp.Jobs)
+	} else if req.Command == "job.list" {
+		fmt.Println("no jobs")
+	}
+	for _, entry := range resp.Logs {
+		printLogEntry(entry)
+	}
+	if resp.Dependencies != nil {
+		printDependencies(resp.Dependencies)
+	}
+	if len(resp.Timers) > 0 {
+		printTimers(resp.Timers)
+	}
+	if len(resp.Approvals) > 0 {
+		printApprovals(resp.Approvals)
+	} else if req.Command == "approval.list" {
+		fmt.Println("no approvals")
+	}
+	if resp.Approval != nil && resp.Approval.State == "pending" {
+		fmt.Printf("ask another operator to run: tunactl approvals approve %s\n", resp.Approval.ID)
 	}
+	if resp.Token != nil && resp.Token.Secret != "" {
+		fmt.Println(resp.Token.Secret)
+		fmt.Fprintln(os.Stderr, "store the token now; it cannot be shown again")
+	}
+	if len(resp.Tokens) > 0 {
+		printTokens(resp.Tokens)
+	} else if req.Command == "token.list" {
+		fmt.Println("no tokens")
+	}
+	if resp.Policy != nil {
+		printPolicy(resp.Policy)
+		if resp.Policy.Command != "" && !resp.Policy.Allowed {
+			os.Exit(1)
+		}
+	}
+	for i, file := range resp.Files {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# %s\n%s", file.Path, file.Content)
+	}
+	if resp.Diff != "" {
+		fmt.Print(resp.Diff)
+	}
+}
+
+func readInput(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(io.LimitReader(os.Stdin, config.MaxRequestBytes))
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	return string(data), err
+}
+
+// parseInterspersed parses flags that may appear before or after the
+// positional arguments and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func printLogEntry(entry models.LogEntry) {
+	source := entry.Identifier
+	if source == "" {
+		source = entry.Unit
+	}
+	if entry.PID > 0 {
+		source = fmt.Sprintf("%s[%d]", source, entry.PID)
+	}
+	fmt.Printf("%s %s: %s\n", entry.Timestamp.Local().Format(time.Stamp), source, entry.Message)
+}
+
+var listCommands = map[string]string{
+	"enabled": "service.list",
+	"running": "service.running",
+	"all":     "service.all",
+	"failed":  "service.failed",
+}
+
+func printServices(list []models.ServiceInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UNIT\tLOAD\tACTIVE\tSUB\tDESCRIPTION")
+	for _, svc := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			svc.Name, orDash(svc.LoadState), orDash(svc.ActiveState), orDash(svc.SubState), svc.Description)
+	}
+	_ = tw.Flush()
+}
+
+func printResults(resp models.Response) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UNIT\tRESULT\tMESSAGE")
+	for _, item := range resp.Results {
+		result, message := "ok", item.Message
+		if !item.OK {
+			result, message = "failed", item.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", item.Service, result, message)
+	}
+	_ = tw.Flush()
+	if resp.CorrelationID != "" {
+		fmt.Println("correlation id:", resp.CorrelationID)
+	}
+	for _, item := range resp.Results {
+		if item.Diagnosis != nil {
+			fmt.Println()
+			printDiagnosis(item.Diagnosis)
+		}
+	}
+}
+
+// printDiagnosis shows why a unit did not settle: its state, result and
+// last journal lines.
+func printDiagnosis(d *models.UnitDiagnosis) {
+	state := fmt.Sprintf("%s (%s)", orDash(d.ActiveState), orDash(d.SubState))
+	if d.Result != "" {
+		state += ", result " + d.Result
+	}
+	if d.ExitCode != "" {
+		state += fmt.Sprintf(", %s/%d", d.ExitCode, d.ExitStatus)
+	}
+	fmt.Printf("%s: %s\n", d.Name, state)
+	for _, entry := range d.Logs {
+		printLogEntry(entry)
+	}
+}
+
+func printFailedServices(list []models.ServiceInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UNIT\tRESULT\tEXIT\tDESCRIPTION")
+	for _, svc := range list {
+		exit := "-"
+		if svc.ExitCode != "" {
+			exit = fmt.Sprintf("%s/%d", svc.ExitCode, svc.ExitStatus)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", svc.Name, orDash(svc.Result), exit, svc.Description)
+	}
+	_ = tw.Flush()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func printServiceStatus(svc *models.ServiceStatus) {
+	if svc.Description != "" {
+		fmt.Printf("%s - %s\n", svc.Name, svc.Description)
+	} else {
+		fmt.Println(svc.Name)
+	}
+	loaded := svc.LoadState
+	if svc.FragmentPath != "" {
+		loaded += " (" + svc.FragmentPath + ")"
+	}
+	fmt.Printf("  Loaded:   %s\n", loaded)
+	active := fmt.Sprintf("%s (%s)", svc.ActiveState, svc.SubState)
+	if svc.ExecMainStartTimestamp != nil && svc.ActiveState == "active" {
+		since := svc.ExecMainStartTimestamp
+		active += fmt.Sprintf(" since %s; %s ago", since.Format(time.RFC3339), time.Since(*since).Truncate(time.Second))
+	}
+	fmt.Printf("  Active:   %s\n", active)
+	if svc.Result != "" {
+		result := svc.Result
+		if svc.ExitCode != "" {
+			result += fmt.Sprintf(" (%s/%d)", svc.ExitCode, svc.ExitStatus)
+		}
+		fmt.Printf("  Result:   %s\n", result)
+	}
+	if svc.MainPID > 0 {
+		fmt.Printf("  Main PID: %d\n", svc.MainPID)
+	}
+	if svc.MemoryCurrent > 0 {
+		fmt.Printf("  Memory:   %s\n", formatBytes(svc.MemoryCurrent))
+	}
+	fmt.Printf("  Restarts: %d\n", svc.NRestarts)
+	if limits := formatLimits(svc.Limits); limits != "" {
+		fmt.Printf("  Limits:   %s\n", limits)
+	}
+}
+
+func formatLimits(limits models.ResourceLimits) string {
+	var parts []string
+	for _, limit := range []struct{ name, value string }{
+		{"CPUQuota", limits.CPUQuota},
+		{"MemoryMax", limits.MemoryMax},
+		{"MemoryHigh", limits.MemoryHigh},
+		{"TasksMax", limits.TasksMax},
+		{"IOWeight", limits.IOWeight},
+	} {
+		if limit.value != "" {
+			parts = append(parts, limit.name+"="+limit.value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func printJob(job *models.JobInfo) {
+	if job.Script != "" {
+		fmt.Printf("%s - %s\n", job.ID, job.Script)
+	} else {
+		fmt.Println(job.ID)
+	}
+	fmt.Printf("  Unit:     %s\n", job.Unit)
+	if !job.StartedAt.IsZero() {
+		fmt.Printf("  Started:  %s by uid %d\n", job.StartedAt.Local().Format(time.RFC3339), job.UID)
+	}
+	fmt.Printf("  Active:   %s (%s)\n", orDash(job.ActiveState), orDash(job.SubState))
+	if job.Result != "" {
+		fmt.Printf("  Result:   %s\n", formatJobResult(*job))
+	}
+}
+
+func printJobs(list []models.JobInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSCRIPT\tSTARTED\tUID\tACTIVE\tRESULT")
+	for _, job := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", job.ID, orDash(job.Script),
+			job.StartedAt.Local().Format("2006-01-02 15:04:05"), job.UID, orDash(job.ActiveState), orDash(formatJobResult(job)))
+	}
+	_ = tw.Flush()
+}
+
+func formatJobResult(job models.JobInfo) string {
+	if job.ExitCode == "" {
+		return job.Result
+	}
+	return fmt.Sprintf("%s (%s/%d)", job.Result, job.ExitCode, job.ExitStatus)
+}
+
+func printApprovals(list []models.ApprovalInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tCOMMAND\tTARGET\tREQUESTED BY\tREQUESTED\tDECIDED BY\tOUTCOME")
+	for _, a := range list {
+		decider, outcome := "-", a.Reason
+		requester := a.Requester
+		if a.OnBehalfOf != "" {
+			requester += " for " + a.OnBehalfOf
+		}
+		if a.DecidedAt != nil {
+			decider = a.Decider
+			if a.DeciderOnBehalfOf != "" {
+				decider += " for " + a.DeciderOnBehalfOf
+			}
+		}
+		if a.Error != "" {
+			outcome = "error: " + a.Error
+		} else if a.Message != "" {
+			outcome = a.Message
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.ID, a.State, a.Command,
+			orDash(strings.Join(a.Units, ",")+a.Script), requester,
+			a.RequestedAt.Local().Format("2006-01-02 15:04:05"), decider, orDash(outcome))
+	}
+	_ = tw.Flush()
+}
+
+func printTokens(list []models.TokenInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tOWNER\tCOMMANDS\tUNITS\tEXPIRES\tLAST USED")
+	for _, t := range list {
+		lastUsed := "-"
+		if t.LastUsed != nil {
+			lastUsed = t.LastUsed.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Owner, strings.Join(t.Commands, ","),
+			orDash(strings.Join(t.Units, ",")), t.ExpiresAt.Local().Format("2006-01-02 15:04:05"), lastUsed)
+	}
+	_ = tw.Flush()
+}
+
+func printPolicy(check *models.PolicyCheck) {
+	fmt.Printf("user %s (uid %d), groups: %s\n", check.User, check.UID, orDash(strings.Join(check.Groups, ", ")))
+	if !check.Enforced {
+		fmt.Println("no policy configured; every command is allowed")
+	} else if len(check.Rules) == 0 {
+		fmt.Println("no rules apply")
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RULE\tCOMMANDS\tUNITS\tSCRIPTS")
+		for _, rule := range check.Rules {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rule.Source, strings.Join(rule.Commands, ","),
+				orDash(strings.Join(rule.Units, ",")), orDash(strings.Join(rule.Scripts, ",")))
+		}
+		_ = tw.Flush()
+	}
+	if check.Command == "" {
+		return
+	}
+	what := check.Command
+	if len(check.Units) > 0 {
+		what += " " + strings.Join(check.Units, " ")
+	}
+	if check.Script != "" {
+		what += " " + check.Script
+	}
+	verdict := "denied"
+	if check.Allowed {
+		verdict = "allowed"
+	}
+	fmt.Printf("%s: %s (%s)\n", what, verdict, check.Reason)
+}
+
+func printTimers(list []models.TimerInfo) {
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NEXT\tLEFT\tLAST\tPASSED\tTIMER\tACTIVATES\tSTATE")
+	for _, timer := range list {
+		next, left, last, passed := "-", "-", "-", "-"
+		if timer.NextElapse != nil {
+			next = timer.NextElapse.Format("2006-01-02 15:04")
+			left = timer.NextElapse.Sub(now).Truncate(time.Second).String()
+		}
+		if timer.LastTrigger != nil {
+			last = timer.LastTrigger.Format("2006-01-02 15:04")
+			passed = now.Sub(*timer.LastTrigger).Truncate(time.Second).String() + " ago"
+		}
+		state := orDash(timer.ActiveState)
+		if timer.UnitFileState != "" {
+			state += "/" + timer.UnitFileState
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", next, left, last, passed, timer.Name, orDash(timer.Activates), state)
+	}
+	_ = tw.Flush()
+}
+
+func printDependencies(tree *models.DependencyTree) {
+	fmt.Printf("%s (%s)\n", tree.Name, orDash(tree.ActiveState))
+	fmt.Println("Depends on:")
+	printDependencyNodes(tree.Dependencies, "  ")
+	fmt.Println("Dependents:")
+	printDependencyNodes(tree.Dependents, "  ")
+}
+
+func printDependencyNodes(nodes []models.DependencyNode, prefix string) {
+	if len(nodes) == 0 && prefix == "  " {
+		fmt.Println(prefix + "(none)")
+	}
+	for i, node := range nodes {
+		branch, indent := "├─", "│ "
+		if i == len(nodes)-1 {
+			branch, indent = "└─", "  "
+		}
+		fmt.Printf("%s%s%s [%s, %s]\n", prefix, branch, node.Name, node.Type, orDash(node.ActiveState))
+		printDependencyNodes(node.Children, prefix+indent)
+	}
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func doRequest(req models.Request) (models.Response, error) {
 	var out models.Response
 
-	const requestTimeout = 5 * time.Second
+	requestTimeout := 5 * time.Second
+	if len(req.Services) > 0 || req.Wait || req.Command == "approval.approve" {
+		requestTimeout = config.BulkTimeout
+	}
 
 	payload, err := json.Marshal(req)
 	if err != nil {
@@ -119,13 +835,8 @@ func doRequest(req models.Request) (models.Response, error) {
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				dialer := net.Dialer{Timeout: requestTimeout}
-				return dialer.DialContext(ctx, "unix", config.SocketPath)
-			},
-		},
-		Timeout: requestTimeout,
+		Transport: agentTransport(requestTimeout),
+		Timeout:   requestTimeout,
 	}
 
 	resp, err := client.Do(httpReq)
@@ -136,7 +847,7 @@ func doRequest(req models.Request) (models.Response, error) {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			return out, fmt.Errorf("agent did not respond within %s", requestTimeout)
 		}
-		return out, fmt.Errorf("unable to reach agent socket %s: %w", config.SocketPath, err)
+		return out, fmt.Errorf("unable to reach agent socket %s: %w", socketPath, err)
 	}
 	defer resp.Body.Close()
 
@@ -145,7 +856,8 @@ func doRequest(req models.Request) (models.Response, error) {
 		return out, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	// 202 means the request waits for approval.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		if out.Error != "" {
 			return out, errors.New(out.Error)
 		}
@@ -155,10 +867,106 @@ func doRequest(req models.Request) (models.Response, error) {
 	return out, nil
 }
 
+func agentTransport(dialTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: dialTimeout}
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+}
+
+// followLogs prints journal entries streamed by the agent until the agent
+// closes the stream or the user interrupts tunactl.
+func followLogs(req models.Request) error {
+	const dialTimeout = 5 * time.Second
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, "http://unix/v1/stream", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: agentTransport(dialTimeout)}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("unable to reach agent socket %s: %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var out models.Response
+		if err := dec.Decode(&out); err == nil && out.Error != "" {
+			return errors.New(out.Error)
+		}
+		return fmt.Errorf("agent error: %s", resp.Status)
+	}
+
+	for {
+		var entry models.LogEntry
+		if err := dec.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		printLogEntry(entry)
+	}
+}
+
 func usage() {
 	fmt.Fprintln(os.Stderr, "Usage:")
 	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] status")
-	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service list")
-	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service start <name>")
-	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service stop <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service list [--state enabled|running|all|failed] [--type type]")
+	fmt.Fprintln(os.Stderr, "  tunactl service failed [--type type]")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service reset-failed [name]")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service start [--wait] [--timeout duration] <name|pattern>...")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service stop [--wait] [--timeout duration] <name|pattern>...")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service restart [--wait] [--timeout duration] <name|pattern>...")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service reload <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service reload-or-restart <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service try-restart <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl service show <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl service deps <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl service cat <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service override [--name drop-in] [--file path|-] <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service override [--name drop-in] --remove|--revert <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service set-property [--runtime] <name> <property=value>...")
+	fmt.Fprintln(os.Stderr, "  tunactl service logs [-f] [-n lines] [--since time] [--until time] [-p priority] <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service enable [--now] <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service disable [--now] <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service mask [--now] <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] service unmask <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl timer list")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] timer start|stop|trigger <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] timer enable|disable [--now] <name>")
+	fmt.Fprintln(os.Stderr, "  tunactl job scripts")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] job run <script>")
+	fmt.Fprintln(os.Stderr, "  tunactl job list")
+	fmt.Fprintln(os.Stderr, "  tunactl job status [-n lines] <id>")
+	fmt.Fprintln(os.Stderr, "  tunactl approvals [list]")
+	fmt.Fprintln(os.Stderr, "  tunactl approvals approve|reject [--reason text] <id>")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] token create [--expires duration] [--units pattern,...] <name> <command>...")
+	fmt.Fprintln(os.Stderr, "  tunactl token list")
+	fmt.Fprintln(os.Stderr, "  tunactl [--dry-run] token revoke <id>")
+	fmt.Fprintln(os.Stderr, "  tunactl policy check [--user name] [command [unit|script]]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Service commands also take socket, path, mount and target units when the")
+	fmt.Fprintln(os.Stderr, "name carries the suffix, e.g. cups.socket; --type is one of service, socket,")
+	fmt.Fprintln(os.Stderr, "path, mount, target, timer or all.")
+	fmt.Fprintln(os.Stderr, "set-property takes CPUQuota, MemoryMax, MemoryHigh, TasksMax and IOWeight; an")
+	fmt.Fprintln(os.Stderr, "empty value resets the property.")
+	fmt.Fprintln(os.Stderr, "job run starts a script from /etc/tunapanel/scripts.d and prints its job ID.")
+	fmt.Fprintln(os.Stderr, "token create prints an API token for the web UI's JSON endpoints, limited to")
+	fmt.Fprintln(os.Stderr, "the commands (e.g. service.list, service.restart) and units given and to what")
+	fmt.Fprintln(os.Stderr, "you may do yourself.")
+	fmt.Fprintln(os.Stderr, "policy check lists the policy rules that apply to you, or to --user, and")
+	fmt.Fprintln(os.Stderr, "tells whether a command such as service.restart nginx would be allowed.")
+	fmt.Fprintf(os.Stderr, "Use --socket or $%s to reach an agent on another socket.\n", config.SocketEnv)
 }
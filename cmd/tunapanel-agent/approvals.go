@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/models"
+	"tunapanel/internal/policy"
+)
+
+const (
+	approvalTTL  = time.Hour
+	maxApprovals = 100
+
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+)
+
+// heldRequest is a request waiting for approval. target is what it acted
+// on when it was held.
+type heldRequest struct {
+	info   models.ApprovalInfo
+	req    models.Request
+	peer   peerInfo
+	target policy.Target
+}
+
+// approvals holds pending and recently decided requests, oldest first.
+// They do not survive an agent restart.
+var approvals struct {
+	mu    sync.Mutex
+	items []*heldRequest
+}
+
+// needsApproval reports which approval, if any, req falls under. Root,
+// dry runs and token checks, which carry a token, never wait.
+func needsApproval(req models.Request, peer peerInfo) (policy.Approval, bool) {
+	p := agentPolicy.Load()
+	if p == nil || req.DryRun || peer.UID == 0 || req.Command == "token.check" {
+		return policy.Approval{}, false
+	}
+	return p.NeedsApproval(policyTarget(req))
+}
+
+// holdForApproval parks req until another user approves or rejects it.
+func holdForApproval(req models.Request, peer peerInfo, approval policy.Approval) (models.Response, int) {
+	id := newRequestID()
+	target := policyTarget(req)
+	if len(req.Services) > 0 {
+		if err := checkBulkWait(req, len(target.Units)); err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+	}
+	now := time.Now()
+	held := &heldRequest{
+		info: models.ApprovalInfo{
+			ID:           id,
+			State:        approvalPending,
+			Command:      req.Command,
+			Units:        target.Units,
+			Script:       target.Script,
+			Rule:         approval.Source,
+			Requester:    policy.LookupSubject(peer.UID, peer.GID, peer.Groups).Name,
+			RequesterUID: peer.UID,
+			OnBehalfOf:   peer.OnBehalfOf,
+			RequestedAt:  now,
+			ExpiresAt:    now.Add(approvalTTL),
+		},
+		req:    req,
+		peer:   peer,
+		target: target,
+	}
+
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+	expireApprovals(now)
+	// Make room by forgetting the oldest decided requests.
+	for i := 0; len(approvals.items) >= maxApprovals && i < len(approvals.items); {
+		if approvals.items[i].info.State != approvalPending {
+			approvals.items = append(approvals.items[:i], approvals.items[i+1:]...)
+			continue
+		}
+		i++
+	}
+	if len(approvals.items) >= maxApprovals {
+		return errorResponse(fmt.Errorf("too many pending approvals (max %d)", maxApprovals), req.DryRun)
+	}
+	approvals.items = append(approvals.items, held)
+
+	info := held.info
+	return models.Response{
+		OK:       true,
+		Message:  fmt.Sprintf("%s needs a second person's approval (%s); pending as %s", req.Command, approval.Source, id),
+		Approval: &info,
+	}, http.StatusAccepted
+}
+
+// expireApprovals marks pending requests older than approvalTTL. The
+// caller holds approvals.mu.
+func expireApprovals(now time.Time) {
+	for _, item := range approvals.items {
+		if item.info.State == approvalPending && now.After(item.info.ExpiresAt) {
+			item.info.State = approvalExpired
+		}
+	}
+}
+
+func listApprovals(req models.Request) (models.Response, int) {
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+	expireApprovals(time.Now())
+
+	list := make([]models.ApprovalInfo, 0, len(approvals.items))
+	for i := len(approvals.items) - 1; i >= 0; i-- {
+		list = append(list, approvals.items[i].info)
+	}
+	return models.Response{OK: true, DryRun: req.DryRun, Approvals: list}, http.StatusOK
+}
+
+// decideApproval approves or rejects a pending request. Approvers must be
+// someone else who may run it; requesters may withdraw their own.
+func decideApproval(req models.Request, peer peerInfo, approve bool) (models.Response, int) {
+	id := strings.TrimSpace(req.Approval)
+	if id == "" {
+		return badRequest("approval id is required", req.DryRun)
+	}
+	decider := policy.LookupSubject(peer.UID, peer.GID, peer.Groups)
+
+	approvals.mu.Lock()
+	now := time.Now()
+	expireApprovals(now)
+	var held *heldRequest
+	for _, item := range approvals.items {
+		if item.info.ID == id {
+			held = item
+		}
+	}
+	if held == nil {
+		approvals.mu.Unlock()
+		return badRequest(fmt.Sprintf("approval not found: %s", id), req.DryRun)
+	}
+	if held.info.State != approvalPending {
+		approvals.mu.Unlock()
+		return badRequest(fmt.Sprintf("approval %s is already %s", id, held.info.State), req.DryRun)
+	}
+	// A peer's own requests and those it relays cannot approve each other.
+	samePeer := held.peer.UID == peer.UID
+	own := samePeer && held.peer.OnBehalfOf == peer.OnBehalfOf
+	if approve && (own || samePeer && (held.peer.OnBehalfOf == "" || peer.OnBehalfOf == "")) {
+		approvals.mu.Unlock()
+		return denied("you cannot approve your own request", req.DryRun)
+	}
+	if !own {
+		if decision := agentPolicy.Load().Check(decider, held.target); !decision.Allowed {
+			approvals.mu.Unlock()
+			return denied("not allowed to decide this request: "+decision.Reason, req.DryRun)
+		}
+	}
+	// Run exactly the units the approver saw.
+	run := held.req
+	if approve && len(held.req.Services) > 0 {
+		if now := policyTarget(held.req).Units; !slices.Equal(now, held.target.Units) {
+			approvals.mu.Unlock()
+			return models.Response{
+				OK:     false,
+				Error:  fmt.Sprintf("the units matched by %s changed since the request was held (now %s); ask for a new approval", strings.Join(held.req.Services, " "), strings.Join(now, ", ")),
+				DryRun: req.DryRun,
+			}, http.StatusConflict
+		}
+		run.Services = held.target.Units
+	}
+	if approve {
+		if decision := authorize(run, held.peer); !decision.Allowed {
+			approvals.mu.Unlock()
+			return denied("the requester is no longer allowed to run this request: "+decision.Reason, req.DryRun)
+		}
+	}
+
+	held.info.State = approvalRejected
+	if approve {
+		held.info.State = approvalApproved
+	}
+	held.info.Decider = decider.Name
+	held.info.DeciderUID = peer.UID
+	held.info.DeciderOnBehalfOf = peer.OnBehalfOf
+	held.info.DecidedAt = &now
+	held.info.Reason = strings.TrimSpace(req.Reason)
+	approvals.mu.Unlock()
+
+	if !approve {
+		info := held.info
+		return models.Response{
+			OK:       true,
+			Message:  fmt.Sprintf("rejected %s: %s", id, held.req.Command),
+			Approval: &info,
+		}, http.StatusOK
+	}
+
+	resp, status := handleCommand(run, held.peer)
+	approvals.mu.Lock()
+	held.info.Message = resp.Message
+	held.info.Error = resp.Error
+	info := held.info
+	approvals.mu.Unlock()
+	resp.Approval = &info
+	return resp, status
+}
+
+func denied(message string, dryRun bool) (models.Response, int) {
+	return models.Response{
+		OK:     false,
+		Error:  message,
+		Code:   models.CodePolicyDenied,
+		DryRun: dryRun,
+	}, http.StatusForbidden
+}
+
+// recordApproval audits a step of an approval with both identities. peer
+// is whoever took the step.
+func recordApproval(log *log.Logger, audit *log.Logger, reqID string, peer peerInfo, info *models.ApprovalInfo) {
+	target := strings.Join(info.Units, ",") + info.Script
+	decider := "-"
+	if info.DecidedAt != nil {
+		decider = fmt.Sprintf("%s(%d)", info.Decider, info.DeciderUID)
+		if info.DeciderOnBehalfOf != "" {
+			decider += "/" + info.DeciderOnBehalfOf
+		}
+	}
+	requester := fmt.Sprintf("%s(%d)", info.Requester, info.RequesterUID)
+	if info.OnBehalfOf != "" {
+		requester += "/" + info.OnBehalfOf
+	}
+	log.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s approval=%s state=%s requested_by=%s decided_by=%s",
+		reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), info.Command, target, info.ID, info.State, requester, decider)
+	if audit != nil {
+		audit.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s approval=%s state=%s requested_by=%s decided_by=%s",
+			reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), info.Command, target, info.ID, info.State, requester, decider)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunapanel/internal/models"
+	"tunapanel/internal/services"
+)
+
+const approvalPolicy = `
+[[rule]]
+users = ["2000", "2001", "2002"]
+commands = ["service.*", "approval.*"]
+
+[[rule]]
+users = ["2003"]
+commands = ["approval.*"]
+
+[[approval]]
+commands = ["service.stop"]
+units = ["postgresql", "worker@*", "tunapanel-job-*"]
+`
+
+var (
+	requester = peerInfo{UID: 2000, GID: 2000, Groups: []int{}}
+	approver  = peerInfo{UID: 2001, GID: 2001, Groups: []int{}}
+	bystander = peerInfo{UID: 2003, GID: 2003, Groups: []int{}}
+	webPeer   = peerInfo{UID: 2002, GID: 2002, Groups: []int{}}
+)
+
+// hold sends req as peer and returns the ID of the approval it is held for.
+func hold(t *testing.T, req models.Request, peer peerInfo) string {
+	t.Helper()
+	approval, ok := needsApproval(req, peer)
+	if !ok {
+		t.Fatalf("%s %s%v does not need approval", req.Command, req.Service, req.Services)
+	}
+	resp, status := holdForApproval(req, peer, approval)
+	if status != http.StatusAccepted || resp.Approval == nil || resp.Approval.State != approvalPending {
+		t.Fatalf("hold: %d %+v", status, resp)
+	}
+	return resp.Approval.ID
+}
+
+func decide(id string, peer peerInfo, approve bool) (models.Response, int) {
+	command := "approval.reject"
+	if approve {
+		command = "approval.approve"
+	}
+	return decideApproval(models.Request{Command: command, Approval: id}, peer, approve)
+}
+
+func setupApprovals(t *testing.T) *services.Simulator {
+	t.Helper()
+	sim := useSimulator(t)
+	usePolicy(t, approvalPolicy)
+	t.Cleanup(func() { approvals.items = nil })
+	return sim
+}
+
+func TestNeedsApproval(t *testing.T) {
+	setupApprovals(t)
+	tests := []struct {
+		req  models.Request
+		peer peerInfo
+		want bool
+	}{
+		{models.Request{Command: "service.stop", Service: "postgresql"}, requester, true},
+		{models.Request{Command: "service.stop", Services: []string{"nginx", "worker@*"}}, requester, true},
+		{models.Request{Command: "service.stop", Service: "nginx"}, requester, false},
+		{models.Request{Command: "service.start", Service: "postgresql"}, requester, false},
+		{models.Request{Command: "service.stop", Service: "postgresql", DryRun: true}, requester, false},
+		{models.Request{Command: "service.stop", Service: "postgresql"}, peerInfo{UID: 0}, false},
+	}
+	for _, tt := range tests {
+		if _, got := needsApproval(tt.req, tt.peer); got != tt.want {
+			t.Errorf("needsApproval(%s %s%v, uid %d) = %v", tt.req.Command, tt.req.Service, tt.req.Services, tt.peer.UID, got)
+		}
+	}
+}
+
+func TestDecideApproval(t *testing.T) {
+	setupApprovals(t)
+	stop := models.Request{Command: "service.stop", Service: "postgresql"}
+
+	id := hold(t, stop, requester)
+	if resp, status := decide(id, requester, true); status != http.StatusForbidden || !strings.Contains(resp.Error, "your own request") {
+		t.Errorf("self-approval: %d %+v", status, resp)
+	}
+	if resp, status := decide(id, bystander, true); status != http.StatusForbidden || !strings.Contains(resp.Error, "not allowed to decide") {
+		t.Errorf("approval by someone who may not stop postgresql: %d %+v", status, resp)
+	}
+	resp, status := decide(id, approver, true)
+	if status != http.StatusOK || resp.Approval == nil || resp.Approval.State != approvalApproved || resp.Approval.DeciderUID != approver.UID {
+		t.Fatalf("approve: %d %+v", status, resp)
+	}
+	if s, _, _ := services.ShowService("postgresql.service", false); s.ActiveState != "inactive" {
+		t.Errorf("postgresql.service is %s after the approved stop", s.ActiveState)
+	}
+	if resp, status := decide(id, approver, false); status != http.StatusBadRequest || !strings.Contains(resp.Error, "already approved") {
+		t.Errorf("second decision: %d %+v", status, resp)
+	}
+	if _, status := decide("nope", approver, true); status != http.StatusBadRequest {
+		t.Errorf("unknown approval: %d", status)
+	}
+
+	// Requesters may withdraw their own requests.
+	id = hold(t, stop, requester)
+	if resp, status := decide(id, requester, false); status != http.StatusOK || resp.Approval.State != approvalRejected {
+		t.Errorf("withdraw: %d %+v", status, resp)
+	}
+}
+
+func TestDecideApprovalOnBehalfOf(t *testing.T) {
+	setupApprovals(t)
+	stop := models.Request{Command: "service.stop", Service: "postgresql"}
+	alice, bob, relayed := webPeer, webPeer, webPeer
+	alice.OnBehalfOf, bob.OnBehalfOf = "alice", "bob"
+
+	id := hold(t, stop, alice)
+	if _, status := decide(id, alice, true); status != http.StatusForbidden {
+		t.Errorf("alice approving her own request: %d", status)
+	}
+	if _, status := decide(id, relayed, true); status != http.StatusForbidden {
+		t.Errorf("the web peer approving for nobody: %d", status)
+	}
+	if resp, status := decide(id, bob, true); status != http.StatusOK || resp.Approval.DeciderOnBehalfOf != "bob" {
+		t.Errorf("bob approving alice's request: %d %+v", status, resp)
+	}
+}
+
+func TestApprovalExpiry(t *testing.T) {
+	setupApprovals(t)
+	id := hold(t, models.Request{Command: "service.stop", Service: "postgresql"}, requester)
+	approvals.items[0].info.ExpiresAt = time.Now().Add(-time.Second)
+
+	if resp, status := decide(id, approver, true); status != http.StatusBadRequest || !strings.Contains(resp.Error, "already expired") {
+		t.Errorf("approving an expired request: %d %+v", status, resp)
+	}
+	resp, _ := listApprovals(models.Request{Command: "approval.list"})
+	if len(resp.Approvals) != 1 || resp.Approvals[0].State != approvalExpired {
+		t.Errorf("list = %+v", resp.Approvals)
+	}
+}
+
+func TestApprovalPolicyChanged(t *testing.T) {
+	setupApprovals(t)
+	id := hold(t, models.Request{Command: "service.stop", Service: "postgresql"}, requester)
+	usePolicy(t, strings.Replace(approvalPolicy, `"2000", `, "", 1))
+
+	if resp, status := decide(id, approver, true); status != http.StatusForbidden || !strings.Contains(resp.Error, "no longer allowed") {
+		t.Errorf("approving after the requester lost the rule: %d %+v", status, resp)
+	}
+	if approvals.items[0].info.State != approvalPending {
+		t.Errorf("state = %s", approvals.items[0].info.State)
+	}
+}
+
+func TestApprovalRunsHeldUnits(t *testing.T) {
+	sim := setupApprovals(t)
+	if err := sim.RunTransient("tunapanel-job-1.service", "job 1", []string{"purge-cache"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	stop := models.Request{Command: "service.stop", Services: []string{"tunapanel-job-*"}}
+	id := hold(t, stop, requester)
+	if got := approvals.items[0].info.Units; len(got) != 1 || got[0] != "tunapanel-job-1.service" {
+		t.Fatalf("held units = %v", got)
+	}
+
+	if err := sim.RunTransient("tunapanel-job-2.service", "job 2", []string{"purge-cache"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, status := decide(id, approver, true)
+	if status != http.StatusConflict || !strings.Contains(resp.Error, "tunapanel-job-1.service, tunapanel-job-2.service") {
+		t.Errorf("approving after the pattern matched more units: %d %+v", status, resp)
+	}
+	if approvals.items[0].info.State != approvalPending {
+		t.Errorf("state = %s", approvals.items[0].info.State)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"tunapanel/internal/identity"
+	"tunapanel/internal/models"
+	"tunapanel/internal/policy"
+)
+
+const maxOnBehalfOfLen = 128
+
+// trusted holds the peers that may say whom a request is for, and the key
+// their requests are signed with. It is set once at startup.
+var trusted struct {
+	peers map[string]bool
+	key   []byte
+}
+
+// setTrustedPeers trusts peers, by user name or UID, to send requests on
+// behalf of other people when signed with the key in keyFile.
+func setTrustedPeers(peers []string, keyFile string) error {
+	if len(peers) == 0 && keyFile == "" {
+		return nil
+	}
+	if len(peers) == 0 || keyFile == "" {
+		return errors.New("trusted_peers and identity_key must be set together")
+	}
+	key, err := identity.LoadKey(keyFile)
+	if err != nil {
+		return err
+	}
+	trusted.peers = make(map[string]bool, len(peers))
+	for _, p := range peers {
+		trusted.peers[p] = true
+	}
+	trusted.key = key
+	return nil
+}
+
+// checkOnBehalfOf verifies that a request naming the person it is for
+// comes from a trusted peer and carries a valid assertion.
+func checkOnBehalfOf(req models.Request, peer peerInfo) error {
+	if trusted.key == nil || !(trusted.peers[strconv.Itoa(peer.UID)] ||
+		trusted.peers[policy.LookupSubject(peer.UID, peer.GID, peer.Groups).Name]) {
+		return errors.New("on_behalf_of is only accepted from trusted peers")
+	}
+	if !validOnBehalfOf(req.OnBehalfOf) {
+		return errors.New("invalid on_behalf_of")
+	}
+	return identity.Verify(trusted.key, req, time.Now())
+}
+
+// validOnBehalfOf keeps names that go into the logs to letters, digits and
+// ".", "_", "-", ":" and "@".
+func validOnBehalfOf(name string) bool {
+	if name == "" || len(name) > maxOnBehalfOfLen {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '.' || r == '_' || r == '-' || r == ':' || r == '@') {
+			return false
+		}
+	}
+	return true
+}
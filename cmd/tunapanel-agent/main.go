@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -16,9 +17,11 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"tunapanel/internal/config"
 	"tunapanel/internal/logger"
@@ -27,38 +30,99 @@ import (
 )
 
 func main() {
-	if os.Geteuid() != 0 {
-		fmt.Fprintln(os.Stderr, "tunapanel-agent must run as root")
+	configPath := flag.String("config", config.AgentConfigPath, "path to the agent configuration file")
+	socketFlag := flag.String("socket", "", "path of the agent socket (default "+config.SocketPath+")")
+	simulate := flag.Bool("simulate", false, "serve an in-memory simulated systemd; does not require root")
+	simulateFail := flag.String("simulate-fail", "", "comma-separated units that fail to start in simulation mode")
+	policyDir := flag.String("policy-dir", config.PolicyDir, "directory of *.toml policy files")
+	tokensPath := flag.String("tokens", "", "file that keeps API tokens (default "+config.TokensPath+"; in memory with --simulate)")
+	flag.Parse()
+
+	if !*simulate && os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "tunapanel-agent must run as root (use --simulate for a demo)")
+		os.Exit(1)
+	}
+
+	cfg, err := config.LoadAgent(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		os.Exit(1)
+	}
+	if err := setTrustedPeers(cfg.TrustedPeers, cfg.IdentityKey); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		os.Exit(1)
+	}
+	if err := services.SetProtectedUnits(cfg.ProtectedUnits); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
 		os.Exit(1)
 	}
 
-	log := logger.New(config.LogPath)
-	log.Printf("starting tunapanel-agent")
-	auditLog := logger.New(config.AuditLogPath)
+	var log, auditLog *log.Logger
+	socketPath := *socketFlag
+	if *simulate {
+		services.SetManager(services.NewSimulator(splitList(*simulateFail)))
+		if socketPath == "" {
+			path, err := config.SimulateSocketPath()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "no socket for simulation mode:", err)
+				os.Exit(1)
+			}
+			socketPath = path
+		}
+		log = logger.Stderr()
+		auditLog = logger.Stderr()
+		log.Printf("starting tunapanel-agent in simulation mode")
+	} else {
+		manager, err := services.NewManager(cfg.Backend, cfg.DBusAddress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid config:", err)
+			os.Exit(1)
+		}
+		services.SetManager(manager)
+		if socketPath == "" {
+			socketPath = config.SocketPath
+		}
+		log = logger.New(config.LogPath)
+		auditLog = logger.New(config.AuditLogPath)
+		log.Printf("starting tunapanel-agent (backend=%s)", cfg.Backend)
+	}
 	auditLog.SetPrefix("tunapanel-audit ")
+	if err := loadPolicy(*policyDir, log); err != nil {
+		log.Printf("failed to load policy: %v", err)
+		os.Exit(1)
+	}
+	if *tokensPath == "" && !*simulate {
+		*tokensPath = config.TokensPath
+	}
+	if err := loadTokens(*tokensPath); err != nil {
+		log.Printf("failed to load tokens: %v", err)
+		os.Exit(1)
+	}
 	limiter := newRateLimiter(config.RateLimitPerSec)
 
-	socketDir := filepath.Dir(config.SocketPath)
+	socketDir := filepath.Dir(socketPath)
 	if err := os.MkdirAll(socketDir, 0750); err != nil {
 		log.Printf("failed to create socket directory: %v", err)
 		os.Exit(1)
 	}
-	if err := os.RemoveAll(config.SocketPath); err != nil {
+	if err := os.RemoveAll(socketPath); err != nil {
 		log.Printf("failed to remove existing socket: %v", err)
 		os.Exit(1)
 	}
 
-	listener, err := net.Listen("unix", config.SocketPath)
+	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		log.Printf("failed to listen on socket: %v", err)
 		os.Exit(1)
 	}
-	defer os.Remove(config.SocketPath)
+	defer os.Remove(socketPath)
 
 	socketMode := os.FileMode(0600)
-	if grp, err := user.LookupGroup("tunapanel"); err == nil {
+	if *simulate {
+		log.Printf("listening on %s; export %s=%s to use it", socketPath, config.SocketEnv, socketPath)
+	} else if grp, err := user.LookupGroup("tunapanel"); err == nil {
 		if gid, err := strconv.Atoi(grp.Gid); err == nil {
-			if err := os.Chown(config.SocketPath, 0, gid); err != nil {
+			if err := os.Chown(socketPath, 0, gid); err != nil {
 				log.Printf("warning: failed to chown socket: %v", err)
 			} else {
 				socketMode = 0660
@@ -67,18 +131,23 @@ func main() {
 	} else {
 		log.Printf("warning: group 'tunapanel' not found; socket restricted to root")
 	}
-	if err := os.Chmod(config.SocketPath, socketMode); err != nil {
+	if err := os.Chmod(socketPath, socketMode); err != nil {
 		log.Printf("warning: failed to chmod socket: %v", err)
 	}
 
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
 	server := &http.Server{
 		Handler:           handler(log, auditLog, limiter),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
 		ConnContext:       connContext,
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       30 * time.Second,
 	}
+	server.RegisterOnShutdown(cancelBase)
 
 	errCh := make(chan error, 1)
 	go func() {
@@ -86,133 +155,491 @@ func main() {
 	}()
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	select {
-	case sig := <-sigCh:
-		log.Printf("signal received: %s", sig)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("shutdown error: %v", err)
-		}
-	case err := <-errCh:
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("server error: %v", err)
+	for {
+		select {
+		case sig := <-sigCh:
+			// SIGHUP reloads the policy; a broken policy keeps the old one.
+			if sig == syscall.SIGHUP {
+				if err := loadPolicy(*policyDir, log); err != nil {
+					log.Printf("failed to reload policy, keeping the previous one: %v", err)
+				}
+				continue
+			}
+			log.Printf("signal received: %s", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("shutdown error: %v", err)
+			}
+		case err := <-errCh:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("server error: %v", err)
+			}
 		}
+		return
 	}
 }
 
 func handler(log *log.Logger, audit *log.Logger, limiter *rateLimiter) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/command", func(w http.ResponseWriter, r *http.Request) {
-		reqID := newRequestID()
-		w.Header().Set("X-Request-Id", reqID)
-		peer := peerFromContext(r.Context())
-
-		if limiter != nil && !limiter.Allow(peer.UID) {
-			resp := models.Response{
-				OK:    false,
-				Error: "rate limit exceeded",
-			}
-			writeJSON(w, http.StatusTooManyRequests, resp)
-			recordRequest(log, audit, reqID, peer, "", "", false, resp.OK, resp.Error)
+		reqID, peer, req, ok := readRequest(w, r, log, audit, limiter)
+		if !ok {
 			return
 		}
 
-		if r.Method != http.MethodPost {
-			resp := models.Response{
-				OK:    false,
-				Error: "method not allowed",
+		// Approving a request runs it, which may take as long as a bulk
+		// request.
+		if len(req.Services) > 0 || req.Wait || req.Command == "approval.approve" {
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(config.BulkTimeout))
+		}
+		var resp models.Response
+		var status int
+		if approval, ok := needsApproval(req, peer); ok {
+			resp, status = holdForApproval(req, peer, approval)
+		} else {
+			resp, status = handleCommand(req, peer)
+		}
+		if len(resp.Results) > 0 {
+			resp.CorrelationID = reqID
+		}
+		writeJSON(w, status, resp)
+		// Tokens are logged by ID; the token itself never reaches the log.
+		if req.Command == "token.check" {
+			outcome := "allowed"
+			if !resp.OK {
+				outcome = "denied"
 			}
-			writeJSON(w, http.StatusMethodNotAllowed, resp)
-			recordRequest(log, audit, reqID, peer, "", "", false, resp.OK, resp.Error)
-			return
+			recordToken(log, audit, reqID, peer, tokenID(req.Token), req.Check, req.Service, outcome)
 		}
-
-		r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBytes)
-		dec := json.NewDecoder(r.Body)
-		dec.DisallowUnknownFields()
-
-		var req models.Request
-		if err := dec.Decode(&req); err != nil {
-			resp := models.Response{
-				OK:    false,
-				Error: "invalid JSON request",
+		if resp.Approval != nil {
+			recordApproval(log, audit, reqID, peer, resp.Approval)
+		}
+		// An approved request is logged under its own command.
+		command := req.Command
+		if resp.Approval != nil && resp.Approval.State == approvalApproved {
+			command = resp.Approval.Command
+		}
+		// Bulk requests log one line per unit, all under the request ID.
+		for _, item := range resp.Results {
+			recordRequest(log, audit, reqID, peer, command, item.Service, req.DryRun, item.OK, item.Error)
+			if item.Code == models.CodeProtectedUnit {
+				recordProtection(log, audit, reqID, peer, command, item.Service, "refused")
 			}
-			writeJSON(w, http.StatusBadRequest, resp)
-			recordRequest(log, audit, reqID, peer, "", "", false, resp.OK, resp.Error)
-			return
 		}
-		if err := ensureEOF(dec); err != nil {
-			resp := models.Response{
-				OK:    false,
-				Error: "invalid JSON request",
+		service := req.Service
+		if service == "" {
+			service = strings.Join(req.Services, ",")
+		}
+		// Jobs are logged by unit so the audit log ties them to the journal.
+		if resp.Job != nil {
+			service = resp.Job.Unit
+		} else if resp.Approval != nil {
+			service = strings.Join(resp.Approval.Units, ",") + resp.Approval.Script
+		} else if strings.HasPrefix(req.Command, "token.") && req.Command != "token.check" {
+			service = "token:" + tokenID(req.Token)
+			if resp.Token != nil {
+				service = "token:" + resp.Token.ID
 			}
-			writeJSON(w, http.StatusBadRequest, resp)
-			recordRequest(log, audit, reqID, peer, "", "", req.DryRun, resp.OK, resp.Error)
+		} else if service == "" {
+			service = req.Script + req.Job + req.Approval
+		}
+		// A held request has not run yet; its approval line records it.
+		held := resp.Approval != nil && resp.Approval.State == approvalPending
+		if len(resp.Results) == 0 && !held {
+			recordRequest(log, audit, reqID, peer, command, service, req.DryRun, resp.OK, resp.Error)
+			if resp.Code == models.CodeProtectedUnit {
+				recordProtection(log, audit, reqID, peer, command, service, "refused")
+			}
+		}
+		if req.Force && status != http.StatusForbidden {
+			recordProtection(log, audit, reqID, peer, req.Command, service, "forced")
+		}
+	})
+	mux.HandleFunc("/v1/stream", func(w http.ResponseWriter, r *http.Request) {
+		reqID, peer, req, ok := readRequest(w, r, log, audit, limiter)
+		if !ok {
 			return
 		}
 
-		resp, status := handleCommand(req)
-		writeJSON(w, status, resp)
-		recordRequest(log, audit, reqID, peer, req.Command, req.Service, req.DryRun, resp.OK, resp.Error)
+		handleStream(w, r, log, audit, reqID, peer, req)
 	})
 
 	return mux
 }
 
-func handleCommand(req models.Request) (models.Response, int) {
+// readRequest applies rate limiting, decodes the request body and checks it
+// against the policy. When it returns false the error response has already
+// been written and recorded.
+func readRequest(w http.ResponseWriter, r *http.Request, log *log.Logger, audit *log.Logger, limiter *rateLimiter) (string, peerInfo, models.Request, bool) {
+	reqID := newRequestID()
+	w.Header().Set("X-Request-Id", reqID)
+	peer := peerFromContext(r.Context())
+
+	var req models.Request
+	if limiter != nil && !limiter.Allow(peer.UID) {
+		resp := models.Response{
+			OK:    false,
+			Error: "rate limit exceeded",
+		}
+		writeJSON(w, http.StatusTooManyRequests, resp)
+		recordRequest(log, audit, reqID, peer, "", "", false, resp.OK, resp.Error)
+		return reqID, peer, req, false
+	}
+
+	if r.Method != http.MethodPost {
+		resp := models.Response{
+			OK:    false,
+			Error: "method not allowed",
+		}
+		writeJSON(w, http.StatusMethodNotAllowed, resp)
+		recordRequest(log, audit, reqID, peer, "", "", false, resp.OK, resp.Error)
+		return reqID, peer, req, false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&req); err != nil {
+		resp := models.Response{
+			OK:    false,
+			Error: "invalid JSON request",
+		}
+		writeJSON(w, http.StatusBadRequest, resp)
+		recordRequest(log, audit, reqID, peer, "", "", false, resp.OK, resp.Error)
+		return reqID, peer, req, false
+	}
+	if err := ensureEOF(dec); err != nil {
+		resp := models.Response{
+			OK:    false,
+			Error: "invalid JSON request",
+		}
+		writeJSON(w, http.StatusBadRequest, resp)
+		recordRequest(log, audit, reqID, peer, "", "", req.DryRun, resp.OK, resp.Error)
+		return reqID, peer, req, false
+	}
+
+	if req.OnBehalfOf != "" || req.Assertion != "" {
+		if err := checkOnBehalfOf(req, peer); err != nil {
+			resp := models.Response{
+				OK:     false,
+				Error:  err.Error(),
+				DryRun: req.DryRun,
+			}
+			writeJSON(w, http.StatusForbidden, resp)
+			recordRequest(log, audit, reqID, peer, req.Command, req.Service, req.DryRun, resp.OK, resp.Error)
+			return reqID, peer, req, false
+		}
+		peer.OnBehalfOf = req.OnBehalfOf
+	}
+
+	if decision := authorize(req, peer); !decision.Allowed {
+		resp := models.Response{
+			OK:     false,
+			Error:  "not allowed by policy: " + decision.Reason,
+			Code:   models.CodePolicyDenied,
+			DryRun: req.DryRun,
+		}
+		writeJSON(w, http.StatusForbidden, resp)
+		target := req.Service
+		if target == "" {
+			target = strings.Join(req.Services, ",") + req.Script + req.Job
+		}
+		recordRequest(log, audit, reqID, peer, req.Command, target, req.DryRun, resp.OK, resp.Error)
+		recordPolicy(log, audit, reqID, peer, req.Command, target, "denied")
+		return reqID, peer, req, false
+	}
+
+	return reqID, peer, req, true
+}
+
+func handleCommand(req models.Request, peer peerInfo) (models.Response, int) {
 	resp := models.Response{OK: true, DryRun: req.DryRun}
 
+	if req.Force && peer.UID != 0 {
+		return models.Response{
+			OK:     false,
+			Error:  "force is only allowed for root",
+			DryRun: req.DryRun,
+		}, http.StatusForbidden
+	}
+
 	switch req.Command {
 	case "status":
 		resp.Message = "ok"
 		return resp, http.StatusOK
 	case "service.list":
-		servicesList, message, err := services.ListEnabledServices(req.DryRun)
+		return serviceList(req, services.ListEnabledServices)
+	case "service.running":
+		return serviceList(req, services.ListRunningServices)
+	case "service.all":
+		return serviceList(req, services.ListAllServices)
+	case "service.failed":
+		return serviceList(req, services.ListFailedServices)
+	case "service.reset-failed":
+		name := ""
+		if req.Service != "" {
+			normalized, err := services.NormalizeUnitName(req.Service)
+			if err != nil {
+				return badRequest(err.Error(), req.DryRun)
+			}
+			name = normalized
+		}
+		cmd, changes, message, err := services.ResetFailedServices(name, req.DryRun)
 		if err != nil {
 			return errorResponse(err, req.DryRun)
 		}
-		resp.Services = servicesList
+		resp.Command = cmd
+		resp.Changes = changes
 		resp.Message = message
 		return resp, http.StatusOK
-	case "service.running":
-		servicesList, message, err := services.ListRunningServices(req.DryRun)
+	case "service.start":
+		action, err := waitAction(req, services.StartService, "active")
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		if len(req.Services) > 0 {
+			return bulkAction(req, action)
+		}
+		return serviceAction(req, action)
+	case "service.stop":
+		action, err := waitAction(req, services.StopService, "inactive")
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		action = protectAction(req, "stop", action)
+		if len(req.Services) > 0 {
+			return bulkAction(req, action)
+		}
+		resp, status := serviceAction(req, action)
+		if !resp.OK || !req.DryRun {
+			return resp, status
+		}
+		name, _ := services.NormalizeUnitName(req.Service)
+		impact, err := services.StopImpact(name)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Impact = impact
+		return resp, status
+	case "service.restart":
+		action, err := waitAction(req, services.RestartService, "active")
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		if len(req.Services) > 0 {
+			return bulkAction(req, action)
+		}
+		return serviceAction(req, action)
+	case "service.reload":
+		return serviceAction(req, services.ReloadService)
+	case "service.reload-or-restart":
+		return serviceAction(req, services.ReloadOrRestartService)
+	case "service.try-restart":
+		return serviceAction(req, services.TryRestartService)
+	case "service.show":
+		if req.Service == "" {
+			return badRequest("service name is required", req.DryRun)
+		}
+		name, err := services.NormalizeUnitName(req.Service)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		status, message, err := services.ShowService(name, req.DryRun)
 		if err != nil {
 			return errorResponse(err, req.DryRun)
 		}
-		resp.Services = servicesList
+		resp.Service = &status
 		resp.Message = message
 		return resp, http.StatusOK
-	case "service.start":
+	case "service.deps":
 		if req.Service == "" {
 			return badRequest("service name is required", req.DryRun)
 		}
-		name, err := services.NormalizeServiceName(req.Service)
+		name, err := services.NormalizeUnitName(req.Service)
 		if err != nil {
 			return badRequest(err.Error(), req.DryRun)
 		}
-		cmd, message, err := services.StartService(name, req.DryRun)
+		tree, message, err := services.ServiceDependencies(name, req.DryRun)
 		if err != nil {
 			return errorResponse(err, req.DryRun)
 		}
-		resp.Command = cmd
+		resp.Dependencies = &tree
 		resp.Message = message
 		return resp, http.StatusOK
-	case "service.stop":
+	case "service.logs":
 		if req.Service == "" {
 			return badRequest("service name is required", req.DryRun)
 		}
-		name, err := services.NormalizeServiceName(req.Service)
+		name, err := services.NormalizeUnitName(req.Service)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		query, err := services.NormalizeLogQuery(services.LogQuery{
+			Since:    req.Since,
+			Until:    req.Until,
+			Lines:    req.Lines,
+			Priority: req.Priority,
+		})
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		entries, message, err := services.ServiceLogs(name, query, req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Logs = entries
+		resp.Message = message
+		return resp, http.StatusOK
+	case "service.enable":
+		return enablementAction(req, services.EnableService)
+	case "service.disable":
+		return enablementAction(req, protectEnablement(req, "disable", services.DisableService))
+	case "service.mask":
+		return enablementAction(req, protectEnablement(req, "mask", services.MaskService))
+	case "service.unmask":
+		if req.Now {
+			return badRequest("now is not supported for service.unmask", req.DryRun)
+		}
+		return enablementAction(req, func(name string, now bool, dryRun bool) (services.EnablementResult, error) {
+			return services.UnmaskService(name, dryRun)
+		})
+	case "service.cat":
+		name, err := services.NormalizeUnitName(req.Service)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		files, message, err := services.CatService(name, req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Files = files
+		resp.Message = message
+		return resp, http.StatusOK
+	case "service.override":
+		name, err := services.NormalizeUnitName(req.Service)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		if req.Remove && req.Revert {
+			return badRequest("remove and revert are mutually exclusive", req.DryRun)
+		}
+		if !req.Remove && !req.Revert && req.Content == "" {
+			return badRequest("content is required", req.DryRun)
+		}
+		if _, err := services.NormalizeDropInName(req.DropIn); err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		result, err := services.OverrideService(name, services.Override{
+			DropIn:  req.DropIn,
+			Content: req.Content,
+			Remove:  req.Remove,
+			Revert:  req.Revert,
+		}, req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Message = result.Message
+		resp.Diff = result.Diff
+		return resp, http.StatusOK
+	case "service.set-property":
+		name, err := services.NormalizeUnitName(req.Service)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		props, err := services.NormalizeProperties(req.Properties)
 		if err != nil {
 			return badRequest(err.Error(), req.DryRun)
 		}
-		cmd, message, err := services.StopService(name, req.DryRun)
+		cmd, changes, message, err := services.SetServiceProperties(name, props, req.Runtime, req.DryRun)
 		if err != nil {
 			return errorResponse(err, req.DryRun)
 		}
 		resp.Command = cmd
+		resp.Changes = changes
+		resp.Message = message
+		return resp, http.StatusOK
+	case "timer.list":
+		timers, message, err := services.ListTimers(req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Timers = timers
+		resp.Message = message
+		return resp, http.StatusOK
+	case "timer.start":
+		return timerAction(req, services.StartTimer)
+	case "timer.stop":
+		return timerAction(req, services.StopTimer)
+	case "timer.trigger":
+		return timerAction(req, services.TriggerTimer)
+	case "timer.enable":
+		return timerEnablement(req, services.EnableTimer)
+	case "timer.disable":
+		return timerEnablement(req, services.DisableTimer)
+	case "policy.check":
+		return policyCheck(req, peer)
+	case "approval.list":
+		return listApprovals(req)
+	case "approval.approve":
+		return decideApproval(req, peer, true)
+	case "approval.reject":
+		return decideApproval(req, peer, false)
+	case "token.create":
+		return createToken(req, peer)
+	case "token.list":
+		return listTokens(req, peer)
+	case "token.revoke":
+		return revokeToken(req, peer)
+	case "token.check":
+		return checkToken(req)
+	case "job.scripts":
+		scripts, message, err := services.ListScripts(req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Scripts = scripts
+		resp.Message = message
+		return resp, http.StatusOK
+	case "job.run":
+		script, err := services.NormalizeScriptName(req.Script)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		job, cmd, message, err := services.RunJob(script, peer.UID, req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Job = &job
+		resp.Command = cmd
+		resp.Message = message
+		return resp, http.StatusOK
+	case "job.status":
+		id, err := services.NormalizeJobID(req.Job)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		query, err := services.NormalizeLogQuery(services.LogQuery{Lines: req.Lines})
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		job, entries, message, err := services.JobStatus(id, query, req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Job = &job
+		resp.Logs = entries
+		resp.Message = message
+		return resp, http.StatusOK
+	case "job.list":
+		jobs, message, err := services.ListJobs(req.DryRun)
+		if err != nil {
+			return errorResponse(err, req.DryRun)
+		}
+		resp.Jobs = jobs
 		resp.Message = message
 		return resp, http.StatusOK
 	default:
@@ -220,6 +647,183 @@ func handleCommand(req models.Request) (models.Response, int) {
 	}
 }
 
+type serviceListFunc func(unitType string, dryRun bool) ([]models.ServiceInfo, string, error)
+
+func serviceList(req models.Request, list serviceListFunc) (models.Response, int) {
+	unitType, err := services.NormalizeUnitType(req.Type)
+	if err != nil {
+		return badRequest(err.Error(), req.DryRun)
+	}
+	servicesList, message, err := list(unitType, req.DryRun)
+	if err != nil {
+		return errorResponse(err, req.DryRun)
+	}
+	return models.Response{
+		OK:       true,
+		DryRun:   req.DryRun,
+		Services: servicesList,
+		Message:  message,
+	}, http.StatusOK
+}
+
+type serviceActionFunc = services.UnitActionFunc
+
+type normalizeFunc func(input string) (string, error)
+
+func serviceAction(req models.Request, action serviceActionFunc) (models.Response, int) {
+	return unitAction(req, services.NormalizeUnitName, action)
+}
+
+func timerAction(req models.Request, action serviceActionFunc) (models.Response, int) {
+	return unitAction(req, services.NormalizeTimerName, action)
+}
+
+func unitAction(req models.Request, normalize normalizeFunc, action serviceActionFunc) (models.Response, int) {
+	if len(req.Services) > 0 {
+		return badRequest("services is only supported for service.start, service.stop and service.restart", req.DryRun)
+	}
+	name, err := normalize(req.Service)
+	if err != nil {
+		return badRequest(err.Error(), req.DryRun)
+	}
+	cmd, message, err := action(name, req.DryRun)
+	if err != nil {
+		return errorResponse(err, req.DryRun)
+	}
+	return models.Response{
+		OK:      true,
+		DryRun:  req.DryRun,
+		Command: cmd,
+		Message: message,
+	}, http.StatusOK
+}
+
+// waitAction wraps action so that it waits for the unit to become want when
+// the request asks for it.
+func waitAction(req models.Request, action serviceActionFunc, want string) (serviceActionFunc, error) {
+	if !req.Wait {
+		if req.WaitTimeout != 0 {
+			return nil, errors.New("wait_timeout requires wait")
+		}
+		return action, nil
+	}
+	timeout, err := services.NormalizeWaitTimeout(req.WaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return services.WithWait(action, want, timeout), nil
+}
+
+// checkBulkWait refuses a waiting bulk request on units that could run past
+// the deadline its reply is written under.
+func checkBulkWait(req models.Request, units int) error {
+	if !req.Wait {
+		return nil
+	}
+	timeout, err := services.NormalizeWaitTimeout(req.WaitTimeout)
+	if err != nil {
+		return err
+	}
+	return services.CheckBulkWait(units, timeout)
+}
+
+// protectAction refuses verb on protected units unless the request is forced;
+// handleCommand only lets root force.
+func protectAction(req models.Request, verb string, action serviceActionFunc) serviceActionFunc {
+	if req.Force {
+		return action
+	}
+	return func(name string, dryRun bool) ([]string, string, error) {
+		if err := services.CheckProtected(verb, name); err != nil {
+			return nil, "", err
+		}
+		return action(name, dryRun)
+	}
+}
+
+func protectEnablement(req models.Request, verb string, action enablementFunc) enablementFunc {
+	if req.Force {
+		return action
+	}
+	return func(name string, now bool, dryRun bool) (services.EnablementResult, error) {
+		if err := services.CheckProtected(verb, name); err != nil {
+			return services.EnablementResult{}, err
+		}
+		return action(name, now, dryRun)
+	}
+}
+
+// bulkAction runs action on every unit matched by req.Services. The
+// response fails when any unit fails, but always carries every result.
+func bulkAction(req models.Request, action serviceActionFunc) (models.Response, int) {
+	if req.Service != "" {
+		return badRequest("service and services are mutually exclusive", req.DryRun)
+	}
+	patterns := make([]string, 0, len(req.Services))
+	for _, input := range req.Services {
+		pattern, err := services.NormalizeUnitPattern(input)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		patterns = append(patterns, pattern)
+	}
+	names, err := services.ExpandUnitPatterns(patterns)
+	if err != nil {
+		return badRequest(err.Error(), req.DryRun)
+	}
+	if err := checkBulkWait(req, len(names)); err != nil {
+		return badRequest(err.Error(), req.DryRun)
+	}
+
+	results := services.RunBulk(names, action, req.DryRun)
+	failed := 0
+	for _, result := range results {
+		if !result.OK {
+			failed++
+		}
+	}
+	resp := models.Response{
+		OK:      failed == 0,
+		DryRun:  req.DryRun,
+		Results: results,
+		Message: fmt.Sprintf("%d of %d units succeeded", len(results)-failed, len(results)),
+	}
+	if failed > 0 {
+		resp.Error = fmt.Sprintf("%d of %d units failed", failed, len(results))
+		return resp, http.StatusInternalServerError
+	}
+	return resp, http.StatusOK
+}
+
+type enablementFunc func(name string, now bool, dryRun bool) (services.EnablementResult, error)
+
+func enablementAction(req models.Request, action enablementFunc) (models.Response, int) {
+	return unitEnablement(req, services.NormalizeUnitName, action)
+}
+
+func timerEnablement(req models.Request, action enablementFunc) (models.Response, int) {
+	return unitEnablement(req, services.NormalizeTimerName, action)
+}
+
+func unitEnablement(req models.Request, normalize normalizeFunc, action enablementFunc) (models.Response, int) {
+	name, err := normalize(req.Service)
+	if err != nil {
+		return badRequest(err.Error(), req.DryRun)
+	}
+	result, err := action(name, req.Now, req.DryRun)
+	if err != nil {
+		return errorResponse(err, req.DryRun)
+	}
+	return models.Response{
+		OK:            true,
+		DryRun:        req.DryRun,
+		Command:       result.Command,
+		Message:       result.Message,
+		Changes:       result.Changes,
+		UnitFileState: result.UnitFileState,
+	}, http.StatusOK
+}
+
 func writeJSON(w http.ResponseWriter, status int, resp models.Response) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -247,17 +851,41 @@ func badRequest(message string, dryRun bool) (models.Response, int) {
 }
 
 func errorResponse(err error, dryRun bool) (models.Response, int) {
-	return models.Response{
+	resp := models.Response{
 		OK:     false,
 		Error:  err.Error(),
 		DryRun: dryRun,
-	}, http.StatusInternalServerError
+	}
+	var waitErr *services.WaitError
+	if errors.As(err, &waitErr) {
+		resp.Diagnosis = &waitErr.Diagnosis
+	}
+	var protectedErr *services.ProtectedError
+	if errors.As(err, &protectedErr) {
+		resp.Code = models.CodeProtectedUnit
+		return resp, http.StatusForbidden
+	}
+	return resp, http.StatusInternalServerError
 }
 
 type peerInfo struct {
 	UID int
 	GID int
 	PID int
+	// Groups are the supplementary groups recorded when the peer
+	// connected, nil if the kernel does not report them.
+	Groups []int
+	// OnBehalfOf is the person a trusted peer made the request for, once
+	// its assertion has been verified.
+	OnBehalfOf string
+}
+
+// onBehalfOf returns the person p acts for in logs, "-" for none.
+func (p peerInfo) onBehalfOf() string {
+	if p.OnBehalfOf == "" {
+		return "-"
+	}
+	return p.OnBehalfOf
 }
 
 type peerKeyType int
@@ -289,7 +917,41 @@ func peerFromConn(c net.Conn) (peerInfo, error) {
 	if err != nil {
 		return peerInfo{}, err
 	}
-	return peerInfo{UID: int(ucred.Uid), GID: int(ucred.Gid), PID: int(ucred.Pid)}, nil
+	return peerInfo{UID: int(ucred.Uid), GID: int(ucred.Gid), PID: int(ucred.Pid), Groups: getPeerGroups(unixConn)}, nil
+}
+
+// soPeerGroups is SO_PEERGROUPS (Linux 4.13), missing from package syscall.
+const soPeerGroups = 59
+
+// getPeerGroups returns the supplementary groups the kernel recorded for
+// the peer at connect time, or nil if it cannot.
+func getPeerGroups(conn *net.UnixConn) []int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var groups []int
+	raw.Control(func(fd uintptr) {
+		buf := make([]uint32, 64)
+		for {
+			size := uint32(len(buf) * 4)
+			_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_SOCKET, soPeerGroups,
+				uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+			if errno == syscall.ERANGE && int(size/4) > len(buf) {
+				buf = make([]uint32, size/4)
+				continue
+			}
+			if errno != 0 {
+				return
+			}
+			groups = make([]int, 0, size/4)
+			for _, gid := range buf[:size/4] {
+				groups = append(groups, int(gid))
+			}
+			return
+		}
+	})
+	return groups
 }
 
 func getUcred(conn *net.UnixConn) (*syscall.Ucred, error) {
@@ -362,6 +1024,16 @@ func (r *rateLimiter) prune(now int64) {
 	}
 }
 
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func newRequestID() string {
 	var buf [8]byte
 	if _, err := rand.Read(buf[:]); err != nil {
@@ -370,11 +1042,22 @@ func newRequestID() string {
 	return hex.EncodeToString(buf[:])
 }
 
+// recordProtection writes a separate audit entry when an action on a
+// protected unit is refused, or when root forces one.
+func recordProtection(log *log.Logger, audit *log.Logger, reqID string, peer peerInfo, command string, service string, outcome string) {
+	log.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s protected=%s",
+		reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, outcome)
+	if audit != nil {
+		audit.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s protected=%s",
+			reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, outcome)
+	}
+}
+
 func recordRequest(log *log.Logger, audit *log.Logger, reqID string, peer peerInfo, command string, service string, dryRun bool, ok bool, errMsg string) {
-	log.Printf("req_id=%s uid=%d gid=%d pid=%d command=%s service=%s dry_run=%t ok=%t error=%s",
-		reqID, peer.UID, peer.GID, peer.PID, command, service, dryRun, ok, errMsg)
+	log.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s dry_run=%t ok=%t error=%s",
+		reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, dryRun, ok, errMsg)
 	if audit != nil {
-		audit.Printf("req_id=%s uid=%d gid=%d pid=%d command=%s service=%s dry_run=%t ok=%t error=%s",
-			reqID, peer.UID, peer.GID, peer.PID, command, service, dryRun, ok, errMsg)
+		audit.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s dry_run=%t ok=%t error=%s",
+			reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, dryRun, ok, errMsg)
 	}
 }
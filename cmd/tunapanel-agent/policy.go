@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"tunapanel/internal/models"
+	"tunapanel/internal/policy"
+	"tunapanel/internal/services"
+)
+
+// agentPolicy is the policy in force. A nil policy allows every request.
+var agentPolicy atomic.Pointer[policy.Policy]
+
+// alwaysAllowed commands do their own checks, or none for status.
+var alwaysAllowed = map[string]bool{
+	"status":       true,
+	"policy.check": true,
+	"token.check":  true,
+}
+
+func loadPolicy(dir string, log *log.Logger) error {
+	p, err := policy.Load(dir)
+	if err != nil {
+		return err
+	}
+	agentPolicy.Store(p)
+	if p == nil {
+		log.Printf("warning: no policy in %s; every peer may run every command", dir)
+	} else {
+		log.Printf("loaded %d policy rules from %s", len(p.Rules), dir)
+	}
+	return nil
+}
+
+// authorize checks req against the policy before it is handled.
+func authorize(req models.Request, peer peerInfo) policy.Decision {
+	p := agentPolicy.Load()
+	if p == nil || alwaysAllowed[req.Command] {
+		return policy.Decision{Allowed: true}
+	}
+	return checkRequest(p, policy.LookupSubject(peer.UID, peer.GID, peer.Groups), req)
+}
+
+// checkRequest decides whether s may run req. Triggering a timer starts the
+// unit it activates, so it also takes service.start on that unit.
+func checkRequest(p *policy.Policy, s policy.Subject, req models.Request) policy.Decision {
+	target := policyTarget(req)
+	decision := p.Check(s, target)
+	if !decision.Allowed || p == nil || s.UID == 0 || target.Command != "timer.trigger" || len(target.Units) != 1 {
+		return decision
+	}
+	unit, err := services.TimerUnit(target.Units[0])
+	if err != nil {
+		return policy.Decision{Reason: fmt.Sprintf("cannot tell which unit %s activates: %v", target.Units[0], err)}
+	}
+	if started := p.Check(s, policy.Target{Command: "service.start", Units: []string{unit}}); !started.Allowed {
+		return policy.Decision{Reason: fmt.Sprintf("%s activates %s: %s", target.Units[0], unit, started.Reason)}
+	}
+	return decision
+}
+
+// policyTarget works out the units or script req acts on, normalized the
+// way handleCommand will.
+func policyTarget(req models.Request) policy.Target {
+	t := policy.Target{Command: req.Command}
+	switch {
+	case len(req.Services) > 0:
+		patterns := make([]string, 0, len(req.Services))
+		for _, input := range req.Services {
+			pattern, err := services.NormalizeUnitPattern(input)
+			if err != nil {
+				pattern = input
+			}
+			patterns = append(patterns, pattern)
+		}
+		if names, err := services.ExpandUnitPatterns(patterns); err == nil {
+			t.Units = names
+		} else {
+			t.Units = patterns
+		}
+	case req.Service != "":
+		normalize := services.NormalizeUnitName
+		if strings.HasPrefix(req.Command, "timer.") {
+			normalize = services.NormalizeTimerName
+		}
+		name, err := normalize(req.Service)
+		if err != nil {
+			name = req.Service
+		}
+		t.Units = []string{name}
+	case req.Command == "service.reset-failed":
+		// Without a name every failed unit is reset.
+		t.Units = []string{"*"}
+	}
+	if req.Command == "job.run" {
+		t.Script = strings.TrimSpace(req.Script)
+	}
+	return t
+}
+
+// policyCheck answers policy.check. Anyone may check themselves; checking
+// another user takes root or a rule that allows policy.check.
+func policyCheck(req models.Request, peer peerInfo) (models.Response, int) {
+	p := agentPolicy.Load()
+	subject := policy.LookupSubject(peer.UID, peer.GID, peer.Groups)
+	if req.User != "" {
+		other, err := policy.LookupUser(req.User)
+		if err != nil {
+			return badRequest(err.Error(), req.DryRun)
+		}
+		if other.UID != subject.UID && !p.Check(subject, policy.Target{Command: "policy.check"}).Allowed {
+			return models.Response{
+				OK:     false,
+				Error:  "checking other users requires root or a policy rule allowing policy.check",
+				Code:   models.CodePolicyDenied,
+				DryRun: req.DryRun,
+			}, http.StatusForbidden
+		}
+		subject = other
+	}
+
+	check := &models.PolicyCheck{
+		User:     subject.Name,
+		UID:      subject.UID,
+		Groups:   subject.Groups,
+		Enforced: p != nil,
+	}
+	for _, rule := range p.RulesFor(subject) {
+		check.Rules = append(check.Rules, models.PolicyRule{
+			Source:   rule.Source,
+			Users:    rule.Users,
+			Groups:   rule.Groups,
+			Commands: rule.Commands,
+			Units:    rule.Units,
+			Scripts:  rule.Scripts,
+		})
+	}
+	if req.Check != "" {
+		checked := models.Request{Command: req.Check, Service: req.Service, Script: req.Script}
+		target := policyTarget(checked)
+		decision := checkRequest(p, subject, checked)
+		if alwaysAllowed[req.Check] {
+			decision = policy.Decision{Allowed: true, Reason: req.Check + " is always allowed"}
+		}
+		check.Command = target.Command
+		check.Units = target.Units
+		check.Script = target.Script
+		check.Allowed = decision.Allowed
+		check.Reason = decision.Reason
+	}
+	return models.Response{OK: true, DryRun: req.DryRun, Policy: check}, http.StatusOK
+}
+
+func recordPolicy(log *log.Logger, audit *log.Logger, reqID string, peer peerInfo, command string, service string, outcome string) {
+	log.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s policy=%s",
+		reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, outcome)
+	if audit != nil {
+		audit.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s policy=%s",
+			reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, outcome)
+	}
+}
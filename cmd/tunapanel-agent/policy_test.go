@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tunapanel/internal/models"
+	"tunapanel/internal/policy"
+	"tunapanel/internal/services"
+)
+
+// useSimulator serves the simulated units for the rest of the test.
+func useSimulator(t *testing.T) *services.Simulator {
+	t.Helper()
+	sim := services.NewSimulator(nil)
+	services.SetManager(sim)
+	t.Cleanup(func() { services.SetManager(services.Systemctl{}) })
+	return sim
+}
+
+// usePolicy puts the policy in data in force for the rest of the test.
+func usePolicy(t *testing.T, data string) *policy.Policy {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.toml"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentPolicy.Store(p)
+	t.Cleanup(func() { agentPolicy.Store(nil) })
+	return p
+}
+
+func TestCheckRequest(t *testing.T) {
+	useSimulator(t)
+	p := usePolicy(t, `
+[[rule]]
+users = ["alice"]
+commands = ["timer.trigger", "service.start", "service.stop"]
+units = ["backup.timer", "logrotate.timer", "backup", "worker@*"]
+`)
+	alice := policy.Subject{UID: 1000, Name: "alice"}
+
+	tests := []struct {
+		req    models.Request
+		reason string
+	}{
+		{models.Request{Command: "timer.trigger", Service: "backup"}, ""},
+		{models.Request{Command: "timer.trigger", Service: "logrotate.timer"}, "logrotate.timer activates logrotate.service: alice may not run service.start on logrotate.service"},
+		{models.Request{Command: "timer.trigger", Service: "certbot"}, "alice may not run timer.trigger on certbot.timer"},
+		{models.Request{Command: "service.stop", Services: []string{"worker@*"}}, ""},
+		{models.Request{Command: "service.stop", Services: []string{"worker@*", "nginx"}}, "on nginx.service"},
+		{models.Request{Command: "service.restart", Service: "backup"}, "may not run service.restart"},
+	}
+	for _, tt := range tests {
+		d := checkRequest(p, alice, tt.req)
+		if d.Allowed != (tt.reason == "") || !strings.Contains(d.Reason, tt.reason) {
+			t.Errorf("checkRequest(%s %s%v) = %+v, want %q", tt.req.Command, tt.req.Service, tt.req.Services, d, tt.reason)
+		}
+	}
+
+	root := policy.Subject{UID: 0, Name: "root"}
+	if d := checkRequest(p, root, models.Request{Command: "timer.trigger", Service: "logrotate"}); !d.Allowed {
+		t.Errorf("root: %+v", d)
+	}
+}
+
+func TestPolicyTarget(t *testing.T) {
+	useSimulator(t)
+	tests := []struct {
+		req   models.Request
+		units string
+	}{
+		{models.Request{Command: "service.start", Service: "nginx"}, "nginx.service"},
+		{models.Request{Command: "timer.start", Service: "backup"}, "backup.timer"},
+		{models.Request{Command: "service.stop", Services: []string{"worker@*"}}, "worker@1.service worker@2.service worker@3.service"},
+		{models.Request{Command: "service.stop", Services: []string{"nomatch-*"}}, "nomatch-*.service"},
+		{models.Request{Command: "service.reset-failed"}, "*"},
+		{models.Request{Command: "service.list"}, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(policyTarget(tt.req).Units, " "); got != tt.units {
+			t.Errorf("policyTarget(%s %s%v) units = %q, want %q", tt.req.Command, tt.req.Service, tt.req.Services, got, tt.units)
+		}
+	}
+}
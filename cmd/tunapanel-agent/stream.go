@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"tunapanel/internal/config"
+	"tunapanel/internal/models"
+	"tunapanel/internal/services"
+)
+
+// streamSlots bounds the number of concurrent follow streams, each of which
+// holds a journalctl process open.
+var streamSlots = make(chan struct{}, config.MaxLogStreams)
+
+// handleStream serves /v1/stream: the response is newline-delimited JSON,
+// one models.LogEntry per line, until the client disconnects or the agent
+// shuts down. Errors detected before the first entry are reported as a
+// regular models.Response.
+func handleStream(w http.ResponseWriter, r *http.Request, log *log.Logger, audit *log.Logger, reqID string, peer peerInfo, req models.Request) {
+	fail := func(resp models.Response, status int) {
+		writeJSON(w, status, resp)
+		recordRequest(log, audit, reqID, peer, req.Command, req.Service, req.DryRun, resp.OK, resp.Error)
+	}
+
+	if req.Command != "service.logs" {
+		fail(badRequest("command does not support streaming", req.DryRun))
+		return
+	}
+	if req.DryRun {
+		fail(badRequest("dry-run is not supported for streams", req.DryRun))
+		return
+	}
+	if req.Service == "" {
+		fail(badRequest("service name is required", req.DryRun))
+		return
+	}
+	name, err := services.NormalizeUnitName(req.Service)
+	if err != nil {
+		fail(badRequest(err.Error(), req.DryRun))
+		return
+	}
+	query, err := services.NormalizeLogQuery(services.LogQuery{
+		Since:    req.Since,
+		Lines:    req.Lines,
+		Priority: req.Priority,
+	})
+	if err != nil {
+		fail(badRequest(err.Error(), req.DryRun))
+		return
+	}
+	if req.Until != "" {
+		fail(badRequest("until is not supported when following logs", req.DryRun))
+		return
+	}
+
+	select {
+	case streamSlots <- struct{}{}:
+		defer func() { <-streamSlots }()
+	default:
+		fail(models.Response{OK: false, Error: "too many log streams"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	// The server-wide timeouts are sized for single request/response
+	// commands; a stream lives until the client goes away.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+	recordRequest(log, audit, reqID, peer, req.Command+".follow", req.Service, req.DryRun, true, "")
+
+	enc := json.NewEncoder(w)
+	err = services.FollowServiceLogs(r.Context(), name, query, func(entry models.LogEntry) error {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("req_id=%s stream ended: %v", reqID, err)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/models"
+	"tunapanel/internal/policy"
+	"tunapanel/internal/services"
+)
+
+const (
+	tokenPrefix     = "tp_"
+	defaultTokenTTL = 30 * 24 * time.Hour
+	maxTokenTTL     = 365 * 24 * time.Hour
+	maxTokens       = 1000
+	maxTokenName    = 64
+
+	// tokenUseInterval is how often a token's LastUsed is written to the
+	// tokens file; in between it is only updated in memory.
+	tokenUseInterval = time.Minute
+)
+
+// storedToken is a token as saved by the agent: its hash instead of the
+// secret, and the owner's groups when it was made, which the policy is
+// checked against when the token is used.
+type storedToken struct {
+	models.TokenInfo
+	Hash        string   `json:"hash"`
+	OwnerGIDs   []int    `json:"owner_gids"`
+	OwnerGroups []string `json:"owner_groups,omitempty"`
+
+	// savedUse is the LastUsed last written to the tokens file.
+	savedUse time.Time
+}
+
+// tokens are the API tokens, saved to path after every change. With an
+// empty path, in simulation mode, they only live in memory.
+var tokens struct {
+	mu    sync.Mutex
+	path  string
+	items []*storedToken
+}
+
+func loadTokens(file string) error {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.path = file
+	tokens.items = nil
+	if file == "" {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s: must only be accessible by root", file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &tokens.items); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, item := range tokens.items {
+		if item.LastUsed != nil {
+			item.savedUse = *item.LastUsed
+		}
+	}
+	return nil
+}
+
+// saveTokens writes every unexpired token, replacing the file in one step.
+// The caller holds tokens.mu.
+func saveTokens(now time.Time) error {
+	live := tokens.items[:0]
+	for _, item := range tokens.items {
+		if now.Before(item.ExpiresAt) {
+			live = append(live, item)
+		}
+	}
+	tokens.items = live
+	if tokens.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(tokens.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(tokens.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tokens-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), tokens.path); err != nil {
+		return err
+	}
+	for _, item := range tokens.items {
+		if item.LastUsed != nil {
+			item.savedUse = *item.LastUsed
+		}
+	}
+	return nil
+}
+
+// createToken makes a token owned by the peer. Only its hash is kept; the
+// response is the one chance to read it.
+func createToken(req models.Request, peer peerInfo) (models.Response, int) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxTokenName {
+		return badRequest(fmt.Sprintf("token name is required (at most %d characters)", maxTokenName), req.DryRun)
+	}
+	if len(req.Commands) == 0 {
+		return badRequest("commands are required", req.DryRun)
+	}
+	var commands []string
+	for _, command := range req.Commands {
+		command = strings.TrimSpace(command)
+		if _, err := path.Match(command, ""); err != nil || command == "" {
+			return badRequest(fmt.Sprintf("invalid command pattern %q", command), req.DryRun)
+		}
+		commands = append(commands, command)
+	}
+	var units []string
+	for _, input := range req.Units {
+		input = strings.TrimSpace(input)
+		if input == "*" {
+			units = append(units, input)
+			continue
+		}
+		pattern, err := services.NormalizeUnitPattern(input)
+		if err != nil {
+			return badRequest(fmt.Sprintf("unit %q: %v", input, err), req.DryRun)
+		}
+		units = append(units, pattern)
+	}
+	ttl, err := parseExpiry(req.Expires)
+	if err != nil {
+		return badRequest(err.Error(), req.DryRun)
+	}
+
+	id, secret, err := newToken()
+	if err != nil {
+		return errorResponse(err, req.DryRun)
+	}
+	owner := policy.LookupSubject(peer.UID, peer.GID, peer.Groups)
+	now := time.Now()
+	item := &storedToken{
+		TokenInfo: models.TokenInfo{
+			ID:        id,
+			Name:      name,
+			Owner:     owner.Name,
+			OwnerUID:  owner.UID,
+			Commands:  commands,
+			Units:     units,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		},
+		Hash:        hashToken(secret),
+		OwnerGIDs:   owner.GIDs,
+		OwnerGroups: owner.Groups,
+	}
+	info := item.TokenInfo
+	info.Secret = secret
+	if req.DryRun {
+		return models.Response{OK: true, DryRun: true, Message: "would create token " + name}, http.StatusOK
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	if len(tokens.items) >= maxTokens {
+		return badRequest(fmt.Sprintf("too many tokens (max %d)", maxTokens), req.DryRun)
+	}
+	tokens.items = append(tokens.items, item)
+	if err := saveTokens(now); err != nil {
+		tokens.items = tokens.items[:len(tokens.items)-1]
+		return errorResponse(fmt.Errorf("failed to save tokens: %w", err), req.DryRun)
+	}
+	return models.Response{
+		OK:      true,
+		Message: fmt.Sprintf("created token %s (%s), valid until %s", id, name, info.ExpiresAt.Format(time.RFC3339)),
+		Token:   &info,
+	}, http.StatusOK
+}
+
+// listTokens shows root every token and everyone else their own.
+func listTokens(req models.Request, peer peerInfo) (models.Response, int) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	now := time.Now()
+	list := make([]models.TokenInfo, 0, len(tokens.items))
+	for _, item := range tokens.items {
+		if now.Before(item.ExpiresAt) && (peer.UID == 0 || item.OwnerUID == peer.UID) {
+			list = append(list, item.TokenInfo)
+		}
+	}
+	return models.Response{OK: true, DryRun: req.DryRun, Tokens: list}, http.StatusOK
+}
+
+// revokeToken deletes a token. Owners may revoke their own tokens and root
+// any token.
+func revokeToken(req models.Request, peer peerInfo) (models.Response, int) {
+	id := tokenID(strings.TrimSpace(req.Token))
+	if id == "" {
+		return badRequest("token id is required", req.DryRun)
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	for i, item := range tokens.items {
+		if item.ID != id || (peer.UID != 0 && item.OwnerUID != peer.UID) {
+			continue
+		}
+		info := item.TokenInfo
+		if req.DryRun {
+			return models.Response{OK: true, DryRun: true, Message: "would revoke token " + id, Token: &info}, http.StatusOK
+		}
+		items := tokens.items
+		tokens.items = append(append([]*storedToken(nil), items[:i]...), items[i+1:]...)
+		if err := saveTokens(time.Now()); err != nil {
+			tokens.items = items
+			return errorResponse(fmt.Errorf("failed to save tokens: %w", err), req.DryRun)
+		}
+		return models.Response{OK: true, Message: fmt.Sprintf("revoked token %s (%s)", id, info.Name), Token: &info}, http.StatusOK
+	}
+	return badRequest(fmt.Sprintf("token not found: %s", id), req.DryRun)
+}
+
+// checkToken answers token.check: whether the token may run req.Check on
+// req.Service. It must be in the token's scope, and the token's owner must
+// still be allowed to run it by the policy.
+func checkToken(req models.Request) (models.Response, int) {
+	id := tokenID(req.Token)
+	now := time.Now()
+
+	tokens.mu.Lock()
+	var item *storedToken
+	for _, candidate := range tokens.items {
+		if candidate.ID == id && id != "" {
+			item = candidate
+		}
+	}
+	if item == nil || subtle.ConstantTimeCompare([]byte(hashToken(req.Token)), []byte(item.Hash)) != 1 {
+		tokens.mu.Unlock()
+		return invalidToken("invalid token", req.DryRun)
+	}
+	if !now.Before(item.ExpiresAt) {
+		tokens.mu.Unlock()
+		return invalidToken("token expired", req.DryRun)
+	}
+	info := item.TokenInfo
+	owner := policy.Subject{UID: item.OwnerUID, Name: item.Owner, GIDs: item.OwnerGIDs, Groups: item.OwnerGroups}
+	tokens.mu.Unlock()
+
+	if reason := tokenDenial(info, owner, req); reason != "" {
+		resp, status := denied(reason, req.DryRun)
+		resp.Token = &info
+		return resp, status
+	}
+
+	// Failing to record the last use must not fail the request.
+	tokens.mu.Lock()
+	item.LastUsed = &now
+	info.LastUsed = &now
+	if now.Sub(item.savedUse) >= tokenUseInterval {
+		_ = saveTokens(now)
+	}
+	tokens.mu.Unlock()
+	return models.Response{OK: true, DryRun: req.DryRun, Message: "allowed", Token: &info}, http.StatusOK
+}
+
+// tokenDenial says why a valid token may not run req.Check on req.Service,
+// or returns "" when it may.
+func tokenDenial(info models.TokenInfo, owner policy.Subject, req models.Request) string {
+	target := policyTarget(models.Request{Command: req.Check, Service: req.Service})
+	if !matchPattern(info.Commands, target.Command) {
+		return fmt.Sprintf("token %s may not run %s", info.ID, target.Command)
+	}
+	if len(info.Units) > 0 {
+		for _, unit := range target.Units {
+			if !matchPattern(info.Units, unit) {
+				return fmt.Sprintf("token %s may not run %s on %s", info.ID, target.Command, unit)
+			}
+		}
+	}
+	if decision := agentPolicy.Load().Check(owner, target); !decision.Allowed {
+		return "token owner not allowed by policy: " + decision.Reason
+	}
+	return ""
+}
+
+func invalidToken(message string, dryRun bool) (models.Response, int) {
+	return models.Response{
+		OK:     false,
+		Error:  message,
+		Code:   models.CodeInvalidToken,
+		DryRun: dryRun,
+	}, http.StatusUnauthorized
+}
+
+// newToken returns a token ID and the token, "tp_<id>_<secret>". The ID
+// names the token in lists and logs; the secret is 256 random bits.
+func newToken() (string, string, error) {
+	var id [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", "", err
+	}
+	idHex := hex.EncodeToString(id[:])
+	return idHex, tokenPrefix + idHex + "_" + base64.RawURLEncoding.EncodeToString(secret[:]), nil
+}
+
+// tokenID returns the ID part of a token, or the input when it already is
+// an ID.
+func tokenID(token string) string {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return token
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	return id
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseExpiry reads how long a token lasts: a Go duration such as "12h"
+// or a number of days such as "30d".
+func parseExpiry(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return defaultTokenTTL, nil
+	}
+	var ttl time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry %q", value)
+		}
+		ttl = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry %q", value)
+		}
+		ttl = d
+	}
+	if ttl <= 0 || ttl > maxTokenTTL {
+		return 0, fmt.Errorf("expiry must be between 1s and %dd", int(maxTokenTTL.Hours()/24))
+	}
+	return ttl, nil
+}
+
+func matchPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// recordToken writes a separate audit entry for every token.check, naming
+// the token by its ID.
+func recordToken(log *log.Logger, audit *log.Logger, reqID string, peer peerInfo, token string, command string, service string, outcome string) {
+	log.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s token=%s token_check=%s",
+		reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, token, outcome)
+	if audit != nil {
+		audit.Printf("req_id=%s uid=%d gid=%d pid=%d on_behalf_of=%s command=%s service=%s token=%s token_check=%s",
+			reqID, peer.UID, peer.GID, peer.PID, peer.onBehalfOf(), command, service, token, outcome)
+	}
+}
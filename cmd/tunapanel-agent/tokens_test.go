@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tunapanel/internal/models"
+)
+
+const tokenPolicy = `
+[[rule]]
+users = ["2000"]
+commands = ["service.list", "service.show", "service.restart", "token.*"]
+units = ["nginx", "worker@*"]
+`
+
+var tokenOwner = peerInfo{UID: 2000, GID: 2000, Groups: []int{}}
+
+// setupTokens keeps tokens in a file under a temporary directory.
+func setupTokens(t *testing.T) string {
+	t.Helper()
+	useSimulator(t)
+	usePolicy(t, tokenPolicy)
+	file := filepath.Join(t.TempDir(), "tokens", "tokens.json")
+	if err := loadTokens(file); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadTokens("") })
+	return file
+}
+
+func newTestToken(t *testing.T, req models.Request) models.TokenInfo {
+	t.Helper()
+	req.Command = "token.create"
+	resp, status := createToken(req, tokenOwner)
+	if status != http.StatusOK || resp.Token == nil || resp.Token.Secret == "" {
+		t.Fatalf("create token: %d %+v", status, resp)
+	}
+	return *resp.Token
+}
+
+func check(token string, command string, service string) (models.Response, int) {
+	return checkToken(models.Request{Command: "token.check", Token: token, Check: command, Service: service})
+}
+
+func TestTokenScope(t *testing.T) {
+	file := setupTokens(t)
+	restart := newTestToken(t, models.Request{Name: "deploy", Commands: []string{"service.restart", "service.show"}, Units: []string{"worker@*"}})
+	anyUnit := newTestToken(t, models.Request{Name: "read", Commands: []string{"service.*"}})
+
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("tokens file: %v, %v", info, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), restart.Secret) || !strings.Contains(string(data), hashToken(restart.Secret)) {
+		t.Error("the tokens file holds the secret rather than its hash")
+	}
+
+	tests := []struct {
+		token   string
+		command string
+		service string
+		status  int
+		err     string
+	}{
+		{restart.Secret, "service.restart", "worker@1", http.StatusOK, ""},
+		{restart.Secret, "service.show", "worker@2.service", http.StatusOK, ""},
+		{restart.Secret, "service.restart", "nginx", http.StatusForbidden, "may not run service.restart on nginx.service"},
+		{restart.Secret, "service.stop", "worker@1", http.StatusForbidden, "may not run service.stop"},
+		{anyUnit.Secret, "service.restart", "nginx", http.StatusOK, ""},
+		{anyUnit.Secret, "service.restart", "postgresql", http.StatusForbidden, "token owner not allowed by policy"},
+		{anyUnit.Secret, "service.stop", "nginx", http.StatusForbidden, "token owner not allowed by policy"},
+		{restart.ID, "service.restart", "worker@1", http.StatusUnauthorized, "invalid token"},
+		{restart.Secret[:len(restart.Secret)-1] + "x", "service.restart", "worker@1", http.StatusUnauthorized, "invalid token"},
+		{"tp_" + anyUnit.ID + "_" + strings.SplitN(restart.Secret, "_", 3)[2], "service.restart", "nginx", http.StatusUnauthorized, "invalid token"},
+		{"", "service.list", "", http.StatusUnauthorized, "invalid token"},
+	}
+	for _, tt := range tests {
+		resp, status := check(tt.token, tt.command, tt.service)
+		if status != tt.status || !strings.Contains(resp.Error, tt.err) {
+			t.Errorf("check %s %s with %.12s…: %d %q, want %d %q", tt.command, tt.service, tt.token, status, resp.Error, tt.status, tt.err)
+		}
+		if status == http.StatusUnauthorized && resp.Code != models.CodeInvalidToken {
+			t.Errorf("check %s %s: code %q", tt.command, tt.service, resp.Code)
+		}
+	}
+}
+
+func TestTokenExpiryAndRevoke(t *testing.T) {
+	setupTokens(t)
+	token := newTestToken(t, models.Request{Name: "short", Commands: []string{"service.list"}, Expires: "1h"})
+	if token.ExpiresAt.Sub(token.CreatedAt) != time.Hour {
+		t.Errorf("token lasts %s", token.ExpiresAt.Sub(token.CreatedAt))
+	}
+
+	other := peerInfo{UID: 2001, GID: 2001}
+	if resp, _ := listTokens(models.Request{Command: "token.list"}, other); len(resp.Tokens) != 0 {
+		t.Errorf("another user sees %d tokens", len(resp.Tokens))
+	}
+	if _, status := revokeToken(models.Request{Command: "token.revoke", Token: token.ID}, other); status != http.StatusBadRequest {
+		t.Errorf("another user revoking the token: %d", status)
+	}
+
+	tokens.mu.Lock()
+	tokens.items[0].ExpiresAt = time.Now().Add(-time.Second)
+	tokens.mu.Unlock()
+	if resp, status := check(token.Secret, "service.list", ""); status != http.StatusUnauthorized || resp.Error != "token expired" {
+		t.Errorf("expired token: %d %+v", status, resp)
+	}
+
+	token = newTestToken(t, models.Request{Name: "gone", Commands: []string{"service.list"}})
+	if _, status := revokeToken(models.Request{Command: "token.revoke", Token: token.Secret}, tokenOwner); status != http.StatusOK {
+		t.Errorf("revoke: %d", status)
+	}
+	if _, status := check(token.Secret, "service.list", ""); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: %d", status)
+	}
+}
+
+func TestCreateTokenErrors(t *testing.T) {
+	setupTokens(t)
+	tests := []struct {
+		req models.Request
+		err string
+	}{
+		{models.Request{Commands: []string{"service.list"}}, "token name is required"},
+		{models.Request{Name: strings.Repeat("x", maxTokenName+1), Commands: []string{"service.list"}}, "token name is required"},
+		{models.Request{Name: "t"}, "commands are required"},
+		{models.Request{Name: "t", Commands: []string{"["}}, "invalid command pattern"},
+		{models.Request{Name: "t", Commands: []string{"service.list"}, Units: []string{"a/b"}}, `unit "a/b"`},
+		{models.Request{Name: "t", Commands: []string{"service.list"}, Expires: "400d"}, "expiry must be between"},
+		{models.Request{Name: "t", Commands: []string{"service.list"}, Expires: "soon"}, "invalid expiry"},
+	}
+	for _, tt := range tests {
+		tt.req.Command = "token.create"
+		if resp, status := createToken(tt.req, tokenOwner); status != http.StatusBadRequest || !strings.Contains(resp.Error, tt.err) {
+			t.Errorf("createToken(%+v): %d %q, want %q", tt.req, status, resp.Error, tt.err)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     defaultTokenTTL,
+		"12h":  12 * time.Hour,
+		"30d":  30 * 24 * time.Hour,
+		"365d": maxTokenTTL,
+		"366d": 0,
+		"0d":   0,
+		"-1h":  0,
+		"1.5d": 0,
+	}
+	for value, want := range tests {
+		got, err := parseExpiry(value)
+		if got != want || (err == nil) != (want != 0) {
+			t.Errorf("parseExpiry(%q) = %s, %v, want %s", value, got, err, want)
+		}
+	}
+}
+
+func TestTokenID(t *testing.T) {
+	id, secret, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 16 || !strings.HasPrefix(secret, tokenPrefix+id+"_") {
+		t.Errorf("newToken = %q, %q", id, secret)
+	}
+	if tokenID(secret) != id || tokenID(id) != id {
+		t.Errorf("tokenID(%q) = %q", secret, tokenID(secret))
+	}
+}
+
+func TestTokenLastUsed(t *testing.T) {
+	file := setupTokens(t)
+	token := newTestToken(t, models.Request{Name: "deploy", Commands: []string{"service.restart"}})
+	saved := func() string {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if resp, status := check(token.Secret, "service.restart", "nginx"); status != http.StatusOK || resp.Token.LastUsed == nil {
+		t.Fatalf("first use: %d %+v", status, resp)
+	}
+	first := saved()
+	if !strings.Contains(first, `"last_used"`) {
+		t.Fatalf("the first use was not saved:\n%s", first)
+	}
+	resp, _ := check(token.Secret, "service.restart", "nginx")
+	if saved() != first {
+		t.Error("a second use within a minute rewrote the tokens file")
+	}
+
+	tokens.mu.Lock()
+	tokens.items[0].savedUse = tokens.items[0].savedUse.Add(-tokenUseInterval)
+	tokens.mu.Unlock()
+	check(token.Secret, "service.restart", "nginx")
+	if saved() == first {
+		t.Error("a use a minute after the last saved one was not written")
+	}
+
+	list, _ := listTokens(models.Request{Command: "token.list"}, tokenOwner)
+	if len(list.Tokens) != 1 || list.Tokens[0].LastUsed == nil || list.Tokens[0].LastUsed.Before(*resp.Token.LastUsed) {
+		t.Errorf("token list = %+v, want the last use in memory", list.Tokens)
+	}
+}
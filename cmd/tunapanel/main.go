@@ -1,33 +1,92 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"tunapanel/internal/config"
+	"tunapanel/internal/identity"
 	"tunapanel/internal/web"
 )
 
 func main() {
+	socketPath := flag.String("socket", config.ClientSocketPath(), "path of the agent socket (env "+config.SocketEnv+")")
+	accountsPath := flag.String("accounts", "", "accounts file; enables login and service actions")
+	stateDir := flag.String("state-dir", config.WebStateDir, "directory for enrolled second factors")
+	identityKey := flag.String("identity-key", "", "key shared with the agent for telling it which user a request is for")
+	addr := flag.String("addr", "", "address to listen on (default 127.0.0.1:8080)")
+	useTLS := flag.Bool("tls", false, "serve HTTPS; implied by the other --tls and --client flags")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, self-signed on first start if it does not exist (default <state-dir>/tls-cert.pem)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file (default <state-dir>/tls-key.pem)")
+	clientCA := flag.String("client-ca", "", "CA certificates for client certificates; a certificate's common name logs in that account")
+	requireClientCert := flag.Bool("require-client-cert", false, "refuse clients without a valid client certificate")
+	flag.Parse()
+
+	if flag.Arg(0) == "hash-password" {
+		os.Exit(hashPassword(flag.Args()[1:]))
+	}
+
 	if os.Geteuid() == 0 {
 		fmt.Fprintln(os.Stderr, "tunapanel must not run as root")
 		os.Exit(1)
 	}
 
-	client := web.DefaultAgentClient(config.SocketPath)
-	server, err := web.NewServer(client)
+	// Client certificates log in to accounts; without any they would only
+	// gate the handshake of a web UI that is open to everyone.
+	if *clientCA != "" && *accountsPath == "" {
+		fmt.Fprintln(os.Stderr, "--client-ca needs --accounts: a client certificate logs in the account named by its common name")
+		os.Exit(1)
+	}
+
+	var auth *web.Auth
+	if *accountsPath != "" {
+		accounts, err := web.LoadAccounts(*accountsPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load accounts:", err)
+			os.Exit(1)
+		}
+		store, err := web.LoadMFAStore(filepath.Join(*stateDir, "mfa.json"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load second factors:", err)
+			os.Exit(1)
+		}
+		auth = web.NewAuth(accounts, store)
+	} else {
+		log.Printf("no --accounts file; the web UI is read-only and does not require login")
+	}
+
+	client := web.DefaultAgentClient(*socketPath)
+	if *identityKey != "" {
+		key, err := identity.LoadKey(*identityKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load identity key:", err)
+			os.Exit(1)
+		}
+		client.SetIdentityKey(key)
+	}
+	server, err := web.NewServer(client, auth)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "failed to initialize web UI:", err)
 		os.Exit(1)
 	}
 
+	if *addr != "" {
+		server.Addr = *addr
+	}
+
 	httpServer := &http.Server{
 		Addr:              server.Addr,
 		Handler:           server.Handler,
@@ -37,10 +96,37 @@ func main() {
 		IdleTimeout:       30 * time.Second,
 	}
 
-	log.Printf("tunapanel web UI listening on http://%s", server.Addr)
+	scheme := "http"
+	if *useTLS || *tlsCert != "" || *tlsKey != "" || *clientCA != "" || *requireClientCert {
+		if *tlsCert == "" {
+			*tlsCert = filepath.Join(*stateDir, "tls-cert.pem")
+		}
+		if *tlsKey == "" {
+			*tlsKey = filepath.Join(*stateDir, "tls-key.pem")
+		}
+		tlsConfig, err := web.NewTLSConfig(web.TLSOptions{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			ClientCAFile:      *clientCA,
+			RequireClientCert: *requireClientCert,
+			Hosts:             certificateHosts(server.Addr),
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to set up TLS:", err)
+			os.Exit(1)
+		}
+		httpServer.TLSConfig = tlsConfig
+		scheme = "https"
+	}
+
+	log.Printf("tunapanel web UI listening on %s://%s", scheme, server.Addr)
 
 	errCh := make(chan error, 1)
 	go func() {
+		if httpServer.TLSConfig != nil {
+			errCh <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
 		errCh <- httpServer.ListenAndServe()
 	}()
 
@@ -64,3 +150,58 @@ func main() {
 		}
 	}
 }
+
+// certificateHosts lists the names a self-signed certificate is made for:
+// this host, localhost and the address the web UI listens on.
+func certificateHosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hashPassword prints an accounts file line for the user named in args,
+// reading the password from the first line of stdin.
+func hashPassword(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	require := fs.String("require", "", "second factor the user must use: mfa or webauthn")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) != 1 || !web.ValidUsername(args[0]) {
+		fmt.Fprintln(os.Stderr, "usage: tunapanel hash-password [--require mfa|webauthn] <user> < password-file")
+		return 2
+	}
+	if *require != "" && *require != "mfa" && *require != "webauthn" {
+		fmt.Fprintln(os.Stderr, "--require must be mfa or webauthn")
+		return 2
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintln(os.Stderr, "failed to read password:", err)
+		return 1
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) < web.MinPasswordLength {
+		fmt.Fprintf(os.Stderr, "password must be at least %d characters\n", web.MinPasswordLength)
+		return 1
+	}
+	hash, err := web.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to hash password:", err)
+		return 1
+	}
+	line := args[0] + ":" + hash
+	if *require != "" {
+		line += ":" + *require
+	}
+	fmt.Println(line)
+	return 0
+}
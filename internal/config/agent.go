@@ -0,0 +1,86 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Agent holds the settings read from the agent configuration file.
+type Agent struct {
+	// Backend selects how the agent talks to systemd: "systemctl" (default)
+	// or "dbus".
+	Backend string
+	// DBusAddress overrides the bus used by the dbus backend, e.g.
+	// "unix:path=/tmp/fake-bus.sock". Empty means the system bus.
+	DBusAddress string
+	// ProtectedUnits are unit names or glob patterns that can never be
+	// stopped, disabled or masked through tunapanel, in addition to the
+	// built-in list.
+	ProtectedUnits []string
+	// TrustedPeers are users, by name or UID, whose requests may name the
+	// person they are made for, signed with the key in IdentityKey. This
+	// is normally the web UI's user, tunapanel-web.
+	TrustedPeers []string
+	IdentityKey  string
+}
+
+func DefaultAgent() Agent {
+	return Agent{Backend: "systemctl"}
+}
+
+// LoadAgent reads a "key = value" file. Blank lines and lines starting with
+// '#' are ignored. A missing file yields the defaults.
+func LoadAgent(path string) (Agent, error) {
+	cfg := DefaultAgent()
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return cfg, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch key {
+		case "backend":
+			cfg.Backend = value
+		case "dbus_address":
+			cfg.DBusAddress = value
+		case "protected_units":
+			cfg.ProtectedUnits = append(cfg.ProtectedUnits, strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		case "trusted_peers":
+			cfg.TrustedPeers = append(cfg.TrustedPeers, strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		case "identity_key":
+			cfg.IdentityKey = value
+		default:
+			return cfg, fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,12 @@
+package config
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedBy reports whether the user uid owns the file.
+func ownedBy(info os.FileInfo, uid int) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == uid
+}
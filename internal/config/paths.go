@@ -1,9 +1,21 @@
 package config
 
+import "time"
+
 const (
 	SocketPath      = "/run/tunapanel/agent.sock"
+	AgentConfigPath = "/etc/tunapanel/agent.conf"
 	LogPath         = "/var/log/tunapanel/agent.log"
 	AuditLogPath    = "/var/log/tunapanel/audit.log"
+	PolicyDir       = "/etc/tunapanel/policy.d"
+	TokensPath      = "/var/lib/tunapanel/tokens.json"
+	WebStateDir     = "/var/lib/tunapanel-web"
 	MaxRequestBytes = int64(64 * 1024)
 	RateLimitPerSec = 5
+	MaxLogStreams   = 16
+
+	// BulkTimeout bounds a bulk start, stop or restart, which waits for
+	// every job to finish, and any request that waits for units to
+	// settle.
+	BulkTimeout = 2 * time.Minute
 )
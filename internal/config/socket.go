@@ -0,0 +1,41 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SocketEnv overrides the agent socket used by tunactl and the web UI.
+const SocketEnv = "TUNAPANEL_SOCKET"
+
+// ClientSocketPath returns the agent socket clients should connect to:
+// $TUNAPANEL_SOCKET if set, otherwise SocketPath.
+func ClientSocketPath() string {
+	if path := os.Getenv(SocketEnv); path != "" {
+		return path
+	}
+	return SocketPath
+}
+
+// SimulateSocketPath returns a socket path an unprivileged user can create,
+// used by the agent in simulation mode.
+func SimulateSocketPath() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tunapanel", "agent.sock"), nil
+	}
+	dir := filepath.Join(os.TempDir(), "tunapanel-"+strconv.Itoa(os.Getuid()))
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 || !ownedBy(info, os.Getuid()) {
+		return "", fmt.Errorf("%s must be a directory of your own with mode 0700", dir)
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
@@ -0,0 +1,356 @@
+// Package dbus is a minimal D-Bus client: enough of the wire protocol to call
+// methods on the system bus and receive signals, with EXTERNAL (uid based)
+// authentication over unix sockets.
+package dbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SystemBusAddress = "unix:path=/run/dbus/system_bus_socket"
+
+	busName      = "org.freedesktop.DBus"
+	busPath      = ObjectPath("/org/freedesktop/DBus")
+	busInterface = "org.freedesktop.DBus"
+)
+
+var ErrClosed = errors.New("dbus: connection closed")
+
+// Conn is a connection to a message bus. It is safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	serial   uint32
+	pending  map[uint32]chan *Message
+	watchers map[chan *Message]struct{}
+	closed   bool
+	err      error
+
+	uniqueName string
+}
+
+// SystemBus connects to the address in DBUS_SYSTEM_BUS_ADDRESS, falling back
+// to the well-known system bus socket.
+func SystemBus(ctx context.Context) (*Conn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = SystemBusAddress
+	}
+	return Dial(ctx, address)
+}
+
+// Dial connects to a bus address such as "unix:path=/run/dbus/system_bus_socket"
+// or "unix:abstract=name", authenticates and registers with the bus.
+func Dial(ctx context.Context, address string) (*Conn, error) {
+	network, path, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, network, path)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = nc.SetDeadline(deadline)
+	}
+
+	reader := bufio.NewReader(nc)
+	if err := authenticate(nc, reader); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	_ = nc.SetDeadline(time.Time{})
+
+	c := &Conn{
+		conn:     nc,
+		pending:  make(map[uint32]chan *Message),
+		watchers: make(map[chan *Message]struct{}),
+	}
+	go c.readLoop(reader)
+
+	reply, err := c.Call(ctx, busName, busPath, busInterface, "Hello", "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(reply) > 0 {
+		c.uniqueName, _ = reply[0].(string)
+	}
+	return c, nil
+}
+
+func parseAddress(address string) (string, string, error) {
+	// A bus address may list several alternatives separated by ';'.
+	for _, entry := range strings.Split(address, ";") {
+		transport, params, ok := strings.Cut(entry, ":")
+		if !ok || transport != "unix" {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(param, "=")
+			value = unescapeAddress(value)
+			switch key {
+			case "path":
+				return "unix", value, nil
+			case "abstract":
+				return "unix", "@" + value, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("dbus: unsupported bus address %q", address)
+}
+
+func unescapeAddress(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			if n, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+func authenticate(nc net.Conn, reader *bufio.Reader) error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(nc, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("dbus: authentication rejected: %s", strings.TrimSpace(line))
+	}
+	_, err = fmt.Fprint(nc, "BEGIN\r\n")
+	return err
+}
+
+// UniqueName returns the name the bus assigned to this connection.
+func (c *Conn) UniqueName() string {
+	return c.uniqueName
+}
+
+func (c *Conn) Close() error {
+	c.shutdown(ErrClosed)
+	return c.conn.Close()
+}
+
+func (c *Conn) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	for serial, ch := range c.pending {
+		close(ch)
+		delete(c.pending, serial)
+	}
+	for ch := range c.watchers {
+		close(ch)
+		delete(c.watchers, ch)
+	}
+}
+
+func (c *Conn) readLoop(reader *bufio.Reader) {
+	for {
+		msg, err := ReadMessage(reader)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		switch msg.Type {
+		case TypeMethodReturn, TypeError:
+			c.mu.Lock()
+			ch, ok := c.pending[msg.ReplySerial]
+			delete(c.pending, msg.ReplySerial)
+			c.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		case TypeSignal, TypeMethodCall:
+			c.mu.Lock()
+			for ch := range c.watchers {
+				select {
+				case ch <- msg:
+				default:
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Conn) nextSerial() uint32 {
+	c.serial++
+	if c.serial == 0 {
+		c.serial = 1
+	}
+	return c.serial
+}
+
+// Send writes a message, assigning it a serial number.
+func (c *Conn) Send(msg *Message) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	msg.Serial = c.nextSerial()
+	c.mu.Unlock()
+	return c.write(msg)
+}
+
+func (c *Conn) write(msg *Message) error {
+	data, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(data)
+	return err
+}
+
+// Call invokes a method and waits for its reply. sig is the signature of
+// args; the reply body is returned as decoded values.
+func (c *Conn) Call(ctx context.Context, dest string, path ObjectPath, iface string, member string, sig string, args ...interface{}) ([]interface{}, error) {
+	msg := &Message{
+		Type:        TypeMethodCall,
+		Path:        path,
+		Interface:   iface,
+		Member:      member,
+		Destination: dest,
+		Signature:   Signature(sig),
+		Body:        args,
+	}
+
+	ch := make(chan *Message, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	msg.Serial = c.nextSerial()
+	c.pending[msg.Serial] = ch
+	c.mu.Unlock()
+
+	if err := c.write(msg); err != nil {
+		c.mu.Lock()
+		delete(c.pending, msg.Serial)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, c.closeErr()
+		}
+		if reply.Type == TypeError {
+			return nil, errorFromMessage(reply)
+		}
+		return reply.Body, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, msg.Serial)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return ErrClosed
+}
+
+// Watch returns a channel receiving every signal and incoming method call
+// delivered to this connection. Messages are dropped when the channel is
+// full. The channel is
+// closed when the connection closes or Unwatch is called.
+func (c *Conn) Watch(buffer int) <-chan *Message {
+	ch := make(chan *Message, buffer)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(ch)
+		return ch
+	}
+	c.watchers[ch] = struct{}{}
+	return ch
+}
+
+func (c *Conn) Unwatch(ch <-chan *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for w := range c.watchers {
+		if w == ch {
+			delete(c.watchers, w)
+			close(w)
+			return
+		}
+	}
+}
+
+// AddMatch asks the bus to route signals matching rule to this connection.
+func (c *Conn) AddMatch(ctx context.Context, rule string) error {
+	_, err := c.Call(ctx, busName, busPath, busInterface, "AddMatch", "s", rule)
+	return err
+}
+
+// Closed reports whether the connection has been shut down.
+func (c *Conn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// GetAll returns every property of iface on the object at path.
+func (c *Conn) GetAll(ctx context.Context, dest string, path ObjectPath, iface string) (map[string]Variant, error) {
+	reply, err := c.Call(ctx, dest, path, "org.freedesktop.DBus.Properties", "GetAll", "s", iface)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 1 {
+		return nil, errors.New("dbus: unexpected GetAll reply")
+	}
+	dict, ok := reply[0].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("dbus: unexpected GetAll reply")
+	}
+	props := make(map[string]Variant, len(dict))
+	for key, value := range dict {
+		name, _ := key.(string)
+		variant, _ := value.(Variant)
+		props[name] = variant
+	}
+	return props, nil
+}
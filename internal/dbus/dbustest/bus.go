@@ -0,0 +1,513 @@
+// Package dbustest is a fake system bus with a fake systemd on it, for
+// testing the dbus backend without root or a real bus. It accepts EXTERNAL
+// authentication, answers the bus's Hello and AddMatch, and implements the
+// part of org.freedesktop.systemd1 the backend uses to list, show, start,
+// stop and restart units. Jobs finish after a delay with a JobRemoved
+// signal, as systemd's do.
+package dbustest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/dbus"
+)
+
+const (
+	busName          = "org.freedesktop.DBus"
+	systemdName      = "org.freedesktop.systemd1"
+	systemdPath      = dbus.ObjectPath("/org/freedesktop/systemd1")
+	managerInterface = "org.freedesktop.systemd1.Manager"
+	unitInterface    = "org.freedesktop.systemd1.Unit"
+	serviceInterface = "org.freedesktop.systemd1.Service"
+	propsInterface   = "org.freedesktop.DBus.Properties"
+	unitPathPrefix   = "/org/freedesktop/systemd1/unit/"
+)
+
+// Unit is a unit the fake systemd knows. Jobs on a unit with Fail set end
+// with the result "failed" and leave it failed. A Oneshot unit is inactive
+// again once started, with Result as its result ("success" if empty).
+type Unit struct {
+	Name          string
+	Description   string
+	ActiveState   string
+	SubState      string
+	UnitFileState string
+	MainPID       uint32
+	Fail          bool
+	Oneshot       bool
+	Result        string
+	// Aliases are further names LoadUnit resolves to this unit.
+	Aliases    []string
+	RequiredBy []string
+}
+
+// Bus is a running fake bus. Its methods are safe for concurrent use.
+type Bus struct {
+	// Address is the bus address to dial, "unix:path=<socket>".
+	Address string
+
+	listener net.Listener
+
+	mu       sync.Mutex
+	jobDelay time.Duration
+	units    map[string]*Unit
+	conns    map[*busConn]bool
+	calls    []string
+	jobs     uint32
+	names    int
+}
+
+// Listen serves a fake bus on the unix socket socketPath with units.
+func Listen(socketPath string, units []Unit) (*Bus, error) {
+	_ = os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bus{
+		Address:  "unix:path=" + socketPath,
+		listener: listener,
+		units:    make(map[string]*Unit),
+		conns:    make(map[*busConn]bool),
+	}
+	for _, u := range units {
+		u := u
+		if u.ActiveState == "" {
+			u.ActiveState, u.SubState = "inactive", "dead"
+		}
+		b.units[u.Name] = &u
+	}
+	go b.serve()
+	return b, nil
+}
+
+// Close stops the bus and drops every connection.
+func (b *Bus) Close() error {
+	err := b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.nc.Close()
+	}
+	return err
+}
+
+// SetJobDelay makes jobs take d before JobRemoved is sent.
+func (b *Bus) SetJobDelay(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobDelay = d
+}
+
+// Unit returns the current state of the unit name.
+func (b *Bus) Unit(name string) (Unit, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, ok := b.units[name]
+	if !ok {
+		return Unit{}, false
+	}
+	return *u, true
+}
+
+// resolve returns the name of the unit that has name as an alias, or name.
+func (b *Bus) resolve(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, u := range b.units {
+		for _, alias := range u.Aliases {
+			if alias == name {
+				return u.Name
+			}
+		}
+	}
+	return name
+}
+
+// Calls returns the methods called so far, as "Interface.Member".
+func (b *Bus) Calls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.calls...)
+}
+
+type busConn struct {
+	bus  *Bus
+	nc   net.Conn
+	name string
+
+	writeMu    sync.Mutex
+	serial     uint32
+	subscribed bool
+}
+
+func (b *Bus) serve() {
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.names++
+		c := &busConn{bus: b, nc: nc, name: fmt.Sprintf(":1.%d", b.names)}
+		b.conns[c] = true
+		b.mu.Unlock()
+		go c.run()
+	}
+}
+
+func (c *busConn) run() {
+	defer func() {
+		c.bus.mu.Lock()
+		delete(c.bus.conns, c)
+		c.bus.mu.Unlock()
+		c.nc.Close()
+	}()
+
+	reader := bufio.NewReader(c.nc)
+	if err := c.handshake(reader); err != nil {
+		return
+	}
+	for {
+		msg, err := dbus.ReadMessage(reader)
+		if err != nil {
+			return
+		}
+		if msg.Type == dbus.TypeMethodCall {
+			c.handle(msg)
+		}
+	}
+}
+
+// handshake accepts EXTERNAL authentication for any user.
+func (c *busConn) handshake(reader *bufio.Reader) error {
+	if b, err := reader.ReadByte(); err != nil || b != 0 {
+		return errors.New("expected a NUL byte")
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "AUTH EXTERNAL ") {
+		fmt.Fprint(c.nc, "REJECTED EXTERNAL\r\n")
+		return errors.New("unsupported authentication")
+	}
+	if _, err := fmt.Fprint(c.nc, "OK 0123456789abcdef0123456789abcdef\r\n"); err != nil {
+		return err
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != "BEGIN" {
+		return errors.New("expected BEGIN")
+	}
+	return nil
+}
+
+func (c *busConn) send(msg *dbus.Message) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.serial++
+	msg.Serial = c.serial
+	msg.Destination = c.name
+	data, err := msg.Encode()
+	if err != nil {
+		return
+	}
+	_, _ = c.nc.Write(data)
+}
+
+func (c *busConn) reply(call *dbus.Message, sig string, body ...interface{}) {
+	c.send(&dbus.Message{
+		Type:        dbus.TypeMethodReturn,
+		ReplySerial: call.Serial,
+		Sender:      call.Destination,
+		Signature:   dbus.Signature(sig),
+		Body:        body,
+	})
+}
+
+func (c *busConn) fail(call *dbus.Message, name string, text string) {
+	c.send(&dbus.Message{
+		Type:        dbus.TypeError,
+		ReplySerial: call.Serial,
+		Sender:      call.Destination,
+		ErrorName:   name,
+		Signature:   "s",
+		Body:        []interface{}{text},
+	})
+}
+
+func (c *busConn) handle(call *dbus.Message) {
+	b := c.bus
+	b.mu.Lock()
+	b.calls = append(b.calls, call.Interface+"."+call.Member)
+	b.mu.Unlock()
+
+	switch call.Interface + "." + call.Member {
+	case busName + ".Hello":
+		c.reply(call, "s", c.name)
+	case busName + ".AddMatch", managerInterface + ".Reload":
+		c.reply(call, "")
+	case managerInterface + ".Subscribe":
+		b.mu.Lock()
+		c.subscribed = true
+		b.mu.Unlock()
+		c.reply(call, "")
+	case managerInterface + ".GetUnit":
+		name := argString(call, 0)
+		if _, ok := b.Unit(name); !ok {
+			c.fail(call, "org.freedesktop.systemd1.NoSuchUnit", fmt.Sprintf("Unit %s not loaded.", name))
+			return
+		}
+		c.reply(call, "o", unitPath(name))
+	case managerInterface + ".LoadUnit":
+		c.reply(call, "o", unitPath(b.resolve(argString(call, 0))))
+	case managerInterface + ".ListUnitsByPatterns":
+		c.reply(call, "a(ssssssouso)", b.listUnits(argStrings(call, 0), argStrings(call, 1)))
+	case managerInterface + ".ListUnitFilesByPatterns":
+		c.reply(call, "a(ss)", b.listUnitFiles(argStrings(call, 1)))
+	case managerInterface + ".StartUnit", managerInterface + ".StopUnit", managerInterface + ".RestartUnit":
+		name := argString(call, 0)
+		if _, ok := b.Unit(name); !ok {
+			c.fail(call, "org.freedesktop.systemd1.NoSuchUnit", fmt.Sprintf("Unit %s not found.", name))
+			return
+		}
+		id, job := b.newJob()
+		c.reply(call, "o", job)
+		go b.finishJob(id, job, call.Member, name)
+	case propsInterface + ".GetAll":
+		props, ok := b.properties(call.Path, argString(call, 0))
+		if !ok {
+			c.fail(call, "org.freedesktop.DBus.Error.UnknownInterface", "Unknown interface "+argString(call, 0))
+			return
+		}
+		c.reply(call, "a{sv}", props)
+	default:
+		c.fail(call, "org.freedesktop.DBus.Error.UnknownMethod", "Unknown method "+call.Member)
+	}
+}
+
+func (b *Bus) newJob() (uint32, dbus.ObjectPath) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobs++
+	return b.jobs, dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/systemd1/job/%d", b.jobs))
+}
+
+// finishJob changes the unit's state after the job delay and tells subscribers
+// the job is gone. An unrelated job is reported first, as happens on a
+// busy system, so clients must match the job path.
+func (b *Bus) finishJob(id uint32, job dbus.ObjectPath, method string, name string) {
+	b.mu.Lock()
+	delay := b.jobDelay
+	b.mu.Unlock()
+	time.Sleep(delay)
+
+	result := "done"
+	b.mu.Lock()
+	u := b.units[name]
+	switch {
+	case method == "StopUnit":
+		u.ActiveState, u.SubState, u.MainPID = "inactive", "dead", 0
+	case u.Fail:
+		u.ActiveState, u.SubState, u.MainPID = "failed", "failed", 0
+		result = "failed"
+	case u.Oneshot:
+		u.ActiveState, u.SubState, u.MainPID = "inactive", "dead", 0
+	default:
+		u.ActiveState, u.SubState = "active", "running"
+		u.MainPID = 1000 + id
+	}
+	var subscribers []*busConn
+	for c := range b.conns {
+		if c.subscribed {
+			subscribers = append(subscribers, c)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.jobRemoved(0, "/org/freedesktop/systemd1/job/0", "other.service", "done")
+		c.jobRemoved(id, job, name, result)
+	}
+}
+
+func (c *busConn) jobRemoved(id uint32, job dbus.ObjectPath, unit string, result string) {
+	c.send(&dbus.Message{
+		Type:      dbus.TypeSignal,
+		Path:      systemdPath,
+		Interface: managerInterface,
+		Member:    "JobRemoved",
+		Sender:    systemdName,
+		Signature: "uoss",
+		Body:      []interface{}{id, job, unit, result},
+	})
+}
+
+func (b *Bus) listUnits(states []string, patterns []string) []interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rows := []interface{}{}
+	for _, u := range b.sortedUnits() {
+		if !matchAny(patterns, u.Name) {
+			continue
+		}
+		// Every fake unit is loaded; states match any of the three.
+		if len(states) > 0 && !contains(states, "loaded") && !contains(states, u.ActiveState) && !contains(states, u.SubState) {
+			continue
+		}
+		rows = append(rows, []interface{}{u.Name, u.Description, "loaded", u.ActiveState, u.SubState, "",
+			unitPath(u.Name), uint32(0), "", dbus.ObjectPath("/")})
+	}
+	return rows
+}
+
+func (b *Bus) listUnitFiles(patterns []string) []interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rows := []interface{}{}
+	for _, u := range b.sortedUnits() {
+		if u.UnitFileState == "" || !matchAny(patterns, u.Name) {
+			continue
+		}
+		rows = append(rows, []interface{}{"/usr/lib/systemd/system/" + u.Name, u.UnitFileState})
+	}
+	return rows
+}
+
+func (b *Bus) properties(obj dbus.ObjectPath, iface string) (map[string]dbus.Variant, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var u *Unit
+	for _, candidate := range b.units {
+		if unitPath(candidate.Name) == obj {
+			u = candidate
+		}
+	}
+	if u == nil {
+		if iface != unitInterface || !strings.HasPrefix(string(obj), unitPathPrefix) {
+			return nil, false
+		}
+		return map[string]dbus.Variant{
+			"LoadState":   dbus.MakeVariant("s", "not-found"),
+			"ActiveState": dbus.MakeVariant("s", "inactive"),
+			"SubState":    dbus.MakeVariant("s", "dead"),
+		}, true
+	}
+	switch iface {
+	case unitInterface:
+		return map[string]dbus.Variant{
+			"Id":            dbus.MakeVariant("s", u.Name),
+			"Names":         dbus.MakeVariant("as", append([]string{u.Name}, u.Aliases...)),
+			"Description":   dbus.MakeVariant("s", u.Description),
+			"LoadState":     dbus.MakeVariant("s", "loaded"),
+			"ActiveState":   dbus.MakeVariant("s", u.ActiveState),
+			"SubState":      dbus.MakeVariant("s", u.SubState),
+			"FragmentPath":  dbus.MakeVariant("s", "/usr/lib/systemd/system/"+u.Name),
+			"UnitFileState": dbus.MakeVariant("s", u.UnitFileState),
+			"DropInPaths":   dbus.MakeVariant("as", []string{}),
+			"RequiredBy":    dbus.MakeVariant("as", append([]string{}, u.RequiredBy...)),
+		}, true
+	case serviceInterface:
+		if !strings.HasSuffix(u.Name, ".service") {
+			return nil, false
+		}
+		result := "success"
+		switch {
+		case u.Result != "":
+			result = u.Result
+		case u.ActiveState == "failed":
+			result = "exit-code"
+		}
+		return map[string]dbus.Variant{
+			"MainPID":       dbus.MakeVariant("u", u.MainPID),
+			"NRestarts":     dbus.MakeVariant("u", uint32(0)),
+			"MemoryCurrent": dbus.MakeVariant("t", ^uint64(0)),
+			"Result":        dbus.MakeVariant("s", result),
+		}, true
+	}
+	return nil, false
+}
+
+func (b *Bus) sortedUnits() []*Unit {
+	names := make([]string, 0, len(b.units))
+	for name := range b.units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	units := make([]*Unit, 0, len(names))
+	for _, name := range names {
+		units = append(units, b.units[name])
+	}
+	return units
+}
+
+// unitPath escapes name the way systemd does for unit object paths: every
+// byte but ASCII letters and digits becomes _xx.
+func unitPath(name string) dbus.ObjectPath {
+	var sb strings.Builder
+	sb.WriteString(unitPathPrefix)
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "_%02x", ch)
+		}
+	}
+	return dbus.ObjectPath(sb.String())
+}
+
+func argString(call *dbus.Message, i int) string {
+	if i >= len(call.Body) {
+		return ""
+	}
+	s, _ := call.Body[i].(string)
+	return s
+}
+
+func argStrings(call *dbus.Message, i int) []string {
+	if i >= len(call.Body) {
+		return nil
+	}
+	items, _ := call.Body[i].([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
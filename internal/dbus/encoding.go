@@ -0,0 +1,546 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ObjectPath is a D-Bus object path ("o").
+type ObjectPath string
+
+// Signature is a D-Bus type signature ("g").
+type Signature string
+
+// Variant is a value together with its signature ("v").
+type Variant struct {
+	Signature Signature
+	Value     interface{}
+}
+
+// MakeVariant wraps value as a variant of the given signature.
+func MakeVariant(sig string, value interface{}) Variant {
+	return Variant{Signature: Signature(sig), Value: value}
+}
+
+const maxDepth = 32
+
+var errSignature = errors.New("dbus: invalid signature")
+
+// Values are decoded as: y byte, b bool, n int16, q uint16, i int32,
+// u uint32, x int64, t uint64, d float64, h uint32, s string,
+// o ObjectPath, g Signature, v Variant, arrays as []interface{},
+// dictionaries as map[interface{}]interface{} and structs as
+// []interface{}. Encoding accepts the same types, any slice for arrays and
+// any map for dictionaries.
+
+func alignment(code byte) int {
+	switch code {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 'h', 's', 'o', 'a':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+// nextType splits the first complete type off sig. Structs must have at
+// least one field, and dictionary entries must be array elements with a
+// basic key type, so that every value takes up space and decodes to
+// something a map can hold.
+func nextType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errSignature
+	}
+	switch sig[0] {
+	case 'a':
+		if len(sig) > 1 && sig[1] == '{' {
+			entry, rest, err := container(sig[1:])
+			if err != nil {
+				return "", "", err
+			}
+			types, err := splitTypes(entry[1 : len(entry)-1])
+			if err != nil || len(types) != 2 || !basicType(types[0]) {
+				return "", "", errSignature
+			}
+			return "a" + entry, rest, nil
+		}
+		elem, rest, err := nextType(sig[1:])
+		if err != nil {
+			return "", "", err
+		}
+		return "a" + elem, rest, nil
+	case '(':
+		st, rest, err := container(sig)
+		if err != nil || len(st) == 2 {
+			return "", "", errSignature
+		}
+		if _, err := splitTypes(st[1 : len(st)-1]); err != nil {
+			return "", "", err
+		}
+		return st, rest, nil
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 'h', 's', 'o', 'g', 'v':
+		return sig[:1], sig[1:], nil
+	}
+	return "", "", errSignature
+}
+
+// container splits the struct or dictionary entry at the start of sig off
+// the rest, without checking its contents.
+func container(sig string) (string, string, error) {
+	closing := byte(')')
+	if sig[0] == '{' {
+		closing = '}'
+	}
+	depth := 0
+	for i := 0; i < len(sig); i++ {
+		switch sig[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+			if depth == 0 {
+				if sig[i] != closing {
+					return "", "", errSignature
+				}
+				return sig[:i+1], sig[i+1:], nil
+			}
+		}
+	}
+	return "", "", errSignature
+}
+
+func basicType(sig string) bool {
+	return len(sig) == 1 && strings.IndexByte("ybnqiuxtdhsog", sig[0]) >= 0
+}
+
+func splitTypes(sig string) ([]string, error) {
+	var types []string
+	for sig != "" {
+		t, rest, err := nextType(sig)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+		sig = rest
+	}
+	return types, nil
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type encoder struct {
+	buf   []byte
+	order byteOrder
+	depth int
+}
+
+func newEncoder(order byteOrder) *encoder {
+	return &encoder{order: order}
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) putUint32(v uint32) {
+	e.align(4)
+	e.buf = e.order.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) putString(s string) {
+	e.putUint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *encoder) encodeAll(sig string, values []interface{}) error {
+	types, err := splitTypes(sig)
+	if err != nil {
+		return err
+	}
+	if len(types) != len(values) {
+		return fmt.Errorf("dbus: signature %q needs %d values, got %d", sig, len(types), len(values))
+	}
+	for i, t := range types {
+		if err := e.encode(t, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encode(sig string, value interface{}) error {
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > maxDepth {
+		return errors.New("dbus: value nested too deeply")
+	}
+
+	rv := reflect.ValueOf(value)
+	mismatch := fmt.Errorf("dbus: cannot encode %T as %q", value, sig)
+	if !rv.IsValid() {
+		return mismatch
+	}
+
+	switch sig[0] {
+	case 'y':
+		if !isUint(rv) {
+			return mismatch
+		}
+		e.buf = append(e.buf, byte(rv.Uint()))
+	case 'b':
+		if rv.Kind() != reflect.Bool {
+			return mismatch
+		}
+		var v uint32
+		if rv.Bool() {
+			v = 1
+		}
+		e.putUint32(v)
+	case 'n', 'q':
+		e.align(2)
+		n, ok := integer(rv)
+		if !ok {
+			return mismatch
+		}
+		e.buf = e.order.AppendUint16(e.buf, uint16(n))
+	case 'i', 'u', 'h':
+		n, ok := integer(rv)
+		if !ok {
+			return mismatch
+		}
+		e.putUint32(uint32(n))
+	case 'x', 't':
+		n, ok := integer(rv)
+		if !ok {
+			return mismatch
+		}
+		e.align(8)
+		e.buf = e.order.AppendUint64(e.buf, n)
+	case 'd':
+		if rv.Kind() != reflect.Float64 && rv.Kind() != reflect.Float32 {
+			return mismatch
+		}
+		e.align(8)
+		e.buf = e.order.AppendUint64(e.buf, math.Float64bits(rv.Float()))
+	case 's', 'o':
+		if rv.Kind() != reflect.String {
+			return mismatch
+		}
+		e.putString(rv.String())
+	case 'g':
+		if rv.Kind() != reflect.String {
+			return mismatch
+		}
+		s := rv.String()
+		e.buf = append(e.buf, byte(len(s)))
+		e.buf = append(e.buf, s...)
+		e.buf = append(e.buf, 0)
+	case 'v':
+		v, ok := value.(Variant)
+		if !ok {
+			return mismatch
+		}
+		if _, rest, err := nextType(string(v.Signature)); err != nil || rest != "" {
+			return errSignature
+		}
+		if err := e.encode("g", string(v.Signature)); err != nil {
+			return err
+		}
+		return e.encode(string(v.Signature), v.Value)
+	case 'a':
+		return e.encodeArray(sig[1:], rv, mismatch)
+	case '(':
+		fields, ok := value.([]interface{})
+		if !ok {
+			return mismatch
+		}
+		e.align(8)
+		return e.encodeAll(sig[1:len(sig)-1], fields)
+	default:
+		return errSignature
+	}
+	return nil
+}
+
+func (e *encoder) encodeArray(elem string, rv reflect.Value, mismatch error) error {
+	e.putUint32(0)
+	lenPos := len(e.buf) - 4
+	e.align(alignment(elem[0]))
+	start := len(e.buf)
+
+	if elem[0] == '{' {
+		if rv.Kind() != reflect.Map {
+			return mismatch
+		}
+		types, err := splitTypes(elem[1 : len(elem)-1])
+		if err != nil || len(types) != 2 {
+			return errSignature
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			e.align(8)
+			if err := e.encode(types[0], key.Interface()); err != nil {
+				return err
+			}
+			if err := e.encode(types[1], rv.MapIndex(key).Interface()); err != nil {
+				return err
+			}
+		}
+	} else {
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return mismatch
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(elem, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+	}
+
+	e.order.PutUint32(e.buf[lenPos:], uint32(len(e.buf)-start))
+	return nil
+}
+
+func isUint(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return true
+	}
+	return false
+}
+
+func integer(rv reflect.Value) (uint64, bool) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), true
+	}
+	return 0, false
+}
+
+type decoder struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+	depth int
+}
+
+func newDecoder(data []byte, order binary.ByteOrder) *decoder {
+	return &decoder{data: data, order: order}
+}
+
+var errShort = errors.New("dbus: message truncated")
+
+func (d *decoder) align(n int) error {
+	next := d.pos + (n-d.pos%n)%n
+	if next > len(d.data) {
+		return errShort
+	}
+	d.pos = next
+	return nil
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.read(int(n) + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
+
+func (d *decoder) decodeAll(sig string) ([]interface{}, error) {
+	types, err := splitTypes(sig)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, len(types))
+	for _, t := range types {
+		v, err := d.decode(t)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *decoder) decode(sig string) (interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDepth {
+		return nil, errors.New("dbus: value nested too deeply")
+	}
+
+	switch sig[0] {
+	case 'y':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		v, err := d.uint32()
+		return v != 0, err
+	case 'n', 'q':
+		if err := d.align(2); err != nil {
+			return nil, err
+		}
+		b, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint16(b)
+		if sig[0] == 'n' {
+			return int16(v), nil
+		}
+		return v, nil
+	case 'i':
+		v, err := d.uint32()
+		return int32(v), err
+	case 'u', 'h':
+		return d.uint32()
+	case 'x', 't', 'd':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(b)
+		switch sig[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 's':
+		return d.string()
+	case 'o':
+		s, err := d.string()
+		return ObjectPath(s), err
+	case 'g':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.read(int(b[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return Signature(s[:b[0]]), nil
+	case 'v':
+		s, err := d.decode("g")
+		if err != nil {
+			return nil, err
+		}
+		sig := string(s.(Signature))
+		if _, rest, err := nextType(sig); err != nil || rest != "" {
+			return nil, errSignature
+		}
+		v, err := d.decode(sig)
+		if err != nil {
+			return nil, err
+		}
+		return Variant{Signature: Signature(sig), Value: v}, nil
+	case 'a':
+		return d.decodeArray(sig[1:])
+	case '(':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		return d.decodeAll(sig[1 : len(sig)-1])
+	}
+	return nil, errSignature
+}
+
+func (d *decoder) decodeArray(elem string) (interface{}, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.align(alignment(elem[0])); err != nil {
+		return nil, err
+	}
+	end := d.pos + int(n)
+	if end > len(d.data) {
+		return nil, errShort
+	}
+
+	if elem[0] == '{' {
+		types, err := splitTypes(elem[1 : len(elem)-1])
+		if err != nil || len(types) != 2 {
+			return nil, errSignature
+		}
+		dict := make(map[interface{}]interface{})
+		for d.pos < end {
+			if err := d.align(8); err != nil {
+				return nil, err
+			}
+			key, err := d.decode(types[0])
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decode(types[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = value
+		}
+		return dict, nil
+	}
+
+	items := []interface{}{}
+	for d.pos < end {
+		v, err := d.decode(elem)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
@@ -0,0 +1,113 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		sig  string
+		body []interface{}
+		want []interface{}
+	}{
+		{"", nil, nil},
+		{"ybnqiuxtd", []interface{}{byte(7), true, int16(-2), uint16(3), int32(-4), uint32(5), int64(-6), uint64(7), 1.5},
+			[]interface{}{byte(7), true, int16(-2), uint16(3), int32(-4), uint32(5), int64(-6), uint64(7), 1.5}},
+		{"sog", []interface{}{"nginx.service", ObjectPath("/org/freedesktop/systemd1"), Signature("a{sv}")},
+			[]interface{}{"nginx.service", ObjectPath("/org/freedesktop/systemd1"), Signature("a{sv}")}},
+		{"asas", []interface{}{[]string{}, []string{"*.service", "*.timer"}},
+			[]interface{}{[]interface{}{}, []interface{}{"*.service", "*.timer"}}},
+		{"a{sv}", []interface{}{map[string]Variant{"MainPID": MakeVariant("u", uint32(42)), "Id": MakeVariant("s", "a.service")}},
+			[]interface{}{map[interface{}]interface{}{"MainPID": MakeVariant("u", uint32(42)), "Id": MakeVariant("s", "a.service")}}},
+		{"a(sasb)", []interface{}{[]interface{}{[]interface{}{"/bin/true", []string{"/bin/true", "-x"}, false}}},
+			[]interface{}{[]interface{}{[]interface{}{"/bin/true", []interface{}{"/bin/true", "-x"}, false}}}},
+		{"ya(yv)t", []interface{}{byte(1), []interface{}{[]interface{}{byte(2), MakeVariant("as", []string{"x"})}}, uint64(9)},
+			[]interface{}{byte(1), []interface{}{[]interface{}{byte(2), MakeVariant("as", []interface{}{"x"})}}, uint64(9)}},
+	}
+	for _, tt := range tests {
+		msg := &Message{
+			Type:        TypeMethodCall,
+			Serial:      17,
+			Path:        "/org/freedesktop/systemd1",
+			Interface:   "org.freedesktop.systemd1.Manager",
+			Member:      "Test",
+			Destination: "org.freedesktop.systemd1",
+			Signature:   Signature(tt.sig),
+			Body:        tt.body,
+		}
+		data, err := msg.Encode()
+		if err != nil {
+			t.Fatalf("%q: encode: %v", tt.sig, err)
+		}
+		got, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%q: decode: %v", tt.sig, err)
+		}
+		if got.Serial != 17 || got.Path != msg.Path || got.Interface != msg.Interface ||
+			got.Member != msg.Member || got.Destination != msg.Destination || got.Signature != msg.Signature {
+			t.Errorf("%q: header = %+v", tt.sig, got)
+		}
+		if !reflect.DeepEqual(got.Body, tt.want) {
+			t.Errorf("%q: body = %#v, want %#v", tt.sig, got.Body, tt.want)
+		}
+	}
+}
+
+func TestEncodeMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		sig  string
+		body []interface{}
+	}{
+		{"s", []interface{}{1}},
+		{"u", []interface{}{"x"}},
+		{"as", []interface{}{"x"}},
+		{"ss", []interface{}{"x"}},
+		{"v", []interface{}{"x"}},
+	} {
+		msg := &Message{Type: TypeMethodCall, Signature: Signature(tt.sig), Body: tt.body}
+		if _, err := msg.Encode(); err == nil {
+			t.Errorf("%q with %#v: expected an error", tt.sig, tt.body)
+		}
+	}
+}
+
+func TestInvalidSignatures(t *testing.T) {
+	for _, sig := range []string{
+		"()", "a()", "(()s)", "{ss}", "a{s}", "a{sss}", "a{vs}", "a{(s)s}", "a{ass}",
+		"(s", "a", "a{s(s}", "(s}", "z", "a{s{ss}}",
+	} {
+		if _, err := splitTypes(sig); err == nil {
+			t.Errorf("%q: expected an error", sig)
+		}
+	}
+	for _, sig := range []string{"a{sv}", "a{ua(ss)}", "(s(i))", "aa{oas}", "a(sasb)"} {
+		if _, err := splitTypes(sig); err != nil {
+			t.Errorf("%q: %v", sig, err)
+		}
+	}
+}
+
+// A reply whose signature has an empty struct or a struct as a dictionary
+// key must fail to decode rather than loop or panic.
+func TestDecodeMalformed(t *testing.T) {
+	for _, sig := range []string{"a()", "a{(y)y}", "a{vy}"} {
+		data := make([]byte, 16)
+		binary.LittleEndian.PutUint32(data, 8)
+		d := newDecoder(data, binary.LittleEndian)
+		if _, err := d.decodeAll(sig); err == nil {
+			t.Errorf("%q: expected an error", sig)
+		}
+	}
+
+	msg := &Message{Type: TypeMethodReturn, ReplySerial: 1, Signature: "as", Body: []interface{}{[]string{"a"}}}
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(bytes.NewReader(data[:len(data)-2])); err == nil {
+		t.Error("truncated message: expected an error")
+	}
+}
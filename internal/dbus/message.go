@@ -0,0 +1,202 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	TypeMethodCall   byte = 1
+	TypeMethodReturn byte = 2
+	TypeError        byte = 3
+	TypeSignal       byte = 4
+)
+
+const (
+	FlagNoReplyExpected byte = 0x1
+)
+
+const (
+	fieldPath        byte = 1
+	fieldInterface   byte = 2
+	fieldMember      byte = 3
+	fieldErrorName   byte = 4
+	fieldReplySerial byte = 5
+	fieldDestination byte = 6
+	fieldSender      byte = 7
+	fieldSignature   byte = 8
+)
+
+const (
+	protocolVersion = 1
+	maxMessageSize  = 128 * 1024 * 1024
+)
+
+// Message is a single D-Bus message. Body holds the decoded arguments in the
+// order given by Signature.
+type Message struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   Signature
+	Body        []interface{}
+}
+
+// Error is a D-Bus error reply.
+type Error struct {
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+func errorFromMessage(msg *Message) error {
+	text := ""
+	if len(msg.Body) > 0 {
+		text, _ = msg.Body[0].(string)
+	}
+	return &Error{Name: msg.ErrorName, Message: text}
+}
+
+// Encode serializes the message in little-endian byte order.
+func (m *Message) Encode() ([]byte, error) {
+	body := newEncoder(binary.LittleEndian)
+	if err := body.encodeAll(string(m.Signature), m.Body); err != nil {
+		return nil, err
+	}
+
+	var fields []interface{}
+	addField := func(code byte, sig string, value interface{}) {
+		fields = append(fields, []interface{}{code, Variant{Signature: Signature(sig), Value: value}})
+	}
+	if m.Path != "" {
+		addField(fieldPath, "o", m.Path)
+	}
+	if m.Interface != "" {
+		addField(fieldInterface, "s", m.Interface)
+	}
+	if m.Member != "" {
+		addField(fieldMember, "s", m.Member)
+	}
+	if m.ErrorName != "" {
+		addField(fieldErrorName, "s", m.ErrorName)
+	}
+	if m.ReplySerial != 0 {
+		addField(fieldReplySerial, "u", m.ReplySerial)
+	}
+	if m.Destination != "" {
+		addField(fieldDestination, "s", m.Destination)
+	}
+	if m.Sender != "" {
+		addField(fieldSender, "s", m.Sender)
+	}
+	if m.Signature != "" {
+		addField(fieldSignature, "g", m.Signature)
+	}
+
+	head := newEncoder(binary.LittleEndian)
+	head.buf = append(head.buf, 'l', m.Type, m.Flags, protocolVersion)
+	head.putUint32(uint32(len(body.buf)))
+	head.putUint32(m.Serial)
+	if err := head.encode("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	head.align(8)
+
+	return append(head.buf, body.buf...), nil
+}
+
+// ReadMessage reads and decodes one message from r.
+func ReadMessage(r io.Reader) (*Message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("dbus: invalid byte order")
+	}
+	if fixed[3] != protocolVersion {
+		return nil, errors.New("dbus: unsupported protocol version")
+	}
+
+	bodyLen := order.Uint32(fixed[4:8])
+	fieldsLen := order.Uint32(fixed[12:16])
+	headerLen := 16 + int(fieldsLen)
+	headerLen += (8 - headerLen%8) % 8
+	total := headerLen + int(bodyLen)
+	if fieldsLen > maxMessageSize || bodyLen > maxMessageSize || total > maxMessageSize {
+		return nil, errors.New("dbus: message too large")
+	}
+
+	raw := make([]byte, total)
+	copy(raw, fixed)
+	if _, err := io.ReadFull(r, raw[16:]); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Type:   fixed[1],
+		Flags:  fixed[2],
+		Serial: order.Uint32(fixed[8:12]),
+	}
+
+	head := newDecoder(raw[:headerLen], order)
+	head.pos = 12
+	fieldsValue, err := head.decode("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fieldsValue.([]interface{}) {
+		pair := f.([]interface{})
+		code := pair[0].(byte)
+		value := pair[1].(Variant).Value
+		switch code {
+		case fieldPath:
+			msg.Path, _ = value.(ObjectPath)
+		case fieldInterface:
+			msg.Interface, _ = value.(string)
+		case fieldMember:
+			msg.Member, _ = value.(string)
+		case fieldErrorName:
+			msg.ErrorName, _ = value.(string)
+		case fieldReplySerial:
+			msg.ReplySerial, _ = value.(uint32)
+		case fieldDestination:
+			msg.Destination, _ = value.(string)
+		case fieldSender:
+			msg.Sender, _ = value.(string)
+		case fieldSignature:
+			msg.Signature, _ = value.(Signature)
+		}
+	}
+
+	if msg.Signature != "" {
+		body := newDecoder(raw[headerLen:], order)
+		msg.Body, err = body.decodeAll(string(msg.Signature))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
@@ -1,7 +1,9 @@
 package executor
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -30,3 +32,54 @@ func Run(args []string) (string, error) {
 
 	return stdout.String(), nil
 }
+
+const maxStreamLineBytes = 1024 * 1024
+
+// Stream runs a long-lived command and passes each line of its standard
+// output to onLine until the command exits, ctx is cancelled or onLine
+// returns an error. The command is killed in the latter two cases.
+func Stream(ctx context.Context, args []string, onLine func([]byte) error) error {
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineBytes)
+	var lineErr error
+	for scanner.Scan() {
+		if lineErr = onLine(scanner.Bytes()); lineErr != nil {
+			break
+		}
+	}
+	if lineErr == nil {
+		lineErr = scanner.Err()
+	}
+	if lineErr != nil {
+		_ = cmd.Process.Kill()
+	}
+
+	err = cmd.Wait()
+	switch {
+	case lineErr != nil:
+		return lineErr
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
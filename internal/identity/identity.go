@@ -0,0 +1,111 @@
+// Package identity lets a trusted front end, such as the web UI, tell the
+// agent which person a request is for. The front end signs each request
+// with HMAC-SHA256 under a key it shares with the agent; the signature
+// covers the whole request and the time it was made, so it cannot be moved
+// to another request or replayed after MaxAge.
+package identity
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunapanel/internal/models"
+)
+
+// MaxAge is how far the time in an assertion may be from the agent's
+// clock.
+const MaxAge = time.Minute
+
+// minKeyLen is the shortest key LoadKey accepts, in bytes.
+const minKeyLen = 32
+
+// LoadKey reads a shared key from path. The file holds the key as text,
+// such as the output of "openssl rand -base64 32", and must not be
+// accessible by others.
+func LoadKey(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		return nil, fmt.Errorf("%s: must not be accessible by others", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minKeyLen {
+		return nil, fmt.Errorf("%s: key must be at least %d characters", path, minKeyLen)
+	}
+	return key, nil
+}
+
+// Sign sets req's OnBehalfOf to user and its Assertion to a signature of
+// the request made at now.
+func Sign(key []byte, req *models.Request, user string, now time.Time) error {
+	req.OnBehalfOf = user
+	req.Assertion = ""
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac, err := sum(key, ts, *req)
+	if err != nil {
+		return err
+	}
+	req.Assertion = ts + "." + hex.EncodeToString(mac)
+	return nil
+}
+
+// Verify checks that req's Assertion was made with key for this request
+// no more than MaxAge from now.
+func Verify(key []byte, req models.Request, now time.Time) error {
+	if req.OnBehalfOf == "" || req.Assertion == "" {
+		return errors.New("on_behalf_of needs an assertion")
+	}
+	ts, sig, ok := strings.Cut(req.Assertion, ".")
+	if !ok {
+		return errors.New("malformed assertion")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("malformed assertion")
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return errors.New("malformed assertion")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > MaxAge || age < -MaxAge {
+		return errors.New("assertion expired")
+	}
+	req.Assertion = ""
+	want, err := sum(key, ts, req)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(got, want) {
+		return errors.New("invalid assertion")
+	}
+	return nil
+}
+
+// sum signs the JSON encoding of req, which must have no Assertion, and
+// ts. Both sides encode the same models.Request, so they get the same
+// bytes.
+func sum(key []byte, ts string, req models.Request) ([]byte, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("tunapanel-identity-v1\n" + ts + "\n"))
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,112 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tunapanel/internal/models"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func signed(t *testing.T, now time.Time) models.Request {
+	t.Helper()
+	req := models.Request{Command: "service.restart", Service: "nginx", Wait: true}
+	if err := Sign(testKey, &req, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	req := signed(t, now)
+	if req.OnBehalfOf != "alice" || !strings.HasPrefix(req.Assertion, "1700000000.") {
+		t.Fatalf("signed request = %+v", req)
+	}
+	for _, at := range []time.Time{now, now.Add(MaxAge), now.Add(-MaxAge)} {
+		if err := Verify(testKey, req, at); err != nil {
+			t.Errorf("verify at %s: %v", at.Sub(now), err)
+		}
+	}
+
+	// Signing again replaces the assertion rather than signing it.
+	again := req
+	if err := Sign(testKey, &again, "alice", now); err != nil || again.Assertion != req.Assertion {
+		t.Errorf("re-signing: %q, %v", again.Assertion, err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ts, sig, _ := strings.Cut(signed(t, now).Assertion, ".")
+
+	tests := []struct {
+		name   string
+		change func(*models.Request)
+		key    []byte
+		at     time.Time
+		err    string
+	}{
+		{"expired", nil, testKey, now.Add(MaxAge + time.Second), "assertion expired"},
+		{"from the future", nil, testKey, now.Add(-MaxAge - time.Second), "assertion expired"},
+		{"other key", nil, []byte("another key of at least 32 bytes"), now, "invalid assertion"},
+		{"other user", func(r *models.Request) { r.OnBehalfOf = "bob" }, testKey, now, "invalid assertion"},
+		{"other unit", func(r *models.Request) { r.Service = "sshd" }, testKey, now, "invalid assertion"},
+		{"other command", func(r *models.Request) { r.Command = "service.stop" }, testKey, now, "invalid assertion"},
+		{"field added", func(r *models.Request) { r.Force = true }, testKey, now, "invalid assertion"},
+		{"field removed", func(r *models.Request) { r.Wait = false }, testKey, now, "invalid assertion"},
+		{"other time", func(r *models.Request) { r.Assertion = "1700000001." + sig }, testKey, now, "invalid assertion"},
+		{"truncated signature", func(r *models.Request) { r.Assertion = ts + "." + sig[:len(sig)-2] }, testKey, now, "invalid assertion"},
+		{"no dot", func(r *models.Request) { r.Assertion = ts + sig }, testKey, now, "malformed assertion"},
+		{"bad time", func(r *models.Request) { r.Assertion = "soon." + sig }, testKey, now, "malformed assertion"},
+		{"bad hex", func(r *models.Request) { r.Assertion = ts + ".zz" }, testKey, now, "malformed assertion"},
+		{"no assertion", func(r *models.Request) { r.Assertion = "" }, testKey, now, "needs an assertion"},
+		{"nobody", func(r *models.Request) { r.OnBehalfOf = "" }, testKey, now, "needs an assertion"},
+	}
+	for _, tt := range tests {
+		req := signed(t, now)
+		if tt.change != nil {
+			tt.change(&req)
+		}
+		if err := Verify(tt.key, req, tt.at); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		data string
+		mode os.FileMode
+		err  string
+	}{
+		{string(testKey) + "\n", 0640, ""},
+		{string(testKey), 0604, "must not be accessible by others"},
+		{"short\n", 0600, "at least 32 characters"},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, "key"+string(rune('a'+i)))
+		if err := os.WriteFile(path, []byte(tt.data), tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		key, err := LoadKey(path)
+		if tt.err == "" {
+			if err != nil || string(key) != string(testKey) {
+				t.Errorf("LoadKey(%q) = %q, %v", tt.data, key, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadKey(%q, %o): err = %v, want %q", tt.data, tt.mode, err, tt.err)
+		}
+	}
+	if _, err := LoadKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing key file was accepted")
+	}
+}
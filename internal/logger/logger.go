@@ -6,6 +6,12 @@ import (
 	"path/filepath"
 )
 
+// Stderr returns a logger writing to standard error, used when the agent
+// runs unprivileged and cannot write to /var/log.
+func Stderr() *log.Logger {
+	return log.New(os.Stderr, "tunapanel-agent ", log.LstdFlags)
+}
+
 func New(path string) *log.Logger {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0750); err != nil {
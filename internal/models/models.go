@@ -1,16 +1,320 @@
 package models
 
+import "time"
+
 type Request struct {
 	Command string `json:"command"`
 	Service string `json:"service,omitempty"`
 	DryRun  bool   `json:"dry_run,omitempty"`
+	Now     bool   `json:"now,omitempty"`
+	Type    string `json:"type,omitempty"`
+
+	// Services lists units or glob patterns for bulk start, stop and
+	// restart; Service must be empty then.
+	Services []string `json:"services,omitempty"`
+
+	Since    string `json:"since,omitempty"`
+	Until    string `json:"until,omitempty"`
+	Lines    int    `json:"lines,omitempty"`
+	Priority string `json:"priority,omitempty"`
+
+	DropIn  string `json:"drop_in,omitempty"`
+	Content string `json:"content,omitempty"`
+	Remove  bool   `json:"remove,omitempty"`
+	Revert  bool   `json:"revert,omitempty"`
+
+	// Properties maps resource control names to new values for
+	// service.set-property; Runtime makes the change last until reboot.
+	Properties map[string]string `json:"properties,omitempty"`
+	Runtime    bool              `json:"runtime,omitempty"`
+	// Wait makes start, stop and restart wait up to WaitTimeout seconds
+	// for the unit to settle.
+	Wait        bool `json:"wait,omitempty"`
+	WaitTimeout int  `json:"wait_timeout,omitempty"`
+
+	// Force lets a root peer stop, disable or mask a protected unit.
+	Force bool `json:"force,omitempty"`
+
+	Script string `json:"script,omitempty"`
+	Job    string `json:"job,omitempty"`
+
+	// User and Check ask policy.check whether User (the caller when
+	// empty) may run the command Check on Service or Script.
+	User  string `json:"user,omitempty"`
+	Check string `json:"check,omitempty"`
+
+	// Approval names the pending request approval.approve and
+	// approval.reject decide; Reason says why it was rejected.
+	Approval string `json:"approval,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	// Token is the token ID for token.revoke and the whole token for
+	// token.check, which asks whether it may run the command Check on
+	// Service. token.create makes a token called Name for the Commands
+	// and Units (glob patterns) that lasts for Expires, e.g. "30d".
+	Token    string   `json:"token,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	Units    []string `json:"units,omitempty"`
+	Expires  string   `json:"expires,omitempty"`
+
+	// OnBehalfOf names the person a trusted front end such as the web UI
+	// sends the request for, e.g. a web login or "token:<id>". Assertion
+	// signs the request with the key the front end shares with the agent;
+	// see internal/identity.
+	OnBehalfOf string `json:"on_behalf_of,omitempty"`
+	Assertion  string `json:"assertion,omitempty"`
 }
 
+const (
+	// CodeProtectedUnit is the error code of a request refused because it
+	// would stop, disable or mask a protected unit.
+	CodeProtectedUnit = "protected_unit"
+	// CodePolicyDenied is the error code of a request the policy does not
+	// allow for the caller.
+	CodePolicyDenied = "policy_denied"
+	// CodeInvalidToken is the error code of a token.check for a token
+	// that is unknown, malformed or expired.
+	CodeInvalidToken = "invalid_token"
+)
+
 type Response struct {
-	OK       bool     `json:"ok"`
-	Message  string   `json:"message,omitempty"`
-	Services []string `json:"services,omitempty"`
-	Error    string   `json:"error,omitempty"`
-	DryRun   bool     `json:"dry_run,omitempty"`
-	Command  []string `json:"command,omitempty"`
+	OK       bool          `json:"ok"`
+	Message  string        `json:"message,omitempty"`
+	Services []ServiceInfo `json:"services,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Code     string        `json:"code,omitempty"`
+	DryRun   bool          `json:"dry_run,omitempty"`
+	Command  []string      `json:"command,omitempty"`
+
+	Changes       []string `json:"changes,omitempty"`
+	UnitFileState string   `json:"unit_file_state,omitempty"`
+
+	Service *ServiceStatus `json:"service,omitempty"`
+	Logs    []LogEntry     `json:"logs,omitempty"`
+
+	Dependencies *DependencyTree `json:"dependencies,omitempty"`
+	Impact       []string        `json:"impact,omitempty"`
+
+	Timers []TimerInfo `json:"timers,omitempty"`
+
+	Files []UnitFile `json:"files,omitempty"`
+	Diff  string     `json:"diff,omitempty"`
+
+	// Results holds one entry per unit of a bulk request, all logged
+	// under CorrelationID.
+	Results       []UnitActionResult `json:"results,omitempty"`
+	CorrelationID string             `json:"correlation_id,omitempty"`
+	// Diagnosis explains why a unit did not reach the state a request
+	// waited for.
+	Diagnosis *UnitDiagnosis `json:"diagnosis,omitempty"`
+
+	Job     *JobInfo  `json:"job,omitempty"`
+	Jobs    []JobInfo `json:"jobs,omitempty"`
+	Scripts []string  `json:"scripts,omitempty"`
+
+	Policy *PolicyCheck `json:"policy,omitempty"`
+
+	Approval  *ApprovalInfo  `json:"approval,omitempty"`
+	Approvals []ApprovalInfo `json:"approvals,omitempty"`
+
+	Token  *TokenInfo  `json:"token,omitempty"`
+	Tokens []TokenInfo `json:"tokens,omitempty"`
+}
+
+// TokenInfo describes an API token. Secret, the token itself, is only
+// returned by token.create; the agent keeps just its hash. A token can do
+// no more than its owner, the user who created it.
+type TokenInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	OwnerUID  int        `json:"owner_uid"`
+	Commands  []string   `json:"commands"`
+	Units     []string   `json:"units,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Secret    string     `json:"secret,omitempty"`
+}
+
+// ApprovalInfo is a request held for a second person's approval. Once
+// approved, Error or Message tell how the request went.
+type ApprovalInfo struct {
+	ID                string     `json:"id"`
+	State             string     `json:"state"`
+	Command           string     `json:"command"`
+	Units             []string   `json:"units,omitempty"`
+	Script            string     `json:"script,omitempty"`
+	Rule              string     `json:"rule"`
+	Requester         string     `json:"requester"`
+	RequesterUID      int        `json:"requester_uid"`
+	OnBehalfOf        string     `json:"on_behalf_of,omitempty"`
+	RequestedAt       time.Time  `json:"requested_at"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	Decider           string     `json:"decider,omitempty"`
+	DeciderUID        int        `json:"decider_uid,omitempty"`
+	DeciderOnBehalfOf string     `json:"decider_on_behalf_of,omitempty"`
+	DecidedAt         *time.Time `json:"decided_at,omitempty"`
+	Reason            string     `json:"reason,omitempty"`
+	Message           string     `json:"message,omitempty"`
+	Error             string     `json:"error,omitempty"`
+}
+
+// PolicyCheck is the answer to policy.check. Rules lists the rules that
+// apply to the user; Allowed and Reason are only set when a command was
+// checked.
+type PolicyCheck struct {
+	User     string       `json:"user"`
+	UID      int          `json:"uid"`
+	Groups   []string     `json:"groups,omitempty"`
+	Enforced bool         `json:"enforced"`
+	Command  string       `json:"command,omitempty"`
+	Units    []string     `json:"units,omitempty"`
+	Script   string       `json:"script,omitempty"`
+	Allowed  bool         `json:"allowed"`
+	Reason   string       `json:"reason,omitempty"`
+	Rules    []PolicyRule `json:"rules,omitempty"`
+}
+
+// PolicyRule is a policy rule as loaded by the agent.
+type PolicyRule struct {
+	Source   string   `json:"source"`
+	Users    []string `json:"users,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Commands []string `json:"commands"`
+	Units    []string `json:"units,omitempty"`
+	Scripts  []string `json:"scripts,omitempty"`
+}
+
+// UnitActionResult is the outcome of a bulk request for one unit.
+type UnitActionResult struct {
+	Service string   `json:"service"`
+	OK      bool     `json:"ok"`
+	Command []string `json:"command,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+
+	Diagnosis *UnitDiagnosis `json:"diagnosis,omitempty"`
+}
+
+// UnitDiagnosis is a unit's state, result and last journal lines after a
+// start, stop or restart did not settle.
+type UnitDiagnosis struct {
+	Name        string     `json:"name"`
+	ActiveState string     `json:"active_state,omitempty"`
+	SubState    string     `json:"sub_state,omitempty"`
+	Result      string     `json:"result,omitempty"`
+	ExitCode    string     `json:"exit_code,omitempty"`
+	ExitStatus  int        `json:"exit_status,omitempty"`
+	TimedOut    bool       `json:"timed_out,omitempty"`
+	Logs        []LogEntry `json:"logs,omitempty"`
+}
+
+type ServiceInfo struct {
+	Name          string `json:"name"`
+	LoadState     string `json:"load_state,omitempty"`
+	ActiveState   string `json:"active_state,omitempty"`
+	SubState      string `json:"sub_state,omitempty"`
+	Description   string `json:"description,omitempty"`
+	UnitFileState string `json:"unit_file_state,omitempty"`
+
+	// Result, ExitCode and ExitStatus are only reported for failed units.
+	Result     string `json:"result,omitempty"`
+	ExitCode   string `json:"exit_code,omitempty"`
+	ExitStatus int    `json:"exit_status,omitempty"`
+}
+
+type ServiceStatus struct {
+	Name                   string     `json:"name"`
+	Names                  []string   `json:"names,omitempty"`
+	Description            string     `json:"description,omitempty"`
+	LoadState              string     `json:"load_state"`
+	ActiveState            string     `json:"active_state"`
+	SubState               string     `json:"sub_state"`
+	MainPID                int        `json:"main_pid,omitempty"`
+	ExecMainStartTimestamp *time.Time `json:"exec_main_start_timestamp,omitempty"`
+	MemoryCurrent          uint64     `json:"memory_current,omitempty"`
+	NRestarts              int        `json:"n_restarts"`
+	FragmentPath           string     `json:"fragment_path,omitempty"`
+
+	// Result, ExitCode and ExitStatus are only reported for failed units.
+	Result     string `json:"result,omitempty"`
+	ExitCode   string `json:"exit_code,omitempty"`
+	ExitStatus int    `json:"exit_status,omitempty"`
+
+	Limits ResourceLimits `json:"limits"`
+}
+
+// ResourceLimits are a unit's effective resource controls in systemctl
+// set-property syntax. Unset and infinite limits are empty.
+type ResourceLimits struct {
+	CPUQuota   string `json:"cpu_quota,omitempty"`
+	MemoryMax  string `json:"memory_max,omitempty"`
+	MemoryHigh string `json:"memory_high,omitempty"`
+	TasksMax   string `json:"tasks_max,omitempty"`
+	IOWeight   string `json:"io_weight,omitempty"`
+}
+
+type LogEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Priority   int       `json:"priority"`
+	Unit       string    `json:"unit,omitempty"`
+	Identifier string    `json:"identifier,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	Message    string    `json:"message"`
+	Cursor     string    `json:"cursor,omitempty"`
+}
+
+// TimerInfo describes a timer unit. NextElapse is unset when the timer is
+// not scheduled; LastTrigger is unset when it never fired.
+type TimerInfo struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description,omitempty"`
+	Activates     string     `json:"activates"`
+	ActiveState   string     `json:"active_state,omitempty"`
+	UnitFileState string     `json:"unit_file_state,omitempty"`
+	NextElapse    *time.Time `json:"next_elapse,omitempty"`
+	LastTrigger   *time.Time `json:"last_trigger,omitempty"`
+}
+
+// JobInfo describes a script started with job.run as a transient unit.
+// systemd removes the unit once the script succeeds; such jobs are reported
+// as inactive with result success.
+type JobInfo struct {
+	ID          string    `json:"id"`
+	Script      string    `json:"script"`
+	Unit        string    `json:"unit"`
+	UID         int       `json:"uid"`
+	StartedAt   time.Time `json:"started_at"`
+	ActiveState string    `json:"active_state,omitempty"`
+	SubState    string    `json:"sub_state,omitempty"`
+	Result      string    `json:"result,omitempty"`
+	ExitCode    string    `json:"exit_code,omitempty"`
+	ExitStatus  int       `json:"exit_status,omitempty"`
+}
+
+// UnitFile is a unit's fragment or one of its drop-ins.
+type UnitFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// DependencyTree holds the units a unit depends on and the units that depend
+// on it.
+type DependencyTree struct {
+	Name         string           `json:"name"`
+	ActiveState  string           `json:"active_state,omitempty"`
+	Dependencies []DependencyNode `json:"dependencies"`
+	Dependents   []DependencyNode `json:"dependents"`
+}
+
+// DependencyNode is a unit in a dependency tree. Type is the dependency
+// property that links it to its parent, e.g. "Requires" or "WantedBy".
+type DependencyNode struct {
+	Name        string           `json:"name"`
+	Type        string           `json:"type"`
+	ActiveState string           `json:"active_state,omitempty"`
+	Children    []DependencyNode `json:"children,omitempty"`
 }
@@ -0,0 +1,183 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// table is one [[rule]] or [[approval]] table: each key holds a list of
+// strings. A plain string value is read as a list of one.
+type table struct {
+	kind   string
+	values map[string][]string
+}
+
+// parse reads the TOML subset policy files use: [[rule]] and [[approval]]
+// tables of strings and arrays of strings.
+func parse(name string, data string) ([]table, error) {
+	var tables []table
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			kind := strings.ReplaceAll(line, " ", "")
+			if kind != "[[rule]]" && kind != "[[approval]]" {
+				return nil, fmt.Errorf("%s:%d: unknown table %s", name, lineNo, line)
+			}
+			tables = append(tables, table{kind: strings.Trim(kind, "[]"), values: map[string][]string{}})
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(tables) == 0 {
+			return nil, fmt.Errorf("%s:%d: %s outside a table", name, lineNo, key)
+		}
+		current := tables[len(tables)-1].values
+		if _, dup := current[key]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key %s", name, lineNo, key)
+		}
+
+		// An array may continue until its closing bracket.
+		for strings.HasPrefix(value, "[") && !closedArray(value) && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+		list, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", name, lineNo, key, err)
+		}
+		current[key] = list
+	}
+	return tables, nil
+}
+
+// parseValue reads a string or an array of strings.
+func parseValue(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		s, rest, err := parseString(value)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected %q after value", rest)
+		}
+		return []string{s}, nil
+	}
+
+	rest := strings.TrimSpace(value[1:])
+	list := []string{}
+	for {
+		if strings.HasPrefix(rest, "]") {
+			rest = rest[1:]
+			break
+		}
+		s, after, err := parseString(rest)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+		rest = strings.TrimSpace(after)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected %q after array", rest)
+	}
+	return list, nil
+}
+
+// parseString reads a basic ("...") or literal ('...') string at the start
+// of s and returns it with the rest of s.
+func parseString(s string) (string, string, error) {
+	if s == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '"':
+				return b.String(), s[i+1:], nil
+			case '\\':
+				if i+1 == len(s) {
+					return "", "", fmt.Errorf("unterminated string")
+				}
+				i++
+				switch s[i] {
+				case '"', '\\':
+					b.WriteByte(s[i])
+				case 't':
+					b.WriteByte('\t')
+				default:
+					return "", "", fmt.Errorf("unsupported escape \\%c", s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	}
+	return "", "", fmt.Errorf("expected a string or an array of strings")
+}
+
+// stripComment drops a trailing # comment that is not inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// closedArray reports whether an array value contains its closing bracket
+// outside of strings.
+func closedArray(value string) bool {
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := `# leading comment
+[[rule]]
+users = ["alice", '1001'] # trailing comment
+groups = "ops"
+commands = [
+  "service.*",   # a comment inside the array
+  "status",
+]
+units = ["a#b", "c\"d", 'e\f', "tab\there"]
+
+[ [approval] ]
+commands = []
+`
+	tables, err := parse("test.toml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []table{
+		{kind: "rule", values: map[string][]string{
+			"users":    {"alice", "1001"},
+			"groups":   {"ops"},
+			"commands": {"service.*", "status"},
+			"units":    {"a#b", `c"d`, `e\f`, "tab\there"},
+		}},
+		{kind: "approval", values: map[string][]string{
+			"commands": {},
+		}},
+	}
+	if !reflect.DeepEqual(tables, want) {
+		t.Errorf("parse =\n%+v\nwant\n%+v", tables, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"[rule]\n", "test.toml:1: unknown table [rule]"},
+		{"[[rules]]\n", "unknown table"},
+		{"users = [\"a\"]\n", "test.toml:1: users outside a table"},
+		{"[[rule]]\nusers\n", "test.toml:2: expected key = value"},
+		{"[[rule]]\nusers = \"a\"\nusers = \"b\"\n", "test.toml:3: duplicate key users"},
+		{"[[rule]]\nusers =\n", "missing value"},
+		{"[[rule]]\nusers = a\n", "expected a string or an array of strings"},
+		{"[[rule]]\nusers = 1\n", "expected a string"},
+		{"[[rule]]\nusers = \"a\n", "unterminated string"},
+		{"[[rule]]\nusers = 'a\n", "unterminated string"},
+		{"[[rule]]\nusers = \"a\\\n", "unterminated string"},
+		{"[[rule]]\nusers = \"\\n\"\n", `unsupported escape \n`},
+		{"[[rule]]\nusers = \"a\" \"b\"\n", `unexpected " \"b\"" after value`},
+		{"[[rule]]\nusers = [\"a\" \"b\"]\n", "expected , or ] in array"},
+		{"[[rule]]\nusers = [\"a\"] x\n", "after array"},
+		{"[[rule]]\nusers = [\"a\",\n", "test.toml:2: users: missing value"},
+		{"[[rule]]\nusers = [\"a\", \"]\"\n", "expected , or ] in array"},
+	}
+	for _, tt := range tests {
+		_, err := parse("test.toml", tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parse(%q): err = %v, want %q", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := map[string]string{
+		`a = "b" # c`:      `a = "b" `,
+		`a = "#" # c`:      `a = "#" `,
+		`a = '#\' # c`:     `a = '#\' `,
+		`a = "\"#" # c`:    `a = "\"#" `,
+		`# only a comment`: ``,
+		`no comment`:       `no comment`,
+	}
+	for line, want := range tests {
+		if got := stripComment(line); got != want {
+			t.Errorf("stripComment(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Package policy decides which users may run which agent commands, and on
+// which units and scripts, from the rules in policy.d/*.toml.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tunapanel/internal/services"
+)
+
+// Rule lets its users and groups run its commands, on its units and
+// scripts when set. Fields hold names, IDs or glob patterns.
+type Rule struct {
+	// Source is the file and position of the rule, e.g. "ops.toml#2".
+	Source   string
+	Users    []string
+	Groups   []string
+	Commands []string
+	Units    []string
+	Scripts  []string
+}
+
+// Approval makes the commands it names, on the units it names (any unit
+// when empty), wait for a second person to approve them.
+type Approval struct {
+	Source   string
+	Commands []string
+	Units    []string
+}
+
+// Policy is the set of rules loaded from a directory; nil allows everything.
+type Policy struct {
+	Rules     []Rule
+	Approvals []Approval
+}
+
+// Subject is the user a request is checked for.
+type Subject struct {
+	UID    int
+	Name   string
+	GIDs   []int
+	Groups []string
+}
+
+// Target is what a request wants to do: a command and the units or script
+// it acts on.
+type Target struct {
+	Command string
+	Units   []string
+	Script  string
+}
+
+// Decision is the outcome of Check.
+type Decision struct {
+	Allowed bool
+	Rule    string
+	Reason  string
+}
+
+var tableKeys = map[string]map[string]bool{
+	"rule": {
+		"users":    true,
+		"groups":   true,
+		"commands": true,
+		"units":    true,
+		"scripts":  true,
+	},
+	"approval": {
+		"commands": true,
+		"units":    true,
+	},
+}
+
+// Load reads every *.toml file in dir, in name order. It returns nil when
+// there are none. Files must not be writable by group or others.
+func Load(dir string) (*Policy, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	sort.Strings(files)
+
+	p := &Policy{}
+	for _, file := range files {
+		info, err := os.Lstat(file)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s: not a regular file", file)
+		}
+		if info.Mode().Perm()&0022 != 0 {
+			return nil, fmt.Errorf("%s: writable by group or others", file)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		tables, err := parse(file, string(data))
+		if err != nil {
+			return nil, err
+		}
+		for i, t := range tables {
+			source := fmt.Sprintf("%s#%d", filepath.Base(file), i+1)
+			if err := p.add(source, t); err != nil {
+				return nil, fmt.Errorf("%s: %s %d: %w", file, t.kind, i+1, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+func (p *Policy) add(source string, t table) error {
+	values := t.values
+	for key := range values {
+		if !tableKeys[t.kind][key] {
+			return fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if len(values["commands"]) == 0 {
+		return fmt.Errorf("commands is required")
+	}
+	for _, pattern := range append(append([]string(nil), values["commands"]...), values["scripts"]...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	units, err := normalizeUnits(values["units"])
+	if err != nil {
+		return err
+	}
+
+	if t.kind == "approval" {
+		p.Approvals = append(p.Approvals, Approval{
+			Source:   source,
+			Commands: values["commands"],
+			Units:    units,
+		})
+		return nil
+	}
+	if len(values["users"]) == 0 && len(values["groups"]) == 0 {
+		return fmt.Errorf("users or groups is required")
+	}
+	p.Rules = append(p.Rules, Rule{
+		Source:   source,
+		Users:    values["users"],
+		Groups:   values["groups"],
+		Commands: values["commands"],
+		Units:    units,
+		Scripts:  values["scripts"],
+	})
+	return nil
+}
+
+// normalizeUnits reads unit patterns spelled like on the command line;
+// "nginx" means nginx.service. A bare "*" matches units of every type.
+func normalizeUnits(inputs []string) ([]string, error) {
+	var units []string
+	for _, input := range inputs {
+		if input == "*" {
+			units = append(units, input)
+			continue
+		}
+		pattern, err := services.NormalizeUnitPattern(input)
+		if err != nil {
+			return nil, fmt.Errorf("unit %q: %w", input, err)
+		}
+		units = append(units, pattern)
+	}
+	return units, nil
+}
+
+// Check decides whether s may run t. Root may run anything. Every unit in
+// t must be allowed by a rule that applies to s and allows the command.
+func (p *Policy) Check(s Subject, t Target) Decision {
+	if p == nil {
+		return Decision{Allowed: true, Reason: "no policy configured"}
+	}
+	if s.UID == 0 {
+		return Decision{Allowed: true, Reason: "root may run every command"}
+	}
+
+	var allowedBy string
+	units := t.Units
+	if len(units) == 0 {
+		units = []string{""}
+	}
+	for _, unit := range units {
+		rule, ok := p.find(s, t.Command, unit, t.Script)
+		if !ok {
+			return Decision{Reason: denial(s, t.Command, unit, t.Script)}
+		}
+		if allowedBy == "" {
+			allowedBy = rule
+		}
+	}
+	return Decision{Allowed: true, Rule: allowedBy, Reason: "allowed by " + allowedBy}
+}
+
+func (p *Policy) find(s Subject, command string, unit string, script string) (string, bool) {
+	for _, rule := range p.Rules {
+		if !rule.AppliesTo(s) || !matchAny(rule.Commands, command) {
+			continue
+		}
+		if unit != "" && len(rule.Units) > 0 && !matchAny(rule.Units, unit) {
+			continue
+		}
+		if script != "" && len(rule.Scripts) > 0 && !matchAny(rule.Scripts, script) {
+			continue
+		}
+		return rule.Source, true
+	}
+	return "", false
+}
+
+func denial(s Subject, command string, unit string, script string) string {
+	reason := fmt.Sprintf("%s may not run %s", s.Name, command)
+	if unit != "" {
+		reason += " on " + unit
+	}
+	if script != "" {
+		reason += " with script " + script
+	}
+	return reason
+}
+
+// NeedsApproval returns the approval t falls under, if any. A request on
+// several units needs approval when one of them does.
+func (p *Policy) NeedsApproval(t Target) (Approval, bool) {
+	if p == nil {
+		return Approval{}, false
+	}
+	for _, approval := range p.Approvals {
+		if !matchAny(approval.Commands, t.Command) {
+			continue
+		}
+		if len(approval.Units) == 0 {
+			return approval, true
+		}
+		for _, unit := range t.Units {
+			if matchAny(approval.Units, unit) {
+				return approval, true
+			}
+		}
+	}
+	return Approval{}, false
+}
+
+// RulesFor returns the rules that apply to s.
+func (p *Policy) RulesFor(s Subject) []Rule {
+	if p == nil {
+		return nil
+	}
+	var rules []Rule
+	for _, rule := range p.Rules {
+		if rule.AppliesTo(s) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// AppliesTo reports whether s is one of the rule's users or in one of its
+// groups.
+func (r Rule) AppliesTo(s Subject) bool {
+	for _, u := range r.Users {
+		if u == "*" || u == s.Name || u == strconv.Itoa(s.UID) {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		if g == "*" || containsString(s.Groups, g) {
+			return true
+		}
+		for _, gid := range s.GIDs {
+			if g == strconv.Itoa(gid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LookupSubject resolves a peer's user name and groups, taking them from
+// the user database when groups is nil.
+func LookupSubject(uid int, gid int, groups []int) Subject {
+	s := Subject{UID: uid, Name: strconv.Itoa(uid), GIDs: []int{gid}}
+	addGID := func(n int) {
+		if !containsInt(s.GIDs, n) {
+			s.GIDs = append(s.GIDs, n)
+		}
+	}
+	for _, n := range groups {
+		addGID(n)
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		s.Name = u.Username
+		if ids, err := u.GroupIds(); err == nil && groups == nil {
+			for _, id := range ids {
+				if n, err := strconv.Atoi(id); err == nil {
+					addGID(n)
+				}
+			}
+		}
+	}
+	addGroupNames(&s)
+	return s
+}
+
+// LookupUser resolves a user name or ID from the user database.
+func LookupUser(input string) (Subject, error) {
+	name := strings.TrimSpace(input)
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, convErr := strconv.Atoi(name); convErr != nil {
+			return Subject{}, fmt.Errorf("unknown user %q", name)
+		}
+		if u, err = user.LookupId(name); err != nil {
+			return Subject{}, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return Subject{}, fmt.Errorf("user %q has no numeric ID", name)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return Subject{}, fmt.Errorf("user %q has no numeric group ID", name)
+	}
+	return LookupSubject(uid, gid, nil), nil
+}
+
+func addGroupNames(s *Subject) {
+	for _, gid := range s.GIDs {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			s.Groups = append(s.Groups, g.Name)
+		}
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
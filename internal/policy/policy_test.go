@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+[[rule]]
+users = ["alice"]
+commands = ["service.*"]
+units = ["nginx", "worker@*"]
+
+[[rule]]
+groups = ["1500"]
+commands = ["service.list", "job.run"]
+scripts = ["backup-*"]
+
+[[rule]]
+users = ["*"]
+commands = ["status"]
+
+[[approval]]
+commands = ["service.stop"]
+units = ["postgresql"]
+`
+
+func writePolicy(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	p, err := Load(writePolicy(t, map[string]string{"20-more.toml": "[[rule]]\nusers = \"bob\"\ncommands = \"*\"\n", "10-ops.toml": testPolicy}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Rules) != 4 || len(p.Approvals) != 1 {
+		t.Fatalf("loaded %d rules and %d approvals", len(p.Rules), len(p.Approvals))
+	}
+	if got := p.Rules[0].Units; len(got) != 2 || got[0] != "nginx.service" || got[1] != "worker@*.service" {
+		t.Errorf("units = %q", got)
+	}
+	if p.Rules[3].Source != "20-more.toml#1" || p.Approvals[0].Source != "10-ops.toml#4" {
+		t.Errorf("sources = %s, %s", p.Rules[3].Source, p.Approvals[0].Source)
+	}
+
+	if p, err := Load(t.TempDir()); p != nil || err != nil {
+		t.Errorf("empty directory: %v, %v", p, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"[[rule]]\nusers = \"a\"\ncommands = \"*\"\nservices = \"x\"\n", `unknown key "services"`},
+		{"[[rule]]\nusers = \"a\"\n", "commands is required"},
+		{"[[rule]]\ncommands = \"*\"\n", "users or groups is required"},
+		{"[[rule]]\nusers = \"a\"\ncommands = \"[\"\n", `invalid pattern "["`},
+		{"[[rule]]\nusers = \"a\"\ncommands = \"*\"\nunits = \"a/b\"\n", `unit "a/b"`},
+		{"[[approval]]\ncommands = \"*\"\nusers = \"a\"\n", `unknown key "users"`},
+	}
+	for _, tt := range tests {
+		_, err := Load(writePolicy(t, map[string]string{"p.toml": tt.data}))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load(%q): err = %v, want %q", tt.data, err, tt.err)
+		}
+	}
+
+	dir := writePolicy(t, map[string]string{"p.toml": testPolicy})
+	if err := os.Chmod(filepath.Join(dir, "p.toml"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "writable by group or others") {
+		t.Errorf("group-writable file: err = %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p, err := Load(writePolicy(t, map[string]string{"ops.toml": testPolicy}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := Subject{UID: 1000, Name: "alice", GIDs: []int{1000}}
+	bob := Subject{UID: 1001, Name: "bob", GIDs: []int{1001, 1500}}
+	root := Subject{UID: 0, Name: "root"}
+
+	tests := []struct {
+		subject Subject
+		target  Target
+		allowed bool
+		reason  string
+	}{
+		{alice, Target{Command: "service.start", Units: []string{"nginx.service"}}, true, "allowed by ops.toml#1"},
+		{alice, Target{Command: "service.start", Units: []string{"nginx.service", "worker@1.service"}}, true, ""},
+		{alice, Target{Command: "service.start", Units: []string{"nginx.service", "sshd.service"}}, false, "alice may not run service.start on sshd.service"},
+		{alice, Target{Command: "service.list"}, true, ""},
+		{alice, Target{Command: "job.run", Script: "backup-db"}, false, "with script backup-db"},
+		{alice, Target{Command: "status"}, true, "allowed by ops.toml#3"},
+		{bob, Target{Command: "service.list"}, true, "allowed by ops.toml#2"},
+		{bob, Target{Command: "job.run", Script: "backup-db"}, true, ""},
+		{bob, Target{Command: "job.run", Script: "wipe"}, false, ""},
+		{bob, Target{Command: "service.start", Units: []string{"nginx.service"}}, false, ""},
+		{root, Target{Command: "service.mask", Units: []string{"sshd.service"}}, true, "root may run every command"},
+	}
+	for _, tt := range tests {
+		d := p.Check(tt.subject, tt.target)
+		if d.Allowed != tt.allowed || !strings.Contains(d.Reason, tt.reason) {
+			t.Errorf("Check(%s, %+v) = %+v, want allowed=%v reason %q", tt.subject.Name, tt.target, d, tt.allowed, tt.reason)
+		}
+	}
+
+	var none *Policy
+	if d := none.Check(bob, Target{Command: "service.mask"}); !d.Allowed {
+		t.Errorf("nil policy: %+v", d)
+	}
+}
+
+func TestNeedsApproval(t *testing.T) {
+	p, err := Load(writePolicy(t, map[string]string{"ops.toml": testPolicy + "\n[[approval]]\ncommands = \"job.run\"\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target Target
+		source string
+	}{
+		{Target{Command: "service.stop", Units: []string{"postgresql.service"}}, "ops.toml#4"},
+		{Target{Command: "service.stop", Units: []string{"nginx.service", "postgresql.service"}}, "ops.toml#4"},
+		{Target{Command: "service.stop", Units: []string{"nginx.service"}}, ""},
+		{Target{Command: "service.start", Units: []string{"postgresql.service"}}, ""},
+		{Target{Command: "job.run", Script: "anything"}, "ops.toml#5"},
+	}
+	for _, tt := range tests {
+		approval, ok := p.NeedsApproval(tt.target)
+		if ok != (tt.source != "") || approval.Source != tt.source {
+			t.Errorf("NeedsApproval(%+v) = %q, %v, want %q", tt.target, approval.Source, ok, tt.source)
+		}
+	}
+}
+
+func TestLookupSubjectGroups(t *testing.T) {
+	// UID 2147483000 is not in the user database.
+	s := LookupSubject(2147483000, 2147483001, []int{2147483002, 2147483001})
+	if s.Name != "2147483000" {
+		t.Errorf("name = %q", s.Name)
+	}
+	if len(s.GIDs) != 2 || s.GIDs[0] != 2147483001 || s.GIDs[1] != 2147483002 {
+		t.Errorf("GIDs = %v", s.GIDs)
+	}
+	if !(Rule{Groups: []string{"2147483002"}}).AppliesTo(s) {
+		t.Error("a rule for a kernel-reported group does not apply")
+	}
+
+	// Kernel-reported groups replace those in the user database.
+	root := LookupSubject(0, 0, []int{})
+	if len(root.GIDs) != 1 || root.GIDs[0] != 0 || root.Name != "root" {
+		t.Errorf("root = %+v", root)
+	}
+}
@@ -0,0 +1,465 @@
+// Package qrcode encodes short texts, such as otpauth:// URIs, as QR codes
+// (ISO/IEC 18004) in byte mode with error correction level L. Versions 1
+// to 10 are supported, which holds up to 271 bytes.
+package qrcode
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code is an encoded QR code. Modules are indexed [y][x]; true is dark.
+type Code struct {
+	Size    int
+	modules [][]bool
+}
+
+// blockLayout describes the error correction blocks of a version at level
+// L: blocks of data codewords, each followed by ecLen correction
+// codewords.
+type blockLayout struct {
+	ecLen  int
+	blocks []int
+}
+
+var layouts = [...]blockLayout{
+	1:  {7, []int{19}},
+	2:  {10, []int{34}},
+	3:  {15, []int{55}},
+	4:  {20, []int{80}},
+	5:  {26, []int{108}},
+	6:  {18, []int{68, 68}},
+	7:  {20, []int{78, 78}},
+	8:  {24, []int{97, 97}},
+	9:  {30, []int{116, 116}},
+	10: {18, []int{68, 68, 69, 69}},
+}
+
+var alignmentPositions = [...][]int{
+	1:  nil,
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+// Dark reports whether the module at x, y is dark.
+func (c *Code) Dark(x int, y int) bool {
+	return c.modules[y][x]
+}
+
+// Encode returns the smallest QR code that holds text.
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v < len(layouts); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*dataCapacity(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("qrcode: text too long")
+	}
+
+	c := newBuilder(version)
+	c.drawCodewords(addErrorCorrection(version, dataCodewords(version, data)))
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if penalty := c.penalty(); best < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c.code, nil
+}
+
+// DataURI renders the code as an SVG image in a data: URI, with scale
+// pixels per module and a four-module quiet zone.
+func (c *Code) DataURI(scale int) string {
+	size := (c.Size + 8) * scale
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, c.Size+8, c.Size+8)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(b.String()))
+}
+
+// builder tracks which modules are function patterns while a code is
+// drawn.
+type builder struct {
+	code     *Code
+	version  int
+	function [][]bool
+}
+
+func newBuilder(version int) *builder {
+	size := 17 + 4*version
+	c := &builder{code: &Code{Size: size}, version: version}
+	c.code.modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for y := range c.code.modules {
+		c.code.modules[y] = make([]bool, size)
+		c.function[y] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+	positions := alignmentPositions[version]
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+	// Reserve the format areas; drawFormat fills them in.
+	c.drawFormat(0)
+	c.drawVersion()
+	return c
+}
+
+func (c *builder) set(x int, y int, dark bool) {
+	c.code.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *builder) drawFinder(cx int, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= c.code.Size || y >= c.code.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.set(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (c *builder) drawAlignment(cx int, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat writes both copies of the format information for level L and
+// mask.
+func (c *builder) drawFormat(mask int) {
+	data := 1<<3 | mask // level L is 01
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	size := c.code.Size
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, size-15+i, bit(i))
+	}
+	c.set(8, size-8, true)
+}
+
+func (c *builder) drawVersion() {
+	if c.version < 7 {
+		return
+	}
+	rem := c.version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := c.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		a, b := c.code.Size-11+i%3, i/3
+		c.set(a, b, dark)
+		c.set(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order of the standard,
+// leaving remainder modules light.
+func (c *builder) drawCodewords(data []byte) {
+	size := c.code.Size
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if upward {
+					y = size - 1 - vert
+				}
+				if c.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+				c.code.modules[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by mask; applying it twice
+// undoes it.
+func (c *builder) applyMask(mask int) {
+	for y := 0; y < c.code.Size; y++ {
+		for x := 0; x < c.code.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.function[y][x] {
+				c.code.modules[y][x] = !c.code.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores a masked code by the four rules of the standard; the mask
+// with the lowest score is used.
+func (c *builder) penalty() int {
+	size := c.code.Size
+	m := c.code.modules
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return m[x][y]
+		}
+		return m[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+
+	score := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < size; y++ {
+			run := 1
+			for x := 1; x <= size; x++ {
+				if x < size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for x := 0; x+len(finder) <= size; x++ {
+				match := true
+				for k, dark := range finder {
+					if at(x+k, y, transpose) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (lightRun(at, x-4, x, y, transpose, size) || lightRun(at, x+7, x+11, y, transpose, size)) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if m[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size && m[y][x] == m[y][x+1] && m[y][x] == m[y+1][x] && m[y][x] == m[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+	total := size * size
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
+
+// lightRun reports whether modules from..to-1 of a row are light, counting
+// modules outside the code as light.
+func lightRun(at func(x, y int, transpose bool) bool, from int, to int, y int, transpose bool, size int) bool {
+	for x := from; x < to; x++ {
+		if x >= 0 && x < size && at(x, y, transpose) {
+			return false
+		}
+	}
+	return true
+}
+
+func dataCapacity(version int) int {
+	total := 0
+	for _, n := range layouts[version].blocks {
+		total += n
+	}
+	return total
+}
+
+// dataCodewords builds the byte mode segment, terminator and padding.
+func dataCodewords(version int, data []byte) []byte {
+	capacity := dataCapacity(version)
+	var bits []bool
+	appendBits := func(value int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>i&1 != 0)
+		}
+	}
+	appendBits(0x4, 4)
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	appendBits(0, min(4, capacity*8-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+
+	out := make([]byte, len(bits)/8, capacity)
+	for i, dark := range bits {
+		if dark {
+			out[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+// addErrorCorrection splits data into blocks, appends Reed-Solomon
+// codewords to each and interleaves the result.
+func addErrorCorrection(version int, data []byte) []byte {
+	layout := layouts[version]
+	divisor := rsDivisor(layout.ecLen)
+	var blocks, ecBlocks [][]byte
+	for _, n := range layout.blocks {
+		block := data[:n]
+		data = data[n:]
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, divisor))
+	}
+
+	var out []byte
+	for i := 0; i < layout.blocks[len(layout.blocks)-1]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecLen; i++ {
+		for _, ec := range ecBlocks {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+func rsDivisor(degree int) []byte {
+	divisor := make([]byte, degree)
+	divisor[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			divisor[j] = gfMultiply(divisor[j], root)
+			if j+1 < degree {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return divisor
+}
+
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x byte, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/config"
+	"tunapanel/internal/models"
+)
+
+const (
+	maxBulkUnits    = 64
+	bulkParallelism = 4
+)
+
+// UnitActionFunc is a job such as StartService applied to a single unit.
+type UnitActionFunc func(name string, dryRun bool) ([]string, string, error)
+
+// NormalizeUnitPattern validates a unit name or a glob pattern such as
+// "worker@*", which like a name defaults to services.
+func NormalizeUnitPattern(input string) (string, error) {
+	pattern := strings.TrimSpace(input)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return NormalizeUnitName(pattern)
+	}
+
+	literal := strings.NewReplacer("*", "x", "?", "x", "[", "x", "]", "x").Replace(pattern)
+	if _, err := validateUnitName(literal, "unit pattern"); err != nil {
+		return "", err
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", errors.New("invalid unit pattern")
+	}
+	unitType := UnitType(pattern)
+	if unitType == "" {
+		return pattern + ".service", nil
+	}
+	if !containsString(UnitTypes, unitType) {
+		return "", fmt.Errorf("unsupported unit type %q", unitType)
+	}
+	return pattern, nil
+}
+
+// ExpandUnitPatterns resolves normalized patterns against the loaded and
+// installed units; each pattern must match at least one.
+func ExpandUnitPatterns(patterns []string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	candidates := make(map[string][]string)
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			add(pattern)
+			continue
+		}
+
+		unitType := UnitType(pattern)
+		if _, ok := candidates[unitType]; !ok {
+			list, err := unitNames(unitType)
+			if err != nil {
+				return nil, err
+			}
+			candidates[unitType] = list
+		}
+
+		matched := false
+		for _, name := range candidates[unitType] {
+			if ok, _ := path.Match(pattern, name); ok {
+				add(name)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no units match %s", pattern)
+		}
+	}
+
+	if len(names) > maxBulkUnits {
+		return nil, fmt.Errorf("too many units (max %d)", maxBulkUnits)
+	}
+	return names, nil
+}
+
+// unitNames lists the loaded and installed units of a type, sorted.
+func unitNames(unitType string) ([]string, error) {
+	units, err := manager.ListUnits(unitType, nil)
+	if err != nil {
+		return nil, err
+	}
+	files, err := manager.ListUnitFiles(unitType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, unit := range append(units, files...) {
+		if seen[unit.Name] || strings.Contains(unit.Name, "@.") {
+			continue
+		}
+		seen[unit.Name] = true
+		names = append(names, unit.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CheckBulkWait refuses to wait for units, bulkParallelism at a time, when
+// the waits alone could outlast config.BulkTimeout.
+func CheckBulkWait(units int, timeout time.Duration) error {
+	waves := (units + bulkParallelism - 1) / bulkParallelism
+	if total := time.Duration(waves) * timeout; total > config.BulkTimeout {
+		return fmt.Errorf("waiting up to %s for each of %d units, %d at a time, could take %s, more than the %s a bulk request may take; wait less or name fewer units",
+			timeout, units, bulkParallelism, total, config.BulkTimeout)
+	}
+	return nil
+}
+
+// RunBulk applies action to every unit, at most bulkParallelism at a time,
+// and returns one result per unit in the order given.
+func RunBulk(names []string, action UnitActionFunc, dryRun bool) []models.UnitActionResult {
+	results := make([]models.UnitActionResult, len(names))
+	sem := make(chan struct{}, bulkParallelism)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			cmd, message, err := action(name, dryRun)
+			result := models.UnitActionResult{
+				Service: name,
+				OK:      err == nil,
+				Command: cmd,
+				Message: message,
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			var waitErr *WaitError
+			if errors.As(err, &waitErr) {
+				result.Diagnosis = &waitErr.Diagnosis
+			}
+			var protectedErr *ProtectedError
+			if errors.As(err, &protectedErr) {
+				result.Code = models.CodeProtectedUnit
+			}
+			results[i] = result
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
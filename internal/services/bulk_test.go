@@ -0,0 +1,28 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBulkWait(t *testing.T) {
+	tests := []struct {
+		units   int
+		timeout time.Duration
+		ok      bool
+	}{
+		{1, MaxWaitTimeout, true},
+		{8, MaxWaitTimeout, true},
+		{9, MaxWaitTimeout, false},
+		{16, DefaultWaitTimeout, true},
+		{17, DefaultWaitTimeout, false},
+		{maxBulkUnits, 7 * time.Second, true},
+		{maxBulkUnits, 8 * time.Second, false},
+	}
+	for _, tt := range tests {
+		err := CheckBulkWait(tt.units, tt.timeout)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckBulkWait(%d, %s) = %v, want ok=%v", tt.units, tt.timeout, err, tt.ok)
+		}
+	}
+}
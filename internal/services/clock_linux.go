@@ -0,0 +1,20 @@
+package services
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const clockMonotonic = 1
+
+// monotonicNow reads CLOCK_MONOTONIC, the clock systemd uses for monotonic
+// timer elapse times.
+func monotonicNow() (time.Duration, bool) {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Nano()), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package services
+
+import "time"
+
+func monotonicNow() (time.Duration, bool) {
+	return 0, false
+}
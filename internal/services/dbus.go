@@ -0,0 +1,621 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/dbus"
+	"tunapanel/internal/models"
+)
+
+const (
+	systemdBusName   = "org.freedesktop.systemd1"
+	systemdPath      = dbus.ObjectPath("/org/freedesktop/systemd1")
+	managerInterface = "org.freedesktop.systemd1.Manager"
+	unitInterface    = "org.freedesktop.systemd1.Unit"
+	serviceInterface = "org.freedesktop.systemd1.Service"
+	timerInterface   = "org.freedesktop.systemd1.Timer"
+
+	dbusCallTimeout = 30 * time.Second
+	dbusJobTimeout  = 2 * time.Minute
+)
+
+var jobMethods = map[string]string{
+	"start":             "StartUnit",
+	"stop":              "StopUnit",
+	"restart":           "RestartUnit",
+	"reload":            "ReloadUnit",
+	"reload-or-restart": "ReloadOrRestartUnit",
+	"try-restart":       "TryRestartUnit",
+}
+
+// DBusManager is the ServiceManager that talks to systemd's
+// org.freedesktop.systemd1 API directly. The bus connection is opened on
+// first use and reopened if it drops.
+type DBusManager struct {
+	address string
+
+	mu   sync.Mutex
+	conn *dbus.Conn
+}
+
+// NewDBusManager returns a manager for the bus at address, or the system bus
+// when address is empty.
+func NewDBusManager(address string) *DBusManager {
+	return &DBusManager{address: address}
+}
+
+func (m *DBusManager) connection(ctx context.Context) (*dbus.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn != nil && !m.conn.Closed() {
+		return m.conn, nil
+	}
+
+	var conn *dbus.Conn
+	var err error
+	if m.address == "" {
+		conn, err = dbus.SystemBus(ctx)
+	} else {
+		conn, err = dbus.Dial(ctx, m.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to systemd bus: %w", err)
+	}
+
+	// JobRemoved is only emitted to subscribed clients.
+	rule := fmt.Sprintf("type='signal',sender='%s',interface='%s',member='JobRemoved'", systemdBusName, managerInterface)
+	if err := conn.AddMatch(ctx, rule); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Call(ctx, systemdBusName, systemdPath, managerInterface, "Subscribe", ""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	m.conn = conn
+	return conn, nil
+}
+
+func (m *DBusManager) call(ctx context.Context, objPath dbus.ObjectPath, iface string, member string, sig string, args ...interface{}) ([]interface{}, error) {
+	conn, err := m.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Call(ctx, systemdBusName, objPath, iface, member, sig, args...)
+}
+
+func (m *DBusManager) ListUnits(unitType string, states []string) ([]models.ServiceInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	if states == nil {
+		states = []string{}
+	}
+	reply, err := m.call(ctx, systemdPath, managerInterface, "ListUnitsByPatterns", "asas", states, []string{"*." + unitType})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := replyArray(reply)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]models.ServiceInfo, 0, len(rows))
+	for _, row := range rows {
+		fields, ok := row.([]interface{})
+		if !ok || len(fields) < 5 {
+			return nil, errors.New("unexpected ListUnitsByPatterns reply")
+		}
+		services = append(services, models.ServiceInfo{
+			Name:        asString(fields[0]),
+			Description: asString(fields[1]),
+			LoadState:   asString(fields[2]),
+			ActiveState: asString(fields[3]),
+			SubState:    asString(fields[4]),
+		})
+	}
+	return services, nil
+}
+
+func (m *DBusManager) ListUnitFiles(unitType string, states []string) ([]models.ServiceInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	if states == nil {
+		states = []string{}
+	}
+	reply, err := m.call(ctx, systemdPath, managerInterface, "ListUnitFilesByPatterns", "asas", states, []string{"*." + unitType})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := replyArray(reply)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]models.ServiceInfo, 0, len(rows))
+	for _, row := range rows {
+		fields, ok := row.([]interface{})
+		if !ok || len(fields) < 2 {
+			return nil, errors.New("unexpected ListUnitFilesByPatterns reply")
+		}
+		services = append(services, models.ServiceInfo{
+			Name:          path.Base(asString(fields[0])),
+			UnitFileState: asString(fields[1]),
+		})
+	}
+	return services, nil
+}
+
+// UnitAction queues a job and waits for systemd to report its result through
+// the JobRemoved signal, as systemctl does.
+func (m *DBusManager) UnitAction(verb string, name string) error {
+	method, ok := jobMethods[verb]
+	if !ok {
+		return fmt.Errorf("unsupported unit action %q", verb)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbusJobTimeout)
+	defer cancel()
+
+	conn, err := m.connection(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Watch before queueing the job so its removal cannot be missed.
+	signals := conn.Watch(256)
+	defer conn.Unwatch(signals)
+
+	reply, err := conn.Call(ctx, systemdBusName, systemdPath, managerInterface, method, "ss", name, "replace")
+	if err != nil {
+		return err
+	}
+	if len(reply) != 1 {
+		return fmt.Errorf("unexpected %s reply", method)
+	}
+	job, _ := reply[0].(dbus.ObjectPath)
+
+	for {
+		select {
+		case msg, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("lost connection to systemd while waiting for %s job", verb)
+			}
+			if msg.Type != dbus.TypeSignal || msg.Interface != managerInterface || msg.Member != "JobRemoved" || len(msg.Body) != 4 {
+				continue
+			}
+			if removed, _ := msg.Body[1].(dbus.ObjectPath); removed != job {
+				continue
+			}
+			if result := asString(msg.Body[3]); result != "done" {
+				return fmt.Errorf("job for %s failed: %s", name, result)
+			}
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s job on %s", verb, name)
+		}
+	}
+}
+
+func (m *DBusManager) ShowUnit(name string) (models.ServiceStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	unit, err := m.unitProperties(ctx, name, unitInterface)
+	if err != nil {
+		return models.ServiceStatus{}, err
+	}
+
+	status := models.ServiceStatus{
+		Name:         variantString(unit, "Id"),
+		Names:        variantStrings(unit, "Names"),
+		Description:  variantString(unit, "Description"),
+		LoadState:    variantString(unit, "LoadState"),
+		ActiveState:  variantString(unit, "ActiveState"),
+		SubState:     variantString(unit, "SubState"),
+		FragmentPath: variantString(unit, "FragmentPath"),
+	}
+	if status.Name == "" {
+		status.Name = name
+	}
+
+	service, err := m.unitProperties(ctx, name, typeInterface(name))
+	if err != nil {
+		return status, nil
+	}
+	status.MainPID = int(variantUint(service, "MainPID"))
+	status.NRestarts = int(variantUint(service, "NRestarts"))
+	if mem := variantUint(service, "MemoryCurrent"); mem != ^uint64(0) {
+		status.MemoryCurrent = mem
+	}
+	if usec := variantUint(service, "ExecMainStartTimestamp"); usec > 0 {
+		ts := time.UnixMicro(int64(usec))
+		status.ExecMainStartTimestamp = &ts
+	}
+	status.Limits = resourceLimits(
+		variantLimit(service, "CPUQuotaPerSecUSec"),
+		variantLimit(service, "MemoryMax"),
+		variantLimit(service, "MemoryHigh"),
+		variantLimit(service, "TasksMax"),
+		variantLimit(service, "IOWeight"),
+	)
+	return status, nil
+}
+
+func (m *DBusManager) UnitFileState(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	unit, err := m.unitProperties(ctx, name, unitInterface)
+	if err != nil {
+		return "", err
+	}
+	return variantString(unit, "UnitFileState"), nil
+}
+
+// ChangeUnitFile mirrors systemctl: change the symlinks, reload the manager
+// configuration and then start or stop the unit when now is set.
+func (m *DBusManager) ChangeUnitFile(verb string, name string, now bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	files := []string{name}
+	var err error
+	switch verb {
+	case "enable":
+		_, err = m.call(ctx, systemdPath, managerInterface, "EnableUnitFiles", "asbb", files, false, false)
+	case "disable":
+		_, err = m.call(ctx, systemdPath, managerInterface, "DisableUnitFiles", "asb", files, false)
+	case "mask":
+		_, err = m.call(ctx, systemdPath, managerInterface, "MaskUnitFiles", "asbb", files, false, false)
+	case "unmask":
+		_, err = m.call(ctx, systemdPath, managerInterface, "UnmaskUnitFiles", "asb", files, false)
+	default:
+		return fmt.Errorf("unsupported unit file action %q", verb)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.call(ctx, systemdPath, managerInterface, "Reload", ""); err != nil {
+		return err
+	}
+
+	if !now {
+		return nil
+	}
+	if verb == "enable" {
+		return m.UnitAction("start", name)
+	}
+	return m.UnitAction("stop", name)
+}
+
+func (m *DBusManager) Dependencies(names []string) ([]UnitDependencies, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	deps := make([]UnitDependencies, 0, len(names))
+	for _, name := range names {
+		unit, err := m.unitProperties(ctx, name, unitInterface)
+		if err != nil {
+			return nil, err
+		}
+		dep := UnitDependencies{
+			Name:        name,
+			ActiveState: variantString(unit, "ActiveState"),
+			Properties:  make(map[string][]string),
+		}
+		for _, prop := range dependencyProperties() {
+			if units := variantStrings(unit, prop); len(units) > 0 {
+				dep.Properties[prop] = units
+			}
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+func (m *DBusManager) ListTimers() ([]models.TimerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	patterns := []string{"*.timer"}
+	files, err := m.call(ctx, systemdPath, managerInterface, "ListUnitFilesByPatterns", "asas", []string{}, patterns)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := m.call(ctx, systemdPath, managerInterface, "ListUnitsByPatterns", "asas", []string{}, patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, reply := range [][]interface{}{files, loaded} {
+		rows, err := replyArray(reply)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			fields, ok := row.([]interface{})
+			if !ok || len(fields) < 1 {
+				return nil, errors.New("unexpected timer list reply")
+			}
+			name := path.Base(asString(fields[0]))
+			if seen[name] || strings.Contains(name, "@.") {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	timers := make([]models.TimerInfo, 0, len(names))
+	for _, name := range names {
+		unit, err := m.unitProperties(ctx, name, unitInterface)
+		if err != nil {
+			return nil, err
+		}
+		timer := models.TimerInfo{
+			Name:          name,
+			Description:   variantString(unit, "Description"),
+			ActiveState:   variantString(unit, "ActiveState"),
+			UnitFileState: variantString(unit, "UnitFileState"),
+		}
+		// Units that failed to load have no Timer interface.
+		if props, err := m.unitProperties(ctx, name, timerInterface); err == nil {
+			timer.Activates = variantString(props, "Unit")
+			timer.NextElapse = nextElapse(variantUint(props, "NextElapseUSecRealtime"), variantUint(props, "NextElapseUSecMonotonic"))
+			if usec := variantUint(props, "LastTriggerUSec"); usec > 0 {
+				ts := time.UnixMicro(int64(usec))
+				timer.LastTrigger = &ts
+			}
+		}
+		timers = append(timers, timer)
+	}
+	return timers, nil
+}
+
+// nextElapse picks the earlier of a timer's realtime and monotonic elapse
+// times, as systemctl list-timers does. Monotonic times count from boot.
+func nextElapse(realtime uint64, monotonic uint64) *time.Time {
+	var next time.Time
+	if realtime > 0 && realtime != ^uint64(0) {
+		next = time.UnixMicro(int64(realtime))
+	}
+	if monotonic > 0 && monotonic != ^uint64(0) {
+		if now, ok := monotonicNow(); ok {
+			ts := time.Now().Add(time.Duration(monotonic)*time.Microsecond - now)
+			if next.IsZero() || ts.Before(next) {
+				next = ts
+			}
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+func (m *DBusManager) UnitPaths(name string) (string, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	unit, err := m.unitProperties(ctx, name, unitInterface)
+	if err != nil {
+		return "", nil, err
+	}
+	return variantString(unit, "FragmentPath"), variantStrings(unit, "DropInPaths"), nil
+}
+
+func (m *DBusManager) DaemonReload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	_, err := m.call(ctx, systemdPath, managerInterface, "Reload", "")
+	return err
+}
+
+func (m *DBusManager) UnitResults(names []string) ([]UnitResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	results := make([]UnitResult, 0, len(names))
+	for _, name := range names {
+		result := UnitResult{Name: name}
+		if props, err := m.unitProperties(ctx, name, typeInterface(name)); err == nil {
+			result.Result = variantString(props, "Result")
+			result.ExitCode = exitCodes[int64(variantUint(props, "ExecMainCode"))]
+			result.ExitStatus = int(int32(variantUint(props, "ExecMainStatus")))
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (m *DBusManager) ResetFailed(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	var err error
+	if name == "" {
+		_, err = m.call(ctx, systemdPath, managerInterface, "ResetFailed", "")
+	} else {
+		_, err = m.call(ctx, systemdPath, managerInterface, "ResetFailedUnit", "s", name)
+	}
+	return err
+}
+
+func (m *DBusManager) SetProperties(name string, props []UnitProperty, runtime bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	values := make([]interface{}, 0, len(props))
+	for _, prop := range props {
+		key, value, err := propertyVariant(prop)
+		if err != nil {
+			return err
+		}
+		values = append(values, []interface{}{key, value})
+	}
+	_, err := m.call(ctx, systemdPath, managerInterface, "SetUnitProperties", "sba(sv)", name, runtime, values)
+	return err
+}
+
+func (m *DBusManager) RunTransient(unit string, description string, argv []string, props []UnitProperty) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusCallTimeout)
+	defer cancel()
+
+	// ExecStart is a list of (path, argv, ignore failure).
+	execStart := []interface{}{[]interface{}{argv[0], argv, false}}
+	values := []interface{}{
+		[]interface{}{"Description", dbus.MakeVariant("s", description)},
+		[]interface{}{"ExecStart", dbus.MakeVariant("a(sasb)", execStart)},
+	}
+	for _, prop := range props {
+		key, value, err := propertyVariant(prop)
+		if err != nil {
+			return err
+		}
+		values = append(values, []interface{}{key, value})
+	}
+	_, err := m.call(ctx, systemdPath, managerInterface, "StartTransientUnit", "ssa(sv)a(sa(sv))", unit, "fail", values, []interface{}{})
+	return err
+}
+
+// propertyVariant converts a validated set-property assignment into the
+// D-Bus property systemctl would send for it. Percentages of memory and
+// tasks are scaled to the full uint32 range. RuntimeMaxSec, which only jobs
+// set, is sent in microseconds.
+func propertyVariant(prop UnitProperty) (string, dbus.Variant, error) {
+	if prop.Name == "RuntimeMaxSec" {
+		sec, err := strconv.ParseUint(prop.Value, 10, 64)
+		if err != nil {
+			return "", dbus.Variant{}, fmt.Errorf("invalid %s value %q", prop.Name, prop.Value)
+		}
+		return "RuntimeMaxUSec", dbus.MakeVariant("t", sec*1000000), nil
+	}
+	if prop.Value == "" || prop.Value == "infinity" {
+		key := prop.Name
+		if key == "CPUQuota" {
+			key = "CPUQuotaPerSecUSec"
+		}
+		return key, dbus.MakeVariant("t", unsetLimit), nil
+	}
+
+	if pct, ok := parsePercent(prop.Value); ok {
+		if prop.Name == "CPUQuota" {
+			return "CPUQuotaPerSecUSec", dbus.MakeVariant("t", pct*10000), nil
+		}
+		scale := uint32(pct * math.MaxUint32 / 100)
+		return prop.Name + "Scale", dbus.MakeVariant("u", scale), nil
+	}
+	if prop.Name == "MemoryMax" || prop.Name == "MemoryHigh" {
+		n, _ := parseBytes(prop.Value)
+		return prop.Name, dbus.MakeVariant("t", n), nil
+	}
+	n, err := strconv.ParseUint(prop.Value, 10, 64)
+	if err != nil {
+		return "", dbus.Variant{}, fmt.Errorf("invalid %s value %q", prop.Name, prop.Value)
+	}
+	return prop.Name, dbus.MakeVariant("t", n), nil
+}
+
+func (m *DBusManager) unitProperties(ctx context.Context, name string, iface string) (map[string]dbus.Variant, error) {
+	reply, err := m.call(ctx, systemdPath, managerInterface, "LoadUnit", "s", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 1 {
+		return nil, errors.New("unexpected LoadUnit reply")
+	}
+	unitPath, _ := reply[0].(dbus.ObjectPath)
+
+	conn, err := m.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.GetAll(ctx, systemdBusName, unitPath, iface)
+}
+
+// typeInterface returns the D-Bus interface holding the type-specific
+// properties of a unit, e.g. org.freedesktop.systemd1.Socket.
+// Units that failed to load lack it, so callers skip the type-specific
+// properties when it cannot be read.
+func typeInterface(name string) string {
+	unitType := UnitType(name)
+	if unitType == "" {
+		return serviceInterface
+	}
+	return "org.freedesktop.systemd1." + strings.ToUpper(unitType[:1]) + unitType[1:]
+}
+
+func replyArray(reply []interface{}) ([]interface{}, error) {
+	if len(reply) != 1 {
+		return nil, errors.New("unexpected reply from systemd")
+	}
+	rows, ok := reply[0].([]interface{})
+	if !ok {
+		return nil, errors.New("unexpected reply from systemd")
+	}
+	return rows, nil
+}
+
+func asString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case dbus.ObjectPath:
+		return string(v)
+	}
+	return ""
+}
+
+func variantString(props map[string]dbus.Variant, key string) string {
+	return asString(props[key].Value)
+}
+
+func variantStrings(props map[string]dbus.Variant, key string) []string {
+	items, _ := props[key].Value.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		list = append(list, asString(item))
+	}
+	return list
+}
+
+// variantLimit returns a numeric property, or unsetLimit when the unit does
+// not have it.
+func variantLimit(props map[string]dbus.Variant, key string) uint64 {
+	if _, ok := props[key]; !ok {
+		return unsetLimit
+	}
+	return variantUint(props, key)
+}
+
+func variantUint(props map[string]dbus.Variant, key string) uint64 {
+	switch v := props[key].Value.(type) {
+	case uint32:
+		return uint64(v)
+	case uint64:
+		return v
+	case int32:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	}
+	return 0
+}
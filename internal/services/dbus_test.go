@@ -0,0 +1,98 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tunapanel/internal/dbus/dbustest"
+)
+
+func fakeSystemd(t *testing.T) (*dbustest.Bus, *DBusManager) {
+	t.Helper()
+	bus, err := dbustest.Listen(filepath.Join(t.TempDir(), "bus.sock"), []dbustest.Unit{
+		{Name: "nginx.service", Description: "web server", ActiveState: "active", SubState: "running", UnitFileState: "enabled", MainPID: 99},
+		{Name: "worker.service", Description: "worker", UnitFileState: "disabled"},
+		{Name: "broken.service", Description: "always fails", UnitFileState: "enabled", Fail: true},
+		{Name: "backup.timer", Description: "backup", UnitFileState: "enabled"},
+		{Name: "migrate.service", Description: "oneshot", UnitFileState: "static", Oneshot: true},
+		{Name: "crashy.service", Description: "exits at once", UnitFileState: "enabled", Oneshot: true, Result: "signal"},
+		{Name: "redis-server.service", Description: "key-value store", ActiveState: "active", SubState: "exited", UnitFileState: "enabled", Aliases: []string{"redis.service"}, RequiredBy: []string{"sessions.service"}},
+		{Name: "sessions.service", Description: "session store", ActiveState: "active", SubState: "exited", UnitFileState: "enabled"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bus.Close() })
+	return bus, NewDBusManager(bus.Address)
+}
+
+func TestDBusUnitActionWaitsForJobRemoved(t *testing.T) {
+	bus, m := fakeSystemd(t)
+	const delay = 200 * time.Millisecond
+	bus.SetJobDelay(delay)
+
+	start := time.Now()
+	if err := m.UnitAction("start", "worker.service"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("start returned after %v, before the job finished", elapsed)
+	}
+	if u, _ := bus.Unit("worker.service"); u.ActiveState != "active" {
+		t.Errorf("worker.service is %s after start", u.ActiveState)
+	}
+
+	err := m.UnitAction("restart", "broken.service")
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("restart of a failing unit: err = %v", err)
+	}
+
+	if err := m.UnitAction("stop", "missing.service"); err == nil || !strings.Contains(err.Error(), "NoSuchUnit") {
+		t.Errorf("stop of a missing unit: err = %v", err)
+	}
+	if err := m.UnitAction("frobnicate", "worker.service"); err == nil {
+		t.Error("unknown verb: expected an error")
+	}
+
+	calls := strings.Join(bus.Calls(), " ")
+	for _, want := range []string{"org.freedesktop.DBus.Hello", "org.freedesktop.DBus.AddMatch", "org.freedesktop.systemd1.Manager.Subscribe"} {
+		if !strings.Contains(calls, want) {
+			t.Errorf("%s was not called; calls: %s", want, calls)
+		}
+	}
+}
+
+func TestDBusListAndShow(t *testing.T) {
+	_, m := fakeSystemd(t)
+
+	running, err := m.ListUnits("service", []string{"running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(running) != 1 || running[0].Name != "nginx.service" || running[0].Description != "web server" {
+		t.Errorf("running services = %+v", running)
+	}
+
+	files, err := m.ListUnitFiles("timer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "backup.timer" || files[0].UnitFileState != "enabled" {
+		t.Errorf("timer unit files = %+v", files)
+	}
+
+	status, err := m.ShowUnit("nginx.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ActiveState != "active" || status.MainPID != 99 || status.FragmentPath != "/usr/lib/systemd/system/nginx.service" {
+		t.Errorf("nginx.service = %+v", status)
+	}
+
+	state, err := m.UnitFileState("worker.service")
+	if err != nil || state != "disabled" {
+		t.Errorf("worker.service unit file state = %q, %v", state, err)
+	}
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"sort"
+	"strings"
+
+	"tunapanel/internal/models"
+)
+
+const (
+	maxDependencyDepth = 8
+	maxDependencyNodes = 512
+)
+
+// UnitDependencies holds a unit's active state and its dependency
+// properties, keyed by property name ("Requires", "WantedBy", ...).
+type UnitDependencies struct {
+	Name        string
+	ActiveState string
+	Properties  map[string][]string
+}
+
+var (
+	forwardDependencies = []string{"Requires", "Requisite", "BindsTo", "PartOf", "Upholds", "Wants"}
+	reverseDependencies = []string{"RequiredBy", "RequisiteOf", "BoundBy", "ConsistsOf", "UpheldBy", "WantedBy"}
+
+	// stopPropagation lists the reverse dependencies along which systemd
+	// turns a stop job into stop jobs for the dependent units.
+	stopPropagation = []string{"RequiredBy", "RequisiteOf", "BoundBy", "ConsistsOf"}
+)
+
+// dependencyProperties is every property a ServiceManager must report.
+func dependencyProperties() []string {
+	return append(append([]string{}, forwardDependencies...), reverseDependencies...)
+}
+
+// ServiceDependencies returns the dependency tree of a unit in both
+// directions. Like systemctl list-dependencies, the forward tree only
+// expands target units; the reverse tree is expanded fully.
+func ServiceDependencies(name string, dryRun bool) (models.DependencyTree, string, error) {
+	message := dryRunMessage("service.deps", dryRun)
+	tree := models.DependencyTree{Name: name}
+
+	root, err := manager.Dependencies([]string{name})
+	if err != nil {
+		return tree, message, err
+	}
+	if len(root) == 1 {
+		tree.ActiveState = root[0].ActiveState
+	}
+
+	tree.Dependencies, err = dependencyTree(name, forwardDependencies, func(unit string) bool {
+		return strings.HasSuffix(unit, ".target")
+	})
+	if err != nil {
+		return tree, message, err
+	}
+	tree.Dependents, err = dependencyTree(name, reverseDependencies, func(string) bool { return true })
+	if err != nil {
+		return tree, message, err
+	}
+	return tree, message, nil
+}
+
+// dependencyTree walks the graph one level at a time so that each level
+// costs a single backend call. A unit is expanded at most once.
+func dependencyTree(name string, props []string, expand func(string) bool) ([]models.DependencyNode, error) {
+	root := &models.DependencyNode{Name: name}
+	level := []*models.DependencyNode{root}
+	expanded := map[string]bool{name: true}
+	count := 1
+
+	for depth := 0; len(level) > 0; depth++ {
+		deps, err := lookupDependencies(level)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []*models.DependencyNode
+		for _, node := range level {
+			info := deps[node.Name]
+			node.ActiveState = info.ActiveState
+			if node != root && (depth >= maxDependencyDepth || expanded[node.Name] || !expand(node.Name)) {
+				continue
+			}
+			expanded[node.Name] = true
+
+			for _, prop := range props {
+				units := append([]string{}, info.Properties[prop]...)
+				sort.Strings(units)
+				for _, unit := range units {
+					if count >= maxDependencyNodes {
+						break
+					}
+					node.Children = append(node.Children, models.DependencyNode{Name: unit, Type: prop})
+					count++
+				}
+			}
+			for i := range node.Children {
+				next = append(next, &node.Children[i])
+			}
+		}
+		level = next
+	}
+	return root.Children, nil
+}
+
+func lookupDependencies(nodes []*models.DependencyNode) (map[string]UnitDependencies, error) {
+	seen := make(map[string]bool, len(nodes))
+	var names []string
+	for _, node := range nodes {
+		if !seen[node.Name] {
+			seen[node.Name] = true
+			names = append(names, node.Name)
+		}
+	}
+
+	deps, err := manager.Dependencies(names)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]UnitDependencies, len(deps))
+	for i, dep := range deps {
+		if i < len(names) {
+			byName[names[i]] = dep
+		}
+	}
+	return byName, nil
+}
+
+// StopImpact returns the active units that systemd would stop along with
+// name, following Requires=, Requisite=, BindsTo= and PartOf= backwards.
+func StopImpact(name string) ([]string, error) {
+	name, _, err := unitAliases(name)
+	if err != nil {
+		return nil, err
+	}
+	visited := map[string]bool{name: true}
+	level := []string{name}
+	var impact []string
+
+	for first := true; len(level) > 0; first = false {
+		deps, err := manager.Dependencies(level)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []string
+		for i, dep := range deps {
+			// Inactive units still pass the stop job on to their dependents.
+			if !first && i < len(level) && isActiveState(dep.ActiveState) {
+				impact = append(impact, level[i])
+			}
+			for _, prop := range stopPropagation {
+				for _, unit := range dep.Properties[prop] {
+					if !visited[unit] && len(visited) < maxDependencyNodes {
+						visited[unit] = true
+						next = append(next, unit)
+					}
+				}
+			}
+		}
+		level = next
+	}
+
+	sort.Strings(impact)
+	return impact, nil
+}
+
+func isActiveState(state string) bool {
+	switch state {
+	case "active", "reloading", "activating", "refreshing":
+		return true
+	}
+	return false
+}
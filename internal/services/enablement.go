@@ -0,0 +1,226 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const unitConfigDir = "/etc/systemd/system"
+
+type EnablementResult struct {
+	Command       []string
+	Message       string
+	Changes       []string
+	UnitFileState string
+}
+
+func EnableService(name string, now bool, dryRun bool) (EnablementResult, error) {
+	return changeEnablement("enable", name, now, dryRun, UnitType(name)+" enabled", planEnable)
+}
+
+func DisableService(name string, now bool, dryRun bool) (EnablementResult, error) {
+	return changeEnablement("disable", name, now, dryRun, UnitType(name)+" disabled", planDisable)
+}
+
+func MaskService(name string, now bool, dryRun bool) (EnablementResult, error) {
+	return changeEnablement("mask", name, now, dryRun, UnitType(name)+" masked", planMask)
+}
+
+func UnmaskService(name string, dryRun bool) (EnablementResult, error) {
+	return changeEnablement("unmask", name, false, dryRun, UnitType(name)+" unmasked", planUnmask)
+}
+
+func enablementCommand(verb string, name string, now bool) []string {
+	cmd := []string{"systemctl", verb}
+	if now {
+		cmd = append(cmd, "--now")
+	}
+	return append(cmd, name)
+}
+
+func changeEnablement(verb string, name string, now bool, dryRun bool, done string, plan func(string) ([]string, error)) (EnablementResult, error) {
+	cmd := enablementCommand(verb, name, now)
+	result := EnablementResult{Command: cmd}
+	if dryRun {
+		if planner, ok := manager.(UnitFilePlanner); ok {
+			plan = func(name string) ([]string, error) { return planner.PlanUnitFile(verb, name) }
+		}
+		changes, err := plan(name)
+		if err != nil {
+			return result, err
+		}
+		if now {
+			action := "stop"
+			if verb == "enable" {
+				action = "start"
+			}
+			changes = append(changes, fmt.Sprintf("%s %s", action, name))
+		}
+		result.Changes = changes
+		result.Message = fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " "))
+		return result, nil
+	}
+
+	if err := manager.ChangeUnitFile(verb, name, now); err != nil {
+		return result, err
+	}
+
+	state, err := manager.UnitFileState(name)
+	if err != nil {
+		return result, err
+	}
+	result.UnitFileState = state
+	result.Message = fmt.Sprintf("%s: %s", done, name)
+	return result, nil
+}
+
+func planEnable(name string) ([]string, error) {
+	fragment, err := fragmentPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if fragment == "" {
+		return nil, fmt.Errorf("unit file not found: %s", name)
+	}
+	install, err := readInstallSection(fragment)
+	if err != nil {
+		return nil, err
+	}
+	if len(install) == 0 {
+		return []string{fmt.Sprintf("no [Install] section in %s; nothing to link", fragment)}, nil
+	}
+
+	var changes []string
+	link := func(path string) {
+		if target, err := os.Readlink(path); err == nil && target == fragment {
+			return
+		}
+		changes = append(changes, fmt.Sprintf("create symlink %s -> %s", path, fragment))
+	}
+	for _, target := range install["WantedBy"] {
+		link(filepath.Join(unitConfigDir, target+".wants", name))
+	}
+	for _, target := range install["RequiredBy"] {
+		link(filepath.Join(unitConfigDir, target+".requires", name))
+	}
+	for _, target := range install["UpheldBy"] {
+		link(filepath.Join(unitConfigDir, target+".upholds", name))
+	}
+	for _, alias := range install["Alias"] {
+		link(filepath.Join(unitConfigDir, alias))
+	}
+	for _, also := range install["Also"] {
+		changes = append(changes, fmt.Sprintf("also enable %s", also))
+	}
+	return changes, nil
+}
+
+func planDisable(name string) ([]string, error) {
+	var changes []string
+	for _, suffix := range []string{".wants", ".requires", ".upholds"} {
+		matches, err := filepath.Glob(filepath.Join(unitConfigDir, "*"+suffix, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			changes = append(changes, fmt.Sprintf("remove symlink %s", path))
+		}
+	}
+
+	fragment, err := fragmentPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if fragment != "" {
+		install, err := readInstallSection(fragment)
+		if err != nil {
+			return nil, err
+		}
+		for _, alias := range install["Alias"] {
+			path := filepath.Join(unitConfigDir, alias)
+			if _, err := os.Readlink(path); err == nil {
+				changes = append(changes, fmt.Sprintf("remove symlink %s", path))
+			}
+		}
+		for _, also := range install["Also"] {
+			changes = append(changes, fmt.Sprintf("also disable %s", also))
+		}
+	}
+	return changes, nil
+}
+
+func planMask(name string) ([]string, error) {
+	path := filepath.Join(unitConfigDir, name)
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSymlink != 0:
+		if target, _ := os.Readlink(path); target == os.DevNull {
+			return []string{fmt.Sprintf("%s is already masked", name)}, nil
+		}
+	default:
+		return nil, fmt.Errorf("cannot mask %s: unit file exists at %s", name, path)
+	}
+	return []string{fmt.Sprintf("create symlink %s -> %s", path, os.DevNull)}, nil
+}
+
+func planUnmask(name string) ([]string, error) {
+	path := filepath.Join(unitConfigDir, name)
+	if target, err := os.Readlink(path); err == nil && target == os.DevNull {
+		return []string{fmt.Sprintf("remove symlink %s", path)}, nil
+	}
+	return []string{fmt.Sprintf("%s is not masked", name)}, nil
+}
+
+func fragmentPath(name string) (string, error) {
+	status, err := manager.ShowUnit(name)
+	if err != nil {
+		return "", err
+	}
+	return status.FragmentPath, nil
+}
+
+func readInstallSection(path string) (map[string][]string, error) {
+	install := make(map[string][]string)
+	if path == "" {
+		return install, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	inInstall := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inInstall = line == "[Install]"
+			continue
+		}
+		if !inInstall {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		install[key] = append(install[key], strings.Fields(value)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return install, nil
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"tunapanel/internal/models"
+)
+
+// UnitResult is why a unit last stopped: systemd's Result= ("exit-code",
+// "signal", "timeout", ...) and how its main process ended.
+type UnitResult struct {
+	Name       string
+	Result     string
+	ExitCode   string
+	ExitStatus int
+}
+
+// exitCodes maps the CLD_* codes systemd reports in ExecMainCode to the
+// names systemctl status prints.
+var exitCodes = map[int64]string{
+	1: "exited",
+	2: "killed",
+	3: "dumped",
+}
+
+// ListFailedServices lists failed units of unitType with the result and
+// exit status of their last run.
+func ListFailedServices(unitType string, dryRun bool) ([]models.ServiceInfo, string, error) {
+	message := dryRunMessage("service.failed", dryRun)
+
+	services, err := listUnitsOfType(unitType, []string{"failed"})
+	if err != nil || len(services) == 0 {
+		return services, message, err
+	}
+
+	names := make([]string, 0, len(services))
+	for _, svc := range services {
+		names = append(names, svc.Name)
+	}
+	results, err := manager.UnitResults(names)
+	if err != nil {
+		return nil, message, err
+	}
+	for i, result := range results {
+		services[i].Result = result.Result
+		services[i].ExitCode = result.ExitCode
+		services[i].ExitStatus = result.ExitStatus
+	}
+	return services, message, nil
+}
+
+// ResetFailedServices clears the failed state of a unit, or of every failed
+// unit when name is empty. A dry run lists the units that would be reset.
+func ResetFailedServices(name string, dryRun bool) ([]string, []string, string, error) {
+	cmd := []string{"systemctl", "reset-failed"}
+	if name != "" {
+		cmd = append(cmd, name)
+	}
+	if dryRun {
+		unitType := AllUnitTypes
+		if name != "" {
+			unitType = UnitType(name)
+		}
+		failed, err := listUnitsOfType(unitType, []string{"failed"})
+		if err != nil {
+			return cmd, nil, "", err
+		}
+		var changes []string
+		for _, svc := range failed {
+			if name == "" || svc.Name == name {
+				changes = append(changes, fmt.Sprintf("reset %s", svc.Name))
+			}
+		}
+		if len(changes) == 0 {
+			changes = append(changes, "no failed units to reset")
+		}
+		return cmd, changes, fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " ")), nil
+	}
+
+	if err := manager.ResetFailed(name); err != nil {
+		return cmd, nil, "", err
+	}
+	if name == "" {
+		return cmd, nil, "failed state reset for all units", nil
+	}
+	return cmd, nil, fmt.Sprintf("failed state reset: %s", name), nil
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/models"
+)
+
+const (
+	// ScriptsDir holds the scripts job.run may launch.
+	ScriptsDir = "/etc/tunapanel/scripts.d"
+
+	jobUnitPrefix = "tunapanel-job-"
+	jobIDBytes    = 6
+	maxJobs       = 100
+)
+
+// jobProperties cap every job. RuntimeMaxSec stops scripts that hang.
+var jobProperties = []UnitProperty{
+	{Name: "CPUQuota", Value: "100%"},
+	{Name: "MemoryMax", Value: "1G"},
+	{Name: "TasksMax", Value: "256"},
+	{Name: "RuntimeMaxSec", Value: "3600"},
+}
+
+var (
+	scriptNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	jobIDPattern      = regexp.MustCompile(`^[0-9a-f]{12}$`)
+)
+
+// scriptStore lists the scripts job.run may launch. The agent reads
+// ScriptsDir; the simulator has a fixed set.
+type scriptStore interface {
+	Scripts() ([]string, error)
+}
+
+func scriptSource() scriptStore {
+	if store, ok := manager.(scriptStore); ok {
+		return store
+	}
+	return hostScripts{}
+}
+
+// hostScripts is the scriptStore backed by ScriptsDir.
+type hostScripts struct{}
+
+// Scripts lists the regular files in ScriptsDir that root owns and can
+// execute and that nobody else can change. Symlinks are skipped.
+func (hostScripts) Scripts() ([]string, error) {
+	entries, err := os.ReadDir(ScriptsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []string
+	for _, entry := range entries {
+		if !scriptNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(ScriptsDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		perm := info.Mode().Perm()
+		if info.Mode().IsRegular() && perm&0100 != 0 && perm&0022 == 0 && ownedByRoot(info) {
+			scripts = append(scripts, entry.Name())
+		}
+	}
+	sort.Strings(scripts)
+	return scripts, nil
+}
+
+// jobs remembers the jobs started since the agent came up, oldest first.
+var (
+	jobsMu sync.Mutex
+	jobs   []models.JobInfo
+)
+
+// NormalizeScriptName validates a script name; it must name a file directly
+// in ScriptsDir.
+func NormalizeScriptName(input string) (string, error) {
+	name := strings.TrimSpace(input)
+	if name == "" {
+		return "", errors.New("script name is required")
+	}
+	if !scriptNamePattern.MatchString(name) {
+		return "", errors.New("invalid script name")
+	}
+	return name, nil
+}
+
+// NormalizeJobID validates a job ID as returned by job.run.
+func NormalizeJobID(input string) (string, error) {
+	id := strings.TrimSpace(input)
+	if id == "" {
+		return "", errors.New("job id is required")
+	}
+	if !jobIDPattern.MatchString(id) {
+		return "", errors.New("invalid job id")
+	}
+	return id, nil
+}
+
+// ListScripts returns the scripts job.run accepts.
+func ListScripts(dryRun bool) ([]string, string, error) {
+	scripts, err := scriptSource().Scripts()
+	return scripts, dryRunMessage("job.scripts", dryRun), err
+}
+
+func systemdRunCommand(unit string, description string, argv []string, props []UnitProperty) []string {
+	cmd := []string{"systemd-run", "--unit=" + unit, "--description=" + description}
+	for _, prop := range props {
+		cmd = append(cmd, "--property="+prop.String())
+	}
+	return append(append(cmd, "--"), argv...)
+}
+
+// RunJob starts an allowlisted script as a transient service with the
+// limits in jobProperties. uid is recorded as the job's owner.
+func RunJob(script string, uid int, dryRun bool) (models.JobInfo, []string, string, error) {
+	scripts, err := scriptSource().Scripts()
+	if err != nil {
+		return models.JobInfo{}, nil, "", err
+	}
+	if !containsString(scripts, script) {
+		return models.JobInfo{}, nil, "", fmt.Errorf("script not found: %s", script)
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return models.JobInfo{}, nil, "", err
+	}
+	job := models.JobInfo{
+		ID:        id,
+		Script:    script,
+		Unit:      jobUnitPrefix + id + ".service",
+		UID:       uid,
+		StartedAt: time.Now(),
+	}
+	description := "tunapanel job " + script
+	argv := []string{filepath.Join(ScriptsDir, script)}
+	cmd := systemdRunCommand(job.Unit, description, argv, jobProperties)
+	if dryRun {
+		return job, cmd, fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " ")), nil
+	}
+
+	if err := manager.RunTransient(job.Unit, description, argv, jobProperties); err != nil {
+		return job, cmd, "", err
+	}
+	job.ActiveState, job.SubState = "active", "running"
+
+	jobsMu.Lock()
+	jobs = append(jobs, job)
+	if len(jobs) > maxJobs {
+		jobs = jobs[len(jobs)-maxJobs:]
+	}
+	jobsMu.Unlock()
+
+	return job, cmd, fmt.Sprintf("job %s started: %s", id, script), nil
+}
+
+// JobStatus returns a job's state and the last q.Lines lines of its output.
+// Jobs started before the agent restarted are found as long as their unit
+// is still loaded.
+func JobStatus(id string, q LogQuery, dryRun bool) (models.JobInfo, []models.LogEntry, string, error) {
+	message := dryRunMessage("job.status", dryRun)
+
+	job, known := findJob(id)
+	status, err := manager.ShowUnit(job.Unit)
+	if err != nil {
+		return job, nil, message, err
+	}
+	if status.LoadState == "not-found" {
+		if !known {
+			return job, nil, message, fmt.Errorf("job not found: %s", id)
+		}
+		job.ActiveState, job.SubState, job.Result = "inactive", "dead", "success"
+	} else {
+		job.ActiveState, job.SubState = status.ActiveState, status.SubState
+		if job.Script == "" {
+			job.Script = strings.TrimPrefix(status.Description, "tunapanel job ")
+		}
+		if err := addJobResults([]*models.JobInfo{&job}); err != nil {
+			return job, nil, message, err
+		}
+	}
+
+	logs, _, err := ServiceLogs(job.Unit, q, false)
+	if err != nil {
+		return job, nil, message, err
+	}
+	return job, logs, message, nil
+}
+
+// ListJobs returns the jobs started since the agent came up, newest first.
+func ListJobs(dryRun bool) ([]models.JobInfo, string, error) {
+	message := dryRunMessage("job.list", dryRun)
+
+	jobsMu.Lock()
+	list := make([]models.JobInfo, len(jobs))
+	copy(list, jobs)
+	jobsMu.Unlock()
+	if len(list) == 0 {
+		return nil, message, nil
+	}
+
+	units, err := manager.ListUnits("service", nil)
+	if err != nil {
+		return nil, message, err
+	}
+	loaded := make(map[string]models.ServiceInfo)
+	for _, unit := range units {
+		if strings.HasPrefix(unit.Name, jobUnitPrefix) {
+			loaded[unit.Name] = unit
+		}
+	}
+
+	var pending []*models.JobInfo
+	for i := range list {
+		job := &list[i]
+		if unit, ok := loaded[job.Unit]; ok {
+			job.ActiveState, job.SubState = unit.ActiveState, unit.SubState
+			pending = append(pending, job)
+		} else {
+			job.ActiveState, job.SubState, job.Result = "inactive", "dead", "success"
+		}
+	}
+	if err := addJobResults(pending); err != nil {
+		return nil, message, err
+	}
+
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, message, nil
+}
+
+func findJob(id string) (models.JobInfo, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, job := range jobs {
+		if job.ID == id {
+			return job, true
+		}
+	}
+	return models.JobInfo{ID: id, Unit: jobUnitPrefix + id + ".service"}, false
+}
+
+// addJobResults fills in how loaded job units ended. Jobs that are still
+// running have no result yet.
+func addJobResults(list []*models.JobInfo) error {
+	var ended []*models.JobInfo
+	var names []string
+	for _, job := range list {
+		if job.ActiveState == "inactive" || job.ActiveState == "failed" {
+			ended = append(ended, job)
+			names = append(names, job.Unit)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	results, err := manager.UnitResults(names)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if i < len(ended) {
+			ended[i].Result = result.Result
+			ended[i].ExitCode = result.ExitCode
+			ended[i].ExitStatus = result.ExitStatus
+		}
+	}
+	return nil
+}
+
+func newJobID() (string, error) {
+	var buf [jobIDBytes]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
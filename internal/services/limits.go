@@ -0,0 +1,267 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"tunapanel/internal/models"
+)
+
+// ResourceProperties are the unit properties service.set-property may
+// change, in the order they are applied and shown.
+var ResourceProperties = []string{"CPUQuota", "MemoryMax", "MemoryHigh", "TasksMax", "IOWeight"}
+
+// UnitProperty is a property assignment in systemctl set-property syntax. An
+// empty Value resets the property to its default.
+type UnitProperty struct {
+	Name  string
+	Value string
+}
+
+func (p UnitProperty) String() string {
+	return p.Name + "=" + p.Value
+}
+
+const (
+	maxCPUQuotaPercent = 100000
+	minIOWeight        = 1
+	maxIOWeight        = 10000
+)
+
+// NormalizeProperties validates property assignments against
+// ResourceProperties and returns them in that order. Property names are
+// matched case-insensitively.
+func NormalizeProperties(input map[string]string) ([]UnitProperty, error) {
+	if len(input) == 0 {
+		return nil, fmt.Errorf("at least one property is required")
+	}
+
+	values := make(map[string]string, len(input))
+	for key, value := range input {
+		name := canonicalProperty(strings.TrimSpace(key))
+		if name == "" {
+			return nil, fmt.Errorf("unsupported property %q (allowed: %s)", key, strings.Join(ResourceProperties, ", "))
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("property %s given twice", name)
+		}
+		normalized, err := normalizePropertyValue(name, strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		values[name] = normalized
+	}
+
+	props := make([]UnitProperty, 0, len(values))
+	for _, name := range ResourceProperties {
+		if value, ok := values[name]; ok {
+			props = append(props, UnitProperty{Name: name, Value: value})
+		}
+	}
+	return props, nil
+}
+
+func canonicalProperty(key string) string {
+	for _, name := range ResourceProperties {
+		if strings.EqualFold(key, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func normalizePropertyValue(name string, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	invalid := fmt.Errorf("invalid %s value %q", name, value)
+
+	switch name {
+	case "CPUQuota":
+		pct, ok := parsePercent(value)
+		if !ok || pct == 0 || pct > maxCPUQuotaPercent {
+			return "", invalid
+		}
+		return strconv.FormatUint(pct, 10) + "%", nil
+	case "MemoryMax", "MemoryHigh":
+		if value == "infinity" {
+			return value, nil
+		}
+		// A zero limit would kill the unit's processes outright.
+		if pct, ok := parsePercent(value); ok {
+			if pct == 0 || pct > 100 {
+				return "", invalid
+			}
+			return value, nil
+		}
+		if n, ok := parseBytes(value); !ok || n == 0 {
+			return "", invalid
+		}
+		return strings.ToUpper(value), nil
+	case "TasksMax":
+		if value == "infinity" {
+			return value, nil
+		}
+		if pct, ok := parsePercent(value); ok {
+			if pct == 0 || pct > 100 {
+				return "", invalid
+			}
+			return value, nil
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || n == 0 {
+			return "", invalid
+		}
+		return value, nil
+	case "IOWeight":
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || n < minIOWeight || n > maxIOWeight {
+			return "", fmt.Errorf("invalid IOWeight value %q (must be %d-%d)", value, minIOWeight, maxIOWeight)
+		}
+		return value, nil
+	}
+	return "", invalid
+}
+
+// parsePercent parses a whole percentage such as "50%".
+func parsePercent(value string) (uint64, bool) {
+	digits, ok := strings.CutSuffix(value, "%")
+	if !ok {
+		return 0, false
+	}
+	pct, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pct, true
+}
+
+var byteSuffixes = []string{"K", "M", "G", "T"}
+
+// parseBytes parses a byte count with an optional base-1024 K, M, G or T
+// suffix, the way systemd does.
+func parseBytes(value string) (uint64, bool) {
+	multiplier := uint64(1)
+	digits := value
+	for i, suffix := range byteSuffixes {
+		if trimmed, ok := strings.CutSuffix(strings.ToUpper(value), suffix); ok {
+			digits = trimmed
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0, false
+	}
+	return n * multiplier, true
+}
+
+// formatBytes prints a byte count with the largest suffix that divides it
+// exactly.
+func formatBytes(n uint64) string {
+	for i := len(byteSuffixes) - 1; i >= 0; i-- {
+		size := uint64(1) << (10 * (i + 1))
+		if n >= size && n%size == 0 {
+			return strconv.FormatUint(n/size, 10) + byteSuffixes[i]
+		}
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// unsetLimit is how systemd reports a limit that is not set or infinite.
+const unsetLimit = ^uint64(0)
+
+// resourceLimits converts the raw cgroup properties systemd reports into
+// set-property syntax. Unset and infinite limits are left empty.
+func resourceLimits(cpuQuotaUSec, memoryMax, memoryHigh, tasksMax, ioWeight uint64) models.ResourceLimits {
+	var limits models.ResourceLimits
+	if cpuQuotaUSec != unsetLimit {
+		// CPUQuotaPerSecUSec is the CPU time allowed per second of
+		// wall clock time; 10ms per second is 1%.
+		limits.CPUQuota = strconv.FormatUint(cpuQuotaUSec/10000, 10) + "%"
+	}
+	if memoryMax != unsetLimit {
+		limits.MemoryMax = formatBytes(memoryMax)
+	}
+	if memoryHigh != unsetLimit {
+		limits.MemoryHigh = formatBytes(memoryHigh)
+	}
+	if tasksMax != unsetLimit {
+		limits.TasksMax = strconv.FormatUint(tasksMax, 10)
+	}
+	if ioWeight != unsetLimit && ioWeight != 0 {
+		limits.IOWeight = strconv.FormatUint(ioWeight, 10)
+	}
+	return limits
+}
+
+// limitValue returns the effective value of a ResourceProperties entry.
+func limitValue(limits models.ResourceLimits, name string) string {
+	switch name {
+	case "CPUQuota":
+		return limits.CPUQuota
+	case "MemoryMax":
+		return limits.MemoryMax
+	case "MemoryHigh":
+		return limits.MemoryHigh
+	case "TasksMax":
+		return limits.TasksMax
+	case "IOWeight":
+		return limits.IOWeight
+	}
+	return ""
+}
+
+func setPropertyCommand(name string, props []UnitProperty, runtime bool) []string {
+	cmd := []string{"systemctl", "set-property"}
+	if runtime {
+		cmd = append(cmd, "--runtime")
+	}
+	cmd = append(cmd, name)
+	for _, prop := range props {
+		cmd = append(cmd, prop.String())
+	}
+	return cmd
+}
+
+// SetServiceProperties changes resource limits of a running unit. Runtime
+// changes are lost at reboot; otherwise systemd persists them in a drop-in
+// under /etc/systemd/system.control. A dry run lists each limit's current
+// and new value.
+func SetServiceProperties(name string, props []UnitProperty, runtime bool, dryRun bool) ([]string, []string, string, error) {
+	cmd := setPropertyCommand(name, props, runtime)
+	if dryRun {
+		status, err := manager.ShowUnit(name)
+		if err != nil {
+			return cmd, nil, "", err
+		}
+		changes := make([]string, 0, len(props))
+		for _, prop := range props {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", prop.Name, orUnset(limitValue(status.Limits, prop.Name)), orUnset(prop.Value)))
+		}
+		return cmd, changes, fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " ")), nil
+	}
+
+	if err := manager.SetProperties(name, props, runtime); err != nil {
+		return cmd, nil, "", err
+	}
+	names := make([]string, 0, len(props))
+	for _, prop := range props {
+		names = append(names, prop.Name)
+	}
+	scope := "persistently"
+	if runtime {
+		scope = "until reboot"
+	}
+	return cmd, nil, fmt.Sprintf("%s set %s: %s", strings.Join(names, ", "), scope, name), nil
+}
+
+func orUnset(value string) string {
+	if value == "" {
+		return "unset"
+	}
+	return value
+}
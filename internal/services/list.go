@@ -0,0 +1,93 @@
+package services
+
+import (
+	"tunapanel/internal/models"
+)
+
+// ListEnabledServices joins the enabled unit files of unitType with the
+// runtime state of the loaded units so that every row carries the full set
+// of columns.
+func ListEnabledServices(unitType string, dryRun bool) ([]models.ServiceInfo, string, error) {
+	message := dryRunMessage("service.list", dryRun)
+
+	var files, units []models.ServiceInfo
+	for _, t := range expandUnitType(unitType) {
+		typeFiles, err := manager.ListUnitFiles(t, []string{"enabled"})
+		if err != nil {
+			return nil, message, err
+		}
+		typeUnits, err := manager.ListUnits(t, nil)
+		if err != nil {
+			return nil, message, err
+		}
+		files = append(files, typeFiles...)
+		units = append(units, typeUnits...)
+	}
+
+	loaded := make(map[string]models.ServiceInfo, len(units))
+	for _, unit := range units {
+		loaded[unit.Name] = unit
+	}
+	for i, file := range files {
+		if unit, ok := loaded[file.Name]; ok {
+			unit.UnitFileState = file.UnitFileState
+			files[i] = unit
+		}
+	}
+
+	return files, message, nil
+}
+
+// ListRunningServices lists active units. Only services have a "running"
+// sub state; other types are listed when their active state is active.
+func ListRunningServices(unitType string, dryRun bool) ([]models.ServiceInfo, string, error) {
+	message := dryRunMessage("service.running", dryRun)
+
+	var services []models.ServiceInfo
+	for _, t := range expandUnitType(unitType) {
+		state := "running"
+		if t != "service" {
+			state = "active"
+		}
+		list, err := manager.ListUnits(t, []string{state})
+		if err != nil {
+			return nil, message, err
+		}
+		services = append(services, list...)
+	}
+	return services, message, nil
+}
+
+func ListAllServices(unitType string, dryRun bool) ([]models.ServiceInfo, string, error) {
+	services, err := listUnitsOfType(unitType, nil)
+	return services, dryRunMessage("service.all", dryRun), err
+}
+
+// expandUnitType turns the AllUnitTypes filter into the list of managed
+// types.
+func expandUnitType(unitType string) []string {
+	if unitType == AllUnitTypes {
+		return UnitTypes
+	}
+	return []string{unitType}
+}
+
+// listUnitsOfType is manager.ListUnits with AllUnitTypes expanded.
+func listUnitsOfType(unitType string, states []string) ([]models.ServiceInfo, error) {
+	var units []models.ServiceInfo
+	for _, t := range expandUnitType(unitType) {
+		list, err := manager.ListUnits(t, states)
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, list...)
+	}
+	return units, nil
+}
+
+func dryRunMessage(command string, dryRun bool) string {
+	if !dryRun {
+		return ""
+	}
+	return "dry-run has no effect on " + command
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunapanel/internal/executor"
+	"tunapanel/internal/models"
+)
+
+const (
+	defaultLogLines = 100
+	maxLogLines     = 1000
+	maxLogLineBytes = 1024 * 1024
+)
+
+var (
+	// journalTimePattern accepts the absolute and relative forms described in
+	// systemd.time(7), e.g. "2026-01-15 10:00", "-1h", "yesterday".
+	journalTimePattern = regexp.MustCompile(`^[0-9A-Za-z :.+-]{1,64}$`)
+	// journalSpanPattern matches a bare time span such as "1h" or "30min",
+	// which is interpreted as "that long ago".
+	journalSpanPattern = regexp.MustCompile(`^([0-9]+\s*[a-z]+\s*)+$`)
+)
+
+var journalPriorities = map[string]int{
+	"emerg":   0,
+	"alert":   1,
+	"crit":    2,
+	"err":     3,
+	"warning": 4,
+	"notice":  5,
+	"info":    6,
+	"debug":   7,
+}
+
+type LogQuery struct {
+	Since    string
+	Until    string
+	Lines    int
+	Priority string
+}
+
+// NormalizeLogQuery validates a log query and fills in defaults.
+func NormalizeLogQuery(q LogQuery) (LogQuery, error) {
+	var err error
+	if q.Since, err = normalizeJournalTime(q.Since); err != nil {
+		return q, fmt.Errorf("invalid since: %w", err)
+	}
+	if q.Until, err = normalizeJournalTime(q.Until); err != nil {
+		return q, fmt.Errorf("invalid until: %w", err)
+	}
+
+	switch {
+	case q.Lines < 0:
+		return q, errors.New("lines must not be negative")
+	case q.Lines == 0:
+		q.Lines = defaultLogLines
+	case q.Lines > maxLogLines:
+		q.Lines = maxLogLines
+	}
+
+	if q.Priority != "" {
+		low, high, isRange := strings.Cut(q.Priority, "..")
+		if !validPriority(low) || (isRange && !validPriority(high)) {
+			return q, errors.New("invalid priority")
+		}
+	}
+	return q, nil
+}
+
+func validPriority(value string) bool {
+	if _, ok := journalPriorities[value]; ok {
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	return err == nil && n >= 0 && n <= 7
+}
+
+func normalizeJournalTime(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if !journalTimePattern.MatchString(value) {
+		return "", errors.New("unsupported time format")
+	}
+	if journalSpanPattern.MatchString(value) {
+		return "-" + strings.ReplaceAll(value, " ", ""), nil
+	}
+	return value, nil
+}
+
+func journalctlCommand(name string, q LogQuery) []string {
+	cmd := []string{
+		"journalctl",
+		"--unit=" + name,
+		"--output=json",
+		"--no-pager",
+		"--lines=" + strconv.Itoa(q.Lines),
+	}
+	if q.Since != "" {
+		cmd = append(cmd, "--since="+q.Since)
+	}
+	if q.Until != "" {
+		cmd = append(cmd, "--until="+q.Until)
+	}
+	if q.Priority != "" {
+		cmd = append(cmd, "--priority="+q.Priority)
+	}
+	return cmd
+}
+
+func ServiceLogs(name string, q LogQuery, dryRun bool) ([]models.LogEntry, string, error) {
+	message := dryRunMessage("service.logs", dryRun)
+
+	if reader, ok := manager.(JournalReader); ok {
+		entries, err := reader.Logs(name, q)
+		return entries, message, err
+	}
+
+	output, err := executor.Run(journalctlCommand(name, q))
+	if err != nil {
+		return nil, message, err
+	}
+
+	entries, err := parseJournalOutput(output)
+	if err != nil {
+		return nil, message, err
+	}
+	return entries, message, nil
+}
+
+// FollowServiceLogs emits the last q.Lines entries and then every new entry
+// until ctx is cancelled or emit returns an error.
+func FollowServiceLogs(ctx context.Context, name string, q LogQuery, emit func(models.LogEntry) error) error {
+	if reader, ok := manager.(JournalReader); ok {
+		return reader.FollowLogs(ctx, name, q, emit)
+	}
+
+	cmd := append(journalctlCommand(name, q), "--follow")
+	return executor.Stream(ctx, cmd, func(line []byte) error {
+		if len(line) == 0 {
+			return nil
+		}
+		entry, err := parseJournalEntry(line)
+		if err != nil {
+			return err
+		}
+		return emit(entry)
+	})
+}
+
+func parseJournalOutput(output string) ([]models.LogEntry, error) {
+	var entries []models.LogEntry
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineBytes)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := parseJournalEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func parseJournalEntry(line []byte) (models.LogEntry, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return models.LogEntry{}, fmt.Errorf("invalid journal entry: %w", err)
+	}
+
+	entry := models.LogEntry{
+		Message:    journalField(raw["MESSAGE"]),
+		Unit:       journalField(raw["_SYSTEMD_UNIT"]),
+		Identifier: journalField(raw["SYSLOG_IDENTIFIER"]),
+		Cursor:     journalField(raw["__CURSOR"]),
+		Priority:   6,
+	}
+	if entry.Identifier == "" {
+		entry.Identifier = journalField(raw["_COMM"])
+	}
+	if usec, err := strconv.ParseInt(journalField(raw["__REALTIME_TIMESTAMP"]), 10, 64); err == nil {
+		entry.Timestamp = time.UnixMicro(usec)
+	}
+	if priority, err := strconv.Atoi(journalField(raw["PRIORITY"])); err == nil {
+		entry.Priority = priority
+	}
+	if pid, err := strconv.Atoi(journalField(raw["_PID"])); err == nil {
+		entry.PID = pid
+	}
+	return entry, nil
+}
+
+// journalField decodes a journal JSON field. journalctl encodes values that
+// are not valid UTF-8 as arrays of bytes and repeated fields as arrays of
+// strings; only the first value of a repeated field is kept.
+func journalField(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var nums []int
+	if json.Unmarshal(raw, &nums) == nil {
+		b := make([]byte, 0, len(nums))
+		for _, n := range nums {
+			b = append(b, byte(n))
+		}
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil && len(list) > 0 {
+		return journalField(list[0])
+	}
+	return ""
+}
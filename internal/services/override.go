@@ -0,0 +1,317 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"tunapanel/internal/executor"
+	"tunapanel/internal/models"
+)
+
+const (
+	defaultDropIn   = "override"
+	maxDropInBytes  = 32 * 1024
+	dropInBackupExt = ".bak"
+)
+
+var (
+	dropInNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	unitKeyPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Override describes a change to a drop-in. With neither Remove nor Revert
+// set, Content replaces the drop-in.
+type Override struct {
+	DropIn  string
+	Content string
+	Remove  bool
+	Revert  bool
+}
+
+type OverrideResult struct {
+	Path    string
+	Message string
+	Diff    string
+}
+
+// unitFileStore reads and writes unit files. The agent uses the host file
+// system; the simulator keeps its files in memory.
+type unitFileStore interface {
+	ReadUnitFile(path string) ([]byte, error)
+	WriteUnitFile(path string, data []byte) error
+	RemoveUnitFile(path string) error
+	// VerifyDropIn checks that unit still loads with content as the
+	// drop-in at path.
+	VerifyDropIn(unit string, path string, content string) error
+}
+
+func unitFiles() unitFileStore {
+	if store, ok := manager.(unitFileStore); ok {
+		return store
+	}
+	return hostFiles{}
+}
+
+// CatService returns the unit's fragment followed by its drop-ins, like
+// systemctl cat.
+func CatService(name string, dryRun bool) ([]models.UnitFile, string, error) {
+	message := dryRunMessage("service.cat", dryRun)
+
+	fragment, dropIns, err := manager.UnitPaths(name)
+	if err != nil {
+		return nil, message, err
+	}
+	if fragment == "" && len(dropIns) == 0 {
+		return nil, message, fmt.Errorf("unit file not found: %s", name)
+	}
+
+	store := unitFiles()
+	var files []models.UnitFile
+	for _, path := range append([]string{fragment}, dropIns...) {
+		if path == "" {
+			continue
+		}
+		data, err := store.ReadUnitFile(path)
+		if err != nil {
+			return nil, message, err
+		}
+		files = append(files, models.UnitFile{Path: path, Content: string(data)})
+	}
+	return files, message, nil
+}
+
+// NormalizeDropInName validates a drop-in name and appends ".conf". An empty
+// name selects "override.conf", the file systemctl edit uses.
+func NormalizeDropInName(input string) (string, error) {
+	name := strings.TrimSpace(input)
+	if name == "" {
+		name = defaultDropIn
+	}
+	name = strings.TrimSuffix(name, ".conf")
+	if !dropInNamePattern.MatchString(name) {
+		return "", errors.New("invalid drop-in name")
+	}
+	return name + ".conf", nil
+}
+
+// OverrideService writes, removes or reverts a drop-in under
+// /etc/systemd/system/<unit>.d, keeping the previous one as .bak.
+func OverrideService(name string, o Override, dryRun bool) (OverrideResult, error) {
+	var result OverrideResult
+	if o.Remove && o.Revert {
+		return result, errors.New("remove and revert are mutually exclusive")
+	}
+	dropIn, err := NormalizeDropInName(o.DropIn)
+	if err != nil {
+		return result, err
+	}
+	path := filepath.Join(unitConfigDir, name+".d", dropIn)
+	backup := path + dropInBackupExt
+	result.Path = path
+
+	store := unitFiles()
+	current, exists, err := readOptional(store, path)
+	if err != nil {
+		return result, err
+	}
+
+	var next string
+	var verb string
+	switch {
+	case o.Remove:
+		if !exists {
+			return result, fmt.Errorf("drop-in not found: %s", path)
+		}
+		verb = "remove"
+	case o.Revert:
+		previous, ok, err := readOptional(store, backup)
+		if err != nil {
+			return result, err
+		}
+		if !ok {
+			return result, fmt.Errorf("no backup to revert to: %s", backup)
+		}
+		next, verb = previous, "revert"
+	default:
+		if o.Content == "" {
+			return result, errors.New("content is required")
+		}
+		if len(o.Content) > maxDropInBytes {
+			return result, errors.New("drop-in is too large")
+		}
+		next = o.Content
+		if !strings.HasSuffix(next, "\n") {
+			next += "\n"
+		}
+		verb = "write"
+	}
+
+	// Restoring an empty backup removes the drop-in.
+	removing := next == ""
+	if !removing {
+		if err := checkUnitSyntax(next); err != nil {
+			return result, err
+		}
+		if err := store.VerifyDropIn(name, path, next); err != nil {
+			return result, err
+		}
+	}
+
+	oldName, newName := path, path
+	if !exists {
+		oldName = "/dev/null"
+	}
+	if removing {
+		newName = "/dev/null"
+	}
+	result.Diff = unifiedDiff(oldName, newName, current, next)
+
+	if dryRun {
+		result.Message = fmt.Sprintf("dry-run: would %s %s and reload systemd", verb, path)
+		return result, nil
+	}
+
+	if err := store.WriteUnitFile(backup, []byte(current)); err != nil {
+		return result, fmt.Errorf("backup %s: %w", path, err)
+	}
+	if removing {
+		if exists {
+			err = store.RemoveUnitFile(path)
+		}
+	} else {
+		err = store.WriteUnitFile(path, []byte(next))
+	}
+	if err != nil {
+		return result, err
+	}
+	if err := manager.DaemonReload(); err != nil {
+		return result, err
+	}
+
+	switch {
+	case o.Revert:
+		result.Message = fmt.Sprintf("drop-in reverted: %s", path)
+	case removing:
+		result.Message = fmt.Sprintf("drop-in removed: %s", path)
+	default:
+		result.Message = fmt.Sprintf("drop-in written: %s", path)
+	}
+	return result, nil
+}
+
+func readOptional(store unitFileStore, path string) (string, bool, error) {
+	data, err := store.ReadUnitFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// checkUnitSyntax catches the mistakes systemd would only log at reload.
+func checkUnitSyntax(content string) error {
+	inSection := false
+	continued := false
+	for i, raw := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(raw)
+		if continued {
+			continued = strings.HasSuffix(line, "\\")
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return fmt.Errorf("line %d: invalid section header", i+1)
+			}
+			inSection = true
+			continue
+		}
+		key, _, ok := strings.Cut(line, "=")
+		if !ok || !unitKeyPattern.MatchString(strings.TrimSpace(key)) {
+			return fmt.Errorf("line %d: expected Key=Value", i+1)
+		}
+		if !inSection {
+			return fmt.Errorf("line %d: assignment outside of a section", i+1)
+		}
+		continued = strings.HasSuffix(line, "\\")
+	}
+	return nil
+}
+
+// hostFiles is the unitFileStore backed by the local file system.
+type hostFiles struct{}
+
+func (hostFiles) ReadUnitFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// WriteUnitFile replaces path atomically so systemd never sees a partial
+// file.
+func (hostFiles) WriteUnitFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tunapanel-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (hostFiles) RemoveUnitFile(path string) error {
+	return os.Remove(path)
+}
+
+// VerifyDropIn runs systemd-analyze verify with the candidate drop-in in
+// place of the installed one.
+func (hostFiles) VerifyDropIn(unit string, path string, content string) error {
+	fragment, _, err := manager.UnitPaths(unit)
+	if err != nil {
+		return err
+	}
+	if fragment == "" || fragment == os.DevNull {
+		return fmt.Errorf("unit file not found: %s", unit)
+	}
+
+	dir, err := os.MkdirTemp("", "tunapanel-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	dropInDir := filepath.Join(dir, unit+".d")
+	if err := os.Mkdir(dropInDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dropInDir, filepath.Base(path)), []byte(content), 0644); err != nil {
+		return err
+	}
+
+	// A trailing colon appends the default search path.
+	cmd := []string{"env", "SYSTEMD_UNIT_PATH=" + dir + ":", "systemd-analyze", "verify", fragment}
+	if _, err := executor.Run(cmd); err != nil {
+		return fmt.Errorf("systemd-analyze verify failed: %w", err)
+	}
+	return nil
+}
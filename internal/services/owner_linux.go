@@ -0,0 +1,12 @@
+package services
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedByRoot reports whether root owns the file.
+func ownedByRoot(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Uid == 0
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package services
+
+import "os"
+
+func ownedByRoot(info os.FileInfo) bool {
+	return false
+}
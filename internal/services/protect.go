@@ -0,0 +1,126 @@
+package services
+
+import (
+	"fmt"
+	"path"
+)
+
+// DefaultProtectedUnits are the units whose loss would lock operators out of
+// the machine or out of tunapanel itself.
+var DefaultProtectedUnits = []string{
+	"tunapanel-agent.service",
+	"ssh.service",
+	"sshd.service",
+	"systemd-journald.service",
+	"systemd-logind.service",
+	"systemd-udevd.service",
+	"dbus.service",
+	"dbus.socket",
+	"dbus-broker.service",
+	"systemd-networkd.service",
+	"NetworkManager.service",
+	"networking.service",
+}
+
+var protectedUnits = DefaultProtectedUnits
+
+// SetProtectedUnits adds unit names or glob patterns to
+// DefaultProtectedUnits. It must be called before the agent starts serving
+// requests.
+func SetProtectedUnits(extra []string) error {
+	units := append([]string(nil), DefaultProtectedUnits...)
+	for _, input := range extra {
+		pattern, err := NormalizeUnitPattern(input)
+		if err != nil {
+			return fmt.Errorf("protected unit %q: %w", input, err)
+		}
+		units = append(units, pattern)
+	}
+	protectedUnits = units
+	return nil
+}
+
+// IsProtected reports whether name matches the protected unit list.
+func IsProtected(name string) bool {
+	for _, pattern := range protectedUnits {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ProtectedError refuses an action on a protected unit. Via names the unit
+// the request was for when the protected unit would only be stopped as a
+// dependent of it.
+type ProtectedError struct {
+	Unit string
+	Verb string
+	Via  string
+}
+
+func (e *ProtectedError) Error() string {
+	if e.Via != "" {
+		return fmt.Sprintf("stopping %s would also stop protected unit %s", e.Via, e.Unit)
+	}
+	return fmt.Sprintf("%s is protected and cannot be %s through tunapanel", e.Unit, protectedVerbs[e.Verb])
+}
+
+var protectedVerbs = map[string]string{
+	"stop":    "stopped",
+	"disable": "disabled",
+	"mask":    "masked",
+}
+
+// CheckProtected returns a *ProtectedError when verb (stop, disable or
+// mask) would take down a protected unit. Stopping a unit is also refused
+// when it would stop a protected unit that depends on it. Aliases of a
+// protected unit are refused too.
+func CheckProtected(verb string, name string) error {
+	if _, ok := protectedVerbs[verb]; !ok {
+		return nil
+	}
+	id, names, err := unitAliases(name)
+	if err != nil {
+		return err
+	}
+	for _, alias := range names {
+		if IsProtected(alias) {
+			return &ProtectedError{Unit: alias, Verb: verb}
+		}
+	}
+	if verb != "stop" {
+		return nil
+	}
+
+	impact, err := StopImpact(id)
+	if err != nil {
+		return err
+	}
+	for _, unit := range impact {
+		if IsProtected(unit) {
+			return &ProtectedError{Unit: unit, Verb: verb, Via: name}
+		}
+	}
+	return nil
+}
+
+// unitAliases returns the canonical Id of the unit name and every name it
+// is known by, name included.
+func unitAliases(name string) (string, []string, error) {
+	status, err := manager.ShowUnit(name)
+	if err != nil {
+		return "", nil, err
+	}
+	id := status.Name
+	if id == "" {
+		id = name
+	}
+	names := []string{name}
+	for _, alias := range append([]string{id}, status.Names...) {
+		if !containsString(names, alias) {
+			names = append(names, alias)
+		}
+	}
+	return id, names, nil
+}
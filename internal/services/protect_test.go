@@ -0,0 +1,56 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckProtectedAliases(t *testing.T) {
+	_, m := fakeSystemd(t)
+	SetManager(m)
+	t.Cleanup(func() {
+		SetManager(Systemctl{})
+		SetProtectedUnits(nil)
+	})
+
+	tests := []struct {
+		protected []string
+		verb      string
+		name      string
+		unit      string
+		via       string
+	}{
+		{[]string{"redis-server"}, "stop", "redis.service", "redis-server.service", ""},
+		{[]string{"redis-server"}, "mask", "redis", "redis-server.service", ""},
+		{[]string{"redis-server"}, "restart", "redis.service", "", ""},
+		{[]string{"redis"}, "disable", "redis-server.service", "redis.service", ""},
+		{[]string{"sessions"}, "stop", "redis.service", "sessions.service", "redis.service"},
+		{[]string{"sessions"}, "disable", "redis.service", "", ""},
+		{nil, "stop", "redis.service", "", ""},
+	}
+	for _, tt := range tests {
+		if err := SetProtectedUnits(tt.protected); err != nil {
+			t.Fatal(err)
+		}
+		name, err := NormalizeUnitName(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckProtected(tt.verb, name)
+		if tt.unit == "" {
+			if err != nil {
+				t.Errorf("%s %s with %v protected: %v", tt.verb, tt.name, tt.protected, err)
+			}
+			continue
+		}
+		var protected *ProtectedError
+		if !errors.As(err, &protected) || protected.Unit != tt.unit || protected.Via != tt.via {
+			t.Errorf("%s %s with %v protected: err = %v, want %s via %q", tt.verb, tt.name, tt.protected, err, tt.unit, tt.via)
+		}
+	}
+
+	impact, err := StopImpact("redis.service")
+	if err != nil || len(impact) != 1 || impact[0] != "sessions.service" {
+		t.Errorf("StopImpact(redis.service) = %v, %v", impact, err)
+	}
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"tunapanel/internal/models"
+)
+
+// ServiceManager is the backend that talks to systemd. Unit names passed to
+// it have already been validated with NormalizeUnitName.
+type ServiceManager interface {
+	// ListUnits lists loaded units of unitType whose load, active or sub
+	// state matches one of states; with no states every loaded unit of
+	// that type is listed.
+	ListUnits(unitType string, states []string) ([]models.ServiceInfo, error)
+	// ListUnitFiles lists installed unit files of unitType in one of
+	// states.
+	ListUnitFiles(unitType string, states []string) ([]models.ServiceInfo, error)
+	// UnitAction runs a job verb (start, stop, restart, reload,
+	// reload-or-restart, try-restart) and waits for it to complete.
+	UnitAction(verb string, name string) error
+	ShowUnit(name string) (models.ServiceStatus, error)
+	UnitFileState(name string) (string, error)
+	// ChangeUnitFile runs an enablement verb (enable, disable, mask,
+	// unmask), optionally starting or stopping the unit as well.
+	ChangeUnitFile(verb string, name string, now bool) error
+	// Dependencies returns the direct dependencies of each named unit, in
+	// the order given. Names may be units of any type.
+	Dependencies(names []string) ([]UnitDependencies, error)
+	// ListTimers lists installed and loaded timer units with their
+	// schedule.
+	ListTimers() ([]models.TimerInfo, error)
+	// UnitPaths returns the unit's fragment path and its drop-in files in
+	// the order systemd applies them.
+	UnitPaths(name string) (string, []string, error)
+	// DaemonReload makes systemd re-read all unit files.
+	DaemonReload() error
+	// UnitResults returns how each named unit last stopped, in the order
+	// given.
+	UnitResults(names []string) ([]UnitResult, error)
+	// ResetFailed clears the failed state of the named unit, or of every
+	// unit when name is empty.
+	ResetFailed(name string) error
+	// SetProperties changes resource controls of a unit, persistently or
+	// until reboot when runtime is set.
+	SetProperties(name string, props []UnitProperty, runtime bool) error
+	// RunTransient starts argv as a transient service unit with the given
+	// properties, like systemd-run.
+	RunTransient(unit string, description string, argv []string, props []UnitProperty) error
+}
+
+const (
+	BackendSystemctl = "systemctl"
+	BackendDBus      = "dbus"
+)
+
+var manager ServiceManager = Systemctl{}
+
+// NewManager returns the backend named in the agent configuration. address
+// is the D-Bus address used by the dbus backend; empty means the system bus.
+func NewManager(backend string, address string) (ServiceManager, error) {
+	switch backend {
+	case "", BackendSystemctl:
+		return Systemctl{}, nil
+	case BackendDBus:
+		return NewDBusManager(address), nil
+	default:
+		return nil, fmt.Errorf("unknown service backend %q", backend)
+	}
+}
+
+// SetManager replaces the backend used by the package-level functions. It
+// must be called before the agent starts serving requests.
+func SetManager(m ServiceManager) {
+	manager = m
+}
+
+const maxServiceNameLen = 128
+
+// UnitTypes are the unit types tunapanel manages.
+var UnitTypes = []string{"service", "socket", "path", "mount", "target", "timer"}
+
+// AllUnitTypes is the unit type filter that selects every type in
+// UnitTypes.
+const AllUnitTypes = "all"
+
+// systemdUnitTypes is every unit type systemd knows. Names ending in one of
+// them are not given a ".service" suffix.
+var systemdUnitTypes = []string{
+	"service", "socket", "device", "mount", "automount", "swap",
+	"target", "path", "timer", "slice", "scope",
+}
+
+// NormalizeUnitName validates a unit name. Names without a unit type suffix
+// are services; other types must be one of UnitTypes.
+func NormalizeUnitName(input string) (string, error) {
+	name, err := validateUnitName(input, "unit")
+	if err != nil {
+		return "", err
+	}
+	unitType := UnitType(name)
+	if unitType == "" {
+		return name + ".service", nil
+	}
+	if !containsString(UnitTypes, unitType) {
+		return "", fmt.Errorf("unsupported unit type %q", unitType)
+	}
+	return name, nil
+}
+
+// NormalizeUnitType validates a unit type filter. An empty type selects
+// services.
+func NormalizeUnitType(input string) (string, error) {
+	unitType := strings.TrimPrefix(strings.TrimSpace(input), ".")
+	if unitType == "" {
+		return "service", nil
+	}
+	if unitType != AllUnitTypes && !containsString(UnitTypes, unitType) {
+		return "", fmt.Errorf("unsupported unit type %q", unitType)
+	}
+	return unitType, nil
+}
+
+// UnitType returns the type suffix of a unit name, or "" when the name does
+// not end in a systemd unit type.
+func UnitType(name string) string {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 || !containsString(systemdUnitTypes, name[i+1:]) {
+		return ""
+	}
+	return name[i+1:]
+}
+
+// normalizeUnitName validates a unit name and appends ".<unitType>" when the
+// name has no such suffix yet.
+func normalizeUnitName(input string, unitType string) (string, error) {
+	name, err := validateUnitName(input, unitType)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(name, "."+unitType) {
+		name += "." + unitType
+	}
+	return name, nil
+}
+
+// validateUnitName checks a unit name for characters systemd does not allow
+// and for a leading dash that systemctl would take as an option. label names
+// the kind of unit in error messages.
+func validateUnitName(input string, label string) (string, error) {
+	name := strings.TrimSpace(input)
+	if name == "" {
+		return "", fmt.Errorf("%s name is required", label)
+	}
+	if strings.HasPrefix(name, "-") {
+		return "", fmt.Errorf("invalid %s name", label)
+	}
+	if len(name) > maxServiceNameLen {
+		return "", fmt.Errorf("%s name is too long", label)
+	}
+	if strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid %s name", label)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9':
+		case strings.ContainsRune("@._:-\\", r):
+		default:
+			return "", fmt.Errorf("invalid %s name", label)
+		}
+	}
+	return name, nil
+}
+
+func StartService(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("start", name, UnitType(name)+" started", dryRun)
+}
+
+func StopService(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("stop", name, UnitType(name)+" stopped", dryRun)
+}
+
+func RestartService(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("restart", name, UnitType(name)+" restarted", dryRun)
+}
+
+func ReloadService(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("reload", name, UnitType(name)+" reloaded", dryRun)
+}
+
+func ReloadOrRestartService(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("reload-or-restart", name, UnitType(name)+" reloaded or restarted", dryRun)
+}
+
+// TryRestartService restarts the unit only if it is already running.
+func TryRestartService(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("try-restart", name, UnitType(name)+" restarted if running", dryRun)
+}
+
+func runUnitAction(verb string, name string, done string, dryRun bool) ([]string, string, error) {
+	cmd := []string{"systemctl", verb, name}
+	if dryRun {
+		return cmd, fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " ")), nil
+	}
+
+	if err := manager.UnitAction(verb, name); err != nil {
+		return cmd, "", err
+	}
+
+	return cmd, fmt.Sprintf("%s: %s", done, name), nil
+}
@@ -0,0 +1,25 @@
+package services
+
+import (
+	"tunapanel/internal/models"
+)
+
+// ShowService returns a unit's status. Failed units also report how they
+// last stopped.
+func ShowService(name string, dryRun bool) (models.ServiceStatus, string, error) {
+	message := dryRunMessage("service.show", dryRun)
+	status, err := manager.ShowUnit(name)
+	if err != nil || status.ActiveState != "failed" {
+		return status, message, err
+	}
+	results, err := manager.UnitResults([]string{name})
+	if err != nil {
+		return status, message, err
+	}
+	if len(results) == 1 {
+		status.Result = results[0].Result
+		status.ExitCode = results[0].ExitCode
+		status.ExitStatus = results[0].ExitStatus
+	}
+	return status, message, nil
+}
@@ -0,0 +1,1137 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunapanel/internal/models"
+)
+
+const (
+	simulatedUnitDir   = "/usr/lib/systemd/system"
+	simulatedLogLimit  = 5000
+	simulatedChatter   = 3 * time.Second
+	simulatedFirstPID  = 4200
+	simulatedBaseBytes = 24 * 1024 * 1024
+	simulatedCrash     = 1500 * time.Millisecond
+)
+
+// JournalReader is implemented by managers that keep their own logs instead
+// of relying on journalctl.
+type JournalReader interface {
+	Logs(name string, q LogQuery) ([]models.LogEntry, error)
+	FollowLogs(ctx context.Context, name string, q LogQuery, emit func(models.LogEntry) error) error
+}
+
+// UnitFilePlanner is implemented by managers that can describe the effect
+// of an enablement change without reading the host's unit directories.
+type UnitFilePlanner interface {
+	PlanUnitFile(verb string, name string) ([]string, error)
+}
+
+type simUnit struct {
+	info     models.ServiceInfo
+	wantedBy string
+	requires []string
+	wants    []string
+
+	// Timer units only.
+	activates   string
+	interval    time.Duration
+	lastTrigger time.Time
+	mainPID     int
+	startedAt   time.Time
+	memory      uint64
+	restarts    int
+	failStart   bool
+	logs        []models.LogEntry
+
+	// result and exitStatus describe how the unit last stopped.
+	result     string
+	exitStatus int
+
+	limits models.ResourceLimits
+
+	// crashStart makes the main process exit shortly after a start.
+	crashStart bool
+}
+
+// Simulator is an in-memory ServiceManager for demos and tests on machines
+// without systemd. Units keep their state only for the lifetime of the
+// process.
+type Simulator struct {
+	mu      sync.Mutex
+	units   map[string]*simUnit
+	nextPID int
+	subs    map[chan models.LogEntry]string
+	// files holds drop-ins and their backups; fragments are generated.
+	files map[string]string
+}
+
+var simulatedSeed = []struct {
+	name        string
+	description string
+	state       string
+	enabled     string
+}{
+	{"nginx.service", "A high performance web server and a reverse proxy server", "active", "enabled"},
+	{"postgresql.service", "PostgreSQL RDBMS", "active", "enabled"},
+	{"redis-server.service", "Advanced key-value store", "active", "enabled"},
+	{"cron.service", "Regular background program processing daemon", "active", "enabled"},
+	{"ssh.service", "OpenBSD Secure Shell server", "active", "enabled"},
+	{"tunapanel-agent.service", "TUNAPANEL Agent", "active", "enabled"},
+	{"worker@1.service", "Application worker 1", "active", "enabled"},
+	{"worker@2.service", "Application worker 2", "active", "enabled"},
+	{"worker@3.service", "Application worker 3", "inactive", "disabled"},
+	{"backup.service", "Nightly backup job", "failed", "static"},
+	{"broken.service", "Service that always fails to start", "inactive", "disabled"},
+	{"flaky.service", "Service that crashes shortly after starting", "inactive", "disabled"},
+	{"legacy-ftp.service", "Legacy FTP server", "inactive", "masked"},
+	{"logrotate.service", "Rotate log files", "inactive", "static"},
+	{"certbot.service", "Certbot", "inactive", "static"},
+	{"backup.timer", "Nightly backup", "active", "enabled"},
+	{"logrotate.timer", "Daily rotation of log files", "active", "enabled"},
+	{"certbot.timer", "Run certbot twice daily", "inactive", "disabled"},
+	{"cups.socket", "CUPS Scheduler", "active", "enabled"},
+	{"cups.path", "CUPS Scheduler", "active", "enabled"},
+	{"dbus.socket", "D-Bus System Message Bus Socket", "active", "static"},
+	{"home.mount", "/home", "active", "generated"},
+	{"mnt-backup.mount", "/mnt/backup", "inactive", "generated"},
+	{"multi-user.target", "Multi-User System", "active", "static"},
+	{"graphical.target", "Graphical Interface", "inactive", "static"},
+	{"basic.target", "Basic System", "active", "static"},
+	{"sockets.target", "Socket Units", "active", "static"},
+	{"paths.target", "Path Units", "active", "static"},
+	{"local-fs.target", "Local File Systems", "active", "static"},
+	{"timers.target", "Timer Units", "active", "static"},
+}
+
+// simulatedDependencies gives the seeded units a small dependency graph:
+// stopping postgresql also stops the running workers.
+var simulatedDependencies = map[string][2][]string{
+	"nginx.service":    {nil, {"worker@1.service", "worker@2.service", "worker@3.service"}},
+	"worker@1.service": {{"postgresql.service"}, {"redis-server.service"}},
+	"worker@2.service": {{"postgresql.service"}, {"redis-server.service"}},
+	"worker@3.service": {{"postgresql.service"}, {"redis-server.service"}},
+	"backup.service":   {{"postgresql.service"}, nil},
+}
+
+// simulatedAliases maps the seeded units' Alias= names to the units.
+var simulatedAliases = map[string]string{
+	"sshd.service":  "ssh.service",
+	"redis.service": "redis-server.service",
+}
+
+// simulatedTimers gives each seeded timer the unit it activates and its
+// period.
+var simulatedTimers = map[string]struct {
+	activates string
+	interval  time.Duration
+}{
+	"backup.timer":    {"backup.service", 24 * time.Hour},
+	"logrotate.timer": {"logrotate.service", 24 * time.Hour},
+	"certbot.timer":   {"certbot.service", 12 * time.Hour},
+}
+
+// simulatedTargets gives the seeded target units the targets each one
+// requires.
+var simulatedTargets = map[string][]string{
+	"multi-user.target": {"basic.target"},
+	"graphical.target":  {"multi-user.target"},
+	"basic.target":      {"sockets.target", "paths.target", "local-fs.target"},
+}
+
+// simulatedInstallTargets is the target that units of a type are installed
+// into; the rest go into multi-user.target.
+var simulatedInstallTargets = map[string]string{
+	"socket": "sockets.target",
+	"path":   "paths.target",
+	"timer":  "timers.target",
+}
+
+// simulatedScripts are the job scripts the simulator offers, with the lines
+// each one prints and its exit status.
+var simulatedScripts = map[string]struct {
+	output     []string
+	exitStatus int
+}{
+	"purge-cache":    {[]string{"purging /var/cache/app", "removed 1432 files (212M)"}, 0},
+	"migrate-db":     {[]string{"applying 0042_add_index", "applying 0043_backfill_totals", "2 migrations applied"}, 0},
+	"reindex-search": {[]string{"rebuilding index products", "error: search cluster unreachable"}, 2},
+}
+
+// simulatedActiveSubStates is the sub state of an active unit of each type
+// other than service.
+var simulatedActiveSubStates = map[string]string{
+	"socket": "listening",
+	"path":   "waiting",
+	"mount":  "mounted",
+	"target": "active",
+	"timer":  "waiting",
+}
+
+// NewSimulator returns a simulator seeded with a handful of typical units.
+// Starting any unit named in failing (or broken.service) fails.
+func NewSimulator(failing []string) *Simulator {
+	s := &Simulator{
+		units:   make(map[string]*simUnit),
+		nextPID: simulatedFirstPID,
+		subs:    make(map[chan models.LogEntry]string),
+		files:   make(map[string]string),
+	}
+
+	now := time.Now()
+	for i, seed := range simulatedSeed {
+		u := &simUnit{
+			info: models.ServiceInfo{
+				Name:          seed.name,
+				LoadState:     "loaded",
+				Description:   seed.description,
+				UnitFileState: seed.enabled,
+			},
+			wantedBy:   "multi-user.target",
+			failStart:  seed.name == "broken.service",
+			crashStart: seed.name == "flaky.service",
+		}
+		if target, ok := simulatedInstallTargets[UnitType(seed.name)]; ok {
+			u.wantedBy = target
+		}
+		if seed.enabled == "masked" {
+			u.info.LoadState = "masked"
+		}
+		if deps, ok := simulatedDependencies[seed.name]; ok {
+			u.requires, u.wants = deps[0], deps[1]
+		}
+		if seed.enabled == "static" || seed.enabled == "generated" {
+			u.wantedBy = ""
+		}
+		if timer, ok := simulatedTimers[seed.name]; ok {
+			u.activates, u.interval = timer.activates, timer.interval
+			if seed.state == "active" {
+				u.lastTrigger = now.Truncate(timer.interval)
+			}
+		}
+		s.units[seed.name] = u
+
+		switch seed.state {
+		case "active":
+			u.startedAt = now.Add(-time.Duration(i+1) * 97 * time.Minute)
+			s.setRunning(u, u.startedAt)
+			s.logLocked(u, u.startedAt, 1, 6, fmt.Sprintf("Started %s.", seed.description))
+		case "failed":
+			at := now.Add(-6 * time.Hour)
+			u.info.ActiveState, u.info.SubState = "failed", "failed"
+			u.result, u.exitStatus = "exit-code", 1
+			s.logLocked(u, at, 1, 6, fmt.Sprintf("Starting %s...", seed.description))
+			s.logLocked(u, at.Add(2*time.Second), simulatedFirstPID, 3, "destination /mnt/backup is not mounted")
+			s.logLocked(u, at.Add(2*time.Second), 1, 4, fmt.Sprintf("%s: Main process exited, code=exited, status=1/FAILURE", seed.name))
+			s.logLocked(u, at.Add(2*time.Second), 1, 3, fmt.Sprintf("%s: Failed with result 'exit-code'.", seed.name))
+		default:
+			u.info.ActiveState, u.info.SubState = "inactive", "dead"
+		}
+	}
+
+	for _, name := range failing {
+		name, err := NormalizeUnitName(name)
+		if err != nil {
+			continue
+		}
+		if u, ok := s.units[name]; ok {
+			u.failStart = true
+		}
+	}
+	return s
+}
+
+func (s *Simulator) unit(name string) (*simUnit, error) {
+	u, ok := s.units[simulatedName(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unit %s not found.", name)
+	}
+	return u, nil
+}
+
+// simulatedName resolves an alias to the name of the unit it points to.
+func simulatedName(name string) string {
+	if target, ok := simulatedAliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// setRunning activates a unit. Only services get a main process.
+func (s *Simulator) setRunning(u *simUnit, at time.Time) {
+	u.startedAt = at
+	if sub, ok := simulatedActiveSubStates[UnitType(u.info.Name)]; ok {
+		u.info.ActiveState, u.info.SubState = "active", sub
+		return
+	}
+	s.nextPID += 7
+	u.mainPID = s.nextPID
+	u.memory = simulatedBaseBytes + uint64(len(u.info.Name))*1024*1024
+	u.info.ActiveState, u.info.SubState = "active", "running"
+}
+
+func (s *Simulator) setStopped(u *simUnit) {
+	u.mainPID = 0
+	u.memory = 0
+	u.startedAt = time.Time{}
+	u.info.ActiveState, u.info.SubState = "inactive", "dead"
+}
+
+// logLocked appends a journal entry and hands it to followers. Entries
+// with pid 1 are attributed to systemd, others to the unit's own process.
+// The caller holds s.mu.
+func (s *Simulator) logLocked(u *simUnit, at time.Time, pid int, priority int, message string) {
+	identifier := "systemd"
+	if pid != 1 {
+		identifier = strings.TrimSuffix(u.info.Name, ".service")
+		if i := strings.IndexByte(identifier, '@'); i >= 0 {
+			identifier = identifier[:i]
+		}
+	}
+	entry := models.LogEntry{
+		Timestamp:  at,
+		Priority:   priority,
+		Unit:       u.info.Name,
+		Identifier: identifier,
+		PID:        pid,
+		Message:    message,
+		Cursor:     strconv.FormatInt(at.UnixNano(), 36),
+	}
+	u.logs = append(u.logs, entry)
+	if len(u.logs) > simulatedLogLimit {
+		u.logs = u.logs[len(u.logs)-simulatedLogLimit:]
+	}
+	for ch, unit := range s.subs {
+		if unit != u.info.Name {
+			continue
+		}
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+func (s *Simulator) ListUnits(unitType string, states []string) ([]models.ServiceInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []models.ServiceInfo
+	for _, u := range s.units {
+		if UnitType(u.info.Name) != unitType {
+			continue
+		}
+		if len(states) > 0 && !matchesState(u.info, states) {
+			continue
+		}
+		info := u.info
+		info.UnitFileState = ""
+		list = append(list, info)
+	}
+	sortServices(list)
+	return list, nil
+}
+
+func (s *Simulator) ListUnitFiles(unitType string, states []string) ([]models.ServiceInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []models.ServiceInfo
+	for _, u := range s.units {
+		if UnitType(u.info.Name) != unitType {
+			continue
+		}
+		if len(states) > 0 && !containsString(states, u.info.UnitFileState) {
+			continue
+		}
+		list = append(list, models.ServiceInfo{Name: u.info.Name, UnitFileState: u.info.UnitFileState})
+	}
+	sortServices(list)
+	return list, nil
+}
+
+func (s *Simulator) UnitAction(verb string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.unit(name)
+	if err != nil {
+		return err
+	}
+	if u.info.UnitFileState == "masked" && verb != "stop" {
+		return fmt.Errorf("Unit %s is masked.", name)
+	}
+
+	active := u.info.ActiveState == "active"
+	switch verb {
+	case "start":
+		if active {
+			return nil
+		}
+		return s.start(u)
+	case "stop":
+		s.stop(u)
+		return nil
+	case "restart":
+		s.stop(u)
+		return s.start(u)
+	case "try-restart":
+		if !active {
+			return nil
+		}
+		s.stop(u)
+		return s.start(u)
+	case "reload":
+		if !active {
+			return fmt.Errorf("Job for %s failed: unit is not active.", name)
+		}
+		s.logLocked(u, time.Now(), 1, 6, fmt.Sprintf("Reloading %s...", u.info.Description))
+		s.logLocked(u, time.Now(), 1, 6, fmt.Sprintf("Reloaded %s.", u.info.Description))
+		return nil
+	case "reload-or-restart":
+		if active {
+			s.logLocked(u, time.Now(), 1, 6, fmt.Sprintf("Reloaded %s.", u.info.Description))
+			return nil
+		}
+		return s.start(u)
+	}
+	return fmt.Errorf("unsupported unit action %q", verb)
+}
+
+func (s *Simulator) start(u *simUnit) error {
+	now := time.Now()
+	s.logLocked(u, now, 1, 6, fmt.Sprintf("Starting %s...", u.info.Description))
+	if u.failStart {
+		s.nextPID += 7
+		u.info.ActiveState, u.info.SubState = "failed", "failed"
+		u.result, u.exitStatus = "exit-code", 1
+		u.mainPID = 0
+		s.logLocked(u, now, s.nextPID, 3, "simulated startup failure")
+		s.logLocked(u, now, 1, 4, fmt.Sprintf("%s: Main process exited, code=exited, status=1/FAILURE", u.info.Name))
+		s.logLocked(u, now, 1, 3, fmt.Sprintf("%s: Failed with result 'exit-code'.", u.info.Name))
+		return fmt.Errorf("Job for %s failed because the control process exited with error code.", u.info.Name)
+	}
+	s.setRunning(u, now)
+	u.result, u.exitStatus = "success", 0
+	s.logLocked(u, now, 1, 6, fmt.Sprintf("Started %s.", u.info.Description))
+	if u.crashStart {
+		pid := u.mainPID
+		time.AfterFunc(simulatedCrash, func() { s.crash(u, pid) })
+	}
+	return nil
+}
+
+// crash fails the unit if pid is still its main process.
+func (s *Simulator) crash(u *simUnit, pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u.mainPID != pid {
+		return
+	}
+	now := time.Now()
+	s.logLocked(u, now, pid, 3, "bind() to 0.0.0.0:8081 failed (98: Address already in use)")
+	s.logLocked(u, now, 1, 4, fmt.Sprintf("%s: Main process exited, code=exited, status=1/FAILURE", u.info.Name))
+	s.logLocked(u, now, 1, 3, fmt.Sprintf("%s: Failed with result 'exit-code'.", u.info.Name))
+	s.setStopped(u)
+	u.info.ActiveState, u.info.SubState = "failed", "failed"
+	u.result, u.exitStatus = "exit-code", 1
+}
+
+func (s *Simulator) stop(u *simUnit) {
+	if u.info.ActiveState != "active" {
+		if u.info.ActiveState == "failed" {
+			u.info.ActiveState, u.info.SubState = "inactive", "dead"
+		}
+		return
+	}
+	s.logLocked(u, time.Now(), 1, 6, fmt.Sprintf("Stopping %s...", u.info.Description))
+	s.setStopped(u)
+	s.logLocked(u, time.Now(), 1, 6, fmt.Sprintf("Stopped %s.", u.info.Description))
+}
+
+func (s *Simulator) ShowUnit(name string) (models.ServiceStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.units[simulatedName(name)]
+	if !ok {
+		return models.ServiceStatus{
+			Name:        name,
+			LoadState:   "not-found",
+			ActiveState: "inactive",
+			SubState:    "dead",
+		}, nil
+	}
+
+	status := models.ServiceStatus{
+		Name:          u.info.Name,
+		Names:         []string{u.info.Name},
+		Description:   u.info.Description,
+		LoadState:     u.info.LoadState,
+		ActiveState:   u.info.ActiveState,
+		SubState:      u.info.SubState,
+		MainPID:       u.mainPID,
+		MemoryCurrent: u.memory,
+		NRestarts:     u.restarts,
+		FragmentPath:  filepath.Join(simulatedUnitDir, u.info.Name),
+	}
+	for alias, target := range simulatedAliases {
+		if target == u.info.Name {
+			status.Names = append(status.Names, alias)
+		}
+	}
+	sort.Strings(status.Names[1:])
+	if u.info.UnitFileState == "masked" {
+		status.FragmentPath = ""
+	}
+	if !u.startedAt.IsZero() {
+		started := u.startedAt
+		status.ExecMainStartTimestamp = &started
+	}
+	status.Limits = u.limits
+	return status, nil
+}
+
+func (s *Simulator) UnitFileState(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.unit(name)
+	if err != nil {
+		return "", err
+	}
+	return u.info.UnitFileState, nil
+}
+
+func (s *Simulator) ChangeUnitFile(verb string, name string, now bool) error {
+	s.mu.Lock()
+	u, err := s.unit(name)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	state := u.info.UnitFileState
+	switch verb {
+	case "enable":
+		switch {
+		case state == "masked":
+			s.mu.Unlock()
+			return fmt.Errorf("Unit file %s is masked.", name)
+		case u.wantedBy == "":
+			s.mu.Unlock()
+			return fmt.Errorf("The unit file %s has no installation config.", name)
+		}
+		u.info.UnitFileState = "enabled"
+	case "disable":
+		if u.wantedBy != "" && state != "masked" {
+			u.info.UnitFileState = "disabled"
+		}
+	case "mask":
+		u.info.UnitFileState = "masked"
+		u.info.LoadState = "masked"
+	case "unmask":
+		if state == "masked" {
+			u.info.UnitFileState = "disabled"
+			u.info.LoadState = "loaded"
+		}
+	default:
+		s.mu.Unlock()
+		return fmt.Errorf("unsupported unit file action %q", verb)
+	}
+	s.mu.Unlock()
+
+	if !now {
+		return nil
+	}
+	if verb == "enable" {
+		return s.UnitAction("start", name)
+	}
+	return s.UnitAction("stop", name)
+}
+
+func (s *Simulator) PlanUnitFile(verb string, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.unit(name)
+	if err != nil {
+		return nil, err
+	}
+	fragment := filepath.Join(simulatedUnitDir, name)
+	wants := filepath.Join(unitConfigDir, u.wantedBy+".wants", name)
+	mask := filepath.Join(unitConfigDir, name)
+
+	switch verb {
+	case "enable":
+		if u.wantedBy == "" {
+			return []string{fmt.Sprintf("no [Install] section in %s; nothing to link", fragment)}, nil
+		}
+		if u.info.UnitFileState == "enabled" {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("create symlink %s -> %s", wants, fragment)}, nil
+	case "disable":
+		if u.info.UnitFileState != "enabled" {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("remove symlink %s", wants)}, nil
+	case "mask":
+		if u.info.UnitFileState == "masked" {
+			return []string{fmt.Sprintf("%s is already masked", name)}, nil
+		}
+		return []string{fmt.Sprintf("create symlink %s -> /dev/null", mask)}, nil
+	case "unmask":
+		if u.info.UnitFileState != "masked" {
+			return []string{fmt.Sprintf("%s is not masked", name)}, nil
+		}
+		return []string{fmt.Sprintf("remove symlink %s", mask)}, nil
+	}
+	return nil, fmt.Errorf("unsupported unit file action %q", verb)
+}
+
+func (s *Simulator) Dependencies(names []string) ([]UnitDependencies, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deps := make([]UnitDependencies, 0, len(names))
+	for _, name := range names {
+		dep := UnitDependencies{
+			Name:        name,
+			ActiveState: "inactive",
+			Properties:  make(map[string][]string),
+		}
+		add := func(prop string, units ...string) {
+			dep.Properties[prop] = append(dep.Properties[prop], units...)
+		}
+
+		if requires, ok := simulatedTargets[name]; ok {
+			dep.ActiveState = "active"
+			add("Requires", requires...)
+			for target, required := range simulatedTargets {
+				if containsString(required, name) {
+					add("RequiredBy", target)
+				}
+			}
+		}
+		if u, ok := s.units[name]; ok {
+			dep.ActiveState = u.info.ActiveState
+			add("Requires", u.requires...)
+			add("Wants", u.wants...)
+			if u.info.UnitFileState == "enabled" && u.wantedBy != "" {
+				add("WantedBy", u.wantedBy)
+			}
+		}
+		for _, u := range s.units {
+			if containsString(u.requires, name) {
+				add("RequiredBy", u.info.Name)
+			}
+			if containsString(u.wants, name) {
+				add("WantedBy", u.info.Name)
+			}
+			if u.info.UnitFileState == "enabled" && u.wantedBy == name {
+				add("Wants", u.info.Name)
+			}
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+func (s *Simulator) UnitPaths(name string) (string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.units[name]
+	if !ok {
+		return "", nil, nil
+	}
+	fragment := filepath.Join(simulatedUnitDir, name)
+	if u.info.UnitFileState == "masked" {
+		fragment = os.DevNull
+	}
+	var dropIns []string
+	for path := range s.files {
+		if filepath.Dir(path) == filepath.Join(unitConfigDir, name+".d") && strings.HasSuffix(path, ".conf") {
+			dropIns = append(dropIns, path)
+		}
+	}
+	sort.Strings(dropIns)
+	return fragment, dropIns, nil
+}
+
+func (s *Simulator) DaemonReload() error {
+	return nil
+}
+
+func (s *Simulator) ReadUnitFile(path string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if content, ok := s.files[path]; ok {
+		return []byte(content), nil
+	}
+	if path == os.DevNull {
+		return nil, nil
+	}
+	if u, ok := s.units[filepath.Base(path)]; ok && filepath.Dir(path) == simulatedUnitDir {
+		return []byte(u.fragment()), nil
+	}
+	return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+}
+
+func (s *Simulator) WriteUnitFile(path string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[path] = string(data)
+	return nil
+}
+
+func (s *Simulator) RemoveUnitFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+// VerifyDropIn accepts anything that passed checkUnitSyntax; there is no
+// systemd-analyze to ask.
+func (s *Simulator) VerifyDropIn(unit string, path string, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.units[unit]; !ok {
+		return fmt.Errorf("unit file not found: %s", unit)
+	}
+	return nil
+}
+
+func (s *Simulator) UnitResults(names []string) ([]UnitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]UnitResult, 0, len(names))
+	for _, name := range names {
+		result := UnitResult{Name: name, Result: "success"}
+		if u, ok := s.units[name]; ok && u.result != "" {
+			result.Result = u.result
+			result.ExitCode = "exited"
+			result.ExitStatus = u.exitStatus
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *Simulator) ResetFailed(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name != "" {
+		if _, err := s.unit(name); err != nil {
+			return err
+		}
+	}
+	for _, u := range s.units {
+		if (name == "" || u.info.Name == name) && u.info.ActiveState == "failed" {
+			u.info.ActiveState, u.info.SubState = "inactive", "dead"
+			u.result, u.exitStatus = "success", 0
+		}
+	}
+	return nil
+}
+
+// SetProperties records the limits; runtime makes no difference because
+// nothing outlives the process.
+func (s *Simulator) SetProperties(name string, props []UnitProperty, runtime bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.unit(name)
+	if err != nil {
+		return err
+	}
+	// Like systemd, only units with a control group take resource limits.
+	switch UnitType(name) {
+	case "target", "path", "timer":
+		return fmt.Errorf("unit type %s does not support setting properties", UnitType(name))
+	}
+	for _, prop := range props {
+		value := prop.Value
+		if value == "infinity" {
+			value = ""
+		}
+		switch prop.Name {
+		case "CPUQuota":
+			u.limits.CPUQuota = value
+		case "MemoryMax":
+			u.limits.MemoryMax = value
+		case "MemoryHigh":
+			u.limits.MemoryHigh = value
+		case "TasksMax":
+			u.limits.TasksMax = value
+		case "IOWeight":
+			u.limits.IOWeight = value
+		}
+	}
+	return nil
+}
+
+func (s *Simulator) Scripts() ([]string, error) {
+	scripts := make([]string, 0, len(simulatedScripts))
+	for name := range simulatedScripts {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+	return scripts, nil
+}
+
+// RunTransient runs one of simulatedScripts, printing a line per interval.
+// Unlike systemd, the simulator keeps the unit after it succeeds.
+func (s *Simulator) RunTransient(unit string, description string, argv []string, props []UnitProperty) error {
+	script, ok := simulatedScripts[filepath.Base(argv[0])]
+	if !ok {
+		return fmt.Errorf("Failed to find executable %s: No such file or directory", argv[0])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.units[unit]; exists {
+		return fmt.Errorf("Unit %s already exists.", unit)
+	}
+	u := &simUnit{
+		info: models.ServiceInfo{
+			Name:          unit,
+			LoadState:     "loaded",
+			Description:   description,
+			UnitFileState: "transient",
+		},
+	}
+	s.units[unit] = u
+	now := time.Now()
+	s.setRunning(u, now)
+	s.logLocked(u, now, 1, 6, fmt.Sprintf("Started %s.", description))
+
+	pid := u.mainPID
+	go func() {
+		for _, line := range script.output {
+			time.Sleep(simulatedChatter / 3)
+			s.mu.Lock()
+			s.logLocked(u, time.Now(), pid, 6, line)
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.setStopped(u)
+		if script.exitStatus == 0 {
+			s.logLocked(u, time.Now(), 1, 6, fmt.Sprintf("%s: Deactivated successfully.", unit))
+			return
+		}
+		u.info.ActiveState, u.info.SubState = "failed", "failed"
+		u.result, u.exitStatus = "exit-code", script.exitStatus
+		s.logLocked(u, time.Now(), 1, 4, fmt.Sprintf("%s: Main process exited, code=exited, status=%d/INVALIDARGUMENT", unit, script.exitStatus))
+		s.logLocked(u, time.Now(), 1, 3, fmt.Sprintf("%s: Failed with result 'exit-code'.", unit))
+	}()
+	return nil
+}
+
+// fragment renders a plausible unit file for the simulated unit.
+func (u *simUnit) fragment() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=%s\n", u.info.Description)
+	if len(u.requires) > 0 {
+		fmt.Fprintf(&b, "Requires=%s\nAfter=%s\n", strings.Join(u.requires, " "), strings.Join(u.requires, " "))
+	}
+	if len(u.wants) > 0 {
+		fmt.Fprintf(&b, "Wants=%s\n", strings.Join(u.wants, " "))
+	}
+	base := strings.TrimSuffix(u.info.Name, "."+UnitType(u.info.Name))
+	switch UnitType(u.info.Name) {
+	case "timer":
+		fmt.Fprintf(&b, "\n[Timer]\nOnUnitActiveSec=%dh\nUnit=%s\nPersistent=true\n", int(u.interval.Hours()), u.activates)
+	case "socket":
+		fmt.Fprintf(&b, "\n[Socket]\nListenStream=/run/%s.sock\n", base)
+	case "path":
+		fmt.Fprintf(&b, "\n[Path]\nPathChanged=/var/spool/%s\n", base)
+	case "mount":
+		fmt.Fprintf(&b, "\n[Mount]\nWhat=/dev/disk/by-label/%s\nWhere=%s\nType=ext4\n", base, u.info.Description)
+	case "target":
+	default:
+		binary := base
+		if i := strings.IndexByte(binary, '@'); i >= 0 {
+			binary = binary[:i] + " --instance " + binary[i+1:]
+		}
+		fmt.Fprintf(&b, "\n[Service]\nExecStart=/usr/bin/%s\nRestart=on-failure\n", binary)
+	}
+	if u.wantedBy != "" {
+		fmt.Fprintf(&b, "\n[Install]\nWantedBy=%s\n", u.wantedBy)
+	}
+	return b.String()
+}
+
+// ListTimers schedules every active timer at the next multiple of its
+// period.
+func (s *Simulator) ListTimers() ([]models.TimerInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var timers []models.TimerInfo
+	for _, u := range s.units {
+		if u.interval == 0 {
+			continue
+		}
+		timer := models.TimerInfo{
+			Name:          u.info.Name,
+			Description:   u.info.Description,
+			Activates:     u.activates,
+			ActiveState:   u.info.ActiveState,
+			UnitFileState: u.info.UnitFileState,
+		}
+		if u.info.ActiveState == "active" {
+			next := now.Truncate(u.interval).Add(u.interval)
+			timer.NextElapse = &next
+		}
+		if !u.lastTrigger.IsZero() {
+			last := u.lastTrigger
+			timer.LastTrigger = &last
+		}
+		timers = append(timers, timer)
+	}
+	sort.Slice(timers, func(i, j int) bool { return timers[i].Name < timers[j].Name })
+	return timers, nil
+}
+
+func (s *Simulator) Logs(name string, q LogQuery) ([]models.LogEntry, error) {
+	since, until, err := simulatedTimeRange(q)
+	if err != nil {
+		return nil, err
+	}
+	low, high := priorityRange(q.Priority)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.units[name]
+	if !ok {
+		return nil, nil
+	}
+	var entries []models.LogEntry
+	for _, entry := range u.logs {
+		if entry.Priority < low || entry.Priority > high {
+			continue
+		}
+		if !since.IsZero() && entry.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && entry.Timestamp.After(until) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if q.Lines > 0 && len(entries) > q.Lines {
+		entries = entries[len(entries)-q.Lines:]
+	}
+	return entries, nil
+}
+
+// FollowLogs emits the tail of the unit's log and then new entries. While a
+// unit is active, a line of simulated activity is logged every few seconds.
+func (s *Simulator) FollowLogs(ctx context.Context, name string, q LogQuery, emit func(models.LogEntry) error) error {
+	tail, err := s.Logs(name, q)
+	if err != nil {
+		return err
+	}
+	low, high := priorityRange(q.Priority)
+
+	ch := make(chan models.LogEntry, 64)
+	s.mu.Lock()
+	s.subs[ch] = name
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}()
+
+	for _, entry := range tail {
+		if err := emit(entry); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(simulatedChatter)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry := <-ch:
+			if entry.Priority < low || entry.Priority > high {
+				continue
+			}
+			if err := emit(entry); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			s.chatter(name)
+		}
+	}
+}
+
+func (s *Simulator) chatter(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.units[name]
+	if !ok || u.info.ActiveState != "active" || u.mainPID == 0 {
+		return
+	}
+	s.logLocked(u, time.Now(), u.mainPID, 6, fmt.Sprintf("handled %d requests", 10+time.Now().Second()))
+}
+
+func matchesState(info models.ServiceInfo, states []string) bool {
+	for _, state := range states {
+		if state == info.LoadState || state == info.ActiveState || state == info.SubState {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortServices(list []models.ServiceInfo) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+}
+
+// priorityRange converts a journalctl priority filter into the inclusive
+// range of numeric priorities it selects.
+func priorityRange(filter string) (int, int) {
+	if filter == "" {
+		return 0, 7
+	}
+	first, second, isRange := strings.Cut(filter, "..")
+	if !isRange {
+		return 0, priorityValue(first)
+	}
+	a, b := priorityValue(first), priorityValue(second)
+	if a > b {
+		a, b = b, a
+	}
+	return a, b
+}
+
+func priorityValue(value string) int {
+	if n, ok := journalPriorities[value]; ok {
+		return n
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 7
+	}
+	return n
+}
+
+// simulatedTimeRange understands the subset of systemd.time(7) produced by
+// NormalizeLogQuery for spans ("-1h") plus absolute timestamps, "today" and
+// "yesterday".
+func simulatedTimeRange(q LogQuery) (time.Time, time.Time, error) {
+	since, err := simulatedTime(q.Since)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	until, err := simulatedTime(q.Until)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return since, until, nil
+}
+
+var simulatedSpanUnits = map[string]time.Duration{
+	"s":       time.Second,
+	"sec":     time.Second,
+	"m":       time.Minute,
+	"min":     time.Minute,
+	"h":       time.Hour,
+	"hr":      time.Hour,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"d":       24 * time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+	"w":       7 * 24 * time.Hour,
+	"week":    7 * 24 * time.Hour,
+	"weeks":   7 * 24 * time.Hour,
+	"minutes": time.Minute,
+}
+
+func simulatedTime(value string) (time.Time, error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	switch value {
+	case "":
+		return time.Time{}, nil
+	case "now":
+		return now, nil
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+
+	if strings.HasPrefix(value, "-") {
+		var total time.Duration
+		rest := value[1:]
+		for rest != "" {
+			i := 0
+			for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+				i++
+			}
+			j := i
+			for j < len(rest) && rest[j] >= 'a' && rest[j] <= 'z' {
+				j++
+			}
+			n, err := strconv.Atoi(rest[:i])
+			unit, ok := simulatedSpanUnits[rest[i:j]]
+			if err != nil || !ok {
+				return time.Time{}, errors.New("unsupported time span in simulation")
+			}
+			total += time.Duration(n) * unit
+			rest = rest[j:]
+		}
+		return now.Add(-total), nil
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", time.RFC3339} {
+		if ts, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, errors.New("unsupported time in simulation")
+}
@@ -2,147 +2,541 @@ package services
 
 import (
 	"bufio"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"tunapanel/internal/executor"
+	"tunapanel/internal/models"
 )
 
-const maxServiceNameLen = 128
+// Systemctl is the ServiceManager that runs systemctl and parses its output.
+type Systemctl struct{}
 
-func NormalizeServiceName(input string) (string, error) {
-	name := strings.TrimSpace(input)
-	if name == "" {
-		return "", errors.New("service name is required")
-	}
-	if strings.HasPrefix(name, "-") {
-		return "", errors.New("invalid service name")
+const systemdTimestampLayout = "Mon 2006-01-02 15:04:05 MST"
+
+var showProperties = []string{
+	"Id",
+	"Names",
+	"Description",
+	"LoadState",
+	"ActiveState",
+	"SubState",
+	"MainPID",
+	"ExecMainStartTimestamp",
+	"MemoryCurrent",
+	"NRestarts",
+	"FragmentPath",
+	"CPUQuotaPerSecUSec",
+	"MemoryMax",
+	"MemoryHigh",
+	"TasksMax",
+	"IOWeight",
+}
+
+var timerProperties = []string{
+	"Id",
+	"Description",
+	"Unit",
+	"ActiveState",
+	"UnitFileState",
+	"NextElapseUSecRealtime",
+	"LastTriggerUSec",
+}
+
+func (Systemctl) ListUnits(unitType string, states []string) ([]models.ServiceInfo, error) {
+	return listUnits(unitType, states)
+}
+
+func (Systemctl) ListUnitFiles(unitType string, states []string) ([]models.ServiceInfo, error) {
+	return listUnitFiles(unitType, states)
+}
+
+func listUnits(unitType string, states []string) ([]models.ServiceInfo, error) {
+	output, err := runListCommand("list-units", unitType, stateFilter(states))
+	if err != nil {
+		return nil, err
 	}
-	if len(name) > maxServiceNameLen {
-		return "", errors.New("service name is too long")
+
+	var rows []jsonUnit
+	if json.Unmarshal([]byte(output), &rows) == nil {
+		services := make([]models.ServiceInfo, 0, len(rows))
+		for _, row := range rows {
+			services = append(services, models.ServiceInfo{
+				Name:        row.Unit,
+				LoadState:   row.Load,
+				ActiveState: row.Active,
+				SubState:    row.Sub,
+				Description: row.Description,
+			})
+		}
+		return services, nil
 	}
-	if strings.Contains(name, "/") {
-		return "", errors.New("invalid service name")
+
+	return parseUnitsFromOutput(output)
+}
+
+func listUnitFiles(unitType string, states []string) ([]models.ServiceInfo, error) {
+	output, err := runListCommand("list-unit-files", unitType, stateFilter(states))
+	if err != nil {
+		return nil, err
 	}
-	for _, r := range name {
-		switch {
-		case r >= 'a' && r <= 'z':
-		case r >= 'A' && r <= 'Z':
-		case r >= '0' && r <= '9':
-		case strings.ContainsRune("@._:-", r):
-		default:
-			return "", errors.New("invalid service name")
+
+	var rows []jsonUnitFile
+	if json.Unmarshal([]byte(output), &rows) == nil {
+		services := make([]models.ServiceInfo, 0, len(rows))
+		for _, row := range rows {
+			services = append(services, models.ServiceInfo{
+				Name:          row.UnitFile,
+				UnitFileState: row.State,
+			})
 		}
+		return services, nil
 	}
 
-	if !strings.HasSuffix(name, ".service") {
-		name += ".service"
-	}
+	return parseUnitFilesFromOutput(output)
+}
 
-	return name, nil
+func (Systemctl) UnitAction(verb string, name string) error {
+	_, err := executor.Run([]string{"systemctl", verb, name})
+	return err
 }
 
-func ListEnabledServices(dryRun bool) ([]string, string, error) {
+func (Systemctl) ShowUnit(name string) (models.ServiceStatus, error) {
 	cmd := []string{
 		"systemctl",
-		"list-unit-files",
-		"--type=service",
-		"--state=enabled",
-		"--no-legend",
+		"show",
+		"--property=" + strings.Join(showProperties, ","),
 		"--no-pager",
-	}
-
-	message := ""
-	if dryRun {
-		message = "dry-run has no effect on service.list"
+		name,
 	}
 
 	output, err := executor.Run(cmd)
 	if err != nil {
-		return nil, message, err
+		return models.ServiceStatus{}, err
 	}
 
-	services, err := parseServicesFromOutput(output)
+	props, err := parseProperties(output)
 	if err != nil {
-		return nil, message, err
+		return models.ServiceStatus{}, err
 	}
 
-	return services, message, nil
+	return serviceStatusFromProperties(name, props), nil
 }
 
-func ListRunningServices(dryRun bool) ([]string, string, error) {
-	cmd := []string{
+func (Systemctl) UnitFileState(name string) (string, error) {
+	output, err := executor.Run([]string{
 		"systemctl",
-		"list-units",
-		"--type=service",
-		"--state=running",
-		"--no-legend",
-		"--no-pager",
+		"show",
+		"--property=UnitFileState",
+		"--value",
+		name,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (Systemctl) ChangeUnitFile(verb string, name string, now bool) error {
+	_, err := executor.Run(enablementCommand(verb, name, now))
+	return err
+}
+
+func (Systemctl) Dependencies(names []string) ([]UnitDependencies, error) {
+	blocks, err := showUnits(names, append([]string{"Id", "ActiveState"}, dependencyProperties()...))
+	if err != nil {
+		return nil, err
 	}
 
-	message := ""
-	if dryRun {
-		message = "dry-run has no effect on service.running"
+	deps := make([]UnitDependencies, 0, len(names))
+	for i, values := range blocks {
+		dep := UnitDependencies{
+			Name:        names[i],
+			ActiveState: values["ActiveState"],
+			Properties:  make(map[string][]string),
+		}
+		for _, prop := range dependencyProperties() {
+			if units := strings.Fields(values[prop]); len(units) > 0 {
+				dep.Properties[prop] = units
+			}
+		}
+		deps = append(deps, dep)
 	}
+	return deps, nil
+}
 
-	output, err := executor.Run(cmd)
+// ListTimers collects timer names from the unit files and the loaded units
+// and reads their state with a single systemctl show. systemctl show only
+// reports the next elapse of calendar timers, so when list-timers supports
+// JSON output its times, which cover monotonic timers too, take precedence.
+func (Systemctl) ListTimers() ([]models.TimerInfo, error) {
+	files, err := listUnitFiles("timer", nil)
 	if err != nil {
-		return nil, message, err
+		return nil, err
+	}
+	units, err := listUnits("timer", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, unit := range append(files, units...) {
+		// Templates such as foo@.timer cannot be shown without an instance.
+		if seen[unit.Name] || strings.Contains(unit.Name, "@.") {
+			continue
+		}
+		seen[unit.Name] = true
+		names = append(names, unit.Name)
 	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
 
-	services, err := parseServicesFromOutput(output)
+	blocks, err := showUnits(names, timerProperties)
 	if err != nil {
-		return nil, message, err
+		return nil, err
+	}
+	timers := make([]models.TimerInfo, 0, len(names))
+	for i, values := range blocks {
+		timer := models.TimerInfo{
+			Name:          names[i],
+			Description:   values["Description"],
+			Activates:     values["Unit"],
+			ActiveState:   values["ActiveState"],
+			UnitFileState: values["UnitFileState"],
+		}
+		if ts := parseSystemdTimestamp(values["NextElapseUSecRealtime"]); !ts.IsZero() {
+			timer.NextElapse = &ts
+		}
+		if ts := parseSystemdTimestamp(values["LastTriggerUSec"]); !ts.IsZero() {
+			timer.LastTrigger = &ts
+		}
+		timers = append(timers, timer)
 	}
 
-	return services, message, nil
+	output, err := executor.Run([]string{"systemctl", "list-timers", "--all", "--no-legend", "--no-pager", "--output=json"})
+	var rows []jsonTimer
+	if err != nil || json.Unmarshal([]byte(output), &rows) != nil {
+		return timers, nil
+	}
+	byName := make(map[string]jsonTimer, len(rows))
+	for _, row := range rows {
+		byName[row.Unit] = row
+	}
+	for i := range timers {
+		row, ok := byName[timers[i].Name]
+		if !ok {
+			continue
+		}
+		timers[i].NextElapse = usecTime(row.Next)
+		timers[i].LastTrigger = usecTime(row.Last)
+	}
+	return timers, nil
 }
 
-func StartService(name string, dryRun bool) ([]string, string, error) {
-	cmd := []string{"systemctl", "start", name}
-	if dryRun {
-		return cmd, fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " ")), nil
+func (Systemctl) UnitPaths(name string) (string, []string, error) {
+	blocks, err := showUnits([]string{name}, []string{"FragmentPath", "DropInPaths"})
+	if err != nil {
+		return "", nil, err
 	}
+	return blocks[0]["FragmentPath"], strings.Fields(blocks[0]["DropInPaths"]), nil
+}
 
-	_, err := executor.Run(cmd)
+func (Systemctl) DaemonReload() error {
+	_, err := executor.Run([]string{"systemctl", "daemon-reload"})
+	return err
+}
+
+func (Systemctl) UnitResults(names []string) ([]UnitResult, error) {
+	// Id makes systemctl print a block for units without any of the other
+	// properties, such as targets.
+	blocks, err := showUnits(names, []string{"Id", "Result", "ExecMainCode", "ExecMainStatus"})
 	if err != nil {
-		return cmd, "", err
+		return nil, err
 	}
 
-	return cmd, fmt.Sprintf("service started: %s", name), nil
+	results := make([]UnitResult, 0, len(names))
+	for i, values := range blocks {
+		result := UnitResult{Name: names[i], Result: values["Result"]}
+		if code, err := strconv.ParseInt(values["ExecMainCode"], 10, 64); err == nil {
+			result.ExitCode = exitCodes[code]
+		}
+		if status, err := strconv.Atoi(values["ExecMainStatus"]); err == nil {
+			result.ExitStatus = status
+		}
+		results = append(results, result)
+	}
+	return results, nil
 }
 
-func StopService(name string, dryRun bool) ([]string, string, error) {
-	cmd := []string{"systemctl", "stop", name}
-	if dryRun {
-		return cmd, fmt.Sprintf("dry-run: would run %s", strings.Join(cmd, " ")), nil
+func (Systemctl) ResetFailed(name string) error {
+	cmd := []string{"systemctl", "reset-failed"}
+	if name != "" {
+		cmd = append(cmd, name)
 	}
-
 	_, err := executor.Run(cmd)
+	return err
+}
+
+func (Systemctl) SetProperties(name string, props []UnitProperty, runtime bool) error {
+	_, err := executor.Run(setPropertyCommand(name, props, runtime))
+	return err
+}
+
+func (Systemctl) RunTransient(unit string, description string, argv []string, props []UnitProperty) error {
+	_, err := executor.Run(systemdRunCommand(unit, description, argv, props))
+	return err
+}
+
+// showUnits runs a single systemctl show for all names. systemctl prints one
+// block of properties per unit, separated by blank lines.
+func showUnits(names []string, props []string) ([]map[string]string, error) {
+	cmd := []string{
+		"systemctl",
+		"show",
+		"--property=" + strings.Join(props, ","),
+		"--no-pager",
+		"--",
+	}
+	output, err := executor.Run(append(cmd, names...))
 	if err != nil {
-		return cmd, "", err
+		return nil, err
+	}
+
+	blocks := strings.Split(strings.TrimSpace(output), "\n\n")
+	if len(blocks) != len(names) {
+		return nil, fmt.Errorf("systemctl show returned %d units, expected %d", len(blocks), len(names))
+	}
+	values := make([]map[string]string, 0, len(blocks))
+	for _, block := range blocks {
+		props, err := parseProperties(block)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, props)
+	}
+	return values, nil
+}
+
+func usecTime(usec *int64) *time.Time {
+	if usec == nil || *usec <= 0 {
+		return nil
+	}
+	ts := time.UnixMicro(*usec)
+	return &ts
+}
+
+func stateFilter(states []string) string {
+	if len(states) == 0 {
+		return "--all"
 	}
+	return "--state=" + strings.Join(states, ",")
+}
+
+type jsonUnit struct {
+	Unit        string `json:"unit"`
+	Load        string `json:"load"`
+	Active      string `json:"active"`
+	Sub         string `json:"sub"`
+	Description string `json:"description"`
+}
+
+type jsonTimer struct {
+	Next      *int64 `json:"next"`
+	Last      *int64 `json:"last"`
+	Unit      string `json:"unit"`
+	Activates string `json:"activates"`
+}
 
-	return cmd, fmt.Sprintf("service stopped: %s", name), nil
+type jsonUnitFile struct {
+	UnitFile string `json:"unit_file"`
+	State    string `json:"state"`
 }
 
-func parseServicesFromOutput(output string) ([]string, error) {
-	var services []string
+// runListCommand prefers systemctl's JSON output and falls back to the plain
+// table on versions that reject --output=json. Versions that silently ignore
+// the flag print the table, which the callers detect when decoding fails.
+func runListCommand(verb string, unitType string, filter string) (string, error) {
+	cmd := []string{
+		"systemctl",
+		verb,
+		"--type=" + unitType,
+		filter,
+		"--no-legend",
+		"--no-pager",
+	}
+
+	output, err := executor.Run(append(cmd, "--output=json"))
+	if err == nil {
+		return output, nil
+	}
+	return executor.Run(cmd)
+}
+
+func parseUnitsFromOutput(output string) ([]models.ServiceInfo, error) {
+	var services []models.ServiceInfo
 	scanner := bufio.NewScanner(strings.NewReader(output))
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+		fields := tableFields(scanner.Text())
+		if len(fields) == 0 {
 			continue
 		}
-		fields := strings.Fields(line)
+		info := models.ServiceInfo{Name: fields[0]}
+		if len(fields) > 1 {
+			info.LoadState = fields[1]
+		}
+		if len(fields) > 2 {
+			info.ActiveState = fields[2]
+		}
+		if len(fields) > 3 {
+			info.SubState = fields[3]
+		}
+		if len(fields) > 4 {
+			info.Description = strings.Join(fields[4:], " ")
+		}
+		services = append(services, info)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+func parseUnitFilesFromOutput(output string) ([]models.ServiceInfo, error) {
+	var services []models.ServiceInfo
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := tableFields(scanner.Text())
 		if len(fields) == 0 {
 			continue
 		}
-		services = append(services, fields[0])
+		info := models.ServiceInfo{Name: fields[0]}
+		if len(fields) > 1 {
+			info.UnitFileState = fields[1]
+		}
+		services = append(services, info)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 	return services, nil
 }
+
+// tableFields splits a systemctl table row, dropping the status marker that
+// systemctl prints in front of failed or not-found units.
+func tableFields(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && (fields[0] == "●" || fields[0] == "*") {
+		fields = fields[1:]
+	}
+	return fields
+}
+
+func serviceStatusFromProperties(name string, props map[string]string) models.ServiceStatus {
+	status := models.ServiceStatus{
+		Name:         props["Id"],
+		Names:        strings.Fields(props["Names"]),
+		Description:  props["Description"],
+		LoadState:    props["LoadState"],
+		ActiveState:  props["ActiveState"],
+		SubState:     props["SubState"],
+		FragmentPath: props["FragmentPath"],
+	}
+	if status.Name == "" {
+		status.Name = name
+	}
+	if pid, err := strconv.Atoi(props["MainPID"]); err == nil {
+		status.MainPID = pid
+	}
+	if restarts, err := strconv.Atoi(props["NRestarts"]); err == nil {
+		status.NRestarts = restarts
+	}
+	// systemd reports an unset counter as "[not set]" or as the maximum uint64.
+	if mem, err := strconv.ParseUint(props["MemoryCurrent"], 10, 64); err == nil && mem != ^uint64(0) {
+		status.MemoryCurrent = mem
+	}
+	if ts := parseSystemdTimestamp(props["ExecMainStartTimestamp"]); !ts.IsZero() {
+		status.ExecMainStartTimestamp = &ts
+	}
+	status.Limits = resourceLimits(
+		parseTimespan(props["CPUQuotaPerSecUSec"]),
+		parseLimit(props["MemoryMax"]),
+		parseLimit(props["MemoryHigh"]),
+		parseLimit(props["TasksMax"]),
+		parseLimit(props["IOWeight"]),
+	)
+	return status
+}
+
+// parseLimit parses a numeric property that systemctl prints as "infinity"
+// or "[not set]" when unset.
+func parseLimit(value string) uint64 {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return unsetLimit
+	}
+	return n
+}
+
+var timespanUnits = map[string]uint64{
+	"us":  1,
+	"ms":  1000,
+	"s":   1000000,
+	"min": 60 * 1000000,
+	"h":   60 * 60 * 1000000,
+}
+
+// parseTimespan parses a time span the way systemctl prints it, such as
+// "1s 500ms", into microseconds.
+func parseTimespan(value string) uint64 {
+	if value == "" || value == "infinity" {
+		return unsetLimit
+	}
+	var usec uint64
+	for _, part := range strings.Fields(value) {
+		i := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return unsetLimit
+		}
+		n, err := strconv.ParseUint(part[:i], 10, 64)
+		unit, ok := timespanUnits[part[i:]]
+		if err != nil || !ok {
+			return unsetLimit
+		}
+		usec += n * unit
+	}
+	return usec
+}
+
+func parseProperties(output string) (map[string]string, error) {
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		props[key] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func parseSystemdTimestamp(value string) time.Time {
+	if value == "" || value == "n/a" {
+		return time.Time{}
+	}
+	ts, err := time.ParseInLocation(systemdTimestampLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
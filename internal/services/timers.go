@@ -0,0 +1,62 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"tunapanel/internal/models"
+)
+
+func NormalizeTimerName(input string) (string, error) {
+	return normalizeUnitName(input, "timer")
+}
+
+func ListTimers(dryRun bool) ([]models.TimerInfo, string, error) {
+	timers, err := manager.ListTimers()
+	return timers, dryRunMessage("timer.list", dryRun), err
+}
+
+func StartTimer(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("start", name, "timer started", dryRun)
+}
+
+func StopTimer(name string, dryRun bool) ([]string, string, error) {
+	return runUnitAction("stop", name, "timer stopped", dryRun)
+}
+
+func EnableTimer(name string, now bool, dryRun bool) (EnablementResult, error) {
+	return changeEnablement("enable", name, now, dryRun, "timer enabled", planEnable)
+}
+
+func DisableTimer(name string, now bool, dryRun bool) (EnablementResult, error) {
+	return changeEnablement("disable", name, now, dryRun, "timer disabled", planDisable)
+}
+
+// TriggerTimer runs the timer's job now by starting the unit it activates.
+// The timer's own schedule is not affected.
+func TriggerTimer(name string, dryRun bool) ([]string, string, error) {
+	unit, err := TimerUnit(name)
+	if err != nil {
+		return nil, "", err
+	}
+	cmd, message, err := runUnitAction("start", unit, "timer triggered", dryRun)
+	if err == nil && !dryRun {
+		message = fmt.Sprintf("timer triggered: %s (started %s)", name, unit)
+	}
+	return cmd, message, err
+}
+
+// TimerUnit returns the unit a timer activates. Timers that are not listed
+// fall back to systemd's default of the service with the same name.
+func TimerUnit(name string) (string, error) {
+	timers, err := manager.ListTimers()
+	if err != nil {
+		return "", err
+	}
+	for _, timer := range timers {
+		if timer.Name == name && timer.Activates != "" {
+			return timer.Activates, nil
+		}
+	}
+	return strings.TrimSuffix(name, ".timer") + ".service", nil
+}
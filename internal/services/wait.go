@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"tunapanel/internal/models"
+)
+
+const (
+	DefaultWaitTimeout = 30 * time.Second
+	MaxWaitTimeout     = time.Minute
+
+	waitPollInterval = 250 * time.Millisecond
+	// waitSettle is how long a started unit must stay active to count.
+	waitSettle        = 2 * time.Second
+	diagnosisLogLines = 20
+)
+
+// WaitError is returned when a unit does not reach or keep the state a
+// request waited for. Diagnosis tells why.
+type WaitError struct {
+	Diagnosis models.UnitDiagnosis
+	reason    string
+}
+
+func (e *WaitError) Error() string {
+	return e.reason
+}
+
+// NormalizeWaitTimeout turns a timeout in seconds into a duration. Zero
+// selects DefaultWaitTimeout.
+func NormalizeWaitTimeout(seconds int) (time.Duration, error) {
+	timeout := time.Duration(seconds) * time.Second
+	switch {
+	case seconds < 0:
+		return 0, fmt.Errorf("wait timeout must not be negative")
+	case seconds == 0:
+		return DefaultWaitTimeout, nil
+	case timeout > MaxWaitTimeout:
+		return 0, fmt.Errorf("wait timeout must be at most %s", MaxWaitTimeout)
+	}
+	return timeout, nil
+}
+
+// WithWait makes a start, stop or restart also wait up to timeout for the
+// unit to become want, returning a *WaitError when it does not.
+func WithWait(action UnitActionFunc, want string, timeout time.Duration) UnitActionFunc {
+	return func(name string, dryRun bool) ([]string, string, error) {
+		cmd, message, err := action(name, dryRun)
+		if err != nil {
+			return cmd, message, diagnose(name, err.Error(), false)
+		}
+		if dryRun {
+			return cmd, fmt.Sprintf("%s and wait up to %s for it to be %s", message, timeout, want), nil
+		}
+
+		status, err := WaitForState(name, want, timeout)
+		if err != nil {
+			return cmd, "", err
+		}
+		if want == "active" && status.ActiveState == "inactive" {
+			return cmd, message + "; ran to completion", nil
+		}
+		return cmd, fmt.Sprintf("%s; %s (%s)", message, status.ActiveState, status.SubState), nil
+	}
+}
+
+// WaitForState polls a unit until it is want, which for "active" means
+// staying active for waitSettle or exiting successfully.
+func WaitForState(name string, want string, timeout time.Duration) (models.ServiceStatus, error) {
+	deadline := time.Now().Add(timeout)
+	first, err := manager.ShowUnit(name)
+	if err != nil {
+		return first, err
+	}
+
+	var activeSince time.Time
+	status := first
+	for {
+		now := time.Now()
+		switch {
+		case status.ActiveState == "failed":
+			return status, diagnose(name, fmt.Sprintf("%s failed", name), false)
+		case status.NRestarts > first.NRestarts:
+			return status, diagnose(name, fmt.Sprintf("%s was restarted by systemd after its main process exited", name), false)
+		case status.ActiveState == want && want != "active":
+			return status, nil
+		case status.ActiveState == want:
+			if activeSince.IsZero() {
+				activeSince = now
+			}
+			if now.Sub(activeSince) >= waitSettle || now.After(deadline) {
+				return status, nil
+			}
+		case want == "active" && status.ActiveState == "inactive":
+			// Oneshot units and those without RemainAfterExit= are done
+			// once they exit successfully.
+			if results, err := manager.UnitResults([]string{name}); err == nil && len(results) == 1 && results[0].Result == "success" {
+				return status, nil
+			}
+			return status, diagnose(name, fmt.Sprintf("%s exited right after starting", name), false)
+		default:
+			activeSince = time.Time{}
+		}
+
+		if now.After(deadline) {
+			return status, diagnose(name, fmt.Sprintf("timed out after %s waiting for %s to be %s", timeout, name, want), true)
+		}
+		time.Sleep(waitPollInterval)
+		if status, err = manager.ShowUnit(name); err != nil {
+			return status, err
+		}
+	}
+}
+
+// diagnose collects the unit's state, result and last journal lines.
+// Whatever cannot be read is left out; the reason is what matters most.
+func diagnose(name string, reason string, timedOut bool) *WaitError {
+	d := models.UnitDiagnosis{Name: name, TimedOut: timedOut}
+	if status, err := manager.ShowUnit(name); err == nil {
+		d.ActiveState, d.SubState = status.ActiveState, status.SubState
+	}
+	if results, err := manager.UnitResults([]string{name}); err == nil && len(results) == 1 {
+		d.Result = results[0].Result
+		d.ExitCode = results[0].ExitCode
+		d.ExitStatus = results[0].ExitStatus
+	}
+	if logs, _, err := ServiceLogs(name, LogQuery{Lines: diagnosisLogLines}, false); err == nil {
+		d.Logs = logs
+	}
+	return &WaitError{Diagnosis: d, reason: reason}
+}
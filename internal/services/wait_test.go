@@ -0,0 +1,42 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithWaitStart(t *testing.T) {
+	_, m := fakeSystemd(t)
+	SetManager(m)
+	t.Cleanup(func() { SetManager(Systemctl{}) })
+
+	start := WithWait(StartService, "active", 5*time.Second)
+	tests := []struct {
+		name    string
+		message string
+		reason  string
+	}{
+		{name: "migrate.service", message: "ran to completion"},
+		{name: "crashy.service", reason: "exited right after starting"},
+		{name: "broken.service", reason: "failed"},
+	}
+	for _, tt := range tests {
+		_, message, err := start(tt.name, false)
+		if tt.reason == "" {
+			if err != nil || !strings.Contains(message, tt.message) {
+				t.Errorf("start %s: message %q, err %v", tt.name, message, err)
+			}
+			continue
+		}
+		var waitErr *WaitError
+		if !errors.As(err, &waitErr) || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("start %s: err = %v, want a wait error about %q", tt.name, err, tt.reason)
+			continue
+		}
+		if waitErr.Diagnosis.Name != tt.name || waitErr.Diagnosis.Result == "" {
+			t.Errorf("start %s: diagnosis = %+v", tt.name, waitErr.Diagnosis)
+		}
+	}
+}
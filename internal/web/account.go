@@ -0,0 +1,478 @@
+package web
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunapanel/internal/qrcode"
+)
+
+const maxKeyName = 64
+
+type accountPage struct {
+	User         string
+	CSRFToken    string
+	Enrolling    bool
+	Requirement  string
+	TOTP         bool
+	TOTPAdded    string
+	RecoveryLeft int
+	Keys         []accountKey
+	// StepUpCodes and StepUpKeys tell the page how the user can confirm
+	// removing a factor: with a code, or a key registered for this host.
+	StepUpCodes bool
+	StepUpKeys  bool
+}
+
+type accountKey struct {
+	ID       string
+	Name     string
+	Host     string
+	Added    string
+	LastUsed string
+}
+
+// stepUp proves a second factor again for changes that weaken the
+// account: a TOTP or recovery code, or a security key's answer to the
+// challenge from /account/verify/begin.
+type stepUp struct {
+	Code string        `json:"code"`
+	Key  *keyAssertion `json:"key"`
+}
+
+type keyAssertion struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+}
+
+// Account shows the user's second factors at /account and changes them
+// through the POST endpoints below it. Users who must enroll a factor
+// before they can do anything else are sent here after the password.
+func (a *Auth) Account(w http.ResponseWriter, r *http.Request) {
+	s, ok := currentSession(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/account"), "/")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		a.accountPage(w, r, s)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAuthJSON(w, http.StatusMethodNotAllowed, authPayload{})
+		return
+	}
+
+	switch action {
+	case "totp/begin":
+		a.beginTOTP(w, r, s)
+	case "totp/confirm":
+		a.confirmTOTP(w, r, s)
+	case "totp/disable":
+		a.disableTOTP(w, r, s)
+	case "webauthn/begin":
+		a.beginKey(w, r, s)
+	case "webauthn/finish":
+		a.finishKey(w, r, s)
+	case "webauthn/remove":
+		a.removeKey(w, r, s)
+	case "recovery":
+		a.regenerateRecovery(w, r, s)
+	case "verify/begin":
+		rpID, _ := relyingParty(r)
+		a.beginAssertion(w, s, a.store.get(s.User), rpID)
+	default:
+		writeAuthJSON(w, http.StatusNotFound, authPayload{Error: "not found"})
+	}
+}
+
+func (a *Auth) accountPage(w http.ResponseWriter, r *http.Request, s session) {
+	record := a.store.get(s.User)
+	rpID, _ := relyingParty(r)
+	page := accountPage{
+		User:         s.User,
+		CSRFToken:    s.CSRF,
+		Enrolling:    s.stage == stageEnroll,
+		Requirement:  a.accounts.Requirement(s.User),
+		TOTP:         record.TOTPSecret != "",
+		RecoveryLeft: len(record.RecoveryCodes),
+		StepUpCodes:  a.codesAllowed(s.User, record),
+		StepUpKeys:   len(credentialsFor(record, rpID)) > 0,
+	}
+	if record.TOTPAdded != nil {
+		page.TOTPAdded = record.TOTPAdded.Format(time.RFC3339)
+	}
+	for _, cred := range record.Credentials {
+		key := accountKey{
+			ID:    cred.ID,
+			Name:  cred.Name,
+			Host:  cred.RPID,
+			Added: cred.Added.Format(time.RFC3339),
+		}
+		if cred.LastUsed != nil {
+			key.LastUsed = cred.LastUsed.Format(time.RFC3339)
+		}
+		page.Keys = append(page.Keys, key)
+	}
+	renderTemplate(w, a.tmpl, "account.html", page)
+}
+
+// beginTOTP makes a new secret for the session to confirm. The secret is
+// only saved once the user proves their app computes the same codes.
+func (a *Auth) beginTOTP(w http.ResponseWriter, r *http.Request, s session) {
+	if a.store.get(s.User).TOTPSecret != "" {
+		writeAuthJSON(w, http.StatusConflict, authPayload{Error: "an authenticator app is already set up; remove it first"})
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+		return
+	}
+	uri := totpURI(s.User, secret)
+	code, err := qrcode.Encode(uri)
+	if err != nil {
+		writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+		return
+	}
+	a.modify(s.token, func(stored *session) { stored.totpSecret = secret })
+	writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Secret: secret, URI: uri, QRCode: code.DataURI(4)})
+}
+
+func (a *Auth) confirmTOTP(w http.ResponseWriter, r *http.Request, s session) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := readAuthJSON(w, r, &body); err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "invalid request: " + err.Error()})
+		return
+	}
+	if s.totpSecret == "" {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "start the setup first"})
+		return
+	}
+	counter, ok := verifyTOTP(s.totpSecret, body.Code, time.Now(), 0)
+	if !ok {
+		audit(r, "mfa.totp.enroll.failure", s.User)
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "the code does not match; check the time on your device"})
+		return
+	}
+
+	var codes []string
+	err := a.store.update(s.User, func(record *mfaRecord) error {
+		if record.TOTPSecret != "" {
+			return errors.New("an authenticator app is already set up")
+		}
+		now := time.Now()
+		record.TOTPSecret = s.totpSecret
+		record.TOTPLastCounter = counter
+		record.TOTPAdded = &now
+		var err error
+		codes, err = ensureRecoveryCodes(record)
+		return err
+	})
+	if err != nil {
+		writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+		return
+	}
+	a.modify(s.token, func(stored *session) { stored.totpSecret = "" })
+	audit(r, "mfa.totp.enroll", s.User)
+	a.enrolled(w, r, s, "Authenticator app set up.", codes)
+}
+
+func (a *Auth) disableTOTP(w http.ResponseWriter, r *http.Request, s session) {
+	var body stepUp
+	if err := readAuthJSON(w, r, &body); err != nil && !errors.Is(err, io.EOF) {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "invalid request: " + err.Error()})
+		return
+	}
+	if !a.verifyStepUp(w, r, s, body) {
+		return
+	}
+	err := a.store.update(s.User, func(record *mfaRecord) error {
+		if record.TOTPSecret == "" {
+			return errors.New("no authenticator app is set up")
+		}
+		if a.accounts.Requirement(s.User) == requireMFA && len(record.Credentials) == 0 {
+			return errors.New("your account requires a second factor; add a security key first")
+		}
+		record.TOTPSecret = ""
+		record.TOTPLastCounter = 0
+		record.TOTPAdded = nil
+		if !record.enrolled() {
+			record.RecoveryCodes = nil
+		}
+		return nil
+	})
+	if err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: err.Error()})
+		return
+	}
+	audit(r, "mfa.totp.remove", s.User)
+	writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Message: "Authenticator app removed."})
+}
+
+// beginKey hands out the options for navigator.credentials.create.
+func (a *Auth) beginKey(w http.ResponseWriter, r *http.Request, s session) {
+	rpID, _ := relyingParty(r)
+	challenge, err := a.newChallenge(s.token)
+	if err != nil {
+		writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+		return
+	}
+	exclude := []map[string]string{}
+	for _, cred := range credentialsFor(a.store.get(s.User), rpID) {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": cred.ID})
+	}
+	writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Options: map[string]interface{}{
+		"challenge": b64url.EncodeToString(challenge),
+		"rp":        map[string]string{"name": totpIssuer, "id": rpID},
+		"user": map[string]string{
+			"id":          userHandle(s.User),
+			"name":        s.User,
+			"displayName": s.User,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+		},
+		"excludeCredentials": exclude,
+		"timeout":            webAuthnTimeout,
+		"attestation":        "none",
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "discouraged",
+			"userVerification": "discouraged",
+		},
+	}})
+}
+
+// userHandle identifies the user to their keys without naming them.
+func userHandle(name string) string {
+	sum := sha256.Sum256([]byte(totpIssuer + ":" + name))
+	return b64url.EncodeToString(sum[:16])
+}
+
+// finishKey registers the key that answered beginKey's challenge.
+func (a *Auth) finishKey(w http.ResponseWriter, r *http.Request, s session) {
+	var body struct {
+		Name              string `json:"name"`
+		ClientDataJSON    string `json:"client_data_json"`
+		AttestationObject string `json:"attestation_object"`
+	}
+	if err := readAuthJSON(w, r, &body); err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "invalid request: " + err.Error()})
+		return
+	}
+	rpID, origin := relyingParty(r)
+	cred, err := a.parseRegistration(a.takeChallenge(s.token), rpID, origin, body.ClientDataJSON, body.AttestationObject)
+	if err != nil {
+		audit(r, "mfa.webauthn.register.failure", s.User, "error", err.Error())
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "security key not registered: " + err.Error()})
+		return
+	}
+
+	var codes []string
+	err = a.store.update(s.User, func(record *mfaRecord) error {
+		for _, existing := range record.Credentials {
+			if existing.ID == cred.ID {
+				return errors.New("this security key is already registered")
+			}
+		}
+		cred.Name = strings.TrimSpace(body.Name)
+		if cred.Name == "" {
+			cred.Name = "Security key " + strconv.Itoa(len(record.Credentials)+1)
+		}
+		if len(cred.Name) > maxKeyName {
+			cred.Name = cred.Name[:maxKeyName]
+		}
+		record.Credentials = append(record.Credentials, cred)
+		var err error
+		codes, err = ensureRecoveryCodes(record)
+		return err
+	})
+	if err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: err.Error()})
+		return
+	}
+	audit(r, "mfa.webauthn.register", s.User, "key", cred.Name, "rp_id", rpID)
+	a.enrolled(w, r, s, "Security key registered.", codes)
+}
+
+func (a *Auth) parseRegistration(challenge []byte, rpID string, origin string, clientDataB64 string, attestationB64 string) (webAuthnCredential, error) {
+	var cred webAuthnCredential
+	clientDataJSON, err1 := b64url.DecodeString(clientDataB64)
+	attestation, err2 := b64url.DecodeString(attestationB64)
+	if err1 != nil || err2 != nil {
+		return cred, errors.New("invalid encoding")
+	}
+	if err := checkClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return cred, err
+	}
+	authData, err := parseAttestation(attestation)
+	if err != nil {
+		return cred, err
+	}
+	ad, err := parseAuthenticatorData(authData, rpID)
+	if err != nil {
+		return cred, err
+	}
+	if len(ad.credentialID) == 0 {
+		return cred, errors.New("no credential in attestation")
+	}
+	alg, key, err := parsePublicKey(ad.publicKey)
+	if err != nil {
+		return cred, err
+	}
+	return webAuthnCredential{
+		ID:        b64url.EncodeToString(ad.credentialID),
+		RPID:      rpID,
+		Alg:       alg,
+		PublicKey: key,
+		SignCount: ad.signCount,
+		Added:     time.Now(),
+	}, nil
+}
+
+func (a *Auth) removeKey(w http.ResponseWriter, r *http.Request, s session) {
+	var body struct {
+		ID string `json:"id"`
+		stepUp
+	}
+	if err := readAuthJSON(w, r, &body); err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "invalid request: " + err.Error()})
+		return
+	}
+	if !a.verifyStepUp(w, r, s, body.stepUp) {
+		return
+	}
+	var removed string
+	err := a.store.update(s.User, func(record *mfaRecord) error {
+		for i, cred := range record.Credentials {
+			if cred.ID != body.ID {
+				continue
+			}
+			switch a.accounts.Requirement(s.User) {
+			case requireWebAuthn:
+				if len(record.Credentials) == 1 {
+					return errors.New("your account requires a security key; register another one first")
+				}
+			case requireMFA:
+				if len(record.Credentials) == 1 && record.TOTPSecret == "" {
+					return errors.New("your account requires a second factor; set up another one first")
+				}
+			}
+			removed = cred.Name
+			record.Credentials = append(record.Credentials[:i], record.Credentials[i+1:]...)
+			if !record.enrolled() {
+				record.RecoveryCodes = nil
+			}
+			return nil
+		}
+		return errUnknownKey
+	})
+	if err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: err.Error()})
+		return
+	}
+	audit(r, "mfa.webauthn.remove", s.User, "key", removed)
+	writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Message: "Security key removed."})
+}
+
+func (a *Auth) regenerateRecovery(w http.ResponseWriter, r *http.Request, s session) {
+	var body stepUp
+	if err := readAuthJSON(w, r, &body); err != nil && !errors.Is(err, io.EOF) {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "invalid request: " + err.Error()})
+		return
+	}
+	if !a.verifyStepUp(w, r, s, body) {
+		return
+	}
+	var codes []string
+	err := a.store.update(s.User, func(record *mfaRecord) error {
+		if !record.enrolled() {
+			return errors.New("set up a second factor first")
+		}
+		record.RecoveryCodes = nil
+		var err error
+		codes, err = ensureRecoveryCodes(record)
+		return err
+	})
+	if err != nil {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: err.Error()})
+		return
+	}
+	audit(r, "mfa.recovery.regenerate", s.User)
+	writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Message: "New recovery codes; the old ones no longer work.", RecoveryCodes: codes})
+}
+
+// verifyStepUp checks the second factor a change to the account came with.
+// Failures count towards the lockout like failed logins. If it fails, the
+// answer is written.
+func (a *Auth) verifyStepUp(w http.ResponseWriter, r *http.Request, s session, proof stepUp) bool {
+	var method string
+	var ok bool
+	switch {
+	case proof.Key != nil:
+		rpID, origin := relyingParty(r)
+		key := proof.Key
+		method = "webauthn"
+		ok = a.verifyKey(s.User, rpID, origin, a.takeChallenge(s.token), key.ID, key.ClientDataJSON, key.AuthenticatorData, key.Signature) == nil
+	case proof.Code != "" && a.codesAllowed(s.User, a.store.get(s.User)):
+		method, ok = a.checkCode(s.User, proof.Code)
+	default:
+		writeAuthJSON(w, http.StatusForbidden, authPayload{Error: "confirm this with your second factor", StepUp: true})
+		return false
+	}
+	if !ok {
+		if a.mfaFailed(w, r, s, "account.step_up.failure", method) {
+			writeAuthJSON(w, http.StatusForbidden, authPayload{Error: "second factor not accepted", StepUp: true})
+		}
+		return false
+	}
+	if method == "recovery" {
+		audit(r, "mfa.recovery.used", s.User, "remaining", strconv.Itoa(len(a.store.get(s.User).RecoveryCodes)))
+	}
+	audit(r, "account.step_up", s.User, "method", method)
+	return true
+}
+
+// ensureRecoveryCodes gives a record its first recovery codes and returns
+// them; records that have some keep them.
+func ensureRecoveryCodes(record *mfaRecord) ([]string, error) {
+	if len(record.RecoveryCodes) > 0 {
+		return nil, nil
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	record.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// enrolled answers a successful enrollment. A session that was waiting for
+// it gets full access once the account's requirement is met.
+func (a *Auth) enrolled(w http.ResponseWriter, r *http.Request, s session, message string, codes []string) {
+	payload := authPayload{OK: true, Message: message, RecoveryCodes: codes}
+	if s.stage == stageEnroll && a.stageFor(s.User) != stageEnroll {
+		if err := a.promote(w, s); err != nil {
+			writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+			return
+		}
+		audit(r, "login.success", s.User, "method", "enroll")
+		payload.Redirect = s.next
+	}
+	writeAuthJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,194 @@
+package web
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// passwordIterations follows the OWASP recommendation for
+	// PBKDF2-HMAC-SHA256.
+	passwordIterations = 600000
+	passwordSaltBytes  = 16
+	passwordKeyBytes   = 32
+	passwordScheme     = "pbkdf2-sha256"
+	MinPasswordLength  = 12
+)
+
+// ValidUsername reports whether name can be used for an account: letters,
+// digits, '.', '_' and '-'.
+func ValidUsername(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Accounts are the local web UI users, read from a file with one
+// "name:hash" line per user as written by HashPassword. A third field may
+// require a second factor: "mfa" for any, "webauthn" for a security key.
+type Accounts struct {
+	hashes  map[string]string
+	require map[string]string
+	// dummy is checked for unknown users so that they take as long as
+	// wrong passwords.
+	dummy string
+}
+
+// LoadAccounts reads an accounts file. It must not be readable or
+// writable by others, since the hashes can be attacked offline.
+func LoadAccounts(path string) (*Accounts, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		return nil, fmt.Errorf("%s: must not be accessible by others", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := &Accounts{hashes: make(map[string]string), require: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok || !ValidUsername(name) {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", path, lineNo)
+		}
+		hash, require, _ := strings.Cut(rest, ":")
+		if require != requireNone && require != requireMFA && require != requireWebAuthn {
+			return nil, fmt.Errorf("%s:%d: unknown requirement %q (want mfa or webauthn)", path, lineNo, require)
+		}
+		if _, _, _, err := parseHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if _, dup := a.hashes[name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", path, lineNo, name)
+		}
+		a.hashes[name] = hash
+		a.require[name] = require
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.hashes) == 0 {
+		return nil, fmt.Errorf("%s: no accounts", path)
+	}
+	if a.dummy, err = HashPassword("tunapanel-dummy-password"); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Verify reports whether password is name's password.
+func (a *Accounts) Verify(name string, password string) bool {
+	hash, ok := a.hashes[name]
+	if !ok {
+		hash = a.dummy
+	}
+	iterations, salt, want, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1 && ok
+}
+
+// Exists reports whether name has an account.
+func (a *Accounts) Exists(name string) bool {
+	_, ok := a.hashes[name]
+	return ok
+}
+
+// Requirement returns the second factor name must use: requireNone,
+// requireMFA or requireWebAuthn.
+func (a *Accounts) Requirement(name string) string {
+	return a.require[name]
+}
+
+// HashPassword returns a salted PBKDF2-HMAC-SHA256 hash of password in the
+// form "pbkdf2-sha256$<iterations>$<salt>$<key>".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, passwordKeyBytes)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func parseHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return 0, nil, nil, errors.New("unsupported password hash")
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 100000 {
+		return 0, nil, nil, errors.New("password hash has too few iterations")
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil || len(salt) < 8 {
+		return 0, nil, nil, errors.New("invalid password salt")
+	}
+	key, err := enc.DecodeString(parts[3])
+	if err != nil || len(key) < 16 {
+		return 0, nil, nil, errors.New("invalid password hash")
+	}
+	return iterations, salt, key, nil
+}
+
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	return pbkdf2(sha256.New, password, salt, iterations, keyLen)
+}
+
+// pbkdf2 implements PBKDF2 (RFC 8018) with HMAC over newHash.
+func pbkdf2(newHash func() hash.Hash, password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	var key []byte
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		name       string
+		sha256     bool
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		// RFC 6070 section 2, without the 16777216-iteration case.
+		{"rfc6070-1", false, "password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"rfc6070-2", false, "password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"rfc6070-3", false, "password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"rfc6070-5", false, "passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"rfc6070-6", false, "pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+		// RFC 7914 section 11.
+		{"rfc7914-1", true, "passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"rfc7914-2", true, "Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		newHash := sha1.New
+		if tt.sha256 {
+			newHash = sha256.New
+		}
+		want, _ := hex.DecodeString(tt.key)
+		got := pbkdf2(newHash, []byte(tt.password), []byte(tt.salt), tt.iterations, len(want))
+		if hex.EncodeToString(got) != tt.key {
+			t.Errorf("%s: key = %x, want %s", tt.name, got, tt.key)
+		}
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	tests := []struct {
+		hash string
+		err  string
+	}{
+		{"bcrypt$600000$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", "unsupported password hash"},
+		{"pbkdf2-sha256$600000$c2FsdHNhbHQ", "unsupported password hash"},
+		{"pbkdf2-sha256$1000$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", "too few iterations"},
+		{"pbkdf2-sha256$x$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", "too few iterations"},
+		{"pbkdf2-sha256$600000$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5", "invalid password salt"},
+		{"pbkdf2-sha256$600000$c2FsdHNhbHQ$a2V5", "invalid password hash"},
+		{"pbkdf2-sha256$600000$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", ""},
+	}
+	for _, tt := range tests {
+		_, _, _, err := parseHash(tt.hash)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("parseHash(%q): err = %v, want %q", tt.hash, err, tt.err)
+		}
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	hash, err := HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "accounts")
+	data := "# web users\nalice:" + hash + "\n\nbob:" + hash + ":webauthn\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := LoadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Verify("alice", "correct horse battery") {
+		t.Error("alice's password was refused")
+	}
+	if a.Verify("alice", "correct horse batterx") || a.Verify("carol", "correct horse battery") {
+		t.Error("a wrong password or an unknown user was accepted")
+	}
+	if a.Requirement("alice") != requireNone || a.Requirement("bob") != requireWebAuthn {
+		t.Errorf("requirements = %q, %q", a.Requirement("alice"), a.Requirement("bob"))
+	}
+
+	tests := []struct {
+		data string
+		mode os.FileMode
+		err  string
+	}{
+		{data, 0604, "must not be accessible by others"},
+		{"alice " + hash + "\n", 0600, "expected name:hash"},
+		{"al/ice:" + hash + "\n", 0600, "expected name:hash"},
+		{"alice:" + hash + ":sms\n", 0600, "unknown requirement"},
+		{"alice:" + hash + "\nalice:" + hash + "\n", 0600, "duplicate user alice"},
+		{"alice:plain\n", 0600, "unsupported password hash"},
+		{"# nobody\n", 0600, "no accounts"},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.data), tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAccounts(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadAccounts(%q, %o): err = %v, want %q", tt.data, tt.mode, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,805 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie      = "tunapanel_session"
+	sessionIdleTimeout = 15 * time.Minute
+	sessionMaxAge      = 8 * time.Hour
+	csrfHeader         = "X-CSRF-Token"
+	csrfField          = "csrf_token"
+
+	// pendingSessionMaxAge bounds how long a user who gave the right
+	// password has to complete the second factor or enrollment.
+	pendingSessionMaxAge = 5 * time.Minute
+
+	// A user name is locked out for loginLockout after loginMaxFailures
+	// failed logins in a row.
+	loginMaxFailures = 5
+	loginLockout     = 5 * time.Minute
+
+	// At most loginVerifiers password hashes are checked at once; a login
+	// waits up to loginVerifyWait for its turn.
+	loginVerifiers  = 2
+	loginVerifyWait = time.Second
+
+	maxLoginForm = 4 << 10
+	maxAuthBody  = 64 << 10
+)
+
+// Session stages. A session only has full access once the user has passed
+// every factor their account uses.
+const (
+	stageFull   = ""
+	stageMFA    = "mfa"
+	stageEnroll = "enroll"
+)
+
+var (
+	errInvalidCode = errors.New("invalid code")
+	errUnknownKey  = errors.New("unknown security key")
+	errKeyCounter  = errors.New("signature counter did not increase; the key may have been cloned")
+)
+
+type session struct {
+	User     string
+	CSRF     string
+	token    string
+	stage    string
+	next     string
+	created  time.Time
+	lastSeen time.Time
+
+	// challenge is the pending WebAuthn challenge and totpSecret the TOTP
+	// secret being enrolled.
+	challenge  []byte
+	totpSecret string
+}
+
+type loginFailures struct {
+	count int
+	until time.Time
+}
+
+type sessionKey struct{}
+
+// Auth keeps the sessions of users logged in to the web UI. Sessions live
+// in memory and end when the server restarts.
+type Auth struct {
+	accounts *Accounts
+	store    *MFAStore
+	tmpl     *template.Template
+
+	// verifying holds a slot for each password check in progress.
+	verifying chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	failures map[string]*loginFailures
+}
+
+// NewAuth returns logins for accounts, with second factors kept in store.
+func NewAuth(accounts *Accounts, store *MFAStore) *Auth {
+	return &Auth{
+		accounts:  accounts,
+		store:     store,
+		verifying: make(chan struct{}, loginVerifiers),
+		sessions:  make(map[string]*session),
+		failures:  make(map[string]*loginFailures),
+	}
+}
+
+// authPayload is the JSON answer of the login and account endpoints.
+type authPayload struct {
+	OK            bool                   `json:"ok"`
+	Error         string                 `json:"error,omitempty"`
+	Message       string                 `json:"message,omitempty"`
+	Redirect      string                 `json:"redirect,omitempty"`
+	Secret        string                 `json:"secret,omitempty"`
+	URI           string                 `json:"uri,omitempty"`
+	QRCode        string                 `json:"qr_code,omitempty"`
+	RecoveryCodes []string               `json:"recovery_codes,omitempty"`
+	Options       map[string]interface{} `json:"options,omitempty"`
+	StepUp        bool                   `json:"step_up,omitempty"`
+}
+
+// Wrap requires a session for everything but the login page and the
+// health check. Pages redirect to the login page, API calls get 401.
+// Requests that change state must also carry the session's CSRF token and
+// must not come from another origin. Sessions still waiting for a second
+// factor or an enrollment only reach the pages for that.
+func (a *Auth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		if r.URL.Path == "/health" || r.URL.Path == "/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s, ok := a.lookup(r)
+		if user, cert := clientCertUser(r); cert && (!ok || s.User != user) && a.accounts.Exists(user) {
+			s, ok = a.certSession(w, r, user)
+		}
+		if !ok {
+			if isPage(r) {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			writeJSON(w, http.StatusUnauthorized, statusPayload{OK: false, Error: "login required"})
+			return
+		}
+		if !safeMethod(r.Method) && !validCSRF(r, s) {
+			writeJSON(w, http.StatusForbidden, statusPayload{OK: false, Error: "invalid CSRF token"})
+			return
+		}
+		if home := stageHome(s.stage); home != "" && !stageAllows(s.stage, r.URL.Path) {
+			if isPage(r) {
+				http.Redirect(w, r, home, http.StatusSeeOther)
+				return
+			}
+			writeJSON(w, http.StatusUnauthorized, statusPayload{OK: false, Error: "login not complete"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+	})
+}
+
+// stageHome is the page a session in stage has to finish on.
+func stageHome(stage string) string {
+	switch stage {
+	case stageMFA:
+		return "/login/mfa"
+	case stageEnroll:
+		return "/account"
+	}
+	return ""
+}
+
+func stageAllows(stage string, path string) bool {
+	if path == "/logout" {
+		return true
+	}
+	switch stage {
+	case stageMFA:
+		return path == "/login/mfa" || strings.HasPrefix(path, "/login/webauthn/")
+	case stageEnroll:
+		return path == "/account" || strings.HasPrefix(path, "/account/")
+	}
+	return true
+}
+
+func isPage(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	switch r.URL.Path {
+	case "/", "/account", "/login/mfa":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/service/")
+}
+
+// certSession logs in the user named by a verified client certificate;
+// only pages get a session cookie.
+func (a *Auth) certSession(w http.ResponseWriter, r *http.Request, user string) (session, bool) {
+	stage := a.stageFor(user)
+	if !isPage(r) {
+		return session{User: user, stage: stage}, stage == stageFull
+	}
+	a.endSession(r)
+	token, err := a.start(user, stage, r.URL.RequestURI())
+	if err != nil {
+		return session{}, false
+	}
+	http.SetCookie(w, sessionCookieFor(token, false))
+	if stage == stageFull {
+		audit(r, "login.success", user, "method", "client_certificate")
+	} else {
+		audit(r, "login.certificate.success", user, "next", stage)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return *a.sessions[token], true
+}
+
+// Login shows the login form and checks the password. Users with a second
+// factor, or who must enroll one, continue in a session limited to that.
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	if !localPath(next) {
+		next = "/"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if s, ok := a.lookup(r); ok && s.stage == stageFull {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		a.renderLogin(w, http.StatusOK, next, "")
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !sameOrigin(r) {
+		a.renderLogin(w, http.StatusForbidden, next, "Cross-origin login refused.")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginForm)
+	if err := r.ParseForm(); err != nil {
+		a.renderLogin(w, http.StatusBadRequest, next, "Invalid login form.")
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("username"))
+	password := r.PostForm.Get("password")
+
+	if a.lockedOut(name) {
+		audit(r, "login.locked", name)
+		a.renderLogin(w, http.StatusTooManyRequests, next, "Too many failed logins. Try again later.")
+		return
+	}
+	verified, ok := a.verifyPassword(r, name, password)
+	if !ok {
+		audit(r, "login.busy", name)
+		a.renderLogin(w, http.StatusServiceUnavailable, next, "Too many logins at once. Try again in a moment.")
+		return
+	}
+	if !verified {
+		a.recordFailure(name)
+		audit(r, "login.password.failure", name)
+		a.renderLogin(w, http.StatusUnauthorized, next, "Invalid user name or password.")
+		return
+	}
+
+	stage := a.stageFor(name)
+	a.endSession(r)
+	token, err := a.start(name, stage, next)
+	if err != nil {
+		a.renderLogin(w, http.StatusInternalServerError, next, "Could not start a session.")
+		return
+	}
+	http.SetCookie(w, sessionCookieFor(token, false))
+	switch stage {
+	case stageMFA:
+		audit(r, "login.password.success", name, "next", "mfa")
+		http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+	case stageEnroll:
+		audit(r, "login.password.success", name, "next", "enroll")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	default:
+		audit(r, "login.success", name, "method", "password")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+// verifyPassword checks name's password once a verifier slot is free. ok is
+// false when none became free in time.
+func (a *Auth) verifyPassword(r *http.Request, name string, password string) (verified bool, ok bool) {
+	timer := time.NewTimer(loginVerifyWait)
+	defer timer.Stop()
+	select {
+	case a.verifying <- struct{}{}:
+	case <-timer.C:
+		return false, false
+	case <-r.Context().Done():
+		return false, false
+	}
+	defer func() { <-a.verifying }()
+	return a.accounts.Verify(name, password), true
+}
+
+// stageFor works out what a user who gave the right password still has to
+// do: use their second factor, enroll the one their account requires, or
+// nothing.
+func (a *Auth) stageFor(name string) string {
+	record := a.store.get(name)
+	switch a.accounts.Requirement(name) {
+	case requireWebAuthn:
+		if len(record.Credentials) == 0 {
+			return stageEnroll
+		}
+	case requireMFA:
+		if !record.enrolled() {
+			return stageEnroll
+		}
+	}
+	if record.enrolled() {
+		return stageMFA
+	}
+	return stageFull
+}
+
+// codesAllowed reports whether name may log in with a TOTP or recovery
+// code rather than a security key.
+func (a *Auth) codesAllowed(name string, record mfaRecord) bool {
+	return a.accounts.Requirement(name) != requireWebAuthn && (record.TOTPSecret != "" || len(record.RecoveryCodes) > 0)
+}
+
+type mfaPage struct {
+	User      string
+	CSRFToken string
+	Codes     bool
+	Keys      bool
+	Error     string
+}
+
+// LoginMFA asks for the second factor. Codes are posted from the form;
+// security keys go through the /login/webauthn/ endpoints.
+func (a *Auth) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	s, ok := currentSession(r)
+	if !ok || s.stage != stageMFA {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	record := a.store.get(s.User)
+	rpID, _ := relyingParty(r)
+	page := mfaPage{
+		User:      s.User,
+		CSRFToken: s.CSRF,
+		Codes:     a.codesAllowed(s.User, record),
+		Keys:      len(credentialsFor(record, rpID)) > 0,
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderTemplate(w, a.tmpl, "mfa.html", page)
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	code := strings.TrimSpace(r.PostFormValue("code"))
+	method, ok := "code", false
+	if page.Codes {
+		method, ok = a.checkCode(s.User, code)
+	}
+	if !ok {
+		if a.mfaFailed(w, r, s, "login.mfa.failure", method) {
+			page.Error = "Invalid code."
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = a.tmpl.ExecuteTemplate(w, "mfa.html", page)
+		}
+		return
+	}
+	if err := a.promote(w, s); err != nil {
+		http.Error(w, "could not start a session", http.StatusInternalServerError)
+		return
+	}
+	if method == "recovery" {
+		audit(r, "mfa.recovery.used", s.User, "remaining", strconv.Itoa(len(a.store.get(s.User).RecoveryCodes)))
+	}
+	audit(r, "login.success", s.User, "method", method)
+	http.Redirect(w, r, s.next, http.StatusSeeOther)
+}
+
+// checkCode accepts a current TOTP code or an unused recovery code, which
+// is used up.
+func (a *Auth) checkCode(name string, code string) (string, bool) {
+	now := time.Now()
+	if len(strings.ReplaceAll(code, " ", "")) == totpDigits {
+		err := a.store.update(name, func(record *mfaRecord) error {
+			if record.TOTPSecret == "" {
+				return errInvalidCode
+			}
+			counter, ok := verifyTOTP(record.TOTPSecret, code, now, record.TOTPLastCounter)
+			if !ok {
+				return errInvalidCode
+			}
+			record.TOTPLastCounter = counter
+			return nil
+		})
+		return "totp", err == nil
+	}
+
+	hash := hashRecoveryCode(code)
+	err := a.store.update(name, func(record *mfaRecord) error {
+		for i, stored := range record.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+				record.RecoveryCodes = append(record.RecoveryCodes[:i], record.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return errInvalidCode
+	})
+	return "recovery", err == nil
+}
+
+// mfaFailed audits a failed second factor as event and counts it against
+// the user. Once they are locked out the session ends and the answer is
+// written; it reports whether the session is still usable.
+func (a *Auth) mfaFailed(w http.ResponseWriter, r *http.Request, s session, event string, method string) bool {
+	a.recordFailure(s.User)
+	audit(r, event, s.User, "method", method)
+	if !a.lockedOut(s.User) {
+		return true
+	}
+	audit(r, "login.locked", s.User)
+	a.endSession(r)
+	http.SetCookie(w, sessionCookieFor("", true))
+	if r.Header.Get(csrfHeader) == "" {
+		a.renderLogin(w, http.StatusTooManyRequests, "/", "Too many failed logins. Try again later.")
+	} else {
+		writeAuthJSON(w, http.StatusTooManyRequests, authPayload{Error: "too many failed logins", Redirect: "/login"})
+	}
+	return false
+}
+
+// WebAuthnLogin serves /login/webauthn/begin, which hands out a challenge
+// for the user's security keys, and /login/webauthn/finish, which checks
+// the key's signature over it.
+func (a *Auth) WebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	s, ok := currentSession(r)
+	if !ok || s.stage != stageMFA {
+		writeAuthJSON(w, http.StatusUnauthorized, authPayload{Error: "log in with your password first", Redirect: "/login"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAuthJSON(w, http.StatusMethodNotAllowed, authPayload{})
+		return
+	}
+	record := a.store.get(s.User)
+	rpID, origin := relyingParty(r)
+
+	switch strings.TrimPrefix(r.URL.Path, "/login/webauthn/") {
+	case "begin":
+		a.beginAssertion(w, s, record, rpID)
+	case "finish":
+		var body struct {
+			ID                string `json:"id"`
+			ClientDataJSON    string `json:"client_data_json"`
+			AuthenticatorData string `json:"authenticator_data"`
+			Signature         string `json:"signature"`
+		}
+		if err := readAuthJSON(w, r, &body); err != nil {
+			writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "invalid request: " + err.Error()})
+			return
+		}
+		challenge := a.takeChallenge(s.token)
+		if err := a.verifyKey(s.User, rpID, origin, challenge, body.ID, body.ClientDataJSON, body.AuthenticatorData, body.Signature); err != nil {
+			if a.mfaFailed(w, r, s, "login.mfa.failure", "webauthn") {
+				writeAuthJSON(w, http.StatusUnauthorized, authPayload{Error: "security key not accepted: " + err.Error()})
+			}
+			return
+		}
+		if err := a.promote(w, s); err != nil {
+			writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+			return
+		}
+		audit(r, "login.success", s.User, "method", "webauthn")
+		writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Redirect: s.next})
+	default:
+		writeAuthJSON(w, http.StatusNotFound, authPayload{Error: "not found"})
+	}
+}
+
+// beginAssertion hands out the options for navigator.credentials.get with
+// a new challenge for the user's security keys on rpID.
+func (a *Auth) beginAssertion(w http.ResponseWriter, s session, record mfaRecord, rpID string) {
+	creds := credentialsFor(record, rpID)
+	if len(creds) == 0 {
+		writeAuthJSON(w, http.StatusBadRequest, authPayload{Error: "no security key is registered for " + rpID})
+		return
+	}
+	challenge, err := a.newChallenge(s.token)
+	if err != nil {
+		writeAuthJSON(w, http.StatusInternalServerError, authPayload{Error: err.Error()})
+		return
+	}
+	allow := make([]map[string]string, 0, len(creds))
+	for _, cred := range creds {
+		allow = append(allow, map[string]string{"type": "public-key", "id": cred.ID})
+	}
+	writeAuthJSON(w, http.StatusOK, authPayload{OK: true, Options: map[string]interface{}{
+		"challenge":        b64url.EncodeToString(challenge),
+		"rpId":             rpID,
+		"allowCredentials": allow,
+		"timeout":          webAuthnTimeout,
+		"userVerification": "discouraged",
+	}})
+}
+
+// verifyKey checks an assertion from one of name's keys and records its
+// new signature counter.
+func (a *Auth) verifyKey(name string, rpID string, origin string, challenge []byte, id string, clientDataB64 string, authDataB64 string, signatureB64 string) error {
+	clientDataJSON, err1 := b64url.DecodeString(clientDataB64)
+	authData, err2 := b64url.DecodeString(authDataB64)
+	signature, err3 := b64url.DecodeString(signatureB64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return errors.New("invalid encoding")
+	}
+	if err := checkClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return err
+	}
+	now := time.Now()
+	return a.store.update(name, func(record *mfaRecord) error {
+		for i := range record.Credentials {
+			cred := &record.Credentials[i]
+			if cred.ID != id || cred.RPID != rpID {
+				continue
+			}
+			ad, err := parseAuthenticatorData(authData, cred.RPID)
+			if err != nil {
+				return err
+			}
+			if err := verifyAssertion(cred.Alg, cred.PublicKey, authData, clientDataJSON, signature); err != nil {
+				return err
+			}
+			// A counter that does not go up hints at a cloned key. Keys
+			// that do not count always report 0.
+			if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+				return errKeyCounter
+			}
+			cred.SignCount = ad.signCount
+			cred.LastUsed = &now
+			return nil
+		}
+		return errUnknownKey
+	})
+}
+
+// Logout ends the session. It is wrapped like any other state change, so
+// it needs the CSRF token.
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s, ok := currentSession(r); ok {
+		audit(r, "logout", s.User)
+	}
+	a.endSession(r)
+	http.SetCookie(w, sessionCookieFor("", true))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (a *Auth) renderLogin(w http.ResponseWriter, status int, next string, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = a.tmpl.ExecuteTemplate(w, "login.html", struct {
+		Next  string
+		Error string
+	}{Next: next, Error: message})
+}
+
+// lookup returns the request's session, ending it if it has been idle or
+// open for too long.
+func (a *Auth) lookup(r *http.Request) (session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return session{}, false
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.sessions[cookie.Value]
+	if s == nil {
+		return session{}, false
+	}
+	if s.expired(now) {
+		delete(a.sessions, cookie.Value)
+		return session{}, false
+	}
+	s.lastSeen = now
+	return *s, true
+}
+
+func (s *session) expired(now time.Time) bool {
+	maxAge := sessionMaxAge
+	if s.stage != stageFull {
+		maxAge = pendingSessionMaxAge
+	}
+	return now.Sub(s.lastSeen) > sessionIdleTimeout || now.Sub(s.created) > maxAge
+}
+
+// start opens a session for name with fresh session and CSRF tokens.
+func (a *Auth) start(name string, stage string, next string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, s := range a.sessions {
+		if s.expired(now) {
+			delete(a.sessions, key)
+		}
+	}
+	if stage == stageFull {
+		delete(a.failures, name)
+	}
+	a.sessions[token] = &session{
+		User:     name,
+		CSRF:     csrf,
+		token:    token,
+		stage:    stage,
+		next:     next,
+		created:  now,
+		lastSeen: now,
+	}
+	return token, nil
+}
+
+// promote replaces a session that has passed every factor with a full one
+// under new tokens.
+func (a *Auth) promote(w http.ResponseWriter, s session) error {
+	token, err := a.start(s.User, stageFull, s.next)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	delete(a.sessions, s.token)
+	a.mu.Unlock()
+	http.SetCookie(w, sessionCookieFor(token, false))
+	return nil
+}
+
+func (a *Auth) endSession(r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, cookie.Value)
+		a.mu.Unlock()
+	}
+}
+
+// modify changes the stored session behind a copy handed out by lookup.
+func (a *Auth) modify(token string, change func(*session)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s := a.sessions[token]; s != nil {
+		change(s)
+	}
+}
+
+func (a *Auth) newChallenge(token string) ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	a.modify(token, func(s *session) { s.challenge = challenge })
+	return challenge, nil
+}
+
+// takeChallenge returns the session's WebAuthn challenge; each one can be
+// answered once.
+func (a *Auth) takeChallenge(token string) []byte {
+	var challenge []byte
+	a.modify(token, func(s *session) {
+		challenge = s.challenge
+		s.challenge = nil
+	})
+	return challenge
+}
+
+func (a *Auth) lockedOut(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.failures[name]
+	return f != nil && f.count >= loginMaxFailures && time.Now().Before(f.until)
+}
+
+func (a *Auth) recordFailure(name string) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, f := range a.failures {
+		if now.After(f.until) {
+			delete(a.failures, key)
+		}
+	}
+	f := a.failures[name]
+	if f == nil {
+		f = &loginFailures{}
+		a.failures[name] = f
+	}
+	f.count++
+	f.until = now.Add(loginLockout)
+}
+
+func credentialsFor(record mfaRecord, rpID string) []webAuthnCredential {
+	var creds []webAuthnCredential
+	for _, cred := range record.Credentials {
+		if cred.RPID == rpID {
+			creds = append(creds, cred)
+		}
+	}
+	return creds
+}
+
+// currentSession returns the session Wrap attached to r, if any.
+func currentSession(r *http.Request) (session, bool) {
+	s, ok := r.Context().Value(sessionKey{}).(session)
+	return s, ok
+}
+
+// sessionCookieFor returns the session cookie, or one that clears it. It is
+// always Secure: browsers still accept it over plain HTTP on localhost.
+func sessionCookieFor(token string, clear bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if clear {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+func validCSRF(r *http.Request, s session) bool {
+	if !sameOrigin(r) {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) == 1
+}
+
+// sameOrigin rejects requests whose Origin header names another host.
+// Requests without one, from older browsers and tools, are let through.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// localPath reports whether next is a path on this server, so that the login
+// page cannot be used to redirect elsewhere.
+func localPath(next string) bool {
+	return strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\")
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func readAuthJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAuthBody)
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+func writeAuthJSON(w http.ResponseWriter, status int, payload authPayload) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse battery"
+
+var (
+	testHashOnce sync.Once
+	testHash     string
+)
+
+// newTestAuth returns logins for alice, who has no second factor, and bob,
+// who must use a security key.
+func newTestAuth(t *testing.T) *Auth {
+	t.Helper()
+	testHashOnce.Do(func() {
+		var err error
+		if testHash, err = HashPassword(testPassword); err != nil {
+			t.Fatal(err)
+		}
+	})
+	accounts := &Accounts{
+		hashes:  map[string]string{"alice": testHash, "bob": testHash},
+		require: map[string]string{"bob": requireWebAuthn},
+		dummy:   testHash,
+	}
+	store, err := LoadMFAStore(filepath.Join(t.TempDir(), "mfa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuth(accounts, store)
+	a.tmpl = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+	return a
+}
+
+func sessionFor(t *testing.T, a *Auth, name string, stage string) session {
+	t.Helper()
+	token, err := a.start(name, stage, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return *a.sessions[token]
+}
+
+func TestWrap(t *testing.T) {
+	a := newTestAuth(t)
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := currentSession(r); !ok && r.URL.Path != "/health" && r.URL.Path != "/login" {
+			t.Errorf("%s %s reached the handler without a session", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	full := sessionFor(t, a, "alice", stageFull)
+	mfa := sessionFor(t, a, "alice", stageMFA)
+	enroll := sessionFor(t, a, "bob", stageEnroll)
+	expired := sessionFor(t, a, "alice", stageFull)
+	a.modify(expired.token, func(s *session) { s.lastSeen = time.Now().Add(-sessionIdleTimeout - time.Minute) })
+
+	tests := []struct {
+		method   string
+		path     string
+		session  *session
+		csrf     string
+		origin   string
+		status   int
+		location string
+	}{
+		{"GET", "/health", nil, "", "", http.StatusOK, ""},
+		{"POST", "/login", nil, "", "", http.StatusOK, ""},
+		{"GET", "/", nil, "", "", http.StatusSeeOther, "/login?next=%2F"},
+		{"GET", "/service/nginx", nil, "", "", http.StatusSeeOther, "/login?next=%2Fservice%2Fnginx"},
+		{"GET", "/status", nil, "", "", http.StatusUnauthorized, ""},
+		{"GET", "/status", &expired, "", "", http.StatusUnauthorized, ""},
+
+		{"GET", "/status", &full, "", "", http.StatusOK, ""},
+		{"POST", "/services/nginx/start", &full, "", "", http.StatusForbidden, ""},
+		{"POST", "/services/nginx/start", &full, "wrong", "", http.StatusForbidden, ""},
+		{"POST", "/services/nginx/start", &full, full.CSRF, "", http.StatusOK, ""},
+		{"POST", "/services/nginx/start", &full, full.CSRF, "https://evil.example", http.StatusForbidden, ""},
+		{"POST", "/services/nginx/start", &full, full.CSRF, "https://panel.example", http.StatusOK, ""},
+		{"POST", "/services/nginx/start", &mfa, full.CSRF, "", http.StatusForbidden, ""},
+
+		{"GET", "/", &mfa, "", "", http.StatusSeeOther, "/login/mfa"},
+		{"GET", "/status", &mfa, "", "", http.StatusUnauthorized, ""},
+		{"GET", "/account", &mfa, "", "", http.StatusSeeOther, "/login/mfa"},
+		{"GET", "/login/mfa", &mfa, "", "", http.StatusOK, ""},
+		{"POST", "/login/webauthn/begin", &mfa, mfa.CSRF, "", http.StatusOK, ""},
+		{"POST", "/logout", &mfa, mfa.CSRF, "", http.StatusOK, ""},
+
+		{"GET", "/", &enroll, "", "", http.StatusSeeOther, "/account"},
+		{"POST", "/services/nginx/start", &enroll, enroll.CSRF, "", http.StatusUnauthorized, ""},
+		{"GET", "/account", &enroll, "", "", http.StatusOK, ""},
+		{"POST", "/account/webauthn/begin", &enroll, enroll.CSRF, "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "https://panel.example"+tt.path, nil)
+		if tt.session != nil {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.session.token})
+		}
+		if tt.csrf != "" {
+			r.Header.Set(csrfHeader, tt.csrf)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		stage := "none"
+		if tt.session != nil {
+			stage = tt.session.User + "/" + tt.session.stage
+		}
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s (session %s): %d %q, want %d %q", tt.method, tt.path, stage, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func login(a *Auth, name string, password string, next string, origin string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {name}, "password": {password}}
+	r := httptest.NewRequest("POST", "https://panel.example/login?next="+url.QueryEscape(next), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	a.Login(w, r)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	a := newTestAuth(t)
+
+	tests := []struct {
+		name     string
+		password string
+		next     string
+		origin   string
+		status   int
+		location string
+	}{
+		{"alice", testPassword, "/service/nginx", "", http.StatusSeeOther, "/service/nginx"},
+		{"alice", testPassword, "//evil.example/", "", http.StatusSeeOther, "/"},
+		{"alice", testPassword, "/", "https://evil.example", http.StatusForbidden, ""},
+		{"bob", testPassword, "/", "", http.StatusSeeOther, "/account"},
+		{"alice", "wrong", "/", "", http.StatusUnauthorized, ""},
+		{"carol", testPassword, "/", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		w := login(a, tt.name, tt.password, tt.next, tt.origin)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("login %s next=%s: %d %q, want %d %q", tt.name, tt.next, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+		if hasCookie := strings.Contains(w.Header().Get("Set-Cookie"), sessionCookie+"="); hasCookie != (tt.status == http.StatusSeeOther) {
+			t.Errorf("login %s next=%s: Set-Cookie %q", tt.name, tt.next, w.Header().Get("Set-Cookie"))
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	a := newTestAuth(t)
+	for i := 0; i < loginMaxFailures; i++ {
+		if w := login(a, "alice", "wrong", "/", ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: %d", i+1, w.Code)
+		}
+	}
+	if w := login(a, "alice", testPassword, "/", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("right password while locked out: %d", w.Code)
+	}
+	a.mu.Lock()
+	a.failures["alice"].until = time.Now().Add(-time.Second)
+	a.mu.Unlock()
+	if w := login(a, "alice", testPassword, "/", ""); w.Code != http.StatusSeeOther {
+		t.Errorf("right password after the lockout: %d", w.Code)
+	}
+}
+
+func TestLoginBusy(t *testing.T) {
+	a := newTestAuth(t)
+	for i := 0; i < loginVerifiers; i++ {
+		a.verifying <- struct{}{}
+	}
+	if w := login(a, "alice", "wrong", "/", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("login with every verifier busy: %d", w.Code)
+	}
+	a.mu.Lock()
+	failed := a.failures["alice"] != nil
+	a.mu.Unlock()
+	if failed {
+		t.Error("a login turned away as busy counted as a failure")
+	}
+
+	<-a.verifying
+	if w := login(a, "alice", testPassword, "/", ""); w.Code != http.StatusSeeOther {
+		t.Errorf("login with a verifier free: %d", w.Code)
+	}
+	if len(a.verifying) != loginVerifiers-1 {
+		t.Errorf("%d verifiers busy after the login, want %d", len(a.verifying), loginVerifiers-1)
+	}
+}
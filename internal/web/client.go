@@ -6,20 +6,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"time"
 
+	"tunapanel/internal/config"
+	"tunapanel/internal/identity"
 	"tunapanel/internal/models"
 )
 
 type AgentClient struct {
-	socketPath string
-	timeout    time.Duration
-	client     *http.Client
+	socketPath  string
+	timeout     time.Duration
+	slowTimeout time.Duration
+	client      *http.Client
+	identityKey []byte
 }
 
-func NewAgentClient(socketPath string, timeout time.Duration) *AgentClient {
+// NewAgentClient returns a client whose calls are bounded by timeout, except
+// for journal queries, which are bounded by slowTimeout.
+func NewAgentClient(socketPath string, timeout time.Duration, slowTimeout time.Duration) *AgentClient {
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			dialer := net.Dialer{Timeout: timeout}
@@ -28,36 +35,200 @@ func NewAgentClient(socketPath string, timeout time.Duration) *AgentClient {
 	}
 
 	return &AgentClient{
-		socketPath: socketPath,
-		timeout:    timeout,
+		socketPath:  socketPath,
+		timeout:     timeout,
+		slowTimeout: slowTimeout,
 		client: &http.Client{
 			Transport: transport,
-			Timeout:   timeout,
 		},
 	}
 }
 
+// SetIdentityKey makes the client tell the agent which web user or API
+// token each request is for, signed with key. The agent must list the web
+// UI's user in trusted_peers with the same key.
+func (c *AgentClient) SetIdentityKey(key []byte) {
+	c.identityKey = key
+}
+
 func (c *AgentClient) Status(ctx context.Context) (models.Response, error) {
 	return c.Do(ctx, models.Request{Command: "status"})
 }
 
-func (c *AgentClient) ListServices(ctx context.Context, state string) (models.Response, error) {
+// ListServices lists units of unitType in state; an empty unitType means
+// services.
+func (c *AgentClient) ListServices(ctx context.Context, state string, unitType string) (models.Response, error) {
 	command := "service.list"
 	switch state {
 	case "", "enabled":
 		command = "service.list"
 	case "running":
 		command = "service.running"
+	case "all":
+		command = "service.all"
+	case "failed":
+		command = "service.failed"
 	default:
 		return models.Response{}, fmt.Errorf("invalid service state")
 	}
 
-	return c.Do(ctx, models.Request{Command: command})
+	return c.Do(ctx, models.Request{Command: command, Type: unitType})
+}
+
+func (c *AgentClient) ShowService(ctx context.Context, name string) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "service.show", Service: name})
+}
+
+func (c *AgentClient) CatService(ctx context.Context, name string) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "service.cat", Service: name})
+}
+
+func (c *AgentClient) ServiceLogs(ctx context.Context, name string, lines int, since string, until string, priority string) (models.Response, error) {
+	return c.do(ctx, models.Request{
+		Command:  "service.logs",
+		Service:  name,
+		Lines:    lines,
+		Since:    since,
+		Until:    until,
+		Priority: priority,
+	}, c.slowTimeout)
+}
+
+// ListTimers reads the state of every timer unit, which can take a while on
+// hosts with many timers.
+func (c *AgentClient) ListTimers(ctx context.Context) (models.Response, error) {
+	return c.do(ctx, models.Request{Command: "timer.list"}, c.slowTimeout)
+}
+
+// ServiceDependencies may walk a large part of the unit graph, so it gets the
+// slow timeout.
+func (c *AgentClient) ServiceDependencies(ctx context.Context, name string) (models.Response, error) {
+	return c.do(ctx, models.Request{Command: "service.deps", Service: name}, c.slowTimeout)
+}
+
+func (c *AgentClient) ListJobs(ctx context.Context) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "job.list"})
+}
+
+func (c *AgentClient) ListScripts(ctx context.Context) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "job.scripts"})
+}
+
+func (c *AgentClient) ListApprovals(ctx context.Context) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "approval.list"})
+}
+
+// DecideApproval approves or rejects a held request. Approving runs the
+// request, which may wait for units to settle, so it gets the bulk timeout.
+func (c *AgentClient) DecideApproval(ctx context.Context, id string, approve bool, reason string) (models.Response, error) {
+	command := "approval.reject"
+	if approve {
+		command = "approval.approve"
+	}
+	return c.do(ctx, models.Request{Command: command, Approval: id, Reason: reason}, config.BulkTimeout)
+}
+
+// ServiceAction starts, stops or restarts a service. The agent waits for the
+// job to finish, so it gets the slow timeout; with wait it also waits for
+// the unit to settle, which may take as long as a bulk request.
+func (c *AgentClient) ServiceAction(ctx context.Context, action string, name string, wait bool) (models.Response, error) {
+	timeout := c.slowTimeout
+	if wait {
+		timeout = config.BulkTimeout
+	}
+	return c.do(ctx, models.Request{Command: "service." + action, Service: name, Wait: wait}, timeout)
+}
+
+// CheckToken asks the agent whether token may run command on unit, which
+// may be empty.
+func (c *AgentClient) CheckToken(ctx context.Context, token string, command string, unit string) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "token.check", Token: token, Check: command, Service: unit})
+}
+
+func (c *AgentClient) ListTokens(ctx context.Context) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "token.list"})
+}
+
+func (c *AgentClient) CreateToken(ctx context.Context, name string, commands []string, units []string, expires string) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "token.create", Name: name, Commands: commands, Units: units, Expires: expires})
+}
+
+func (c *AgentClient) RevokeToken(ctx context.Context, id string) (models.Response, error) {
+	return c.Do(ctx, models.Request{Command: "token.revoke", Token: id})
+}
+
+// JobStatus reads the job's output from the journal, so it gets the slow
+// timeout like ServiceLogs.
+func (c *AgentClient) JobStatus(ctx context.Context, id string, lines int) (models.Response, error) {
+	return c.do(ctx, models.Request{Command: "job.status", Job: id, Lines: lines}, c.slowTimeout)
+}
+
+// StreamLogs follows a unit's journal through the agent's stream endpoint and
+// calls emit for every entry until ctx is cancelled or the agent ends the
+// stream.
+func (c *AgentClient) StreamLogs(ctx context.Context, name string, lines int, priority string, emit func(models.LogEntry) error) error {
+	req := models.Request{
+		Command:  "service.logs",
+		Service:  name,
+		Lines:    lines,
+		Priority: priority,
+	}
+	if err := c.sign(ctx, &req); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://unix/v1/stream", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return classifyError(err, c.timeout)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var out models.Response
+		if err := dec.Decode(&out); err == nil && out.Error != "" {
+			return errors.New(out.Error)
+		}
+		return fmt.Errorf("agent error: %s", resp.Status)
+	}
+
+	for {
+		var entry models.LogEntry
+		if err := dec.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := emit(entry); err != nil {
+			return err
+		}
+	}
 }
 
 func (c *AgentClient) Do(ctx context.Context, req models.Request) (models.Response, error) {
+	return c.do(ctx, req, c.timeout)
+}
+
+func (c *AgentClient) do(ctx context.Context, req models.Request, timeout time.Duration) (models.Response, error) {
 	var out models.Response
 
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := c.sign(ctx, &req); err != nil {
+		return out, err
+	}
 	payload, err := json.Marshal(req)
 	if err != nil {
 		return out, err
@@ -71,7 +242,7 @@ func (c *AgentClient) Do(ctx context.Context, req models.Request) (models.Respon
 
 	resp, err := c.client.Do(httpReq)
 	if err != nil {
-		return out, classifyError(err, c.timeout)
+		return out, classifyError(err, timeout)
 	}
 	defer resp.Body.Close()
 
@@ -80,7 +251,8 @@ func (c *AgentClient) Do(ctx context.Context, req models.Request) (models.Respon
 		return out, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	// 202 means the request is waiting for approval.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		if out.Error != "" {
 			return out, errors.New(out.Error)
 		}
@@ -96,6 +268,19 @@ func (c *AgentClient) Do(ctx context.Context, req models.Request) (models.Respon
 	return out, nil
 }
 
+// sign names the web user or API token behind ctx in req, if the client
+// has an identity key and ctx has someone.
+func (c *AgentClient) sign(ctx context.Context, req *models.Request) error {
+	if c.identityKey == nil {
+		return nil
+	}
+	user, ok := actorFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return identity.Sign(c.identityKey, req, user, time.Now())
+}
+
 func classifyError(err error, timeout time.Duration) error {
 	if errors.Is(err, context.DeadlineExceeded) {
 		return fmt.Errorf("agent timeout after %s", timeout)
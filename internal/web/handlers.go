@@ -3,9 +3,16 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"tunapanel/internal/config"
+	"tunapanel/internal/models"
 )
 
 type Handlers struct {
@@ -14,12 +21,25 @@ type Handlers struct {
 }
 
 type statusPayload struct {
-	OK           bool     `json:"ok"`
-	AgentOK      bool     `json:"agent_ok"`
-	AgentMessage string   `json:"agent_message,omitempty"`
-	AgentError   string   `json:"agent_error,omitempty"`
-	Error        string   `json:"error,omitempty"`
-	Services     []string `json:"services,omitempty"`
+	OK           bool                   `json:"ok"`
+	AgentOK      bool                   `json:"agent_ok"`
+	AgentMessage string                 `json:"agent_message,omitempty"`
+	AgentError   string                 `json:"agent_error,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+	Services     []models.ServiceInfo   `json:"services,omitempty"`
+	Service      *models.ServiceStatus  `json:"service,omitempty"`
+	Logs         []models.LogEntry      `json:"logs,omitempty"`
+	Dependencies *models.DependencyTree `json:"dependencies,omitempty"`
+	Timers       []models.TimerInfo     `json:"timers,omitempty"`
+	Files        []models.UnitFile      `json:"files,omitempty"`
+	Jobs         []models.JobInfo       `json:"jobs,omitempty"`
+	Job          *models.JobInfo        `json:"job,omitempty"`
+	Scripts      []string               `json:"scripts,omitempty"`
+	Approvals    []models.ApprovalInfo  `json:"approvals,omitempty"`
+	Message      string                 `json:"message,omitempty"`
+	Token        *models.TokenInfo      `json:"token,omitempty"`
+	Tokens       []models.TokenInfo     `json:"tokens,omitempty"`
+	Diagnosis    *models.UnitDiagnosis  `json:"diagnosis,omitempty"`
 }
 
 type statusPage struct {
@@ -27,10 +47,35 @@ type statusPage struct {
 	AgentOK       bool
 	AgentMessage  string
 	AgentError    string
-	Services      []string
+	Services      []models.ServiceInfo
 	ServiceState  string
+	UnitType      string
 	TotalServices int
+	FailedUnits   int
 	CheckedAt     string
+	User          string
+	CSRFToken     string
+}
+
+type servicePage struct {
+	Name       string
+	AgentOK    bool
+	AgentError string
+	Service    *models.ServiceStatus
+	Since      string
+	Uptime     string
+	Memory     string
+	CheckedAt  string
+	User       string
+	CSRFToken  string
+}
+
+// serviceActions are the service commands the web UI offers to logged-in
+// users.
+var serviceActions = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"restart": true,
 }
 
 func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
@@ -78,7 +123,7 @@ func (h *Handlers) Services(w http.ResponseWriter, r *http.Request) {
 	if state == "" {
 		state = "enabled"
 	}
-	if state != "enabled" && state != "running" {
+	if !validServiceState(state) {
 		writeJSON(w, http.StatusBadRequest, statusPayload{
 			OK:    false,
 			Error: "invalid service state",
@@ -86,10 +131,22 @@ func (h *Handlers) Services(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	unitType := r.URL.Query().Get("type")
+	if unitType == "" {
+		unitType = "service"
+	}
+	if !validUnitType(unitType) {
+		writeJSON(w, http.StatusBadRequest, statusPayload{
+			OK:    false,
+			Error: "invalid unit type",
+		})
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), h.client.timeout)
 	defer cancel()
 
-	resp, err := h.client.ListServices(ctx, state)
+	resp, err := h.client.ListServices(ctx, state, unitType)
 	if err != nil {
 		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
 			OK:         false,
@@ -106,6 +163,513 @@ func (h *Handlers) Services(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (h *Handlers) Timers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+		return
+	}
+
+	resp, err := h.client.ListTimers(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Timers:  resp.Timers,
+	})
+}
+
+// Jobs lists the jobs the agent started and the scripts it can run.
+func (h *Handlers) Jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.client.timeout)
+	defer cancel()
+
+	resp, err := h.client.ListJobs(ctx)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+	scripts, err := h.client.ListScripts(ctx)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Jobs:    resp.Jobs,
+		Scripts: scripts.Scripts,
+	})
+}
+
+// Approvals lists requests waiting for, or decided by, a second person.
+// Logged-in users decide them with POST /approvals/{id}/approve or reject.
+func (h *Handlers) Approvals(w http.ResponseWriter, r *http.Request) {
+	if id, decision, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/approvals/"), "/"); ok {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+			return
+		}
+		if id == "" || (decision != "approve" && decision != "reject") {
+			writeJSON(w, http.StatusNotFound, statusPayload{OK: false, Error: "not found"})
+			return
+		}
+		h.decideApproval(w, r, id, decision == "approve")
+		return
+	}
+	if r.URL.Path != "/approvals" {
+		writeJSON(w, http.StatusNotFound, statusPayload{OK: false, Error: "not found"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+		return
+	}
+
+	resp, err := h.client.ListApprovals(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:        true,
+		AgentOK:   true,
+		Approvals: resp.Approvals,
+	})
+}
+
+// decideApproval approves or rejects a held request for the logged-in
+// user. The agent decides whether they may; with an identity key it knows
+// who they are and refuses their own requests.
+func (h *Handlers) decideApproval(w http.ResponseWriter, r *http.Request, id string, approve bool) {
+	s, ok := currentSession(r)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, statusPayload{
+			OK:    false,
+			Error: "deciding approvals requires login; start tunapanel with --accounts",
+		})
+		return
+	}
+	// Approving runs the request, which may wait for units to settle.
+	if approve {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(config.BulkTimeout))
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := readAuthJSON(w, r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, statusPayload{OK: false, Error: "invalid request: " + err.Error()})
+			return
+		}
+	}
+	event := "approval.reject"
+	if approve {
+		event = "approval.approve"
+	}
+
+	resp, err := h.client.DecideApproval(r.Context(), id, approve, body.Reason)
+	if err != nil && resp.Approval == nil {
+		audit(r, event+".failure", s.User, "approval", id, "error", err.Error())
+		writeAgentError(w, resp, err)
+		return
+	}
+	// An approved request that then failed is still decided.
+	outcome := "ok"
+	if err != nil {
+		outcome = err.Error()
+	}
+	audit(r, event, s.User, "approval", id, "command", resp.Approval.Command, "outcome", outcome)
+	message := resp.Message
+	if err != nil {
+		message = fmt.Sprintf("approved %s, which failed: %s", id, err)
+	}
+	writeJSON(w, http.StatusOK, statusPayload{OK: true, AgentOK: true, Message: message})
+}
+
+// Job returns a job's state and output.
+func (h *Handlers) Job(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSON(w, http.StatusNotFound, statusPayload{
+			OK:    false,
+			Error: "not found",
+		})
+		return
+	}
+	lines := 0
+	if value := r.URL.Query().Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, statusPayload{
+				OK:    false,
+				Error: "invalid lines",
+			})
+			return
+		}
+		lines = n
+	}
+
+	resp, err := h.client.JobStatus(r.Context(), id, lines)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Job:     resp.Job,
+		Logs:    resp.Logs,
+	})
+}
+
+func (h *Handlers) Service(w http.ResponseWriter, r *http.Request) {
+	name, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/services/"), "/")
+	if r.Method == http.MethodPost && name != "" && serviceActions[sub] {
+		h.serviceAction(w, r, name, sub)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+		return
+	}
+
+	if name == "" || (sub != "" && sub != "logs" && sub != "logs/stream" && sub != "deps" && sub != "files") {
+		writeJSON(w, http.StatusNotFound, statusPayload{
+			OK:    false,
+			Error: "not found",
+		})
+		return
+	}
+	switch sub {
+	case "logs":
+		h.serviceLogs(w, r, name)
+		return
+	case "logs/stream":
+		h.streamLogs(w, r, name)
+		return
+	case "deps":
+		h.serviceDependencies(w, r, name)
+		return
+	case "files":
+		h.serviceFiles(w, r, name)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.client.timeout)
+	defer cancel()
+
+	resp, err := h.client.ShowService(ctx, name)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Service: resp.Service,
+	})
+}
+
+// serviceAction runs start, stop or restart for the logged-in user or an
+// API token. Without accounts or a token there is no one to run it for and
+// the web UI stays read-only. With ?wait=true the agent also waits for the
+// unit to settle and explains why it did not.
+func (h *Handlers) serviceAction(w http.ResponseWriter, r *http.Request, name string, action string) {
+	user, ok := actor(r)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, statusPayload{
+			OK:    false,
+			Error: "service actions require login or an API token; start tunapanel with --accounts",
+		})
+		return
+	}
+	wait := false
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = strconv.ParseBool(value); err != nil {
+			writeJSON(w, http.StatusBadRequest, statusPayload{
+				OK:    false,
+				Error: "invalid wait",
+			})
+			return
+		}
+	}
+	if wait {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(config.BulkTimeout))
+	}
+
+	resp, err := h.client.ServiceAction(r.Context(), action, name, wait)
+	if err != nil {
+		log.Printf("action user=%s service=%s action=%s error=%q", user, name, action, err)
+		// A unit that would not start, stop or settle is not a bad request.
+		if resp.Error != "" && resp.Code == "" {
+			writeJSON(w, http.StatusConflict, statusPayload{OK: false, AgentOK: true, Error: err.Error(), Diagnosis: resp.Diagnosis})
+			return
+		}
+		writeAgentError(w, resp, err)
+		return
+	}
+	status, outcome := http.StatusOK, "ok"
+	if resp.Approval != nil {
+		status, outcome = http.StatusAccepted, "pending approval "+resp.Approval.ID
+	}
+	log.Printf("action user=%s service=%s action=%s %s", user, name, action, outcome)
+	writeJSON(w, status, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Message: resp.Message,
+	})
+}
+
+func (h *Handlers) serviceLogs(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	lines := 0
+	if value := query.Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, statusPayload{
+				OK:    false,
+				Error: "invalid lines",
+			})
+			return
+		}
+		lines = n
+	}
+
+	resp, err := h.client.ServiceLogs(r.Context(), name, lines, query.Get("since"), query.Get("until"), query.Get("priority"))
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Logs:    resp.Logs,
+	})
+}
+
+func (h *Handlers) serviceDependencies(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.client.ServiceDependencies(r.Context(), name)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:           true,
+		AgentOK:      true,
+		Dependencies: resp.Dependencies,
+	})
+}
+
+func (h *Handlers) serviceFiles(w http.ResponseWriter, r *http.Request, name string) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.client.timeout)
+	defer cancel()
+
+	resp, err := h.client.CatService(ctx, name)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{
+			OK:         false,
+			AgentOK:    false,
+			AgentError: err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusPayload{
+		OK:      true,
+		AgentOK: true,
+		Files:   resp.Files,
+	})
+}
+
+// streamLogs bridges the agent's log stream to the browser as Server-Sent
+// Events. Each journal entry is sent as a "log" event carrying the JSON
+// entry; a comment line is sent periodically to keep idle connections open.
+func (h *Handlers) streamLogs(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	lines := 0
+	if value := query.Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, statusPayload{
+				OK:    false,
+				Error: "invalid lines",
+			})
+			return
+		}
+		lines = n
+	}
+
+	// The server timeouts would otherwise cut the stream and, for the read
+	// deadline, cancel the request context.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	entries := make(chan models.LogEntry)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.client.StreamLogs(ctx, name, lines, query.Get("priority"), func(entry models.LogEntry) error {
+			select {
+			case entries <- entry:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case entry := <-entries:
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: log\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			_ = rc.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			_ = rc.Flush()
+		case err := <-errCh:
+			msg := "stream closed"
+			if err != nil {
+				msg = err.Error()
+			}
+			data, _ := json.Marshal(msg)
+			fmt.Fprintf(w, "event: end\ndata: %s\n\n", data)
+			_ = rc.Flush()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Handlers) ServicePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/service/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.client.timeout)
+	defer cancel()
+
+	page := servicePage{
+		Name:      name,
+		CheckedAt: time.Now().Format(time.RFC3339),
+	}
+	if s, ok := currentSession(r); ok {
+		page.User = s.User
+		page.CSRFToken = s.CSRF
+	}
+
+	resp, err := h.client.ShowService(ctx, name)
+	if err != nil {
+		page.AgentError = err.Error()
+	} else {
+		page.AgentOK = true
+		page.Service = resp.Service
+		if svc := resp.Service; svc != nil {
+			if svc.ExecMainStartTimestamp != nil && svc.ActiveState == "active" {
+				page.Since = svc.ExecMainStartTimestamp.Format(time.RFC3339)
+				page.Uptime = time.Since(*svc.ExecMainStartTimestamp).Truncate(time.Second).String()
+			}
+			if svc.MemoryCurrent > 0 {
+				page.Memory = formatBytes(svc.MemoryCurrent)
+			}
+		}
+	}
+
+	renderTemplate(w, h.tmpl, "service.html", page)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func (h *Handlers) Index(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -118,27 +682,52 @@ func (h *Handlers) Index(w http.ResponseWriter, r *http.Request) {
 	page := statusPage{
 		WebOK:        true,
 		ServiceState: "enabled",
+		UnitType:     "service",
 		CheckedAt:    time.Now().Format(time.RFC3339),
 	}
+	if s, ok := currentSession(r); ok {
+		page.User = s.User
+		page.CSRFToken = s.CSRF
+	}
 
 	resp, err := h.client.Status(ctx)
 	if err != nil {
 		page.AgentOK = false
 		page.AgentError = err.Error()
-		renderTemplate(w, h.tmpl, page)
+		renderTemplate(w, h.tmpl, "status.html", page)
 		return
 	}
 
 	page.AgentOK = true
 	page.AgentMessage = resp.Message
 
-	servicesResp, err := h.client.ListServices(ctx, page.ServiceState)
+	servicesResp, err := h.client.ListServices(ctx, page.ServiceState, page.UnitType)
 	if err == nil {
 		page.Services = servicesResp.Services
 		page.TotalServices = len(page.Services)
 	}
+	failedResp, err := h.client.ListServices(ctx, "failed", "all")
+	if err == nil {
+		page.FailedUnits = len(failedResp.Services)
+	}
+
+	renderTemplate(w, h.tmpl, "status.html", page)
+}
 
-	renderTemplate(w, h.tmpl, page)
+func validServiceState(state string) bool {
+	switch state {
+	case "enabled", "running", "all", "failed":
+		return true
+	}
+	return false
+}
+
+func validUnitType(unitType string) bool {
+	switch unitType {
+	case "service", "socket", "path", "mount", "target", "timer", "all":
+		return true
+	}
+	return false
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload statusPayload) {
@@ -157,9 +746,9 @@ func writeHealth(w http.ResponseWriter, status int, ok bool) {
 	}{OK: ok})
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl *template.Template, data statusPage) {
+func renderTemplate(w http.ResponseWriter, tmpl *template.Template, name string, data interface{}) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := tmpl.Execute(w, data); err != nil {
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
 		http.Error(w, "template error", http.StatusInternalServerError)
 	}
 }
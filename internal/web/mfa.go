@@ -0,0 +1,144 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Second factor requirements, set per user in the accounts file.
+const (
+	requireNone     = ""
+	requireMFA      = "mfa"
+	requireWebAuthn = "webauthn"
+)
+
+// mfaRecord is a user's enrolled second factors.
+type mfaRecord struct {
+	TOTPSecret      string               `json:"totp_secret,omitempty"`
+	TOTPLastCounter int64                `json:"totp_last_counter,omitempty"`
+	TOTPAdded       *time.Time           `json:"totp_added,omitempty"`
+	RecoveryCodes   []string             `json:"recovery_codes,omitempty"`
+	Credentials     []webAuthnCredential `json:"credentials,omitempty"`
+}
+
+// webAuthnCredential is a registered security key.
+type webAuthnCredential struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	RPID      string     `json:"rp_id"`
+	Alg       int        `json:"alg"`
+	PublicKey []byte     `json:"public_key"`
+	SignCount uint32     `json:"sign_count"`
+	Added     time.Time  `json:"added"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+func (r mfaRecord) enrolled() bool {
+	return r.TOTPSecret != "" || len(r.Credentials) > 0
+}
+
+// MFAStore keeps second factors in a JSON file that only the web UI can
+// read, since it holds the TOTP secrets. Every change rewrites the file.
+type MFAStore struct {
+	path  string
+	mu    sync.Mutex
+	users map[string]mfaRecord
+}
+
+// LoadMFAStore reads path, which need not exist yet; its directory must.
+func LoadMFAStore(path string) (*MFAStore, error) {
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	s := &MFAStore{path: path, users: make(map[string]mfaRecord)}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s: must only be accessible by its owner", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// get returns a copy of name's record.
+func (s *MFAStore) get(name string) mfaRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyRecord(s.users[name])
+}
+
+// update applies change to a copy of name's record and saves it; nothing
+// changes if change or saving fails.
+func (s *MFAStore) update(name string, change func(*mfaRecord) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := copyRecord(s.users[name])
+	if err := change(&record); err != nil {
+		return err
+	}
+
+	users := make(map[string]mfaRecord, len(s.users)+1)
+	for k, v := range s.users {
+		users[k] = v
+	}
+	if record.enrolled() || len(record.RecoveryCodes) > 0 {
+		users[name] = record
+	} else {
+		delete(users, name)
+	}
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".mfa-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+func copyRecord(r mfaRecord) mfaRecord {
+	r.RecoveryCodes = append([]string(nil), r.RecoveryCodes...)
+	r.Credentials = append([]webAuthnCredential(nil), r.Credentials...)
+	return r
+}
+
+// audit logs a security event: logins, second factor use and enrollment
+// changes. details are appended as key=value pairs.
+func audit(r *http.Request, event string, user string, details ...string) {
+	line := fmt.Sprintf("audit event=%s user=%q remote=%s", event, user, r.RemoteAddr)
+	for i := 0; i+1 < len(details); i += 2 {
+		line += fmt.Sprintf(" %s=%q", details[i], details[i+1])
+	}
+	log.Print(line)
+}
@@ -8,8 +8,10 @@ import (
 )
 
 const (
-	defaultAddr  = "127.0.0.1:8080"
-	agentTimeout = 800 * time.Millisecond
+	defaultAddr      = "127.0.0.1:8080"
+	agentTimeout     = 800 * time.Millisecond
+	agentSlowTimeout = 5 * time.Second
+	sseKeepalive     = 15 * time.Second
 )
 
 //go:embed templates/*.html
@@ -20,8 +22,11 @@ type Server struct {
 	Handler http.Handler
 }
 
-func NewServer(client *AgentClient) (*Server, error) {
-	tmpl, err := template.ParseFS(templateFS, "templates/status.html")
+// NewServer returns the web UI. With auth it requires users to log in and
+// offers service actions; with a nil auth it is read-only and open to
+// anyone who can reach it. Either way the JSON endpoints accept API tokens.
+func NewServer(client *AgentClient, auth *Auth) (*Server, error) {
+	tmpl, err := template.ParseFS(templateFS, "templates/*.html")
 	if err != nil {
 		return nil, err
 	}
@@ -36,13 +41,35 @@ func NewServer(client *AgentClient) (*Server, error) {
 	mux.HandleFunc("/health", handlers.Health)
 	mux.HandleFunc("/status", handlers.Status)
 	mux.HandleFunc("/services", handlers.Services)
+	mux.HandleFunc("/services/", handlers.Service)
+	mux.HandleFunc("/timers", handlers.Timers)
+	mux.HandleFunc("/jobs", handlers.Jobs)
+	mux.HandleFunc("/jobs/", handlers.Job)
+	mux.HandleFunc("/approvals", handlers.Approvals)
+	mux.HandleFunc("/approvals/", handlers.Approvals)
+	mux.HandleFunc("/service/", handlers.ServicePage)
+	mux.HandleFunc("/tokens", handlers.Tokens)
+	mux.HandleFunc("/tokens/", handlers.Tokens)
+
+	var handler http.Handler = mux
+	if auth != nil {
+		auth.tmpl = tmpl
+		mux.HandleFunc("/login", auth.Login)
+		mux.HandleFunc("/login/mfa", auth.LoginMFA)
+		mux.HandleFunc("/login/webauthn/", auth.WebAuthnLogin)
+		mux.HandleFunc("/logout", auth.Logout)
+		mux.HandleFunc("/account", auth.Account)
+		mux.HandleFunc("/account/", auth.Account)
+		handler = auth.Wrap(mux)
+	}
+	handler = handlers.Bearer(mux, handler)
 
 	return &Server{
 		Addr:    defaultAddr,
-		Handler: mux,
+		Handler: handler,
 	}, nil
 }
 
 func DefaultAgentClient(socketPath string) *AgentClient {
-	return NewAgentClient(socketPath, agentTimeout)
+	return NewAgentClient(socketPath, agentTimeout, agentSlowTimeout)
 }
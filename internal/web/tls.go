@@ -0,0 +1,254 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// tlsCheckInterval is how often handshakes look for changed
+	// certificate files.
+	tlsCheckInterval = 5 * time.Second
+
+	selfSignedName        = "tunapanel self-signed"
+	selfSignedValidity    = 365 * 24 * time.Hour
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+)
+
+// TLSOptions configures HTTPS.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile signs the client certificates that log in by common name.
+	ClientCAFile      string
+	RequireClientCert bool
+	// Hosts are the names in a self-signed certificate.
+	Hosts []string
+}
+
+// NewTLSConfig returns a server configuration that picks up changes to the
+// certificate, key and client CA files without a restart.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.RequireClientCert && opts.ClientCAFile == "" {
+		return nil, errors.New("requiring client certificates needs a client CA file")
+	}
+	if err := ensureCertificate(opts); err != nil {
+		return nil, err
+	}
+	reloader := &tlsReloader{opts: opts}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &reloader.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.current(), nil
+		},
+	}, nil
+}
+
+// tlsReloader rebuilds the configuration when the files change, keeping the
+// last one that loaded.
+type tlsReloader struct {
+	opts TLSOptions
+
+	mu      sync.Mutex
+	checked time.Time
+	stamp   string
+	config  *tls.Config
+}
+
+func (t *tlsReloader) current() *tls.Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now := time.Now(); now.Sub(t.checked) >= tlsCheckInterval {
+		t.checked = now
+		if t.fileStamp() != t.stamp {
+			if err := t.loadLocked(); err != nil {
+				log.Printf("keeping the current TLS certificate: %v", err)
+			} else {
+				log.Printf("reloaded TLS certificate from %s", t.opts.CertFile)
+			}
+		}
+	}
+	return t.config
+}
+
+func (t *tlsReloader) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checked = time.Now()
+	return t.loadLocked()
+}
+
+func (t *tlsReloader) loadLocked() error {
+	stamp := t.fileStamp()
+	cert, err := tls.LoadX509KeyPair(t.opts.CertFile, t.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if t.opts.ClientCAFile != "" {
+		data, err := os.ReadFile(t.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no certificates found", t.opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.opts.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	t.config = config
+	t.stamp = stamp
+	return nil
+}
+
+// fileStamp sums up the modification times and sizes of the files.
+func (t *tlsReloader) fileStamp() string {
+	stamp := ""
+	for _, path := range []string{t.opts.CertFile, t.opts.KeyFile, t.opts.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamp += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+		} else {
+			stamp += "-;"
+		}
+	}
+	return stamp
+}
+
+// ensureCertificate writes a self-signed certificate when there is none,
+// and replaces one it wrote before when it is about to expire.
+func ensureCertificate(opts TLSOptions) error {
+	_, certErr := os.Stat(opts.CertFile)
+	_, keyErr := os.Stat(opts.KeyFile)
+	switch {
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+	case certErr != nil:
+		return certErr
+	case keyErr != nil:
+		return keyErr
+	default:
+		data, err := os.ReadFile(opts.CertFile)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || cert.Subject.CommonName != selfSignedName ||
+			time.Until(cert.NotAfter) > selfSignedRenewBefore {
+			return nil
+		}
+	}
+	return writeSelfSigned(opts.CertFile, opts.KeyFile, opts.Hosts)
+}
+
+func writeSelfSigned(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: selfSignedName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(der)
+	log.Printf("wrote a self-signed TLS certificate to %s (SHA-256 fingerprint %s)", certFile, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tls-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// clientCertUser returns the common name of the client certificate r was
+// made with, if the handshake verified one.
+func clientCertUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	opts := TLSOptions{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"), Hosts: []string{"panel.example", "127.0.0.1"}}
+	config, err := NewTLSConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != selfSignedName || leaf.VerifyHostname("panel.example") != nil || leaf.VerifyHostname("127.0.0.1") != nil {
+		t.Errorf("certificate for %s, %v, %v", leaf.Subject.CommonName, leaf.DNSNames, leaf.IPAddresses)
+	}
+	if info, err := os.Stat(opts.KeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", info, err)
+	}
+
+	// A certificate that is still good is kept.
+	before, _ := os.ReadFile(opts.CertFile)
+	if err := ensureCertificate(opts); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(opts.CertFile); string(after) != string(before) {
+		t.Error("a valid self-signed certificate was replaced")
+	}
+
+	if _, err := NewTLSConfig(TLSOptions{CertFile: opts.CertFile, KeyFile: opts.KeyFile, RequireClientCert: true}); err == nil {
+		t.Error("requiring client certificates without a CA was accepted")
+	}
+	if err := os.Remove(opts.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTLSConfig(opts); err == nil {
+		t.Error("a certificate without its key was accepted")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	opts := TLSOptions{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	if err := writeSelfSigned(opts.CertFile, opts.KeyFile, []string{"one.example"}); err != nil {
+		t.Fatal(err)
+	}
+	r := &tlsReloader{opts: opts}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	first := r.current()
+
+	recheck := func() *tls.Config {
+		r.mu.Lock()
+		r.checked = time.Time{}
+		r.mu.Unlock()
+		return r.current()
+	}
+	if recheck() != first {
+		t.Error("the configuration was rebuilt although no file changed")
+	}
+
+	// A certificate replaced before its key keeps the old configuration.
+	other := t.TempDir()
+	if err := writeSelfSigned(filepath.Join(other, "cert.pem"), filepath.Join(other, "key.pem"), []string{"two.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(other, "cert.pem"), opts.CertFile); err != nil {
+		t.Fatal(err)
+	}
+	if recheck() != first {
+		t.Error("a mismatched certificate and key replaced the configuration")
+	}
+
+	if err := os.Rename(filepath.Join(other, "key.pem"), opts.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	config := recheck()
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config == first || leaf.DNSNames[0] != "two.example" {
+		t.Errorf("after replacing both files the certificate is for %v", leaf.DNSNames)
+	}
+}
+
+func TestClientCertificateLogin(t *testing.T) {
+	a := newTestAuth(t)
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := currentSession(r)
+		w.Write([]byte(s.User))
+	}))
+	request := func(method string, path string, commonName string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "https://panel.example"+path, nil)
+		if commonName != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("GET", "/", "alice")
+	if w.Code != http.StatusOK || w.Body.String() != "alice" || !strings.Contains(w.Header().Get("Set-Cookie"), sessionCookie+"=") {
+		t.Errorf("page with alice's certificate: %d %q, cookie %q", w.Code, w.Body.String(), w.Header().Get("Set-Cookie"))
+	}
+	if w := request("GET", "/status", "alice"); w.Code != http.StatusOK || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("API call with alice's certificate: %d, cookie %q", w.Code, w.Header().Get("Set-Cookie"))
+	}
+	if w := request("POST", "/services/nginx/start", "alice"); w.Code != http.StatusForbidden {
+		t.Errorf("POST with a certificate but no CSRF token: %d", w.Code)
+	}
+	if w := request("GET", "/status", "mallory"); w.Code != http.StatusUnauthorized {
+		t.Errorf("certificate for an unknown account: %d", w.Code)
+	}
+	// bob must enroll a security key, which a certificate does not replace.
+	if w := request("GET", "/status", "bob"); w.Code != http.StatusUnauthorized {
+		t.Errorf("API call with bob's certificate: %d", w.Code)
+	}
+	if w := request("GET", "/", "bob"); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/account" {
+		t.Errorf("page with bob's certificate: %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,207 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"tunapanel/internal/models"
+)
+
+type tokenKey struct{}
+
+// Bearer serves requests that carry an API token in an Authorization
+// header. The agent checks the token against the command the endpoint
+// runs, and the request goes to api without a session or CSRF token, which
+// only protect browsers. Requests without a token go to next.
+func (h *Handlers) Bearer(api http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok || r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		command, unit, ok := apiTarget(r)
+		if !ok {
+			writeJSON(w, http.StatusForbidden, statusPayload{OK: false, Error: "not available to API tokens"})
+			return
+		}
+
+		resp, err := h.client.CheckToken(r.Context(), token, command, unit)
+		if err != nil {
+			status := http.StatusServiceUnavailable
+			switch resp.Code {
+			case models.CodeInvalidToken:
+				status = http.StatusUnauthorized
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			case models.CodePolicyDenied:
+				status = http.StatusForbidden
+			}
+			if status == http.StatusServiceUnavailable {
+				writeJSON(w, status, statusPayload{OK: false, AgentOK: false, AgentError: err.Error()})
+				return
+			}
+			user := ""
+			if resp.Token != nil {
+				user = "token:" + resp.Token.ID
+			}
+			audit(r, "api.token.failure", user, "command", command, "unit", unit, "error", err.Error())
+			writeJSON(w, status, statusPayload{OK: false, AgentOK: true, Error: err.Error()})
+			return
+		}
+		api.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, *resp.Token)))
+	})
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// apiTarget returns the agent command an API endpoint runs, and the unit
+// it runs it on, for checking a token's scope. Pages and the login and
+// token endpoints are not available to tokens.
+func apiTarget(r *http.Request) (string, string, bool) {
+	switch r.URL.Path {
+	case "/status":
+		return "status", "", true
+	case "/services":
+		switch r.URL.Query().Get("state") {
+		case "running":
+			return "service.running", "", true
+		case "all":
+			return "service.all", "", true
+		case "failed":
+			return "service.failed", "", true
+		}
+		return "service.list", "", true
+	case "/timers":
+		return "timer.list", "", true
+	case "/jobs":
+		return "job.list", "", true
+	case "/approvals":
+		return "approval.list", "", true
+	}
+	if id, ok := strings.CutPrefix(r.URL.Path, "/jobs/"); ok && id != "" {
+		return "job.status", "", true
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/services/")
+	if !ok {
+		return "", "", false
+	}
+	name, sub, _ := strings.Cut(rest, "/")
+	if name == "" {
+		return "", "", false
+	}
+	switch {
+	case sub == "":
+		return "service.show", name, true
+	case sub == "logs" || sub == "logs/stream":
+		return "service.logs", name, true
+	case sub == "deps":
+		return "service.deps", name, true
+	case sub == "files":
+		return "service.cat", name, true
+	case serviceActions[sub]:
+		return "service." + sub, name, true
+	}
+	return "", "", false
+}
+
+// currentToken returns the API token Bearer attached to r, if any.
+func currentToken(r *http.Request) (models.TokenInfo, bool) {
+	t, ok := r.Context().Value(tokenKey{}).(models.TokenInfo)
+	return t, ok
+}
+
+// actor names who is behind r in logs and to the agent: the logged-in
+// user, or the API token as "token:<id>".
+func actor(r *http.Request) (string, bool) {
+	return actorFromContext(r.Context())
+}
+
+func actorFromContext(ctx context.Context) (string, bool) {
+	if s, ok := ctx.Value(sessionKey{}).(session); ok {
+		return s.User, true
+	}
+	if t, ok := ctx.Value(tokenKey{}).(models.TokenInfo); ok {
+		return "token:" + t.ID, true
+	}
+	return "", false
+}
+
+// Tokens lets logged-in users manage API tokens: GET /tokens lists them,
+// POST /tokens creates one and POST /tokens/{id}/revoke revokes one. The
+// agent keeps the tokens, owned by the web UI's own user, so every
+// logged-in user sees the same ones.
+func (h *Handlers) Tokens(w http.ResponseWriter, r *http.Request) {
+	s, ok := currentSession(r)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, statusPayload{
+			OK:    false,
+			Error: "managing tokens requires login; start tunapanel with --accounts",
+		})
+		return
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/tokens"), "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		resp, err := h.client.ListTokens(r.Context())
+		if err != nil {
+			writeAgentError(w, resp, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, statusPayload{OK: true, AgentOK: true, Tokens: resp.Tokens})
+	case id == "" && r.Method == http.MethodPost:
+		var body struct {
+			Name     string   `json:"name"`
+			Commands []string `json:"commands"`
+			Units    []string `json:"units"`
+			Expires  string   `json:"expires"`
+		}
+		if err := readAuthJSON(w, r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, statusPayload{OK: false, Error: "invalid request: " + err.Error()})
+			return
+		}
+		resp, err := h.client.CreateToken(r.Context(), body.Name, body.Commands, body.Units, body.Expires)
+		if err != nil {
+			writeAgentError(w, resp, err)
+			return
+		}
+		audit(r, "token.create", s.User, "token", resp.Token.ID, "name", resp.Token.Name,
+			"commands", strings.Join(resp.Token.Commands, ","), "units", strings.Join(resp.Token.Units, ","))
+		writeJSON(w, http.StatusOK, statusPayload{OK: true, AgentOK: true, Message: resp.Message, Token: resp.Token})
+	case id != "" && sub == "revoke" && r.Method == http.MethodPost:
+		resp, err := h.client.RevokeToken(r.Context(), id)
+		if err != nil {
+			writeAgentError(w, resp, err)
+			return
+		}
+		audit(r, "token.revoke", s.User, "token", id)
+		writeJSON(w, http.StatusOK, statusPayload{OK: true, AgentOK: true, Message: resp.Message})
+	case id == "" || sub == "revoke":
+		writeJSON(w, http.StatusMethodNotAllowed, statusPayload{OK: false})
+	default:
+		writeJSON(w, http.StatusNotFound, statusPayload{OK: false, Error: "not found"})
+	}
+}
+
+// writeAgentError reports a failed agent request: refused requests as the
+// agent's error, anything else as the agent being unavailable.
+func writeAgentError(w http.ResponseWriter, resp models.Response, err error) {
+	switch {
+	case resp.Code == models.CodePolicyDenied:
+		writeJSON(w, http.StatusForbidden, statusPayload{OK: false, AgentOK: true, Error: err.Error()})
+	case resp.Code == models.CodeProtectedUnit:
+		writeJSON(w, http.StatusConflict, statusPayload{OK: false, AgentOK: true, Error: err.Error()})
+	case resp.Error != "":
+		writeJSON(w, http.StatusBadRequest, statusPayload{OK: false, AgentOK: true, Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusServiceUnavailable, statusPayload{OK: false, AgentOK: false, AgentError: err.Error()})
+	}
+}
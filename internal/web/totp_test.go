@@ -0,0 +1,90 @@
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA-1 key of the RFC 4226 and RFC 6238 test vectors.
+var rfcKey = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 4226 appendix D.
+	hotp := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, want := range hotp {
+		if got := totpCode(rfcKey, int64(counter)); got != want {
+			t.Errorf("counter %d: %s, want %s", counter, got, want)
+		}
+	}
+
+	// RFC 6238 appendix B, SHA-1; the vectors have eight digits, of which
+	// a six-digit code is the last six.
+	totp := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range totp {
+		if got := totpCode(rfcKey, unix/totpPeriod); got != want[2:] {
+			t.Errorf("time %d: %s, want %s", unix, got, want[2:])
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	code := func(counter int64) string { return totpCode(rfcKey, counter) }
+
+	tests := []struct {
+		name    string
+		code    string
+		last    int64
+		counter int64
+		ok      bool
+	}{
+		{"current", code(step), 0, step, true},
+		{"previous step", code(step - 1), 0, step - 1, true},
+		{"next step", code(step + 1), 0, step + 1, true},
+		{"two steps ago", code(step - 2), 0, 0, false},
+		{"spaces", " " + code(step)[:3] + " " + code(step)[3:] + " ", 0, step, true},
+		{"replayed", code(step), step, 0, false},
+		{"older than the last used", code(step - 1), step - 1, 0, false},
+		{"too short", code(step)[:5], 0, 0, false},
+		{"wrong", "000000", 0, 0, code(step) == "000000"},
+	}
+	for _, tt := range tests {
+		counter, ok := verifyTOTP(secret, tt.code, now, tt.last)
+		if ok != tt.ok || ok && counter != tt.counter {
+			t.Errorf("%s: %d, %v, want %d, %v", tt.name, counter, ok, tt.counter, tt.ok)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", code(step), now, 0); ok {
+		t.Error("an invalid secret verified")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("%d codes, %d hashes", len(codes), len(hashes))
+	}
+	for i, code := range codes {
+		if len(code) != 19 || code[4] != '-' {
+			t.Errorf("code %q", code)
+		}
+		if hashRecoveryCode(code) != hashes[i] {
+			t.Errorf("hash of %q does not match", code)
+		}
+	}
+	if hashRecoveryCode("abcd efgh-jklm-npqr") != hashRecoveryCode("ABCD-EFGH-JKLM-NPQR") {
+		t.Error("recovery codes are not compared ignoring case, dashes and spaces")
+	}
+}
@@ -0,0 +1,317 @@
+package web
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+)
+
+// COSE algorithms accepted for security keys.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+)
+
+const (
+	authDataUserPresent  = 0x01
+	authDataAttestedData = 0x40
+	webAuthnTimeout      = 60000 // milliseconds
+)
+
+var b64url = base64.RawURLEncoding
+
+// clientData is the part of clientDataJSON the server checks.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authenticator data of a registration or
+// assertion (WebAuthn Level 2, section 6.1).
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // COSE_Key, registration only
+}
+
+// relyingParty returns the WebAuthn relying party ID and origin for r: the
+// host the browser used, without a port.
+func relyingParty(r *http.Request) (string, string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host, scheme + "://" + r.Host
+}
+
+// checkClientData verifies the type, challenge and origin the browser
+// signed.
+func checkClientData(raw []byte, typ string, challenge []byte, origin string) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("invalid client data: %w", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("unexpected client data type %q", cd.Type)
+	}
+	got, err := b64url.DecodeString(cd.Challenge)
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if cd.Origin != origin {
+		return fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte, rpID string) (authenticatorData, error) {
+	var ad authenticatorData
+	if len(data) < 37 {
+		return ad, errors.New("authenticator data too short")
+	}
+	ad.rpIDHash = data[:32]
+	ad.flags = data[32]
+	ad.signCount = binary.BigEndian.Uint32(data[33:37])
+	want := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.rpIDHash, want[:]) {
+		return ad, errors.New("relying party mismatch")
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return ad, errors.New("user not present")
+	}
+	if ad.flags&authDataAttestedData == 0 {
+		return ad, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return ad, errors.New("credential ID truncated")
+	}
+	ad.credentialID = rest[:idLen]
+	_, n, err := decodeCBOR(rest[idLen:])
+	if err != nil {
+		return ad, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	ad.publicKey = rest[idLen : idLen+n]
+	return ad, nil
+}
+
+// parseAttestation reads the authenticator data out of an attestation
+// object. The attestation statement itself is not verified: keys are
+// registered by a user who is already logged in, and the server asks for
+// "none" attestation.
+func parseAttestation(raw []byte) ([]byte, error) {
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid attestation object")
+	}
+	authData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object has no authenticator data")
+	}
+	return authData, nil
+}
+
+// parsePublicKey converts a COSE_Key into the algorithm and key bytes
+// stored for a credential: an uncompressed P-256 point for ES256, the raw
+// key for Ed25519.
+func parsePublicKey(cose []byte) (int, []byte, error) {
+	v, _, err := decodeCBOR(cose)
+	if err != nil {
+		return 0, nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errors.New("public key is not a map")
+	}
+	alg, _ := m[int64(3)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	switch alg {
+	case coseES256:
+		y, _ := m[int64(-3)].([]byte)
+		if crv, _ := m[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("unsupported ES256 key")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdsaKey(point); err != nil {
+			return 0, nil, err
+		}
+		return coseES256, point, nil
+	case coseEdDSA:
+		if crv, _ := m[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("unsupported EdDSA key")
+		}
+		return coseEdDSA, x, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported key algorithm %d", alg)
+}
+
+// verifyAssertion checks a signature over authenticator data and the hash
+// of the client data.
+func verifyAssertion(alg int, key []byte, authData []byte, clientDataJSON []byte, signature []byte) error {
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), hash[:]...)
+	switch alg {
+	case coseES256:
+		pub, err := ecdsaKey(key)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseEdDSA:
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key), signed, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key algorithm %d", alg)
+}
+
+func ecdsaKey(point []byte) (*ecdsa.PublicKey, error) {
+	if len(point) != 65 || point[0] != 4 {
+		return nil, errors.New("invalid P-256 key")
+	}
+	x := new(big.Int).SetBytes(point[1:33])
+	y := new(big.Int).SetBytes(point[33:])
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return nil, errors.New("P-256 key is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// decodeCBOR decodes the first CBOR item in data (RFC 8949), enough of it
+// for attestation objects and COSE keys: integers, byte and text strings,
+// arrays, maps and simple values, all of definite length. It returns the
+// item and the number of bytes it took.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > 16 {
+		return nil, 0, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, 0, errors.New("cbor: unexpected end of data")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	n := 1
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < 1+size {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		for _, b := range data[1 : 1+size] {
+			arg = arg<<8 | uint64(b)
+		}
+		n += size
+	default:
+		return nil, 0, errors.New("cbor: indefinite lengths are not supported")
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<62 {
+			return nil, 0, errors.New("cbor: integer too large")
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > 1<<62 {
+			return nil, 0, errors.New("cbor: integer too large")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		b := data[n : n+int(arg)]
+		if major == 3 {
+			return string(b), n + int(arg), nil
+		}
+		return append([]byte(nil), b...), n + int(arg), nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		list := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, item)
+			n += used
+		}
+		return list, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += used
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errors.New("cbor: unsupported map key")
+			}
+			value, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += used
+			m[key] = value
+		}
+		return m, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		}
+		return nil, 0, errors.New("cbor: unsupported simple value")
+	}
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
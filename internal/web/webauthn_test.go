@@ -0,0 +1,254 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// cbor encodes the values the tests need: int, []byte, string and maps
+// with int or string keys, in a fixed key order.
+func cbor(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v))
+		byKey := make(map[string]interface{})
+		for k := range v {
+			s := string(cbor(k))
+			keys = append(keys, s)
+			byKey[s] = v[k]
+		}
+		sort.Strings(keys)
+		out := head(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(append(out, k...), cbor(byKey[k])...)
+		}
+		return out
+	}
+	panic("cbor: unsupported value")
+}
+
+func es256COSE(pub *ecdsa.PublicKey) []byte {
+	return cbor(map[interface{}]interface{}{1: 2, 3: coseES256, -1: 1, -2: pub.X.FillBytes(make([]byte, 32)), -3: pub.Y.FillBytes(make([]byte, 32))})
+}
+
+func authData(rpID string, flags byte, signCount uint32, credentialID []byte, cose []byte) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	data := append(hash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], signCount)
+	if flags&authDataAttestedData != 0 {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(credentialID)))
+		data = append(append(data, credentialID...), cose...)
+	}
+	return data
+}
+
+func TestRegistration(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cose := es256COSE(&key.PublicKey)
+	data := authData("panel.example", authDataUserPresent|authDataAttestedData, 7, []byte("cred-1"), cose)
+	attestation := cbor(map[interface{}]interface{}{"fmt": "none", "attStmt": map[interface{}]interface{}{}, "authData": data})
+
+	raw, err := parseAttestation(attestation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad, err := parseAuthenticatorData(raw, "panel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ad.credentialID) != "cred-1" || ad.signCount != 7 || !reflect.DeepEqual(ad.publicKey, cose) {
+		t.Errorf("authenticator data = %+v", ad)
+	}
+	alg, point, err := parsePublicKey(ad.publicKey)
+	if err != nil || alg != coseES256 || len(point) != 65 {
+		t.Errorf("parsePublicKey: %d, %x, %v", alg, point, err)
+	}
+
+	tests := []struct {
+		data []byte
+		rpID string
+		err  string
+	}{
+		{data, "evil.example", "relying party mismatch"},
+		{data[:36], "panel.example", "too short"},
+		{authData("panel.example", authDataAttestedData, 0, []byte("x"), cose), "panel.example", "user not present"},
+		{data[:37+17], "panel.example", "attested credential data too short"},
+		{data[:37+18+3], "panel.example", "credential ID truncated"},
+		{data[:len(data)-1], "panel.example", "invalid credential public key"},
+	}
+	for _, tt := range tests {
+		if _, err := parseAuthenticatorData(tt.data, tt.rpID); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseAuthenticatorData(%d bytes, %s): err = %v, want %q", len(tt.data), tt.rpID, err, tt.err)
+		}
+	}
+	if _, err := parseAttestation(cbor(map[interface{}]interface{}{"fmt": "none"})); err == nil {
+		t.Error("an attestation without authData was accepted")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	x := make([]byte, 32)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		cose []byte
+		err  string
+	}{
+		{cbor(map[interface{}]interface{}{1: 1, 3: coseEdDSA, -1: 6, -2: []byte(edPub)}), ""},
+		{cbor(map[interface{}]interface{}{1: 1, 3: coseEdDSA, -1: 6, -2: x[:31]}), "unsupported EdDSA key"},
+		{cbor(map[interface{}]interface{}{1: 2, 3: coseES256, -1: 1, -2: x, -3: x}), "not on the curve"},
+		{cbor(map[interface{}]interface{}{1: 2, 3: coseES256, -1: 2, -2: x, -3: x}), "unsupported ES256 key"},
+		{cbor(map[interface{}]interface{}{1: 3, 3: -257}), "unsupported key algorithm -257"},
+		{cbor("not a map"), "not a map"},
+	}
+	for _, tt := range tests {
+		_, _, err := parsePublicKey(tt.cose)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("parsePublicKey(%x): err = %v, want %q", tt.cose, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	data := authData("panel.example", authDataUserPresent, 8, nil, nil)
+	clientDataJSON := []byte(`{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://panel.example"}`)
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), data...), hash[:]...)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, point, err := parsePublicKey(es256COSE(&ecKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(signed)
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edSig := ed25519.Sign(edKey, signed)
+
+	tampered := append([]byte(nil), data...)
+	tampered[36]++
+	tests := []struct {
+		name      string
+		alg       int
+		key       []byte
+		authData  []byte
+		signature []byte
+		ok        bool
+	}{
+		{"es256", coseES256, point, data, ecSig, true},
+		{"es256 tampered", coseES256, point, tampered, ecSig, false},
+		{"es256 other key", coseES256, point, data, edSig, false},
+		{"eddsa", coseEdDSA, edPub, data, edSig, true},
+		{"eddsa tampered", coseEdDSA, edPub, tampered, edSig, false},
+		{"unknown algorithm", -257, edPub, data, edSig, false},
+	}
+	for _, tt := range tests {
+		err := verifyAssertion(tt.alg, tt.key, tt.authData, clientDataJSON, tt.signature)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestCheckClientData(t *testing.T) {
+	challenge := []byte("challenge")
+	tests := []struct {
+		raw       string
+		typ       string
+		challenge []byte
+		err       string
+	}{
+		{`{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://panel.example"}`, "webauthn.get", challenge, ""},
+		{`{"type":"webauthn.create","challenge":"Y2hhbGxlbmdl","origin":"https://panel.example"}`, "webauthn.get", challenge, "unexpected client data type"},
+		{`{"type":"webauthn.get","challenge":"b3RoZXI","origin":"https://panel.example"}`, "webauthn.get", challenge, "challenge mismatch"},
+		{`{"type":"webauthn.get","challenge":"","origin":"https://panel.example"}`, "webauthn.get", nil, "challenge mismatch"},
+		{`{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://evil.example"}`, "webauthn.get", challenge, "unexpected origin"},
+		{`{"type":`, "webauthn.get", challenge, "invalid client data"},
+	}
+	for _, tt := range tests {
+		err := checkClientData([]byte(tt.raw), tt.typ, tt.challenge, "https://panel.example")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("checkClientData(%s): err = %v, want %q", tt.raw, err, tt.err)
+		}
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	nested := []byte{}
+	for i := 0; i < 20; i++ {
+		nested = append(nested, 0x81) // array of one
+	}
+	nested = append(nested, 0x00)
+
+	tests := []struct {
+		data []byte
+		want interface{}
+		n    int
+		err  string
+	}{
+		{[]byte{0x18, 0x64}, int64(100), 2, ""},
+		{[]byte{0x38, 0x63}, int64(-100), 2, ""},
+		{[]byte{0x43, 1, 2, 3, 0xff}, []byte{1, 2, 3}, 4, ""},
+		{[]byte{0x62, 'h', 'i'}, "hi", 3, ""},
+		{[]byte{0x82, 0xf5, 0xf6}, []interface{}{true, nil}, 3, ""},
+		{[]byte{0xa1, 0x01, 0xf4}, map[interface{}]interface{}{int64(1): false}, 3, ""},
+		{[]byte{}, nil, 0, "unexpected end of data"},
+		{[]byte{0x19, 0x01}, nil, 0, "unexpected end of data"},
+		{[]byte{0x45, 1, 2}, nil, 0, "unexpected end of data"},
+		{[]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, 0, "unexpected end of data"},
+		{[]byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, 0, "integer too large"},
+		{[]byte{0x5f, 0x41, 0x00, 0xff}, nil, 0, "indefinite lengths"},
+		{[]byte{0xa1, 0x41, 0x00, 0x00}, nil, 0, "unsupported map key"},
+		{[]byte{0xc1, 0x00}, nil, 0, "unsupported major type 6"},
+		{[]byte{0xf9, 0x00, 0x00}, nil, 0, "unsupported simple value"},
+		{nested, nil, 0, "nested too deeply"},
+	}
+	for _, tt := range tests {
+		v, n, err := decodeCBOR(tt.data)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("decodeCBOR(%x): err = %v, want %q", tt.data, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || n != tt.n || !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("decodeCBOR(%x) = %#v, %d, %v, want %#v, %d", tt.data, v, n, err, tt.want, tt.n)
+		}
+	}
+}